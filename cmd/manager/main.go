@@ -6,23 +6,31 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	configclient "github.com/openshift/client-go/config/clientset/versioned"
 	operatorv1 "github.com/openshift/client-go/operator/clientset/versioned/typed/operator/v1"
 	"github.com/openshift/windows-machine-config-operator/pkg/apis"
 	"github.com/openshift/windows-machine-config-operator/pkg/clusternetwork"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/operatorconfig"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/payload"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/retry"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/nodeconfig"
 	"github.com/openshift/windows-machine-config-operator/version"
 	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
 	"github.com/operator-framework/operator-sdk/pkg/leader"
 	"github.com/operator-framework/operator-sdk/pkg/log/zap"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -37,6 +45,9 @@ const (
 	// baseK8sVersion specifies the base k8s version supported by the operator. (For eg. All versions in the format
 	// 1.19.x are supported for baseK8sVersion 1.18)
 	baseK8sVersion = "1.19"
+	// machineConfigServerTimeout is the maximum amount of time spent checking that the worker ignition file can be
+	// fetched from the Machine Config Server at startup
+	machineConfigServerTimeout = 2 * time.Minute
 )
 
 // clusterConfig contains information specific to cluster configuration
@@ -119,7 +130,6 @@ func main() {
 		payload.HybridOverlayPath,
 		payload.KubeletPath,
 		payload.KubeProxyPath,
-		payload.IgnoreWgetPowerShellPath,
 		payload.WmcbPath,
 		payload.CNIConfigTemplatePath,
 		payload.HNSPSModule,
@@ -172,6 +182,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Check that the Machine Config Server is reachable, so that a misconfigured endpoint is reported before any
+	// Windows VM is configured. The check runs in the background once the caches are synced, as the Windows nodes
+	// already configured do not need the Machine Config Server, and the error is surfaced again when a Windows VM is
+	// configured.
+	if err := mgr.Add(manager.RunnableFunc(func(<-chan struct{}) error {
+		if err := checkMachineConfigServer(ctx, mgr, namespace); err != nil {
+			log.Error(err, "failed to reach the Machine Config Server")
+			if err := recordMachineConfigServerUnreachable(ctx, mgr, namespace, err); err != nil {
+				log.Error(err, "failed to record the Machine Config Server check failure")
+			}
+		}
+		return nil
+	})); err != nil {
+		log.Error(err, "failed to add the Machine Config Server check to the Manager")
+		os.Exit(1)
+	}
+
 	// Add the Metrics Service and Service Monitor
 	if err := winmetrics.Add(ctx, cfg, namespace); err != nil {
 		log.Error(err, "failed to add Metrics Service and Service Monitor")
@@ -205,6 +232,58 @@ func checkIfRequiredFilesExist(requiredFiles []string) error {
 	return nil
 }
 
+// checkMachineConfigServer checks that the worker ignition file can be fetched from the Machine Config Server set in
+// the operator configuration of the given namespace, or from the one running on the internal API server host. The
+// check is retried until machineConfigServerTimeout expires.
+func checkMachineConfigServer(ctx context.Context, mgr manager.Manager, namespace string) error {
+	operatorConfig, err := operatorconfig.Get(mgr.GetClient(), namespace)
+	if err != nil {
+		return err
+	}
+	endpoint, err := nodeconfig.WorkerIgnitionEndpoint(ctx, mgr.GetClient(), operatorConfig.MachineConfigServerURL,
+		operatorConfig.MachineConfigServerName)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return errors.Wrap(err, "could not create kubernetes clientset")
+	}
+
+	var fetchErr error
+	err = wait.PollImmediate(retry.Interval, machineConfigServerTimeout, func() (bool, error) {
+		_, _, fetchErr = nodeconfig.FetchWorkerIgnition(ctx, clientset, endpoint)
+		if fetchErr != nil {
+			log.Info("unable to fetch the worker ignition, retrying", "endpoint", endpoint.URL, "error", fetchErr)
+		}
+		return fetchErr == nil, nil
+	})
+	if err != nil {
+		return errors.Wrapf(fetchErr, "unable to fetch the worker ignition from %s", endpoint.URL)
+	}
+	log.Info("Machine Config Server is reachable", "endpoint", endpoint.URL)
+	return nil
+}
+
+// recordMachineConfigServerUnreachable records a warning event on the operator pod of the given namespace, reporting
+// that the Machine Config Server check failed with the given error
+func recordMachineConfigServerUnreachable(ctx context.Context, mgr manager.Manager, namespace string,
+	checkErr error) error {
+	podName := os.Getenv(k8sutil.PodNameEnvVar)
+	if podName == "" {
+		return errors.Errorf("required env %s not set", k8sutil.PodNameEnvVar)
+	}
+	// The pod is read from the API server, as the operator does not otherwise watch pods
+	pod := &core.Pod{}
+	if err := mgr.GetAPIReader().Get(ctx, client.ObjectKey{Namespace: namespace, Name: podName}, pod); err != nil {
+		return errors.Wrap(err, "could not get the operator pod")
+	}
+	mgr.GetEventRecorderFor("windows-machine-config-operator").Eventf(pod, core.EventTypeWarning,
+		"MachineConfigServerUnreachable",
+		"Windows VMs cannot be configured until the worker ignition file can be fetched: %v", checkErr)
+	return nil
+}
+
 // newClusterConfig creates clusterConfig struct that holds information of the cluster configurations
 func newClusterConfig(config *rest.Config) (*clusterConfig, error) {
 	// get OpenShift API config client.
@@ -0,0 +1,10 @@
+package apis
+
+import (
+	config "github.com/openshift/api/config/v1"
+)
+
+func init() {
+	// Register the OpenShift config types, so that the cluster Infrastructure can be watched
+	AddToSchemes = append(AddToSchemes, config.Install)
+}
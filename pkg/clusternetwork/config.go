@@ -11,13 +11,19 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-const ovnKubernetesNetwork = "OVNKubernetes"
+const (
+	ovnKubernetesNetwork = "OVNKubernetes"
+	// defaultServiceNodePortRange is the port range of the NodePort services if the cluster does not set one
+	defaultServiceNodePortRange = "30000-32767"
+)
 
 // ClusterNetworkConfig interface contains methods to validate network configuration of a cluster
 type ClusterNetworkConfig interface {
 	Validate() error
 	GetServiceCIDR() (string, error)
 	VXLANPort() string
+	// ServiceNodePortRange returns the port range of the NodePort services, such as 30000-32767
+	ServiceNodePortRange() string
 }
 
 // networkType holds information for a required network type
@@ -34,6 +40,8 @@ type clusterNetworkCfg struct {
 	serviceCIDR string
 	// vxlanPort is the port to be used for VXLAN communication
 	vxlanPort string
+	// serviceNodePortRange is the port range of the NodePort services
+	serviceNodePortRange string
 }
 
 // ovnKubernetes contains information specific to network type OVNKubernetes
@@ -61,10 +69,16 @@ func NetworkConfigurationFactory(oclient configclient.Interface, operatorClient
 		return nil, errors.Wrap(err, "error getting the custom vxlan port")
 	}
 
+	serviceNodePortRange, err := getServiceNodePortRange(oclient)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the service node port range")
+	}
+
 	clusterNetworkCfg, err := NewClusterNetworkCfg(serviceCIDR, vxlanPort)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error getting cluster network config")
 	}
+	clusterNetworkCfg.serviceNodePortRange = serviceNodePortRange
 	switch network {
 	case ovnKubernetesNetwork:
 		return &ovnKubernetes{
@@ -101,6 +115,11 @@ func (ovn *ovnKubernetes) VXLANPort() string {
 	return ovn.clusterNetworkConfig.vxlanPort
 }
 
+// ServiceNodePortRange returns the port range of the NodePort services
+func (ovn *ovnKubernetes) ServiceNodePortRange() string {
+	return ovn.clusterNetworkConfig.serviceNodePortRange
+}
+
 // Validate for OVN Kubernetes checks for network type and hybrid overlay.
 func (ovn *ovnKubernetes) Validate() error {
 	//check if hybrid overlay is enabled for the cluster
@@ -166,6 +185,19 @@ func getVXLANPort(operatorClient operatorv1.OperatorV1Interface) (string, error)
 	return "", nil
 }
 
+// getServiceNodePortRange gets the port range of the NodePort services from the cluster config, falling back to the
+// default range if it is not set
+func getServiceNodePortRange(oclient configclient.Interface) (string, error) {
+	networkCR, err := oclient.ConfigV1().Networks().Get(context.TODO(), "cluster", metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, "error getting cluster network object")
+	}
+	if networkCR.Spec.ServiceNodePortRange == "" {
+		return defaultServiceNodePortRange, nil
+	}
+	return networkCR.Spec.ServiceNodePortRange, nil
+}
+
 // ValidateCIDR uses the parseCIDR from network package to validate the format of the CIDR
 func ValidateCIDR(cidr string) error {
 	_, _, err := net.ParseCIDR(cidr)
@@ -154,3 +154,36 @@ func TestGetVXLANPort(t *testing.T) {
 		})
 	}
 }
+
+// TestGetServiceNodePortRange tests that the NodePort range of the cluster is returned, or the default range if the
+// cluster does not set one
+func TestGetServiceNodePortRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		networkPatch []byte
+		want         string
+	}{
+		{
+			name: "default range",
+			want: "30000-32767",
+		},
+		{
+			name:         "custom range",
+			networkPatch: []byte(`{"spec":{"serviceNodePortRange":"31000-31999"}}`),
+			want:         "31000-31999",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeConfigClient, _ := createFakeClients("OVNKubernetes")
+			if tt.networkPatch != nil {
+				_, err := fakeConfigClient.ConfigV1().Networks().Patch(context.TODO(), "cluster",
+					k8stypes.MergePatchType, tt.networkPatch, metav1.PatchOptions{})
+				require.NoError(t, err)
+			}
+			got, err := getServiceNodePortRange(fakeConfigClient)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
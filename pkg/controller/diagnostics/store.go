@@ -0,0 +1,161 @@
+package diagnostics
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxBundles is the default maximum number of bundles kept by a Store
+	DefaultMaxBundles = 10
+	// DefaultMaxBytes is the default maximum total size of the bundles kept by a Store
+	DefaultMaxBytes = 100 * 1024 * 1024
+	// bundleSuffix is the file name suffix of the bundles
+	bundleSuffix = ".tar.gz"
+	// timestampFormat is the format of the timestamp in the file names of the bundles, which sorts chronologically
+	timestampFormat = "20060102T150405.000Z"
+)
+
+// DefaultDir returns the default directory of the Store, within the temporary directory of the operator pod
+func DefaultDir() string {
+	return filepath.Join(os.TempDir(), "windows-diagnostics")
+}
+
+// Bundle describes a diagnostics bundle held by a Store
+type Bundle struct {
+	// Name is the file name of the bundle, made of the Machine name and the time the bundle was saved
+	Name string
+	// Path is the local path of the bundle
+	Path string
+	// Size is the size of the bundle in bytes
+	Size int64
+	// ModTime is the time the bundle was saved
+	ModTime time.Time
+}
+
+// Store holds the diagnostics bundles collected from the Windows VMs in a local directory. The oldest bundles are
+// removed once the store holds more than maxBundles bundles or maxBytes bytes.
+type Store struct {
+	// dir is the directory holding the bundles
+	dir string
+	// maxBundles is the maximum number of bundles held
+	maxBundles int
+	// maxBytes is the maximum total size of the bundles held
+	maxBytes int64
+	// mu serializes the changes to the directory
+	mu sync.Mutex
+}
+
+// NewStore returns a Store holding the bundles in the given directory, which is created if needed
+func NewStore(dir string, maxBundles int, maxBytes int64) (*Store, error) {
+	if maxBundles < 1 || maxBytes < 1 {
+		return nil, errors.Errorf("invalid diagnostics store limits: %d bundles, %d bytes", maxBundles, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "unable to create diagnostics directory %s", dir)
+	}
+	return &Store{dir: dir, maxBundles: maxBundles, maxBytes: maxBytes}, nil
+}
+
+// Save stores the bundle written by the given function, collected from the given Machine, and returns its local path.
+// The bundle is streamed to a temporary file of the store directory, and the function fails to write once the bundle
+// exceeds the store limit. The oldest bundles are removed to stay within the limits of the store.
+func (s *Store) Save(machine string, write func(io.Writer) error) (string, error) {
+	name := machine + "-" + time.Now().UTC().Format(timestampFormat) + bundleSuffix
+	// Write to a temporary file first so that a partially written bundle is never listed
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create diagnostics bundle")
+	}
+	if err := write(&limitedWriter{w: tmp, limit: s.maxBytes}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", errors.Wrapf(err, "unable to write diagnostics bundle %s", name)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.Wrapf(err, "unable to write diagnostics bundle %s", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, name)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.Wrapf(err, "unable to save diagnostics bundle %s", name)
+	}
+
+	if err := s.pruneLocked(); err != nil {
+		return path, err
+	}
+	return path, nil
+}
+
+// limitedWriter is an io.Writer failing once more than a given number of bytes are written to the underlying writer
+type limitedWriter struct {
+	// w is the underlying writer
+	w io.Writer
+	// limit is the maximum number of bytes written to w
+	limit int64
+	// written is the number of bytes written to w so far
+	written int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		return 0, errors.Errorf("diagnostics bundle exceeds the store limit of %d bytes", l.limit)
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+// List returns the bundles held by the store, newest first
+func (s *Store) List() ([]Bundle, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read diagnostics directory %s", s.dir)
+	}
+	var bundles []Bundle
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), bundleSuffix) {
+			continue
+		}
+		bundles = append(bundles, Bundle{Name: entry.Name(), Path: filepath.Join(s.dir, entry.Name()),
+			Size: entry.Size(), ModTime: entry.ModTime()})
+	}
+	sort.SliceStable(bundles, func(i, j int) bool {
+		if !bundles[i].ModTime.Equal(bundles[j].ModTime) {
+			return bundles[i].ModTime.After(bundles[j].ModTime)
+		}
+		return bundles[i].Name > bundles[j].Name
+	})
+	return bundles, nil
+}
+
+// pruneLocked removes the oldest bundles until the store is within its limits. s.mu must be held.
+func (s *Store) pruneLocked() error {
+	bundles, err := s.List()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for i, bundle := range bundles {
+		total += bundle.Size
+		if i < s.maxBundles && total <= s.maxBytes {
+			continue
+		}
+		if err := os.Remove(bundle.Path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unable to remove diagnostics bundle %s", bundle.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package diagnostics
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStoreSave tests that saved bundles can be read back and that the oldest bundles are pruned to stay within the
+// limits of the store
+func TestStoreSave(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBundles int
+		maxBytes   int64
+		sizes      []int
+		// expected holds the indexes of the bundles left in the store, newest first
+		expected    []int
+		expectedErr bool
+	}{
+		{
+			name:       "within limits",
+			maxBundles: 3,
+			maxBytes:   100,
+			sizes:      []int{10, 10},
+			expected:   []int{1, 0},
+		},
+		{
+			name:       "too many bundles",
+			maxBundles: 2,
+			maxBytes:   100,
+			sizes:      []int{10, 10, 10},
+			expected:   []int{2, 1},
+		},
+		{
+			name:       "too many bytes",
+			maxBundles: 10,
+			maxBytes:   50,
+			sizes:      []int{30, 10, 30},
+			expected:   []int{2, 1},
+		},
+		{
+			name:        "bundle larger than the store",
+			maxBundles:  10,
+			maxBytes:    50,
+			sizes:       []int{51},
+			expectedErr: true,
+		},
+		{
+			name:       "bundle as large as the store",
+			maxBundles: 10,
+			maxBytes:   50,
+			sizes:      []int{50},
+			expected:   []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "diagnostics")
+			store, err := NewStore(dir, tt.maxBundles, tt.maxBytes)
+			require.NoError(t, err)
+
+			var paths []string
+			for i, size := range tt.sizes {
+				path, err := store.Save("machine", func(w io.Writer) error {
+					// The bundle is written in several chunks, as it is collected
+					for j := 0; j < size; j += 10 {
+						n := size - j
+						if n > 10 {
+							n = 10
+						}
+						if _, err := w.Write([]byte(strings.Repeat(string(rune('a'+i)), n))); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if tt.expectedErr {
+					require.Error(t, err)
+					continue
+				}
+				require.NoError(t, err)
+				paths = append(paths, path)
+				// Ensure the bundles have distinct timestamps
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			bundles, err := store.List()
+			require.NoError(t, err)
+			require.Len(t, bundles, len(tt.expected))
+			for i, index := range tt.expected {
+				assert.Equal(t, paths[index], bundles[i].Path)
+				assert.True(t, strings.HasPrefix(bundles[i].Name, "machine-"))
+				data, err := ioutil.ReadFile(bundles[i].Path)
+				require.NoError(t, err)
+				assert.Equal(t, tt.sizes[index], len(data))
+			}
+
+			// Temporary files must not be left behind
+			entries, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, len(tt.expected))
+		})
+	}
+}
+
+// TestNewStoreInvalidLimits tests that a store cannot be created without room for a bundle
+func TestNewStoreInvalidLimits(t *testing.T) {
+	_, err := NewStore(t.TempDir(), 0, DefaultMaxBytes)
+	assert.Error(t, err)
+	_, err = NewStore(t.TempDir(), DefaultMaxBundles, 0)
+	assert.Error(t, err)
+}
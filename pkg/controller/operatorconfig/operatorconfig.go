@@ -0,0 +1,382 @@
+package operatorconfig
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
+	"github.com/openshift/windows-machine-config-operator/pkg/ignition"
+)
+
+const (
+	// ConfigMapName is the name of the optional ConfigMap, in the operator namespace, that holds the operator
+	// configuration
+	ConfigMapName = "windows-machine-config-operator-config"
+	// ConfigKey is the key within the ConfigMap which holds the YAML configuration document
+	ConfigKey = "config.yaml"
+	// defaultWinRMPort is the default WinRM HTTPS port
+	defaultWinRMPort = "5986"
+	// defaultWinRMCredentialsSecret is the default name of the secret holding the WinRM credentials
+	defaultWinRMCredentialsSecret = "windows-winrm-credentials"
+)
+
+// Config holds the operator configuration. Any field that is not set in the ConfigMap takes its default value.
+type Config struct {
+	// Connectivity configures how the operator connects to the Windows VMs
+	Connectivity Connectivity `json:"connectivity,omitempty"`
+	// Timeouts overrides the timeouts of the operations run on the Windows VMs
+	Timeouts Timeouts `json:"timeouts,omitempty"`
+	// ServiceRecovery configures how the node services are recovered when they stop unexpectedly
+	ServiceRecovery ServiceRecovery `json:"serviceRecovery,omitempty"`
+	// WindowsExporter configures the windows_exporter service run on the Windows nodes
+	WindowsExporter WindowsExporter `json:"windowsExporter,omitempty"`
+	// KubeProxy configures the kube-proxy service run on the Windows nodes
+	KubeProxy KubeProxy `json:"kubeProxy,omitempty"`
+	// MachineConfigServerURL is the base URL of the Machine Config Server the worker ignition file is fetched from,
+	// such as https://10.0.0.5:22623. If it is empty, the Machine Config Server running on the host of the internal
+	// API server is used.
+	MachineConfigServerURL string `json:"machineConfigServerURL,omitempty"`
+	// MachineConfigServerName is the host name the Machine Config Server certificate is verified against. If it is
+	// empty, the host name of the internal API server is used, which the certificate is issued for.
+	MachineConfigServerName string `json:"machineConfigServerName,omitempty"`
+}
+
+// Connectivity configures how the operator connects to the Windows VMs
+type Connectivity struct {
+	// Backend is the default connectivity backend, either ssh or winrm. It can be overridden per Machine using the
+	// windowsmachineconfig.openshift.io/connectivity annotation.
+	Backend string `json:"backend,omitempty"`
+	// WinRM configures the WinRM backend
+	WinRM WinRM `json:"winrm,omitempty"`
+	// JumpHosts holds the jump hosts, in order, that the SSH connections to the Windows VMs are tunneled through. The
+	// VMs are dialed directly if it is empty. It is not used by the WinRM backend.
+	JumpHosts []JumpHost `json:"jumpHosts,omitempty"`
+}
+
+// JumpHost configures an SSH server, such as an ssh-bastion, that the SSH connections to the Windows VMs are tunneled
+// through
+type JumpHost struct {
+	// Address is the host name or IP address of the jump host, optionally followed by the SSH port
+	Address string `json:"address"`
+	// User is the user to authenticate as on the jump host
+	User string `json:"user"`
+	// KeySecret is the name of the secret in the operator namespace that holds the private key used to authenticate
+	// against the jump host, under the private-key.pem key
+	KeySecret string `json:"keySecret"`
+	// HostKeyFingerprint is the SHA256 fingerprint of the host key of the jump host, as printed by
+	// `ssh-keygen -l -f`. If it is empty, the host key presented on first contact is recorded and verified on every
+	// later connection.
+	HostKeyFingerprint string `json:"hostKeyFingerprint,omitempty"`
+}
+
+// WinRM configures the WinRM backend
+type WinRM struct {
+	// Port is the WinRM HTTPS port on the Windows VMs
+	Port string `json:"port,omitempty"`
+	// AuthType is the WinRM authentication type, either certificate or ntlm
+	AuthType string `json:"authType,omitempty"`
+	// CredentialsSecret is the name of the secret in the operator namespace that holds the WinRM credentials. For
+	// certificate authentication it must contain the tls.crt and tls.key keys. For NTLM authentication it must contain
+	// the password key and may contain the username key.
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+// Timeouts holds the timeouts of each type of operation run on the Windows VMs
+type Timeouts struct {
+	// Connect is the timeout of a single attempt to connect to a VM
+	Connect meta.Duration `json:"connect,omitempty"`
+	// Command is the timeout of the commands which do not belong to any of the other types
+	Command meta.Duration `json:"command,omitempty"`
+	// FileHash is the timeout of the commands checking the existence and hash of a file
+	FileHash meta.Duration `json:"fileHash,omitempty"`
+	// FileTransfer is the timeout of a single file transfer
+	FileTransfer meta.Duration `json:"fileTransfer,omitempty"`
+	// ServiceQuery is the timeout of the commands querying a Windows service
+	ServiceQuery meta.Duration `json:"serviceQuery,omitempty"`
+	// ServiceControl is the timeout of the commands creating, starting and stopping a Windows service
+	ServiceControl meta.Duration `json:"serviceControl,omitempty"`
+	// Bootstrapper is the timeout of the bootstrapper runs
+	Bootstrapper meta.Duration `json:"bootstrapper,omitempty"`
+	// Network is the timeout of the commands querying and configuring the HNS networks
+	Network meta.Duration `json:"network,omitempty"`
+}
+
+// Windows returns the timeouts in the form used by the windows package
+func (t Timeouts) Windows() windows.Timeouts {
+	return windows.Timeouts{
+		Connect:        t.Connect.Duration,
+		Command:        t.Command.Duration,
+		FileHash:       t.FileHash.Duration,
+		FileTransfer:   t.FileTransfer.Duration,
+		ServiceQuery:   t.ServiceQuery.Duration,
+		ServiceControl: t.ServiceControl.Duration,
+		Bootstrapper:   t.Bootstrapper.Duration,
+		Network:        t.Network.Duration,
+	}
+}
+
+// validate returns an error if any of the timeouts is not positive
+func (t Timeouts) validate() error {
+	for name, timeout := range map[string]meta.Duration{
+		"connect":        t.Connect,
+		"command":        t.Command,
+		"fileHash":       t.FileHash,
+		"fileTransfer":   t.FileTransfer,
+		"serviceQuery":   t.ServiceQuery,
+		"serviceControl": t.ServiceControl,
+		"bootstrapper":   t.Bootstrapper,
+		"network":        t.Network,
+	} {
+		if timeout.Duration <= 0 {
+			return errors.Errorf("%s timeout must be positive", name)
+		}
+	}
+	return nil
+}
+
+// ServiceRecovery configures the failure actions of the node services, such as kubelet and kube-proxy
+type ServiceRecovery struct {
+	// RestartDelay is the time to wait before restarting a service that stopped unexpectedly
+	RestartDelay meta.Duration `json:"restartDelay,omitempty"`
+	// ResetPeriod is the time without failures after which the failure count of a service is reset
+	ResetPeriod meta.Duration `json:"resetPeriod,omitempty"`
+	// Attempts is the number of times a service is restarted before its failure count is reset. Services are not
+	// restarted if it is 0.
+	Attempts int `json:"attempts"`
+}
+
+// Windows returns the recovery policy in the form used by the windows package
+func (r ServiceRecovery) Windows() *windows.RecoveryPolicy {
+	return &windows.RecoveryPolicy{
+		RestartDelay: r.RestartDelay.Duration,
+		ResetPeriod:  r.ResetPeriod.Duration,
+		Attempts:     r.Attempts,
+	}
+}
+
+// validate returns an error if any of the settings is negative
+func (r ServiceRecovery) validate() error {
+	if r.RestartDelay.Duration < 0 || r.ResetPeriod.Duration < 0 {
+		return errors.New("service recovery restart delay and reset period cannot be negative")
+	}
+	if r.Attempts < 0 {
+		return errors.New("service recovery attempts cannot be negative")
+	}
+	return nil
+}
+
+// ExporterSettings holds the settings of the windows_exporter service
+type ExporterSettings struct {
+	// Collectors holds the names of the enabled collectors, such as cpu or iis. It replaces the list of collectors
+	// enabled by default.
+	Collectors []string `json:"collectors,omitempty"`
+	// CollectorFlags holds the collector specific flags, keyed by flag name without the leading dashes, such as
+	// collector.process.whitelist
+	CollectorFlags map[string]string `json:"collectorFlags,omitempty"`
+	// Port is the port the metrics are exposed on
+	Port int32 `json:"port,omitempty"`
+}
+
+// WindowsExporter configures the windows_exporter service run on the Windows nodes
+type WindowsExporter struct {
+	// ExporterSettings holds the settings applied to all the nodes
+	ExporterSettings `json:",inline"`
+	// MachineSets overrides the settings of the nodes of the given MachineSets, keyed by MachineSet name. The
+	// collectors and port replace the global ones when set, and the collector flags are merged with the global ones.
+	MachineSets map[string]ExporterSettings `json:"machineSets,omitempty"`
+}
+
+// ForMachineSet returns the windows_exporter configuration of the nodes of the given MachineSet, in the form used by
+// the windows package
+func (e WindowsExporter) ForMachineSet(name string) *windows.ExporterConfig {
+	config := &windows.ExporterConfig{
+		Collectors:     e.Collectors,
+		CollectorFlags: make(map[string]string),
+		Port:           e.Port,
+	}
+	for flag, value := range e.CollectorFlags {
+		config.CollectorFlags[flag] = value
+	}
+	override, present := e.MachineSets[name]
+	if !present {
+		return config
+	}
+	if len(override.Collectors) > 0 {
+		config.Collectors = override.Collectors
+	}
+	for flag, value := range override.CollectorFlags {
+		config.CollectorFlags[flag] = value
+	}
+	if override.Port != 0 {
+		config.Port = override.Port
+	}
+	return config
+}
+
+// validate returns an error if the configuration of any of the nodes is not valid
+func (e WindowsExporter) validate() error {
+	if err := e.ForMachineSet("").Validate(); err != nil {
+		return err
+	}
+	for name := range e.MachineSets {
+		if err := e.ForMachineSet(name).Validate(); err != nil {
+			return errors.Wrapf(err, "invalid windows_exporter settings of MachineSet %s", name)
+		}
+	}
+	return nil
+}
+
+// KubeProxy configures the kube-proxy service run on the Windows nodes
+type KubeProxy struct {
+	// Verbosity is the log level of kube-proxy
+	Verbosity int `json:"verbosity"`
+	// EnableDSR enables Direct Server Return for the load balancers. It requires the WinDSR feature gate.
+	EnableDSR bool `json:"enableDSR,omitempty"`
+	// FeatureGates holds the kube-proxy feature gates. They are merged with the default ones, which enable WinOverlay.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// ExtraArgs holds additional kube-proxy flags, keyed by flag name without the leading dashes. The flags set by
+	// the operator, and the ones bound to the fields of the kube-proxy configuration file, are rejected.
+	ExtraArgs map[string]string `json:"extraArgs,omitempty"`
+}
+
+// Windows returns the kube-proxy configuration in the form used by the windows package
+func (k KubeProxy) Windows() *windows.KubeProxyConfig {
+	return &windows.KubeProxyConfig{
+		Verbosity:    k.Verbosity,
+		EnableDSR:    k.EnableDSR,
+		FeatureGates: k.FeatureGates,
+		ExtraArgs:    k.ExtraArgs,
+	}
+}
+
+// Default returns the default operator configuration
+func Default() *Config {
+	timeouts := windows.DefaultTimeouts()
+	recovery := windows.DefaultRecoveryPolicy()
+	exporter := windows.DefaultExporterConfig()
+	kubeProxy := windows.DefaultKubeProxyConfig()
+	return &Config{
+		Connectivity: Connectivity{
+			Backend: windows.SSHBackend,
+			WinRM: WinRM{
+				Port:              defaultWinRMPort,
+				AuthType:          windows.WinRMCertificateAuth,
+				CredentialsSecret: defaultWinRMCredentialsSecret,
+			},
+		},
+		Timeouts: Timeouts{
+			Connect:        meta.Duration{Duration: timeouts.Connect},
+			Command:        meta.Duration{Duration: timeouts.Command},
+			FileHash:       meta.Duration{Duration: timeouts.FileHash},
+			FileTransfer:   meta.Duration{Duration: timeouts.FileTransfer},
+			ServiceQuery:   meta.Duration{Duration: timeouts.ServiceQuery},
+			ServiceControl: meta.Duration{Duration: timeouts.ServiceControl},
+			Bootstrapper:   meta.Duration{Duration: timeouts.Bootstrapper},
+			Network:        meta.Duration{Duration: timeouts.Network},
+		},
+		ServiceRecovery: ServiceRecovery{
+			RestartDelay: meta.Duration{Duration: recovery.RestartDelay},
+			ResetPeriod:  meta.Duration{Duration: recovery.ResetPeriod},
+			Attempts:     recovery.Attempts,
+		},
+		WindowsExporter: WindowsExporter{
+			ExporterSettings: ExporterSettings{
+				Collectors: exporter.Collectors,
+				Port:       exporter.Port,
+			},
+		},
+		KubeProxy: KubeProxy{
+			Verbosity:    kubeProxy.Verbosity,
+			FeatureGates: kubeProxy.FeatureGates,
+		},
+	}
+}
+
+// Get returns the operator configuration held by the ConfigMap in the given namespace. The default configuration is
+// returned if the ConfigMap does not exist.
+func Get(c client.Client, namespace string) (*Config, error) {
+	configMap := &core.ConfigMap{}
+	err := c.Get(context.TODO(), kubeTypes.NamespacedName{Namespace: namespace, Name: ConfigMapName}, configMap)
+	if err != nil {
+		if k8sapierrors.IsNotFound(err) {
+			return Default(), nil
+		}
+		return nil, errors.Wrapf(err, "unable to get ConfigMap %s", ConfigMapName)
+	}
+	return Parse(configMap.Data[ConfigKey])
+}
+
+// Parse parses the given YAML configuration document on top of the default configuration and validates the result
+func Parse(data string) (*Config, error) {
+	cfg := Default()
+	if err := yaml.Unmarshal([]byte(data), cfg); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s in ConfigMap %s", ConfigKey, ConfigMapName)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid configuration in ConfigMap %s", ConfigMapName)
+	}
+	return cfg, nil
+}
+
+// Validate returns an error if the configuration is not valid
+func (cfg *Config) Validate() error {
+	if err := ValidateBackend(cfg.Connectivity.Backend); err != nil {
+		return err
+	}
+	switch cfg.Connectivity.WinRM.AuthType {
+	case windows.WinRMCertificateAuth, windows.WinRMNTLMAuth:
+	default:
+		return errors.Errorf("unsupported WinRM authentication type %q", cfg.Connectivity.WinRM.AuthType)
+	}
+	if cfg.Connectivity.WinRM.Port == "" || cfg.Connectivity.WinRM.CredentialsSecret == "" {
+		return errors.New("WinRM port and credentials secret cannot be empty")
+	}
+	for i, jumpHost := range cfg.Connectivity.JumpHosts {
+		if jumpHost.Address == "" || jumpHost.User == "" || jumpHost.KeySecret == "" {
+			return errors.Errorf("address, user and key secret of jump host %d cannot be empty", i)
+		}
+	}
+	if err := cfg.Timeouts.validate(); err != nil {
+		return err
+	}
+	if err := cfg.ServiceRecovery.validate(); err != nil {
+		return err
+	}
+	if err := cfg.WindowsExporter.validate(); err != nil {
+		return err
+	}
+	if err := cfg.KubeProxy.Windows().Validate(); err != nil {
+		return errors.Wrap(err, "invalid kube-proxy settings")
+	}
+	if cfg.MachineConfigServerURL != "" {
+		if _, err := ignition.WorkerEndpoint(cfg.MachineConfigServerURL); err != nil {
+			return err
+		}
+	}
+	if cfg.MachineConfigServerName != "" {
+		if errs := validation.IsDNS1123Subdomain(cfg.MachineConfigServerName); len(errs) > 0 {
+			return errors.Errorf("invalid Machine Config Server name %q: %s", cfg.MachineConfigServerName,
+				strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// ValidateBackend returns an error if the given connectivity backend is not supported
+func ValidateBackend(backend string) error {
+	switch backend {
+	case windows.SSHBackend, windows.WinRMBackend:
+		return nil
+	default:
+		return errors.Errorf("unsupported connectivity backend %q", backend)
+	}
+}
@@ -0,0 +1,197 @@
+package operatorconfig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
+)
+
+// TestParse tests that the configuration document is parsed on top of the defaults and validated
+func TestParse(t *testing.T) {
+	winrmNTLM := Default()
+	winrmNTLM.Connectivity.Backend = windows.WinRMBackend
+	winrmNTLM.Connectivity.WinRM.AuthType = windows.WinRMNTLMAuth
+	bootstrapperTimeout := Default()
+	bootstrapperTimeout.Timeouts.Bootstrapper.Duration = 20 * time.Minute
+	noRestarts := Default()
+	noRestarts.ServiceRecovery.Attempts = 0
+	jumpHost := Default()
+	jumpHost.Connectivity.JumpHosts = []JumpHost{{Address: "bastion.example.com", User: "core",
+		KeySecret: "bastion-key"}}
+	exporterCollectors := Default()
+	exporterCollectors.WindowsExporter.Collectors = []string{"cpu", "iis"}
+	exporterCollectors.WindowsExporter.MachineSets = map[string]ExporterSettings{"iis": {Port: 9200}}
+	kubeProxyDSR := Default()
+	kubeProxyDSR.KubeProxy.EnableDSR = true
+	kubeProxyDSR.KubeProxy.FeatureGates = map[string]bool{"WinOverlay": true, "WinDSR": true}
+	machineConfigServer := Default()
+	machineConfigServer.MachineConfigServerURL = "https://[fd00::5]:22623"
+	machineConfigServer.MachineConfigServerName = "api-int.example.com"
+
+	tests := []struct {
+		name        string
+		data        string
+		expected    *Config
+		expectedErr bool
+	}{
+		{
+			name:     "empty document",
+			data:     "",
+			expected: Default(),
+		},
+		{
+			name:     "winrm backend with NTLM",
+			data:     "connectivity:\n  backend: winrm\n  winrm:\n    authType: ntlm\n",
+			expected: winrmNTLM,
+		},
+		{
+			name:     "bootstrapper timeout override",
+			data:     "timeouts:\n  bootstrapper: 20m\n",
+			expected: bootstrapperTimeout,
+		},
+		{
+			name:     "service recovery disabled",
+			data:     "serviceRecovery:\n  attempts: 0\n",
+			expected: noRestarts,
+		},
+		{
+			name: "jump host",
+			data: "connectivity:\n  jumpHosts:\n  - address: bastion.example.com\n    user: core\n" +
+				"    keySecret: bastion-key\n",
+			expected: jumpHost,
+		},
+		{
+			name:     "windows_exporter collectors and MachineSet port",
+			data:     "windowsExporter:\n  collectors: [cpu, iis]\n  machineSets:\n    iis:\n      port: 9200\n",
+			expected: exporterCollectors,
+		},
+		{
+			name:        "invalid windows_exporter MachineSet flag",
+			data:        "windowsExporter:\n  machineSets:\n    iis:\n      collectorFlags:\n        log.level: debug\n",
+			expectedErr: true,
+		},
+		{
+			name:     "kube-proxy DSR merged with the default feature gates",
+			data:     "kubeProxy:\n  enableDSR: true\n  featureGates:\n    WinDSR: true\n",
+			expected: kubeProxyDSR,
+		},
+		{
+			name:        "kube-proxy DSR without its feature gate",
+			data:        "kubeProxy:\n  enableDSR: true\n",
+			expectedErr: true,
+		},
+		{
+			name:        "kube-proxy flag set by the operator",
+			data:        "kubeProxy:\n  extraArgs:\n    proxy-mode: userspace\n",
+			expectedErr: true,
+		},
+		{
+			name:        "kube-proxy flag of a configuration file field",
+			data:        "kubeProxy:\n  extraArgs:\n    udp-timeout: 250ms\n",
+			expectedErr: true,
+		},
+		{
+			name:     "Machine Config Server URL",
+			data:     "machineConfigServerURL: https://[fd00::5]:22623\nmachineConfigServerName: api-int.example.com\n",
+			expected: machineConfigServer,
+		},
+		{
+			name:        "invalid Machine Config Server name",
+			data:        "machineConfigServerName: https://api-int.example.com\n",
+			expectedErr: true,
+		},
+		{
+			name:        "Machine Config Server URL with a path",
+			data:        "machineConfigServerURL: https://10.0.0.5:22623/config/worker\n",
+			expectedErr: true,
+		},
+		{
+			name:        "jump host without key secret",
+			data:        "connectivity:\n  jumpHosts:\n  - address: bastion.example.com\n    user: core\n",
+			expectedErr: true,
+		},
+		{
+			name:        "negative service recovery attempts",
+			data:        "serviceRecovery:\n  attempts: -1\n",
+			expectedErr: true,
+		},
+		{
+			name:        "negative timeout",
+			data:        "timeouts:\n  command: -1m\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid timeout",
+			data:        "timeouts:\n  command: forever\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid backend",
+			data:        "connectivity:\n  backend: telnet\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid authentication type",
+			data:        "connectivity:\n  winrm:\n    authType: basic\n",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid YAML",
+			data:        "connectivity: [",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse(tt.data)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cfg)
+		})
+	}
+}
+
+// TestWindowsExporterForMachineSet tests that the windows_exporter settings of a MachineSet override the global ones
+func TestWindowsExporterForMachineSet(t *testing.T) {
+	exporter := WindowsExporter{
+		ExporterSettings: ExporterSettings{
+			Collectors:     []string{"cpu", "process"},
+			CollectorFlags: map[string]string{"collector.process.whitelist": "w3wp"},
+			Port:           windows.DefaultExporterPort,
+		},
+		MachineSets: map[string]ExporterSettings{
+			"sql": {
+				CollectorFlags: map[string]string{"collector.process.whitelist": "sqlservr",
+					"collector.mssql.class-whitelist": "accessmethods"},
+				Port: 9200,
+			},
+			"hyperv": {Collectors: []string{"hyperv"}},
+		},
+	}
+
+	assert.Equal(t, &windows.ExporterConfig{
+		Collectors:     []string{"cpu", "process"},
+		CollectorFlags: map[string]string{"collector.process.whitelist": "w3wp"},
+		Port:           windows.DefaultExporterPort,
+	}, exporter.ForMachineSet("other"))
+	assert.Equal(t, &windows.ExporterConfig{
+		Collectors: []string{"cpu", "process"},
+		CollectorFlags: map[string]string{"collector.process.whitelist": "sqlservr",
+			"collector.mssql.class-whitelist": "accessmethods"},
+		Port: 9200,
+	}, exporter.ForMachineSet("sql"))
+	assert.Equal(t, &windows.ExporterConfig{
+		Collectors:     []string{"hyperv"},
+		CollectorFlags: map[string]string{"collector.process.whitelist": "w3wp"},
+		Port:           windows.DefaultExporterPort,
+	}, exporter.ForMachineSet("hyperv"))
+	// The global flags are not modified by the overrides
+	assert.Equal(t, "w3wp", exporter.CollectorFlags["collector.process.whitelist"])
+}
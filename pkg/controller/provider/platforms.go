@@ -0,0 +1,96 @@
+package provider
+
+import (
+	config "github.com/openshift/api/config/v1"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+)
+
+// platforms is the registry of the supported platforms. Supporting a new platform only requires adding its entry.
+var platforms = []*Platform{
+	{
+		Name:               "aws",
+		ProviderIDScheme:   "aws",
+		InfrastructureType: config.AWSPlatformType,
+		User:               "Administrator",
+		AddressType:        core.NodeInternalIP,
+		UserData:           UserDataPowerShellTags,
+		// aws:///us-east-1e/i-078285fdadccb2eaa
+		instanceID: func(path string) (string, error) {
+			segments, err := pathSegments(path, 2)
+			if err != nil {
+				return "", err
+			}
+			return segments[1], nil
+		},
+	},
+	{
+		Name:               "azure",
+		ProviderIDScheme:   "azure",
+		InfrastructureType: config.AzurePlatformType,
+		// TODO: This should be changed so that the "core" user is used on all platforms for SSH connections.
+		// https://issues.redhat.com/browse/WINC-430
+		User:        "capi",
+		AddressType: core.NodeInternalIP,
+		UserData:    UserDataPowerShellTags,
+		// azure:///subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<name>
+		instanceID: func(path string) (string, error) {
+			segments, err := pathSegments(path, 8)
+			if err != nil {
+				return "", err
+			}
+			if segments[6] != "virtualMachines" {
+				return "", errors.Errorf("%s is not a virtual machine", path)
+			}
+			return segments[7], nil
+		},
+	},
+	{
+		Name:               "vsphere",
+		ProviderIDScheme:   "vsphere",
+		InfrastructureType: config.VSpherePlatformType,
+		User:               "Administrator",
+		AddressType:        core.NodeInternalIP,
+		UserData:           UserDataCloudbaseInit,
+		// vsphere://4230e8c2-6b8f-5a3a-41bb-9a3bb4c5bd8c
+		instanceID: func(path string) (string, error) {
+			segments, err := pathSegments(path, 1)
+			if err != nil {
+				return "", err
+			}
+			return segments[0], nil
+		},
+	},
+	{
+		Name:               "gcp",
+		ProviderIDScheme:   "gce",
+		InfrastructureType: config.GCPPlatformType,
+		User:               "Administrator",
+		AddressType:        core.NodeInternalIP,
+		UserData:           UserDataPowerShell,
+		// gce://<project>/<zone>/<name>
+		instanceID: func(path string) (string, error) {
+			segments, err := pathSegments(path, 3)
+			if err != nil {
+				return "", err
+			}
+			return segments[2], nil
+		},
+	},
+	{
+		Name:               "baremetal",
+		ProviderIDScheme:   "baremetalhost",
+		InfrastructureType: config.BareMetalPlatformType,
+		User:               "Administrator",
+		AddressType:        core.NodeInternalIP,
+		UserData:           UserDataNone,
+		// baremetalhost:///<namespace>/<host>/<uid>
+		instanceID: func(path string) (string, error) {
+			segments, err := pathSegments(path, 3)
+			if err != nil {
+				return "", err
+			}
+			return segments[2], nil
+		},
+	},
+}
@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"strings"
+
+	config "github.com/openshift/api/config/v1"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+)
+
+// UserDataFlavor is the format of the user data the Windows VMs of a platform are provisioned with
+type UserDataFlavor string
+
+const (
+	// UserDataPowerShellTags is a PowerShell script wrapped in <powershell> tags which is run on every boot, as
+	// consumed by EC2Launch
+	UserDataPowerShellTags UserDataFlavor = "powershell-tags"
+	// UserDataPowerShell is a plain PowerShell script
+	UserDataPowerShell UserDataFlavor = "powershell"
+	// UserDataCloudbaseInit is a PowerShell script with the #ps1_sysnative header, as consumed by cloudbase-init
+	UserDataCloudbaseInit UserDataFlavor = "cloudbase-init"
+	// UserDataNone is used by the platforms whose Windows VMs are not provisioned with user data
+	UserDataNone UserDataFlavor = "none"
+)
+
+// Platform describes how the operator interacts with the Windows VMs of a platform
+type Platform struct {
+	// Name is the name of the platform
+	Name string
+	// ProviderIDScheme is the scheme of the provider IDs of the Machines of the platform, such as aws in
+	// aws:///us-east-1e/i-078285fdadccb2eaa
+	ProviderIDScheme string
+	// InfrastructureType is the platform type reported by the cluster Infrastructure object
+	InfrastructureType config.PlatformType
+	// User is the user the operator connects to the Windows VMs as, unless it is overridden for a Machine
+	User string
+	// AddressType is the type of the Machine address the operator connects to
+	AddressType core.NodeAddressType
+	// UserData is the flavor of the user data the Windows VMs are provisioned with
+	UserData UserDataFlavor
+	// instanceID returns the instance ID of a VM from the provider ID of its Machine, without the scheme and the
+	// following `://`
+	instanceID func(path string) (string, error)
+}
+
+// ForProviderID returns the platform of the Machine with the given provider ID, along with the instance ID of the
+// VM backing the Machine
+func ForProviderID(providerID string) (*Platform, string, error) {
+	tokens := strings.SplitN(providerID, "://", 2)
+	if len(tokens) != 2 {
+		return nil, "", errors.Errorf("invalid provider ID %q", providerID)
+	}
+	for _, platform := range platforms {
+		if platform.ProviderIDScheme != tokens[0] {
+			continue
+		}
+		instanceID, err := platform.instanceID(tokens[1])
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "unable to get %s instance ID from provider ID %q", platform.Name,
+				providerID)
+		}
+		return platform, instanceID, nil
+	}
+	return nil, "", errors.Errorf("unsupported platform for provider ID %q", providerID)
+}
+
+// ForInfrastructure returns the platform of the given type, as reported by the cluster Infrastructure object
+func ForInfrastructure(platformType config.PlatformType) (*Platform, error) {
+	for _, platform := range platforms {
+		if platform.InfrastructureType == platformType {
+			return platform, nil
+		}
+	}
+	return nil, errors.Errorf("unsupported platform %q", platformType)
+}
+
+// pathSegments returns the non-empty segments of the given provider ID path, requiring the given number of segments
+func pathSegments(path string, count int) ([]string, error) {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) != count {
+		return nil, errors.Errorf("expected %d path segments, found %d", count, len(segments))
+	}
+	return segments, nil
+}
@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"testing"
+
+	config "github.com/openshift/api/config/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestForProviderID tests that the platform and instance ID are found from the provider ID of a Machine
+func TestForProviderID(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+		platform   string
+		instanceID string
+		wantErr    bool
+	}{
+		{
+			name:       "aws",
+			providerID: "aws:///us-east-1e/i-078285fdadccb2eaa",
+			platform:   "aws",
+			instanceID: "i-078285fdadccb2eaa",
+		},
+		{
+			name: "azure",
+			providerID: "azure:///subscriptions/0123/resourceGroups/cluster-rg/providers/Microsoft.Compute/" +
+				"virtualMachines/winhost-1",
+			platform:   "azure",
+			instanceID: "winhost-1",
+		},
+		{
+			name:       "vsphere",
+			providerID: "vsphere://4230e8c2-6b8f-5a3a-41bb-9a3bb4c5bd8c",
+			platform:   "vsphere",
+			instanceID: "4230e8c2-6b8f-5a3a-41bb-9a3bb4c5bd8c",
+		},
+		{
+			name:       "gcp",
+			providerID: "gce://openshift-project/us-central1-a/winhost-1",
+			platform:   "gcp",
+			instanceID: "winhost-1",
+		},
+		{
+			name:       "baremetal",
+			providerID: "baremetalhost:///openshift-machine-api/winhost-1/5b4ad1e4-d2e5-4a4d-a9ab-0f1c2a7b5d7e",
+			platform:   "baremetal",
+			instanceID: "5b4ad1e4-d2e5-4a4d-a9ab-0f1c2a7b5d7e",
+		},
+		{
+			name:       "missing instance ID",
+			providerID: "aws:///us-east-1e/",
+			wantErr:    true,
+		},
+		{
+			name: "azure resource other than a virtual machine",
+			providerID: "azure:///subscriptions/0123/resourceGroups/cluster-rg/providers/Microsoft.Compute/" +
+				"disks/winhost-1",
+			wantErr: true,
+		},
+		{
+			name:       "unsupported platform",
+			providerID: "openstack:///0123",
+			wantErr:    true,
+		},
+		{
+			name:       "no scheme",
+			providerID: "i-078285fdadccb2eaa",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platform, instanceID, err := ForProviderID(tt.providerID)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.platform, platform.Name)
+			assert.Equal(t, tt.instanceID, instanceID)
+		})
+	}
+}
+
+// TestForInfrastructure tests that the platform is found from the platform type of the cluster
+func TestForInfrastructure(t *testing.T) {
+	platform, err := ForInfrastructure(config.AzurePlatformType)
+	require.NoError(t, err)
+	assert.Equal(t, "azure", platform.Name)
+	assert.Equal(t, "capi", platform.User)
+
+	_, err = ForInfrastructure(config.NonePlatformType)
+	assert.Error(t, err)
+}
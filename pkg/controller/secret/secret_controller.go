@@ -3,6 +3,7 @@ package secret
 import (
 	"context"
 
+	configclient "github.com/openshift/client-go/config/clientset/versioned"
 	"github.com/pkg/errors"
 	core "k8s.io/api/core/v1"
 	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -21,6 +22,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/openshift/windows-machine-config-operator/pkg/clusternetwork"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/provider"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/secrets"
 )
 
@@ -54,7 +56,12 @@ func newReconciler(mgr manager.Manager) (reconcile.Reconciler, error) {
 		return nil, err
 	}
 
-	reconciler := &ReconcileSecret{client: client, scheme: mgr.GetScheme()}
+	oclient, err := configclient.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating config client")
+	}
+
+	reconciler := &ReconcileSecret{client: client, scheme: mgr.GetScheme(), oclient: oclient}
 	return reconciler, nil
 }
 
@@ -125,6 +132,8 @@ type ReconcileSecret struct {
 	// that reads objects from the cache and writes to the apiserver
 	client client.Client
 	scheme *runtime.Scheme
+	// oclient is the OpenShift config client, used to get the platform of the cluster
+	oclient configclient.Interface
 }
 
 // Reconcile reads that state of the cluster for a Secret object and makes changes based on the state read
@@ -144,8 +153,16 @@ func (r *ReconcileSecret) Reconcile(request reconcile.Request) (reconcile.Result
 		}
 		return reconcile.Result{}, errors.Wrapf(err, "unable to get secret %s", request.NamespacedName)
 	}
+	flavor, err := r.userDataFlavor()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if flavor == provider.UserDataNone {
+		log.V(1).Info("user data is not used on the cluster platform", "name", userDataSecret)
+		return reconcile.Result{}, nil
+	}
 	// Generate expected userData based on the existing private key
-	validUserData, err := secrets.GenerateUserData(privateKey)
+	validUserData, err := secrets.GenerateUserData(privateKey, flavor)
 	if err != nil {
 		return reconcile.Result{}, errors.Wrapf(err, "error generating %s secret", userDataSecret)
 	}
@@ -180,6 +197,25 @@ func (r *ReconcileSecret) Reconcile(request reconcile.Request) (reconcile.Result
 	}
 }
 
+// userDataFlavor returns the flavor of the user data used on the platform of the cluster. The user data wrapped in
+// PowerShell tags is used on the platforms which are not in the provider registry.
+func (r *ReconcileSecret) userDataFlavor() (provider.UserDataFlavor, error) {
+	infra, err := r.oclient.ConfigV1().Infrastructures().Get(context.TODO(), "cluster", meta.GetOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get cluster infrastructure resource")
+	}
+	platformType := infra.Status.Platform
+	if infra.Status.PlatformStatus != nil && infra.Status.PlatformStatus.Type != "" {
+		platformType = infra.Status.PlatformStatus.Type
+	}
+	platform, err := provider.ForInfrastructure(platformType)
+	if err != nil {
+		log.V(1).Info("using the default user data flavor", "reason", err.Error())
+		return provider.UserDataPowerShellTags, nil
+	}
+	return platform.UserData, nil
+}
+
 // userDataMapper is a simple implementation of the Mapper interface allowing for the mapping from the userData secret
 // to the private key secret
 type userDataMapper struct {
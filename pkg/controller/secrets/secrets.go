@@ -2,14 +2,17 @@ package secrets
 
 import (
 	"context"
+	"strings"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeTypes "k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/provider"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/signer"
 )
 
@@ -22,6 +25,15 @@ const (
 	PrivateKeySecret = "cloud-private-key"
 	// PrivateKeySecretKey is the key within the private key secret which holds the private key
 	PrivateKeySecretKey = "private-key.pem"
+	// WinRMUsernameKey is the key within the WinRM credentials secret which holds the username used for NTLM
+	// authentication
+	WinRMUsernameKey = "username"
+	// WinRMPasswordKey is the key within the WinRM credentials secret which holds the password used for NTLM
+	// authentication
+	WinRMPasswordKey = "password"
+	// HostKeySecret is the name of the secret that WMCO creates to record the SSH host key fingerprints of the
+	// Windows VMs. The secret is keyed by the VM's instance ID.
+	HostKeySecret = "windows-host-keys"
 )
 
 // GetPrivateKey fetches the specified secret and extracts the private key data
@@ -39,8 +51,8 @@ func GetPrivateKey(secret kubeTypes.NamespacedName, c client.Client) ([]byte, er
 	return privateKey, nil
 }
 
-// GenerateUserData generates the desired value of userdata secret.
-func GenerateUserData(privateKey []byte) (*core.Secret, error) {
+// GenerateUserData generates the desired value of userdata secret in the given user data flavor.
+func GenerateUserData(privateKey []byte, flavor provider.UserDataFlavor) (*core.Secret, error) {
 	keySigner, err := signer.Create(privateKey)
 	if err != nil {
 		return nil, err
@@ -53,13 +65,7 @@ func GenerateUserData(privateKey []byte) (*core.Secret, error) {
 
 	// sshd service is started to create the default sshd_config file. This file is modified
 	// for enabling publicKey auth and the service is restarted for the changes to take effect.
-	userDataSecret := &core.Secret{
-		ObjectMeta: meta.ObjectMeta{
-			Name:      userDataSecret,
-			Namespace: userDataNamespace,
-		},
-		Data: map[string][]byte{
-			"userData": []byte(`<powershell>
+	script := `
 			Add-WindowsCapability -Online -Name OpenSSH.Server~~~~0.0.1.0
 			$firewallRuleName = "ContainerLogsPort"
 			$containerLogsPort = "10250"
@@ -81,10 +87,114 @@ func GenerateUserData(privateKey []byte) (*core.Secret, error) {
 			$acl.SetAccessRule($systemRule)
 			$acl | Set-Acl
 			Restart-Service sshd
-			</powershell>
-			<persist>true</persist>`),
+			`
+	var userData string
+	switch flavor {
+	case provider.UserDataPowerShellTags:
+		userData = "<powershell>" + script + "</powershell>\n\t\t\t<persist>true</persist>"
+	case provider.UserDataPowerShell:
+		userData = script
+	case provider.UserDataCloudbaseInit:
+		userData = "#ps1_sysnative" + script
+	default:
+		return nil, errors.Errorf("unsupported user data flavor %q", flavor)
+	}
+
+	userDataSecret := &core.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      userDataSecret,
+			Namespace: userDataNamespace,
+		},
+		Data: map[string][]byte{
+			"userData": []byte(userData),
 		},
 	}
 
 	return userDataSecret, nil
 }
+
+// HostKeyStore records the SSH host key fingerprints of the Windows VMs in the host key secret
+type HostKeyStore struct {
+	// client is used to interact with the host key secret
+	client client.Client
+	// secret is the namespaced name of the host key secret
+	secret kubeTypes.NamespacedName
+}
+
+// NewHostKeyStore returns a HostKeyStore backed by the host key secret in the given namespace
+func NewHostKeyStore(c client.Client, namespace string) *HostKeyStore {
+	return &HostKeyStore{
+		client: c,
+		secret: kubeTypes.NamespacedName{Namespace: namespace, Name: HostKeySecret},
+	}
+}
+
+// Get returns the host key fingerprint recorded for the given instance ID, or an empty string if there is none
+func (s *HostKeyStore) Get(instanceID string) (string, error) {
+	hostKeySecret := &core.Secret{}
+	if err := s.client.Get(context.TODO(), s.secret, hostKeySecret); err != nil {
+		if k8sapierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "unable to get secret %s", s.secret)
+	}
+	return string(hostKeySecret.Data[HostKeySecretKey(instanceID)]), nil
+}
+
+// Set records the host key fingerprint for the given instance ID, creating the host key secret if required
+func (s *HostKeyStore) Set(instanceID, fingerprint string) error {
+	hostKeySecret := &core.Secret{}
+	err := s.client.Get(context.TODO(), s.secret, hostKeySecret)
+	if err != nil {
+		if !k8sapierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "unable to get secret %s", s.secret)
+		}
+		hostKeySecret = &core.Secret{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      s.secret.Name,
+				Namespace: s.secret.Namespace,
+			},
+			Data: map[string][]byte{HostKeySecretKey(instanceID): []byte(fingerprint)},
+		}
+		return errors.Wrapf(s.client.Create(context.TODO(), hostKeySecret), "unable to create secret %s", s.secret)
+	}
+	if hostKeySecret.Data == nil {
+		hostKeySecret.Data = make(map[string][]byte)
+	}
+	hostKeySecret.Data[HostKeySecretKey(instanceID)] = []byte(fingerprint)
+	return errors.Wrapf(s.client.Update(context.TODO(), hostKeySecret), "unable to update secret %s", s.secret)
+}
+
+// Delete removes the host key fingerprints recorded for the given instance IDs, if any
+func (s *HostKeyStore) Delete(instanceIDs ...string) error {
+	hostKeySecret := &core.Secret{}
+	if err := s.client.Get(context.TODO(), s.secret, hostKeySecret); err != nil {
+		if k8sapierrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "unable to get secret %s", s.secret)
+	}
+	deleted := false
+	for _, instanceID := range instanceIDs {
+		if _, present := hostKeySecret.Data[HostKeySecretKey(instanceID)]; present {
+			delete(hostKeySecret.Data, HostKeySecretKey(instanceID))
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return errors.Wrapf(s.client.Update(context.TODO(), hostKeySecret), "unable to update secret %s", s.secret)
+}
+
+// HostKeySecretKey returns the key within the host key secret for the given instance ID. Secret keys are restricted
+// to alphanumeric characters, '-', '_' and '.', so any other character is replaced with '_'.
+func HostKeySecretKey(instanceID string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' ||
+			r == '.' {
+			return r
+		}
+		return '_'
+	}, instanceID)
+}
@@ -0,0 +1,244 @@
+package windowsmachine
+
+import (
+	"context"
+	"time"
+
+	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/provider"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
+)
+
+const (
+	// DeconfigureFinalizer is the finalizer added to the Windows Machines so that their VM is deconfigured, and their
+	// node removed, before the Machine is deleted
+	DeconfigureFinalizer = "windowsmachineconfig.openshift.io/deconfigure"
+	// deconfigureGracePeriod is the amount of time after the deletion of a Machine during which the node is drained
+	// and the VM deconfigured. The Machine is released once it expires without deconfiguring the VM, so that a
+	// Machine whose VM cannot be deconfigured does not stay stuck deleting.
+	deconfigureGracePeriod = 15 * time.Minute
+	// deconfigureTimeout is the maximum amount of time spent deconfiguring a VM in a single reconcile
+	deconfigureTimeout = 10 * time.Minute
+	// deconfigureConnectTimeout is the maximum amount of time spent connecting to the VM of a Machine being deleted.
+	// The VM is considered gone if it cannot be connected to within it.
+	deconfigureConnectTimeout = 2 * time.Minute
+	// deletingPhase is the phase of a Machine whose deletion was initiated
+	deletingPhase = "Deleting"
+	// drainRequeueInterval is the interval at which the eviction of the pods of a draining node is checked
+	drainRequeueInterval = 10 * time.Second
+	// mirrorPodAnnotation is the annotation set on the mirror pods of static pods, which cannot be evicted
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+// hasFinalizer returns true if the given finalizer is set on the Machine
+func hasFinalizer(machine *mapi.Machine, finalizer string) bool {
+	for _, f := range machine.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// errVMUnreachable is returned by deconfigureVM if the VM of the Machine cannot be connected to
+var errVMUnreachable = errors.New("VM unreachable")
+
+// ensureFinalizer adds the DeconfigureFinalizer to the given Machine if it is not set. The Machine is updated rather
+// than patched, so that the finalizers of other controllers removed in the meantime are not put back.
+func (r *ReconcileWindowsMachine) ensureFinalizer(machine *mapi.Machine) error {
+	if hasFinalizer(machine, DeconfigureFinalizer) {
+		return nil
+	}
+	controllerutil.AddFinalizer(machine, DeconfigureFinalizer)
+	return errors.Wrapf(r.client.Update(r.ctx, machine), "unable to add finalizer to machine %s", machine.Name)
+}
+
+// isInstanceGone returns true if the cloud instance of the given Machine being deleted is gone. The Machine API
+// removes its finalizer from a Machine being deleted once its instance is deleted.
+func isInstanceGone(machine *mapi.Machine) bool {
+	return machine.Status.Phase != nil && *machine.Status.Phase == deletingPhase &&
+		!hasFinalizer(machine, mapi.MachineFinalizer)
+}
+
+// deconfigure drains the node of the given Machine being deleted, deconfigures its VM and deletes the node, before
+// removing the DeconfigureFinalizer to let the Machine be deleted. The Machine is requeued while its node is draining.
+// The VM is not deconfigured if its instance is gone or cannot be connected to, nor once the grace period expired.
+func (r *ReconcileWindowsMachine) deconfigure(machine *mapi.Machine, privateKey []byte) (reconcile.Result, error) {
+	expired := time.Since(machine.GetDeletionTimestamp().Time) > deconfigureGracePeriod
+	gone := isInstanceGone(machine)
+	log.Info("deconfiguring", "name", machine.Name, "gracePeriodExpired", expired, "instanceGone", gone)
+
+	var node *core.Node
+	if machine.Status.NodeRef != nil {
+		node = &core.Node{}
+		err := r.client.Get(r.ctx, kubeTypes.NamespacedName{Name: machine.Status.NodeRef.Name}, node)
+		if err != nil {
+			if !k8sapierrors.IsNotFound(err) {
+				return reconcile.Result{}, errors.Wrapf(err, "could not get node associated with machine %s",
+					machine.Name)
+			}
+			node = nil
+		}
+	}
+
+	if node != nil && !expired && !gone {
+		drained, err := r.drainNode(node)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !drained {
+			log.Info("waiting for the node to drain", "name", machine.Name, "node", node.Name)
+			return reconcile.Result{RequeueAfter: drainRequeueInterval}, nil
+		}
+	}
+
+	switch {
+	case expired:
+		r.recorder.Eventf(machine, core.EventTypeWarning, "MachineDeconfigureSkipped",
+			"Machine %s could not be deconfigured within %v of its deletion, releasing it", machine.Name,
+			deconfigureGracePeriod)
+	case gone:
+		log.Info("instance is gone, skipping the deconfiguration of its VM", "name", machine.Name)
+	default:
+		if err := r.deconfigureVM(machine, privateKey); err != nil {
+			if !errors.Is(err, errVMUnreachable) {
+				r.recorder.Eventf(machine, core.EventTypeWarning, "MachineDeconfigureFailure",
+					"Machine %s deconfiguration failure: %v", machine.Name, err)
+				return reconcile.Result{}, err
+			}
+			log.Info("VM cannot be connected to, assuming it is gone", "name", machine.Name, "error", err)
+		}
+	}
+
+	if node != nil {
+		if err := r.client.Delete(r.ctx, node); err != nil && !k8sapierrors.IsNotFound(err) {
+			return reconcile.Result{}, errors.Wrapf(err, "unable to delete node %s", node.Name)
+		}
+		log.Info("deleted node", "name", machine.Name, "node", node.Name)
+	}
+
+	if instanceID := machineInstanceID(machine); instanceID != "" {
+		if err := r.hostKeys.Delete(windows.HostKeyIDs(instanceID)...); err != nil {
+			return reconcile.Result{}, errors.Wrapf(err, "unable to remove host keys of machine %s", machine.Name)
+		}
+		r.sshPool.Remove(instanceID)
+	}
+
+	// The Machine is updated rather than patched, so that the finalizers of other controllers removed in the meantime
+	// are not put back
+	controllerutil.RemoveFinalizer(machine, DeconfigureFinalizer)
+	if err := r.client.Update(r.ctx, machine); err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "unable to remove finalizer from machine %s", machine.Name)
+	}
+	r.recorder.Eventf(machine, core.EventTypeNormal, "MachineDeconfigured",
+		"Machine %s deconfigured successfully", machine.Name)
+	return reconcile.Result{}, nil
+}
+
+// deconfigureVM deconfigures the VM backing the given Machine. There is nothing to deconfigure if the Machine was
+// never given an address, as the VM was never configured. An error wrapping errVMUnreachable is returned if the VM
+// cannot be connected to.
+func (r *ReconcileWindowsMachine) deconfigureVM(machine *mapi.Machine, privateKey []byte) error {
+	if len(machine.Status.Addresses) == 0 {
+		log.Info("machine has no address, skipping the deconfiguration of its VM", "name", machine.Name)
+		return nil
+	}
+	access, err := r.vmAccess(machine, privateKey)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, deconfigureTimeout)
+	defer cancel()
+	connectCtx, cancelConnect := context.WithTimeout(ctx, deconfigureConnectTimeout)
+	defer cancelConnect()
+	nc, err := nodeconfig.NewNodeConfig(connectCtx, r.k8sclientset, access.ipAddress, access.username,
+		access.instanceID, r.clusterServiceCIDR, r.vxlanPort, access.firewallRules, access.connSettings)
+	if err != nil {
+		var mismatch *windows.HostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			return errors.Wrapf(err, "failed to deconfigure Windows VM %s", access.instanceID)
+		}
+		return errors.Wrapf(errVMUnreachable, "failed to deconfigure Windows VM %s: %v", access.instanceID, err)
+	}
+	return errors.Wrapf(nc.Deconfigure(ctx), "failed to deconfigure Windows VM %s", access.instanceID)
+}
+
+// drainNode cordons the given node and evicts its pods. It returns true once the pods are gone, except for the pods
+// of DaemonSets and the mirror pods, which are not evicted.
+func (r *ReconcileWindowsMachine) drainNode(node *core.Node) (bool, error) {
+	if !node.Spec.Unschedulable {
+		err := nodeconfig.PatchNode(r.ctx, r.k8sclientset, node, func(node *core.Node) {
+			node.Spec.Unschedulable = true
+		})
+		if err != nil {
+			return false, errors.Wrapf(err, "unable to cordon node %s", node.Name)
+		}
+		log.Info("cordoned node", "node", node.Name)
+	}
+
+	pods, err := r.k8sclientset.CoreV1().Pods("").List(r.ctx,
+		meta.ListOptions{FieldSelector: "spec.nodeName=" + node.Name})
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to list the pods of node %s", node.Name)
+	}
+	drained := true
+	for _, pod := range pods.Items {
+		if !isEvictable(&pod) {
+			continue
+		}
+		drained = false
+		if pod.GetDeletionTimestamp() != nil {
+			// The pod is already terminating
+			continue
+		}
+		eviction := &policy.Eviction{ObjectMeta: meta.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace}}
+		err := r.k8sclientset.PolicyV1beta1().Evictions(pod.Namespace).Evict(r.ctx, eviction)
+		if err != nil && !k8sapierrors.IsNotFound(err) {
+			// Evictions violating a PodDisruptionBudget are rejected with TooManyRequests, retry them later
+			if k8sapierrors.IsTooManyRequests(err) {
+				log.V(1).Info("pod eviction rejected", "pod", pod.Namespace+"/"+pod.Name, "error", err)
+				continue
+			}
+			return false, errors.Wrapf(err, "unable to evict pod %s/%s", pod.Namespace, pod.Name)
+		}
+	}
+	return drained, nil
+}
+
+// machineInstanceID returns the instance ID of the VM backing the given Machine, or an empty string if it is unknown
+func machineInstanceID(machine *mapi.Machine) string {
+	if machine.Spec.ProviderID == nil {
+		return ""
+	}
+	_, instanceID, err := provider.ForProviderID(*machine.Spec.ProviderID)
+	if err != nil {
+		return ""
+	}
+	return instanceID
+}
+
+// isEvictable returns true if the given pod has to be evicted to drain its node
+func isEvictable(pod *core.Pod) bool {
+	if pod.Status.Phase == core.PodSucceeded || pod.Status.Phase == core.PodFailed {
+		return false
+	}
+	if _, present := pod.Annotations[mirrorPodAnnotation]; present {
+		return false
+	}
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return true
+}
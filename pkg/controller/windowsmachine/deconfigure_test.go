@@ -0,0 +1,165 @@
+package windowsmachine
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/apis"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/secrets"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
+)
+
+// testNamespace is the namespace the operator watches in the tests
+const testNamespace = "openshift-windows-machine-config-operator"
+
+// newTestReconciler returns a reconciler whose client holds the given objects and whose clientset holds the given
+// core objects, along with the recorder of its events
+func newTestReconciler(t *testing.T, objects []runtime.Object, coreObjects ...runtime.Object) (*ReconcileWindowsMachine,
+	*record.FakeRecorder) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, apis.AddToScheme(scheme))
+	c := fake.NewFakeClientWithScheme(scheme, objects...)
+	recorder := record.NewFakeRecorder(10)
+	return &ReconcileWindowsMachine{
+		client:         c,
+		scheme:         scheme,
+		k8sclientset:   k8sfake.NewSimpleClientset(coreObjects...),
+		recorder:       recorder,
+		watchNamespace: testNamespace,
+		hostKeys:       secrets.NewHostKeyStore(c, testNamespace),
+		sshPool:        windows.NewSSHPool(),
+		ctx:            context.Background(),
+	}, recorder
+}
+
+// newDeletingMachine returns a Windows Machine deleted at the given time, backed by the node named after it
+func newDeletingMachine(deleted time.Time, phase string, finalizers ...string) *mapi.Machine {
+	providerID := "aws:///us-east-1a/i-0123456789"
+	return &mapi.Machine{
+		ObjectMeta: meta.ObjectMeta{Name: "windows", Namespace: "openshift-machine-api",
+			Labels: map[string]string{windowsOSLabel: "Windows"}, Finalizers: finalizers,
+			DeletionTimestamp: &meta.Time{Time: deleted}},
+		Spec: mapi.MachineSpec{ProviderID: &providerID},
+		Status: mapi.MachineStatus{Phase: &phase, NodeRef: &core.ObjectReference{Name: "windows"},
+			Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.5"}}},
+	}
+}
+
+// events returns the events recorded so far
+func events(recorder *record.FakeRecorder) []string {
+	var recorded []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+// TestDeconfigure tests that a Machine being deleted is released without deconfiguring its VM once its instance is
+// gone or the grace period expired, and that its node is deleted
+func TestDeconfigure(t *testing.T) {
+	tests := []struct {
+		name      string
+		machine   *mapi.Machine
+		wantEvent string
+	}{
+		{
+			name:      "instance gone",
+			machine:   newDeletingMachine(time.Now(), deletingPhase, DeconfigureFinalizer),
+			wantEvent: "Normal MachineDeconfigured",
+		},
+		{
+			name: "grace period expired",
+			machine: newDeletingMachine(time.Now().Add(-deconfigureGracePeriod-time.Minute), deletingPhase,
+				DeconfigureFinalizer, mapi.MachineFinalizer),
+			wantEvent: "Warning MachineDeconfigureSkipped",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "windows"}}
+			// A pod left on the node would keep it draining
+			pod := &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "workload", Namespace: "default"},
+				Spec: core.PodSpec{NodeName: node.Name}}
+			r, recorder := newTestReconciler(t, []runtime.Object{tt.machine, node}, node.DeepCopy(), pod)
+
+			// The VM would fail to be deconfigured, as the private key is invalid
+			result, err := r.deconfigure(tt.machine, []byte("invalid"))
+			require.NoError(t, err)
+			assert.Equal(t, reconcile.Result{}, result)
+
+			machine := &mapi.Machine{}
+			require.NoError(t, r.client.Get(r.ctx, kubeTypes.NamespacedName{Namespace: tt.machine.Namespace,
+				Name: tt.machine.Name}, machine))
+			assert.False(t, hasFinalizer(machine, DeconfigureFinalizer))
+			err = r.client.Get(r.ctx, kubeTypes.NamespacedName{Name: node.Name}, &core.Node{})
+			assert.True(t, k8sapierrors.IsNotFound(err), "node was not deleted")
+
+			recorded := events(recorder)
+			require.NotEmpty(t, recorded)
+			assert.True(t, strings.HasPrefix(recorded[0], tt.wantEvent), "unexpected events %v", recorded)
+		})
+	}
+}
+
+// TestDeconfigureDrains tests that the node of a Machine being deleted is cordoned and drained before its VM is
+// deconfigured
+func TestDeconfigureDrains(t *testing.T) {
+	machine := newDeletingMachine(time.Now(), deletingPhase, DeconfigureFinalizer, mapi.MachineFinalizer)
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "windows"}}
+	pod := &core.Pod{ObjectMeta: meta.ObjectMeta{Name: "workload", Namespace: "default"},
+		Spec: core.PodSpec{NodeName: node.Name}}
+	r, _ := newTestReconciler(t, []runtime.Object{machine, node}, node.DeepCopy(), pod)
+
+	result, err := r.deconfigure(machine, nil)
+	require.NoError(t, err)
+	assert.Equal(t, drainRequeueInterval, result.RequeueAfter)
+
+	cordoned, err := r.k8sclientset.CoreV1().Nodes().Get(r.ctx, node.Name, meta.GetOptions{})
+	require.NoError(t, err)
+	assert.True(t, cordoned.Spec.Unschedulable)
+	assert.True(t, hasFinalizer(machine, DeconfigureFinalizer))
+}
+
+// TestDeconfigureKeepsFinalizers tests that removing the DeconfigureFinalizer from an outdated Machine does not put
+// back the finalizers removed in the meantime
+func TestDeconfigureKeepsFinalizers(t *testing.T) {
+	machine := newDeletingMachine(time.Now().Add(-deconfigureGracePeriod-time.Minute), deletingPhase,
+		DeconfigureFinalizer, mapi.MachineFinalizer)
+	machine.Status.NodeRef = nil
+	r, _ := newTestReconciler(t, []runtime.Object{machine})
+
+	key := kubeTypes.NamespacedName{Namespace: machine.Namespace, Name: machine.Name}
+	outdated := &mapi.Machine{}
+	require.NoError(t, r.client.Get(r.ctx, key, outdated))
+	// The Machine API removes its finalizer once the instance is deleted
+	current := outdated.DeepCopy()
+	current.Finalizers = []string{DeconfigureFinalizer}
+	require.NoError(t, r.client.Update(r.ctx, current))
+
+	_, err := r.deconfigure(outdated, nil)
+	assert.True(t, k8sapierrors.IsConflict(errors.Cause(err)), "unexpected error %v", err)
+	require.NoError(t, r.client.Get(r.ctx, key, current))
+	assert.Equal(t, []string{DeconfigureFinalizer}, current.Finalizers)
+}
@@ -0,0 +1,214 @@
+package windowsmachine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	config "github.com/openshift/api/config/v1"
+	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/operatorconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/ignition"
+)
+
+// workerPoolName is the name of the MachineConfigPool of the worker nodes, whose rendered config is served by the
+// Machine Config Server as the worker ignition file
+const workerPoolName = "worker"
+
+// infrastructureName is the name of the cluster Infrastructure, whose internal API server URL hosts the Machine Config
+// Server
+const infrastructureName = "cluster"
+
+// machineConfigPoolGVK is the group, version and kind of the MachineConfigPools
+var machineConfigPoolGVK = schema.GroupVersionKind{Group: "machineconfiguration.openshift.io", Version: "v1",
+	Kind: "MachineConfigPool"}
+
+// newMachineConfigPool returns an empty MachineConfigPool
+func newMachineConfigPool() *unstructured.Unstructured {
+	pool := &unstructured.Unstructured{}
+	pool.SetGroupVersionKind(machineConfigPoolGVK)
+	return pool
+}
+
+// isWorkerPool returns true if the given object is the worker MachineConfigPool
+func isWorkerPool(object meta.Object) bool {
+	return object.GetName() == workerPoolName
+}
+
+// renderedConfig returns the name of the rendered MachineConfig served to the nodes of the given MachineConfigPool,
+// or an empty string if it is not known
+func renderedConfig(object runtime.Object) string {
+	pool, ok := object.(*unstructured.Unstructured)
+	if !ok {
+		return ""
+	}
+	name, _, _ := unstructured.NestedString(pool.Object, "status", "configuration", "name")
+	return name
+}
+
+// apiServerInternalURL returns the internal API server URL of the given Infrastructure, or an empty string if it is
+// not known
+func apiServerInternalURL(object runtime.Object) string {
+	infrastructure, ok := object.(*config.Infrastructure)
+	if !ok {
+		return ""
+	}
+	return infrastructure.Status.APIServerInternalURL
+}
+
+// renderedWorkerConfig returns the name of the rendered MachineConfig served to the worker nodes, or an empty string
+// if the cluster has no worker MachineConfigPool
+func (r *ReconcileWindowsMachine) renderedWorkerConfig() (string, error) {
+	pool := newMachineConfigPool()
+	if err := r.client.Get(r.ctx, kubeTypes.NamespacedName{Name: workerPoolName}, pool); err != nil {
+		if k8sapierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "unable to get MachineConfigPool %s", workerPoolName)
+	}
+	return renderedConfig(pool), nil
+}
+
+// workerIgnitionEndpoint returns the endpoint of the worker ignition file, served by the Machine Config Server set in
+// the operator configuration if any. It is rebuilt from the cached cluster Infrastructure if its internal API server
+// URL changed.
+func (r *ReconcileWindowsMachine) workerIgnitionEndpoint() (ignition.Endpoint, error) {
+	cfg, err := operatorconfig.Get(r.client, r.watchNamespace)
+	if err != nil {
+		return ignition.Endpoint{}, err
+	}
+	return nodeconfig.WorkerIgnitionEndpoint(r.ctx, r.client, cfg.MachineConfigServerURL, cfg.MachineConfigServerName)
+}
+
+// ensureRenderedConfig ensures the given node, configured by the current operator version, is configured from the
+// rendered config of the worker MachineConfigPool, served at the current worker ignition endpoint. Nodes are
+// reconfigured if they were bootstrapped from another endpoint, or if the parts of the worker ignition file used to
+// configure them changed, within the limit of unavailable Windows nodes. The node is then tainted with the
+// ConfiguringTaint, cordoned, drained and its version annotation removed, for the next reconcile to configure it
+// again. A non-empty result is returned while the node is being reconfigured.
+func (r *ReconcileWindowsMachine) ensureRenderedConfig(machine *mapi.Machine, node *core.Node) (reconcile.Result,
+	error) {
+	if _, reconfiguring := node.Annotations[nodeconfig.ReconfigureAnnotation]; !reconfiguring {
+		rendered, err := r.renderedWorkerConfig()
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		endpoint, err := r.workerIgnitionEndpoint()
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		var reason string
+		// Nodes configured before the endpoint was recorded are assumed to be bootstrapped from the current one
+		if previous := node.Annotations[nodeconfig.WorkerIgnitionEndpointAnnotation]; previous != "" &&
+			previous != endpoint.URL {
+			reason = fmt.Sprintf("its worker ignition endpoint changed from %s to %s", previous, endpoint.URL)
+		} else {
+			if rendered == "" || node.Annotations[nodeconfig.RenderedConfigAnnotation] == rendered {
+				return reconcile.Result{}, nil
+			}
+			changed, err := r.changedWindowsConfig(node, endpoint)
+			if err != nil {
+				return reconcile.Result{}, errors.Wrapf(err, "unable to check rendered config %s for machine %s",
+					rendered, machine.Name)
+			}
+			if len(changed) == 0 {
+				log.Info("rendered config does not affect the node", "name", machine.Name, "renderedConfig", rendered)
+				err := nodeconfig.PatchNode(r.ctx, r.k8sclientset, node, func(node *core.Node) {
+					node.Annotations[nodeconfig.RenderedConfigAnnotation] = rendered
+				})
+				return reconcile.Result{}, errors.Wrapf(err, "unable to update annotations of node %s", node.Name)
+			}
+			reason = fmt.Sprintf("its %s changed", strings.Join(changed, ", "))
+		}
+		allowed, err := r.isAllowedReconfiguration(machine, node)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !allowed {
+			log.Info("machine reconfiguration restricted", "name", machine.GetName(),
+				"maxUnhealthyCount", maxUnhealthyCount)
+			r.recorder.Eventf(machine, core.EventTypeWarning, "MachineReconfigureRestricted",
+				"Machine %v reconfiguration restricted as the maximum unhealthy machines can`t exceed %v count",
+				machine.Name, maxUnhealthyCount)
+			return reconcile.Result{Requeue: true}, nil
+		}
+		err = nodeconfig.PatchNode(r.ctx, r.k8sclientset, node, func(node *core.Node) {
+			node.Annotations[nodeconfig.ReconfigureAnnotation] = rendered
+			nodeconfig.AddConfiguringTaint(node)
+		})
+		if err != nil {
+			return reconcile.Result{}, errors.Wrapf(err, "unable to update annotations of node %s", node.Name)
+		}
+		r.recorder.Eventf(machine, core.EventTypeNormal, "MachineReconfiguring",
+			"Machine %s is reconfigured for rendered config %s as %s", machine.Name, rendered, reason)
+	}
+
+	drained, err := r.drainNode(node)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !drained {
+		log.Info("waiting for the node to drain", "name", machine.Name, "node", node.Name)
+		return reconcile.Result{RequeueAfter: drainRequeueInterval}, nil
+	}
+	// Without the version annotation, the node counts as unhealthy and is configured again by the next reconcile.
+	// The configuration uncordons the node and removes the ReconfigureAnnotation and the ConfiguringTaint.
+	err = nodeconfig.PatchNode(r.ctx, r.k8sclientset, node, func(node *core.Node) {
+		delete(node.Annotations, nodeconfig.VersionAnnotation)
+	})
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "unable to remove version annotation from node %s", node.Name)
+	}
+	log.Info("drained node for reconfiguration", "name", machine.Name, "node", node.Name)
+	return reconcile.Result{Requeue: true}, nil
+}
+
+// isAllowedReconfiguration determines if the node of the given machine can be reconfigured within the limit of
+// unavailable Windows nodes. The nodes being reconfigured are counted from the API server rather than the informer
+// cache, which may not hold yet the ReconfigureAnnotation of a node patched by the previous reconcile.
+func (r *ReconcileWindowsMachine) isAllowedReconfiguration(machine *mapi.Machine, node *core.Node) (bool, error) {
+	nodes, err := r.k8sclientset.CoreV1().Nodes().List(r.ctx, meta.ListOptions{LabelSelector: nodeconfig.WindowsOSLabel})
+	if err != nil {
+		return false, errors.Wrap(err, "unable to list Windows nodes")
+	}
+	reconfiguring := 0
+	for _, other := range nodes.Items {
+		if _, present := other.Annotations[nodeconfig.ReconfigureAnnotation]; present && other.Name != node.Name {
+			reconfiguring++
+		}
+	}
+	if reconfiguring >= maxUnhealthyCount {
+		return false, nil
+	}
+	return r.isAllowedDisruption(machine), nil
+}
+
+// changedWindowsConfig returns the names of the parts of the worker ignition file served at the given endpoint which
+// differ from the ones the given node was configured with. All the parts are returned if those are unknown.
+func (r *ReconcileWindowsMachine) changedWindowsConfig(node *core.Node, endpoint ignition.Endpoint) ([]string,
+	error) {
+	ctx, cancel := context.WithTimeout(r.ctx, nodeHealthTimeout)
+	defer cancel()
+	_, hashes, err := nodeconfig.FetchWorkerIgnition(ctx, r.k8sclientset, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var previous map[string]string
+	if err := json.Unmarshal([]byte(node.Annotations[nodeconfig.WindowsConfigAnnotation]), &previous); err != nil {
+		log.Info("unable to parse the Windows configuration of the node", "node", node.Name, "error", err)
+	}
+	return ignition.ChangedParts(previous, hashes), nil
+}
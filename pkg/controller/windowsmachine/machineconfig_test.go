@@ -0,0 +1,193 @@
+package windowsmachine
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/operatorconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/ignition"
+)
+
+// testWorkerIgnition is a worker ignition holding the files used by the bootstrapper
+const testWorkerIgnition = `{"ignition":{"version":"3.1.0"},"storage":{"files":[
+{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,apiVersion%3A%20v1%0Akind%3A%20Config%0A"}},
+{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:,CA"}},
+{"path":"/etc/kubernetes/kubelet.conf","contents":{"source":"data:,clusterDomain%3A%20cluster.local%0A"}}]}}`
+
+// newWorkerPool returns the worker MachineConfigPool serving the given rendered config
+func newWorkerPool(t *testing.T, rendered string) *unstructured.Unstructured {
+	pool := newMachineConfigPool()
+	pool.SetName(workerPoolName)
+	require.NoError(t, unstructured.SetNestedField(pool.Object, rendered, "status", "configuration", "name"))
+	return pool
+}
+
+// newReconfiguredMachine returns a running Windows Machine owned by a MachineSet of the given number of replicas,
+// backed by the node named after it
+func newReconfiguredMachine(replicas int32) (*mapi.Machine, *mapi.MachineSet) {
+	machineSet := &mapi.MachineSet{ObjectMeta: meta.ObjectMeta{Name: "windows", Namespace: "openshift-machine-api"},
+		Spec: mapi.MachineSetSpec{Replicas: &replicas}}
+	phase := "Running"
+	machine := &mapi.Machine{
+		ObjectMeta: meta.ObjectMeta{Name: "windows", Namespace: machineSet.Namespace,
+			Labels:          map[string]string{windowsOSLabel: "Windows"},
+			OwnerReferences: []meta.OwnerReference{{Kind: "MachineSet", Name: machineSet.Name}}},
+		Status: mapi.MachineStatus{Phase: &phase, NodeRef: &core.ObjectReference{Name: "windows"}},
+	}
+	return machine, machineSet
+}
+
+// TestEnsureRenderedConfig tests that a node is only reconfigured when the parts of the worker ignition file it was
+// configured with changed, within the limit of unavailable Windows nodes, and once it is drained
+func TestEnsureRenderedConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		// unchanged is true if the node was configured with the Windows parts of the current worker ignition file
+		unchanged bool
+		// reconfiguring is true if the node is already being reconfigured
+		reconfiguring bool
+		// otherReconfiguring is true if another Windows node is being reconfigured
+		otherReconfiguring bool
+		// workload is true if a pod is left on the node
+		workload              bool
+		expectedResult        reconcile.Result
+		expectedEvent         string
+		expectedReconfiguring bool
+		expectedVersion       bool
+	}{
+		{
+			name:            "unchanged parts",
+			unchanged:       true,
+			expectedResult:  reconcile.Result{},
+			expectedVersion: true,
+		},
+		{
+			name:               "budget restricted",
+			otherReconfiguring: true,
+			expectedResult:     reconcile.Result{Requeue: true},
+			expectedEvent:      "Warning MachineReconfigureRestricted",
+			expectedVersion:    true,
+		},
+		{
+			name:                  "drain pending",
+			workload:              true,
+			expectedResult:        reconcile.Result{RequeueAfter: drainRequeueInterval},
+			expectedEvent:         "Normal MachineReconfiguring",
+			expectedReconfiguring: true,
+			expectedVersion:       true,
+		},
+		{
+			name:                  "drained",
+			expectedResult:        reconcile.Result{Requeue: true},
+			expectedEvent:         "Normal MachineReconfiguring",
+			expectedReconfiguring: true,
+		},
+		{
+			name:                  "drained while reconfiguring",
+			reconfiguring:         true,
+			otherReconfiguring:    true,
+			expectedResult:        reconcile.Result{Requeue: true},
+			expectedReconfiguring: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(testWorkerIgnition))
+			}))
+			defer server.Close()
+			rootCA := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "root-ca", Namespace: "kube-system"},
+				Data: map[string]string{"ca.crt": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+					Bytes: server.Certificate().Raw}))}}
+			// The certificate of the test server is valid for example.com
+			operatorConfig := &core.ConfigMap{
+				ObjectMeta: meta.ObjectMeta{Name: operatorconfig.ConfigMapName, Namespace: testNamespace},
+				Data: map[string]string{operatorconfig.ConfigKey: "machineConfigServerURL: " + server.URL +
+					"\nmachineConfigServerName: example.com\n"},
+			}
+
+			windowsConfig := "{}"
+			if tt.unchanged {
+				windowsConfig = workerIgnitionHashes(t, server.URL, rootCA)
+			}
+			node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "windows",
+				Labels: map[string]string{"node.openshift.io/os_id": "Windows"},
+				Annotations: map[string]string{
+					nodeconfig.VersionAnnotation:                "4.6.0",
+					nodeconfig.WindowsConfigAnnotation:          windowsConfig,
+					nodeconfig.RenderedConfigAnnotation:         "rendered-worker-1",
+					nodeconfig.WorkerIgnitionEndpointAnnotation: server.URL + "/config/worker",
+				}}}
+			if tt.reconfiguring {
+				node.Annotations[nodeconfig.ReconfigureAnnotation] = "rendered-worker-2"
+			}
+			coreObjects := []runtime.Object{node.DeepCopy(), rootCA}
+			if tt.otherReconfiguring {
+				coreObjects = append(coreObjects, &core.Node{ObjectMeta: meta.ObjectMeta{Name: "other",
+					Labels:      map[string]string{"node.openshift.io/os_id": "Windows"},
+					Annotations: map[string]string{nodeconfig.ReconfigureAnnotation: "rendered-worker-2"}}})
+			}
+			if tt.workload {
+				coreObjects = append(coreObjects, &core.Pod{
+					ObjectMeta: meta.ObjectMeta{Name: "workload", Namespace: "default"},
+					Spec:       core.PodSpec{NodeName: node.Name}})
+			}
+			machine, machineSet := newReconfiguredMachine(1)
+			r, recorder := newTestReconciler(t, []runtime.Object{machine, machineSet, operatorConfig,
+				newWorkerPool(t, "rendered-worker-2")}, coreObjects...)
+
+			result, err := r.ensureRenderedConfig(machine, node)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedResult, result)
+
+			current, err := r.k8sclientset.CoreV1().Nodes().Get(r.ctx, node.Name, meta.GetOptions{})
+			require.NoError(t, err)
+			_, reconfiguring := current.Annotations[nodeconfig.ReconfigureAnnotation]
+			assert.Equal(t, tt.expectedReconfiguring, reconfiguring)
+			_, version := current.Annotations[nodeconfig.VersionAnnotation]
+			assert.Equal(t, tt.expectedVersion, version)
+			if tt.unchanged {
+				assert.Equal(t, "rendered-worker-2", current.Annotations[nodeconfig.RenderedConfigAnnotation])
+			}
+			assert.Equal(t, tt.expectedReconfiguring, current.Spec.Unschedulable)
+
+			recorded := events(recorder)
+			if tt.expectedEvent == "" {
+				assert.Empty(t, recorded)
+				return
+			}
+			require.Len(t, recorded, 1)
+			assert.True(t, strings.HasPrefix(recorded[0], tt.expectedEvent), "unexpected event %s", recorded[0])
+		})
+	}
+}
+
+// workerIgnitionHashes returns the hashes of the Windows parts of the worker ignition file served by the given
+// Machine Config Server, as recorded on the nodes configured from it
+func workerIgnitionHashes(t *testing.T, serverURL string, rootCA *core.ConfigMap) string {
+	workerIgnition, err := ignition.Fetch(context.Background(), ignition.Endpoint{URL: serverURL + "/config/worker",
+		ServerName: "example.com"}, []byte(rootCA.Data["ca.crt"]))
+	require.NoError(t, err)
+	windowsConfig, err := ignition.ParseWindowsConfig(workerIgnition.Data)
+	require.NoError(t, err)
+	hashes, err := windowsConfig.Hashes()
+	require.NoError(t, err)
+	data, err := json.Marshal(hashes)
+	require.NoError(t, err)
+	return string(data)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
 
 	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
 	"github.com/operator-framework/operator-sdk/pkg/metrics"
@@ -18,6 +19,7 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
 )
 
 var (
@@ -33,8 +35,9 @@ const (
 	PortName = "metrics"
 	// Host is the host address used by Windows metrics
 	Host = "0.0.0.0"
-	// Port is the port number on which windows-exporter is exposed.
-	Port int32 = 9182
+	// Port is the default port number on which windows-exporter is exposed. The port of each node is held by its
+	// nodeconfig.MetricsPortAnnotation.
+	Port = windows.DefaultExporterPort
 )
 
 // PrometheusNodeConfig holds the information required to configure Prometheus, so that it can scrape metrics from the
@@ -115,24 +118,11 @@ func Add(ctx context.Context, cfg *rest.Config, namespace string) error {
 	return nil
 }
 
-// syncMetricsEndpoint updates the endpoint object with the new list of IP addresses from the Windows nodes and the
-// metrics port.
-func (pc *PrometheusNodeConfig) syncMetricsEndpoint(nodeEndpointAdressess []v1.EndpointAddress) error {
-	// Update EndpointSubset field with list of Windows Nodes endpoint addresses and required metrics port information
+// syncMetricsEndpoint updates the endpoint object with the given subsets, holding the IP addresses of the Windows nodes
+// grouped by metrics port.
+func (pc *PrometheusNodeConfig) syncMetricsEndpoint(subsets []v1.EndpointSubset) error {
 	// We need to patch the entire endpoint subset field, since addresses and ports both fields are deleted when there
 	// are no Windows nodes.
-	var subsets []v1.EndpointSubset
-	if nodeEndpointAdressess != nil {
-		subsets = []v1.EndpointSubset{{
-			Addresses: nodeEndpointAdressess,
-			Ports: []v1.EndpointPort{{
-				Name:     PortName,
-				Port:     Port,
-				Protocol: v1.ProtocolTCP,
-			}},
-		}}
-	}
-
 	patchData := []patchEndpoint{{
 		Op:    "replace",
 		Path:  "/subsets",
@@ -149,8 +139,30 @@ func (pc *PrometheusNodeConfig) syncMetricsEndpoint(nodeEndpointAdressess []v1.E
 	return errors.Wrap(err, "unable to sync metrics endpoints")
 }
 
-// Configure patches the endpoint object to reflect the current list Windows nodes.
-func (pc *PrometheusNodeConfig) Configure() error {
+// syncMetricsService sets the port of the metrics Service to the given port, if it differs
+func (pc *PrometheusNodeConfig) syncMetricsService(port int32) error {
+	service, err := pc.k8sclientset.CoreV1().Services(pc.namespace).Get(context.TODO(), windowsMetricsEndpoints,
+		metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "could not get metrics service %s", windowsMetricsEndpoints)
+	}
+	if len(service.Spec.Ports) == 1 && service.Spec.Ports[0].Port == port &&
+		service.Spec.Ports[0].TargetPort.IntValue() == int(port) {
+		return nil
+	}
+	patchData, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"ports": []v1.ServicePort{{
+		Port: port, Name: PortName, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(int(port))}}}})
+	if err != nil {
+		return errors.Wrap(err, "unable to get patch data in bytes")
+	}
+	_, err = pc.k8sclientset.CoreV1().Services(pc.namespace).Patch(context.TODO(), windowsMetricsEndpoints,
+		types.MergePatchType, patchData, metav1.PatchOptions{})
+	return errors.Wrap(err, "unable to sync metrics service port")
+}
+
+// Configure patches the endpoint object to reflect the current list Windows nodes and their metrics ports, and sets
+// the port of the metrics Service to the given port.
+func (pc *PrometheusNodeConfig) Configure(servicePort int32) error {
 	// Check if metrics are enabled in current cluster
 	if !metricsEnabled {
 		log.Info("install the prometheus-operator to enable Prometheus configuration")
@@ -171,27 +183,50 @@ func (pc *PrometheusNodeConfig) Configure() error {
 	}
 
 	if !isEndpointsValid(nodes, endpoints) {
-		// check if we can get list of endpoint addresses
-		windowsIPList := getNodeEndpointAddresses(nodes)
 		// sync metrics endpoints object with the current list of addresses
-		if err := pc.syncMetricsEndpoint(windowsIPList); err != nil {
+		if err := pc.syncMetricsEndpoint(getEndpointSubsets(nodes)); err != nil {
 			return errors.Wrap(err, "error updating endpoints object with list of endpoint addresses")
 		}
 	}
-	log.Info("Prometheus configured", "endpoints", windowsMetricsEndpoints, "port", Port, "name", PortName)
+	if err := pc.syncMetricsService(servicePort); err != nil {
+		return err
+	}
+	log.Info("Prometheus configured", "endpoints", windowsMetricsEndpoints, "port", servicePort, "name", PortName)
 	return nil
 }
 
-// getNodeEndpointAddresses returns a list of endpoint addresses according to the given list of Windows nodes
-func getNodeEndpointAddresses(nodes *v1.NodeList) []v1.EndpointAddress {
-	// an empty list to store node IP addresses
-	var nodeIPAddress []v1.EndpointAddress
+// metricsPort returns the port windows_exporter exposes the metrics of the given node on, as held by its
+// MetricsPortAnnotation. The default port is returned if the annotation is missing or invalid.
+func metricsPort(node *v1.Node) int32 {
+	port, err := strconv.ParseInt(node.Annotations[nodeconfig.MetricsPortAnnotation], 10, 32)
+	if err != nil || port < 1 {
+		return Port
+	}
+	return int32(port)
+}
+
+// getEndpointSubsets returns the endpoint subsets holding the addresses of the given Windows nodes, one subset per
+// metrics port
+func getEndpointSubsets(nodes *v1.NodeList) []v1.EndpointSubset {
+	var subsets []v1.EndpointSubset
+	subsetIndexes := make(map[int32]int)
 	// loops through nodes
 	for _, node := range nodes.Items {
 		for _, address := range node.Status.Addresses {
 			if address.Type == "InternalIP" && address.Address != "" {
+				port := metricsPort(&node)
+				index, found := subsetIndexes[port]
+				if !found {
+					index = len(subsets)
+					subsetIndexes[port] = index
+					subsets = append(subsets, v1.EndpointSubset{Ports: []v1.EndpointPort{{
+						Name:     PortName,
+						Port:     port,
+						Protocol: v1.ProtocolTCP,
+					}}})
+				}
 				// add IP address address to the endpoint address list
-				nodeIPAddress = append(nodeIPAddress, v1.EndpointAddress{
+				subsets[index].Addresses = append(subsets[index].Addresses, v1.EndpointAddress{
 					IP:       address.Address,
 					Hostname: "",
 					NodeName: nil,
@@ -204,26 +239,33 @@ func getNodeEndpointAddresses(nodes *v1.NodeList) []v1.EndpointAddress {
 			}
 		}
 	}
-	return nodeIPAddress
+	return subsets
 }
 
-// isEndpointsValid returns true if Endpoints object has entries for all the Windows nodes in the cluster.
-// It returns false when any one of the Windows nodes is not present in the subset.
+// isEndpointsValid returns true if Endpoints object has entries for all the Windows nodes in the cluster, with their
+// metrics port. It returns false when any one of the Windows nodes is not present in the subsets, or is present with
+// another port.
 func isEndpointsValid(nodes *v1.NodeList, endpoints *v1.Endpoints) bool {
+	// map the nodes present in the endpoints object to their port
+	ports := make(map[string]int32)
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Ports) != 1 {
+			return false
+		}
+		for _, address := range subset.Addresses {
+			if address.TargetRef == nil {
+				return false
+			}
+			ports[address.TargetRef.Name] = subset.Ports[0].Port
+		}
+	}
 	// check if number of entries in endpoints object match number of Ready Windows nodes
-	if len(endpoints.Subsets) == 0 || len(nodes.Items) != len(endpoints.Subsets[0].Addresses) {
+	if len(nodes.Items) == 0 || len(nodes.Items) != len(ports) {
 		return false
 	}
 
 	for _, node := range nodes.Items {
-		nodeFound := false
-		for _, address := range endpoints.Subsets[0].Addresses {
-			if address.TargetRef.Name == node.Name {
-				nodeFound = true
-				break
-			}
-		}
-		if !nodeFound {
+		if port, found := ports[node.Name]; !found || port != metricsPort(&node) {
 			return false
 		}
 	}
@@ -1,40 +1,64 @@
 package nodeconfig
 
 import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/ignition"
 )
 
-// cache holds the information of the nodeConfig that is invariant for multiple reconciliation cycles. We'll use this
-// information when we don't want to get the information from the global context coming from reconciler
-// but to have something at nodeConfig package locally which will be passed onto other structs. There is no need to
-// invalidate this cache as of now, since the only entry in this workerIgnitionEndPoint which will be immutable. If
-// someone wants to change it, they've to restart the operator which will invalidate the cache automatically.
-// Note : It is ok to remove this struct in future, if we don't want to continue. As of now, I can think of only
-// 		  worker ignition endpoint being part of this struct.
+// cache holds the information of the nodeConfig that is invariant for multiple reconciliation cycles. It is derived
+// from the internal API server URL of the cluster Infrastructure and rebuilt when that URL changes, see
+// SetAPIServerInternalURL. The cache is filled lazily, so that nothing talks to the API server at import time.
 type cache struct {
+	// Mutex guards the fields of the cache, which is shared by the reconciles and the operator startup checks
+	sync.Mutex
 	// workerIgnitionEndpoint is the Machine Config Server(MCS) endpoint from which we can download the
 	// the OpenShift worker ignition file.
-	workerIgnitionEndPoint string
+	workerIgnitionEndpoint ignition.Endpoint
 }
 
 var log = logf.Log.WithName("nodeconfig")
 
-// cache has the information related to nodeConfig that should not be changed.
+// nodeConfigCache has the information related to nodeConfig derived from the cluster Infrastructure
 var nodeConfigCache = cache{}
 
-// init populates the cache that we need for nodeConfig
-func init() {
-	var kubeAPIServerEndpoint string
-	kubeAPIServerEndpoint, err := discoverKubeAPIServerEndpoint()
+// SetAPIServerInternalURL rebuilds the cache from the given internal API server URL, such as
+// https://api-int.abc.devcluster.openshift.com:6443. The Machine Config Server certificate is verified against the host
+// name of the URL, if it is not an IP address. The nodes bootstrapped from a previous worker ignition endpoint hold
+// it in their WorkerIgnitionEndpointAnnotation, and are reconfigured by the caller. The cache is left untouched if the
+// URL is invalid.
+func SetAPIServerInternalURL(apiServerInternalURL string) error {
+	clusterAddress, err := getClusterAddr(apiServerInternalURL)
 	if err != nil {
-		log.Error(err, "unable to find kube api server endpoint")
-		return
+		return errors.Wrap(err, "error getting cluster address")
 	}
-	clusterAddress, err := getClusterAddr(kubeAPIServerEndpoint)
+	workerIgnitionURL, err := ignition.WorkerEndpoint(ignition.ServerURL(clusterAddress))
 	if err != nil {
-		log.Error(err, "error getting cluster address")
-		return
+		return errors.Wrap(err, "error getting worker ignition endpoint")
 	}
-	// populate the cache
-	nodeConfigCache.workerIgnitionEndPoint = "https://" + clusterAddress + ":22623/config/worker"
+	workerIgnitionEndpoint := ignition.Endpoint{URL: workerIgnitionURL}
+	if net.ParseIP(clusterAddress) == nil {
+		workerIgnitionEndpoint.ServerName = clusterAddress
+	}
+
+	nodeConfigCache.Lock()
+	defer nodeConfigCache.Unlock()
+	if previous := nodeConfigCache.workerIgnitionEndpoint; previous != workerIgnitionEndpoint {
+		log.Info("worker ignition endpoint updated", "apiServerInternalURL", apiServerInternalURL,
+			"previous", previous.URL, "endpoint", workerIgnitionEndpoint.URL)
+	}
+	nodeConfigCache.workerIgnitionEndpoint = workerIgnitionEndpoint
+	return nil
+}
+
+// cachedWorkerIgnitionEndpoint returns the worker ignition endpoint held by the cache, whose URL is empty if the cache
+// has not been built yet
+func cachedWorkerIgnitionEndpoint() ignition.Endpoint {
+	nodeConfigCache.Lock()
+	defer nodeConfigCache.Unlock()
+	return nodeConfigCache.workerIgnitionEndpoint
 }
@@ -2,23 +2,27 @@ package nodeconfig
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
-	"strings"
+	"strconv"
+	"time"
 
-	clientset "github.com/openshift/client-go/config/clientset/versioned"
+	configv1 "github.com/openshift/api/config/v1"
 	"github.com/openshift/windows-machine-config-operator/pkg/clusternetwork"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/payload"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/provider"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/retry"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
+	"github.com/openshift/windows-machine-config-operator/pkg/ignition"
 	"github.com/openshift/windows-machine-config-operator/version"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/ssh"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -33,13 +37,51 @@ const (
 	WorkerLabel = "node-role.kubernetes.io/worker"
 	// VersionAnnotation indicates the version of WMCO that configured the node
 	VersionAnnotation = "windowsmachineconfig.openshift.io/version"
+	// MetricsPortAnnotation holds the port windows_exporter exposes the metrics of the node on
+	MetricsPortAnnotation = "windowsmachineconfig.openshift.io/metrics-port"
+	// SourceVIPAnnotation holds the source VIP of the node, the IP address of its VIP endpoint used by kube-proxy
+	SourceVIPAnnotation = "windowsmachineconfig.openshift.io/source-vip"
+	// OSVersionLabel holds the OS build number and update build revision of the node, such as 17763.1457
+	OSVersionLabel = "windowsmachineconfig.openshift.io/os-version"
+	// PlatformAnnotation holds the platform facts of the node collected before it was configured, as JSON
+	PlatformAnnotation = "windowsmachineconfig.openshift.io/platform"
+	// WorkerIgnitionAnnotation holds the SHA-256 hash of the worker ignition file the node was bootstrapped with
+	WorkerIgnitionAnnotation = "windowsmachineconfig.openshift.io/worker-ignition-sha256"
+	// WorkerIgnitionEndpointAnnotation holds the endpoint the worker ignition file the node was bootstrapped with was
+	// fetched from
+	WorkerIgnitionEndpointAnnotation = "windowsmachineconfig.openshift.io/worker-ignition-endpoint"
+	// WindowsConfigAnnotation holds the hashes of the parts of the worker ignition file used to configure the node,
+	// as JSON
+	WindowsConfigAnnotation = "windowsmachineconfig.openshift.io/windows-config"
+	// RenderedConfigAnnotation holds the name of the rendered worker MachineConfig the node was configured from
+	RenderedConfigAnnotation = "windowsmachineconfig.openshift.io/rendered-config"
+	// ReconfigureAnnotation is set on a node cordoned to be configured again, as the parts of the worker ignition file
+	// used to configure it or the endpoint it is served at changed. It holds the name of the rendered worker
+	// MachineConfig the node is reconfigured for, empty if it is not known.
+	ReconfigureAnnotation = "windowsmachineconfig.openshift.io/reconfigure"
+	// infrastructureName is the name of the cluster Infrastructure, whose internal API server URL hosts the Machine
+	// Config Server
+	infrastructureName = "cluster"
+	// hybridOverlayReadyTimeout is the maximum time to wait for the hybrid-overlay to complete reconfiguring the
+	// Windows VM's network after it is started
+	hybridOverlayReadyTimeout = 10 * time.Minute
 )
 
+// hybridOverlayReadyBackoff is the backoff between the checks for the completion of the network reconfiguration done
+// by the hybrid-overlay
+var hybridOverlayReadyBackoff = wait.Backoff{
+	Duration: 2 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    10,
+	Cap:      30 * time.Second,
+}
+
 // nodeConfig holds the information to make the given VM a kubernetes node. As of now, it holds the information
 // related to kubeclient and the windowsVM.
 type nodeConfig struct {
 	// k8sclientset holds the information related to kubernetes clientset
-	k8sclientset *kubernetes.Clientset
+	k8sclientset kubernetes.Interface
 	// Windows holds the information related to the windows VM
 	windows.Windows
 	// Node holds the information related to node object
@@ -48,124 +90,185 @@ type nodeConfig struct {
 	network *network
 	// clusterServiceCIDR holds the service CIDR for cluster
 	clusterServiceCIDR string
+	// firewallRules holds the firewall rules required by the node
+	firewallRules []windows.FirewallRule
+	// metricsPort is the port windows_exporter exposes the metrics of the node on
+	metricsPort int32
+	// sourceVIP is the source VIP of the node, set once kube-proxy is configured
+	sourceVIP string
+	// platform holds the platform facts of the VM, set once the pre-flight validation succeeded
+	platform *windows.PlatformFacts
+	// workerIgnition is the worker ignition file the node is bootstrapped with, set once it is fetched
+	workerIgnition *ignition.Ignition
+	// windowsConfig holds the hashes of the parts of the worker ignition file used to configure the node
+	windowsConfig map[string]string
 }
 
-// discoverKubeAPIServerEndpoint discovers the kubernetes api server endpoint from the
-func discoverKubeAPIServerEndpoint() (string, error) {
-	cfg, err := config.GetConfig()
-	if err != nil {
-		return "", errors.Wrap(err, "unable to get config to talk to kubernetes api server")
-	}
-
-	client, err := clientset.NewForConfig(cfg)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to get client from the given config")
-	}
-
-	host, err := client.ConfigV1().Infrastructures().Get(context.TODO(), "cluster", metav1.GetOptions{})
-	if err != nil {
+// discoverKubeAPIServerEndpoint discovers the kubernetes api server endpoint from the cluster Infrastructure, read
+// with the given client
+func discoverKubeAPIServerEndpoint(ctx context.Context, c client.Client) (string, error) {
+	host := &configv1.Infrastructure{}
+	if err := c.Get(ctx, types.NamespacedName{Name: infrastructureName}, host); err != nil {
 		return "", errors.Wrap(err, "unable to get cluster infrastructure resource")
 	}
 	// get API server internal url of format https://api-int.abc.devcluster.openshift.com:6443
 	if host.Status.APIServerInternalURL == "" {
-		return "", errors.Wrap(err, "could not get host name for the kubernetes api server")
+		return "", errors.New("could not get host name for the kubernetes api server")
 	}
 	return host.Status.APIServerInternalURL, nil
 }
 
-// NewNodeConfig creates a new instance of nodeConfig to be used by the caller.
-func NewNodeConfig(clientset *kubernetes.Clientset, ipAddress, providerName, instanceID, clusterServiceCIDR, vxlanPort string,
-	signer ssh.Signer) (*nodeConfig, error) {
+// NewNodeConfig creates a new instance of nodeConfig to be used by the caller. The VM is connected to as the given
+// user. Connecting to the VM is aborted if the context is done. The given firewall rules are configured on the VM
+// along with the node.
+func NewNodeConfig(ctx context.Context, clientset kubernetes.Interface, ipAddress, username, instanceID,
+	clusterServiceCIDR, vxlanPort string, firewallRules []windows.FirewallRule,
+	connSettings windows.ConnectionSettings) (*nodeConfig, error) {
 
 	// Update the logger name with the VM's cloud ID. Ideally this should be the Machine name but is not available at
 	// this point.
 	log = logf.Log.WithName(fmt.Sprintf("nodeconfig %s", instanceID))
 
-	var err error
-	if nodeConfigCache.workerIgnitionEndPoint == "" {
-		var kubeAPIServerEndpoint string
-		// We couldn't find it in cache. Let's compute it now.
-		kubeAPIServerEndpoint, err = discoverKubeAPIServerEndpoint()
-		if err != nil {
-			return nil, errors.Wrap(err, "unable to find kube api server endpoint")
-		}
-		clusterAddress, err := getClusterAddr(kubeAPIServerEndpoint)
-		if err != nil {
-			return nil, errors.Wrap(err, "error getting cluster address")
-		}
-		workerIgnitionEndpoint := "https://" + clusterAddress + ":22623/config/worker"
-		nodeConfigCache.workerIgnitionEndPoint = workerIgnitionEndpoint
-	}
-	if err = clusternetwork.ValidateCIDR(clusterServiceCIDR); err != nil {
+	if err := clusternetwork.ValidateCIDR(clusterServiceCIDR); err != nil {
 		return nil, errors.Wrap(err, "error receiving valid CIDR value for "+
 			"creating new node config")
 	}
 
-	win, err := windows.New(ipAddress, providerName, instanceID, nodeConfigCache.workerIgnitionEndPoint, vxlanPort, signer)
+	win, err := windows.New(ctx, ipAddress, username, instanceID, vxlanPort, connSettings)
 	if err != nil {
 		return nil, errors.Wrap(err, "error instantiating Windows instance from VM")
 	}
 
+	metricsPort := windows.DefaultExporterPort
+	if connSettings.WindowsExporter != nil {
+		metricsPort = connSettings.WindowsExporter.Port
+	}
+
 	return &nodeConfig{k8sclientset: clientset, Windows: win, network: newNetwork(),
-		clusterServiceCIDR: clusterServiceCIDR}, nil
+		clusterServiceCIDR: clusterServiceCIDR, firewallRules: firewallRules, metricsPort: metricsPort}, nil
 }
 
-// getClusterAddr gets the cluster address associated with given kubernetes APIServerEndpoint.
-// For example: https://api-int.abc.devcluster.openshift.com:6443 gets translated to
-// api-int.abc.devcluster.openshift.com
-// TODO: Think if this needs to be removed as this is too restrictive. Imagine apiserver behind
-// 		a loadbalancer.
-// 		Jira story: https://issues.redhat.com/browse/WINC-398
+// getClusterAddr gets the cluster address associated with given kubernetes APIServerEndpoint, which is either a host
+// name or an IP address. For example: https://api-int.abc.devcluster.openshift.com:6443 gets translated to
+// api-int.abc.devcluster.openshift.com, and https://[fd00::5]:6443 to fd00::5
 func getClusterAddr(kubeAPIServerEndpoint string) (string, error) {
 	clusterEndPoint, err := url.Parse(kubeAPIServerEndpoint)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to parse the kubernetes API server endpoint")
 	}
 	hostName := clusterEndPoint.Hostname()
-
-	// Check if hostname is valid
-	if !strings.HasPrefix(hostName, "api-int.") {
-		return "", fmt.Errorf("invalid API server url %s: expected hostname to start with `api-int.`", hostName)
+	if hostName == "" {
+		return "", errors.Errorf("invalid API server url %s: expected a host", kubeAPIServerEndpoint)
 	}
 	return hostName, nil
 }
 
-// Configure configures the Windows VM to make it a Windows worker node
-func (nc *nodeConfig) Configure() error {
-	if err := nc.Windows.Configure(); err != nil {
+// WorkerIgnitionEndpoint returns the endpoint of the worker ignition file. It is served by the Machine Config Server
+// at the given URL, or by the Machine Config Server running on the internal API server host if the URL is empty. The
+// server certificate is verified against the given server name, or against the host name of the internal API server
+// if it is empty. The internal API server URL is read from the cluster Infrastructure with the given client, and the
+// cache is rebuilt if it changed. The cached endpoint is kept if the URL became invalid.
+func WorkerIgnitionEndpoint(ctx context.Context, c client.Client, serverURL, serverName string) (ignition.Endpoint,
+	error) {
+	if serverURL == "" || serverName == "" {
+		kubeAPIServerEndpoint, err := discoverKubeAPIServerEndpoint(ctx, c)
+		if err != nil {
+			return ignition.Endpoint{}, errors.Wrap(err, "unable to find kube api server endpoint")
+		}
+		if err := SetAPIServerInternalURL(kubeAPIServerEndpoint); err != nil {
+			if cachedWorkerIgnitionEndpoint().URL == "" {
+				return ignition.Endpoint{}, err
+			}
+			log.Error(err, "keeping the previous worker ignition endpoint", "apiServerInternalURL",
+				kubeAPIServerEndpoint)
+		}
+	}
+	endpoint := cachedWorkerIgnitionEndpoint()
+	if serverURL != "" {
+		url, err := ignition.WorkerEndpoint(serverURL)
+		if err != nil {
+			return ignition.Endpoint{}, err
+		}
+		endpoint.URL = url
+	}
+	if serverName != "" {
+		endpoint.ServerName = serverName
+	}
+	return endpoint, nil
+}
+
+// Configure configures the Windows VM to make it a Windows worker node, from the worker ignition file served at the
+// given endpoint. The node is tainted with the ConfiguringTaint until it is fully configured. It is then annotated with
+// the given rendered worker MachineConfig, unless it is empty, and uncordoned if it was cordoned to be reconfigured.
+// The configuration is aborted if the context is done.
+func (nc *nodeConfig) Configure(ctx context.Context, ignitionEndpoint ignition.Endpoint, renderedConfig string) error {
+	// Reject unsupported platforms before anything is changed on the VM
+	platform, err := nc.Preflight(ctx)
+	if err != nil {
+		return errors.Wrap(err, "pre-flight validation of the Windows VM failed")
+	}
+	nc.platform = platform
+	if err := nc.fetchWorkerIgnition(ctx, ignitionEndpoint); err != nil {
+		return err
+	}
+	if err := nc.Windows.Configure(ctx, nc.workerIgnition.Data); err != nil {
 		return errors.Wrap(err, "configuring the Windows VM failed")
 	}
+	// The firewall rules are needed before the network is configured, as the hybrid-overlay uses the VXLAN port
+	if err := nc.ConfigureFirewall(ctx, nc.firewallRules); err != nil {
+		return errors.Wrap(err, "configuring the Windows firewall failed")
+	}
 	// populate node object in nodeConfig
-	if err := nc.setNode(); err != nil {
+	if err := nc.setNode(ctx); err != nil {
 		return errors.Wrapf(err, "error getting node object for VM %s", nc.ID())
 	}
+	// Keep pods off the node until its network is configured
+	if err := nc.addConfiguringTaint(ctx); err != nil {
+		return err
+	}
 	// Now that basic kubelet configuration is complete, configure networking in the node
-	if err := nc.configureNetwork(); err != nil {
+	if err := nc.configureNetwork(ctx); err != nil {
 		return errors.Wrap(err, "configuring node network failed")
 	}
 
 	// Now that the node has been fully configured, add the version annotation to signify that the node
 	// was successfully configured by this version of WMCO
-	// populate node object in nodeConfig once more
-	if err := nc.setNode(); err != nil {
-		return errors.Wrapf(err, "error getting node object for VM %s", nc.ID())
+	windowsConfig, err := json.Marshal(nc.windowsConfig)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal the Windows configuration hashes")
 	}
-	nc.addVersionAnnotation()
-	node, err := nc.k8sclientset.CoreV1().Nodes().Update(context.TODO(), nc.node, metav1.UpdateOptions{})
+	platformFacts, err := json.Marshal(nc.platform)
 	if err != nil {
-		return errors.Wrap(err, "error updating node labels and annotations")
+		return errors.Wrap(err, "unable to marshal platform facts")
 	}
-	nc.node = node
-
-	return nil
+	err = PatchNode(ctx, nc.k8sclientset, nc.node, func(node *v1.Node) {
+		addVersionAnnotation(node)
+		node.Annotations[MetricsPortAnnotation] = strconv.Itoa(int(nc.metricsPort))
+		node.Annotations[SourceVIPAnnotation] = nc.sourceVIP
+		node.Annotations[WorkerIgnitionAnnotation] = nc.workerIgnition.SHA256
+		node.Annotations[WorkerIgnitionEndpointAnnotation] = ignitionEndpoint.URL
+		node.Annotations[WindowsConfigAnnotation] = string(windowsConfig)
+		if renderedConfig != "" {
+			node.Annotations[RenderedConfigAnnotation] = renderedConfig
+		}
+		if _, reconfigured := node.Annotations[ReconfigureAnnotation]; reconfigured {
+			delete(node.Annotations, ReconfigureAnnotation)
+			node.Spec.Unschedulable = false
+		}
+		node.Annotations[PlatformAnnotation] = string(platformFacts)
+		node.Labels[OSVersionLabel] = nc.platform.OSVersion()
+		// The node can be scheduled on from the moment it is annotated as configured
+		removeConfiguringTaint(node)
+	})
+	return errors.Wrap(err, "error updating node labels and annotations")
 }
 
 // configureNetwork configures k8s networking in the node
 // we are assuming that the WindowsVM and node objects are valid
-func (nc *nodeConfig) configureNetwork() error {
+func (nc *nodeConfig) configureNetwork(ctx context.Context) error {
 	// Wait until the node object has the hybrid overlay subnet annotation. Otherwise the hybrid-overlay will fail to
 	// start
-	if err := nc.waitForNodeAnnotation(HybridOverlaySubnet); err != nil {
+	if err := nc.waitForNodeAnnotation(ctx, HybridOverlaySubnet); err != nil {
 		return errors.Wrapf(err, "error waiting for %s node annotation for %s", HybridOverlaySubnet,
 			nc.node.GetName())
 	}
@@ -174,37 +277,89 @@ func (nc *nodeConfig) configureNetwork() error {
 	// become more clear with the outcome of https://issues.redhat.com/browse/WINC-343
 
 	// Configure the hybrid overlay in the Windows VM
-	if err := nc.Windows.ConfigureHybridOverlay(nc.node.GetName()); err != nil {
+	if err := nc.Windows.ConfigureHybridOverlay(ctx, nc.node.GetName()); err != nil {
 		return errors.Wrapf(err, "error configuring hybrid overlay for %s", nc.node.GetName())
 	}
 
-	// Wait until the node object has the hybrid overlay MAC annotation. This is required for the CNI configuration to
-	// start.
-	if err := nc.waitForNodeAnnotation(HybridOverlayMac); err != nil {
-		return errors.Wrapf(err, "error waiting for %s node annotation for %s", HybridOverlayMac,
-			nc.node.GetName())
+	// Wait until the hybrid-overlay has reconfigured the network and set the hybrid overlay MAC annotation on the
+	// node object. This is required for the CNI configuration to start.
+	if err := nc.waitForHybridOverlay(ctx); err != nil {
+		return errors.Wrapf(err, "error waiting for hybrid overlay for %s", nc.node.GetName())
 	}
 
 	// Configure CNI in the Windows VM
-	if err := nc.configureCNI(); err != nil {
+	if err := nc.configureCNI(ctx); err != nil {
 		return errors.Wrapf(err, "error configuring CNI for %s", nc.node.GetName())
 	}
+	// Reuse the source VIP recorded on the node, if its VIP endpoint still exists
+	sourceVIP, err := nc.Windows.EnsureSourceVIP(ctx, nc.node.Annotations[SourceVIPAnnotation])
+	if err != nil {
+		return errors.Wrapf(err, "error getting source VIP for %s", nc.node.GetName())
+	}
 	// Start the kube-proxy service
-	if err := nc.Windows.ConfigureKubeProxy(nc.node.GetName(), nc.node.Annotations[HybridOverlaySubnet]); err != nil {
+	if err := nc.Windows.ConfigureKubeProxy(ctx, nc.node.GetName(),
+		nc.node.Annotations[HybridOverlaySubnet], sourceVIP); err != nil {
 		return errors.Wrapf(err, "error starting kube-proxy for %s", nc.node.GetName())
 	}
+	nc.sourceVIP = sourceVIP
 	return nil
 }
 
-// addVersionAnnotation adds the version annotation to nc.node
-func (nc *nodeConfig) addVersionAnnotation() {
-	nc.node.Annotations[VersionAnnotation] = version.Get()
+// FetchWorkerIgnition fetches the worker ignition file served at the given endpoint, verifying the Machine Config
+// Server certificate against the root CA of the cluster. The hashes of the parts of the file used to configure the
+// Windows nodes are returned along with it.
+func FetchWorkerIgnition(ctx context.Context, clientset kubernetes.Interface,
+	endpoint ignition.Endpoint) (*ignition.Ignition, map[string]string, error) {
+	rootCA, err := ignition.GetRootCA(ctx, clientset)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to get the root CA of the cluster")
+	}
+	workerIgnition, err := ignition.Fetch(ctx, endpoint, rootCA)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to fetch the worker ignition")
+	}
+	windowsConfig, err := ignition.ParseWindowsConfig(workerIgnition.Data)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid worker ignition")
+	}
+	hashes, err := windowsConfig.Hashes()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.V(1).Info("fetched worker ignition", "spec version", workerIgnition.SpecVersion, "sha256",
+		workerIgnition.SHA256)
+	return workerIgnition, hashes, nil
+}
+
+// fetchWorkerIgnition fetches the worker ignition file the node is bootstrapped with from the given endpoint
+func (nc *nodeConfig) fetchWorkerIgnition(ctx context.Context, endpoint ignition.Endpoint) error {
+	workerIgnition, windowsConfig, err := FetchWorkerIgnition(ctx, nc.k8sclientset, endpoint)
+	if err != nil {
+		return err
+	}
+	nc.workerIgnition, nc.windowsConfig = workerIgnition, windowsConfig
+	return nil
+}
+
+// addConfiguringTaint adds the ConfiguringTaint to nc.node, unless it is already tainted
+func (nc *nodeConfig) addConfiguringTaint(ctx context.Context) error {
+	err := PatchNode(ctx, nc.k8sclientset, nc.node, func(node *v1.Node) {
+		AddConfiguringTaint(node)
+	})
+	return errors.Wrapf(err, "error adding taint %s to node %s", ConfiguringTaint, nc.node.GetName())
+}
+
+// addVersionAnnotation adds the version annotation to the given node, whose annotations must not be nil
+func addVersionAnnotation(node *v1.Node) {
+	node.Annotations[VersionAnnotation] = version.Get()
 }
 
 // setNode identifies the node from the instanceID provided and sets the node object in the nodeconfig.
-func (nc *nodeConfig) setNode() error {
-	err := wait.Poll(retry.Interval, retry.Timeout, func() (bool, error) {
-		nodes, err := nc.k8sclientset.CoreV1().Nodes().List(context.TODO(),
+func (nc *nodeConfig) setNode(ctx context.Context) error {
+	pollCtx, cancel := context.WithTimeout(ctx, retry.Timeout)
+	defer cancel()
+	err := wait.PollUntil(retry.Interval, func() (bool, error) {
+		nodes, err := nc.k8sclientset.CoreV1().Nodes().List(pollCtx,
 			metav1.ListOptions{LabelSelector: WindowsOSLabel})
 		if err != nil {
 			log.V(1).Error(err, "node listing failed")
@@ -216,23 +371,26 @@ func (nc *nodeConfig) setNode() error {
 		}
 		// get the node with given instance id
 		for _, node := range nodes.Items {
-			if nc.ID() == getInstanceIDfromProviderID(node.Spec.ProviderID) {
+			// Nodes whose provider ID is not set yet or belongs to an unsupported platform cannot be the VM's
+			if _, instanceID, err := provider.ForProviderID(node.Spec.ProviderID); err == nil && nc.ID() == instanceID {
 				nc.node = &node
 				return true, nil
 			}
 		}
 		return false, nil
-	})
+	}, pollCtx.Done())
 	return errors.Wrapf(err, "unable to find node for instanceID %s", nc.ID())
 }
 
 // waitForNodeAnnotation checks if the node object has the given annotation and waits for retry.Interval seconds and
 // returns an error if the annotation does not appear in that time frame.
-func (nc *nodeConfig) waitForNodeAnnotation(annotation string) error {
+func (nc *nodeConfig) waitForNodeAnnotation(ctx context.Context, annotation string) error {
 	nodeName := nc.node.GetName()
 	var found bool
-	err := wait.Poll(retry.Interval, retry.Timeout, func() (bool, error) {
-		node, err := nc.k8sclientset.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	pollCtx, cancel := context.WithTimeout(ctx, retry.Timeout)
+	defer cancel()
+	err := wait.PollUntil(retry.Interval, func() (bool, error) {
+		node, err := nc.k8sclientset.CoreV1().Nodes().Get(pollCtx, nodeName, metav1.GetOptions{})
 		if err != nil {
 			log.V(1).Error(err, "unable to get associated node object")
 			return false, nil
@@ -244,7 +402,7 @@ func (nc *nodeConfig) waitForNodeAnnotation(annotation string) error {
 			return true, nil
 		}
 		return false, nil
-	})
+	}, pollCtx.Done())
 
 	if !found {
 		return errors.Wrapf(err, "timeout waiting for %s node annotation", annotation)
@@ -252,9 +410,50 @@ func (nc *nodeConfig) waitForNodeAnnotation(annotation string) error {
 	return nil
 }
 
+// waitForHybridOverlay waits until the hybrid-overlay has completed reconfiguring the Windows VM's network, which is
+// the case once the OVN overlay HNS networks exist and the node object has the hybrid overlay MAC annotation. The
+// checks are retried with a short backoff, reconnecting to the VM as needed, until hybridOverlayReadyTimeout.
+func (nc *nodeConfig) waitForHybridOverlay(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, hybridOverlayReadyTimeout)
+	defer cancel()
+	backoff := hybridOverlayReadyBackoff
+	networksReady, annotated := false, false
+	for {
+		if !networksReady {
+			ready, err := nc.Windows.HybridOverlayNetworksReady(ctx)
+			if err != nil {
+				log.V(1).Info("unable to check for the OVN overlay HNS networks", "error", err)
+			}
+			networksReady = ready
+		}
+		if !annotated {
+			node, err := nc.k8sclientset.CoreV1().Nodes().Get(ctx, nc.node.GetName(), metav1.GetOptions{})
+			if err != nil {
+				log.V(1).Error(err, "unable to get associated node object")
+			} else if _, found := node.Annotations[HybridOverlayMac]; found {
+				//update node to avoid staleness
+				nc.node = node
+				annotated = true
+			}
+		}
+		if networksReady && annotated {
+			return nil
+		}
+
+		timer := time.NewTimer(backoff.Step())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(ctx.Err(), "timeout waiting for hybrid overlay, OVN overlay HNS networks found: %t, "+
+				"%s node annotation found: %t", networksReady, HybridOverlayMac, annotated)
+		}
+	}
+}
+
 // configureCNI populates the CNI config template and sends the config file location
 // for completing CNI configuration in the windows VM
-func (nc *nodeConfig) configureCNI() error {
+func (nc *nodeConfig) configureCNI(ctx context.Context) error {
 	// set the hostSubnet value in the network struct
 	if err := nc.network.setHostSubnet(nc.node.Annotations[HybridOverlaySubnet]); err != nil {
 		return errors.Wrapf(err, "error populating host subnet in node network")
@@ -265,7 +464,7 @@ func (nc *nodeConfig) configureCNI() error {
 		return errors.Wrapf(err, "error populating CNI config file %s", configFile)
 	}
 	// configure CNI in the Windows VM
-	if err = nc.Windows.ConfigureCNI(configFile); err != nil {
+	if err = nc.Windows.ConfigureCNI(ctx, configFile); err != nil {
 		return errors.Wrapf(err, "error configuring CNI for %s", nc.node.GetName())
 	}
 	if err = nc.network.cleanupTempConfig(configFile); err != nil {
@@ -274,10 +473,3 @@ func (nc *nodeConfig) configureCNI() error {
 	}
 	return nil
 }
-
-// getInstanceIDfromProviderID gets the instanceID of VM for a given cloud provider ID
-// Ex: aws:///us-east-1e/i-078285fdadccb2eaa. We always want the last entry which is the instanceID
-func getInstanceIDfromProviderID(providerID string) string {
-	providerTokens := strings.Split(providerID, "/")
-	return providerTokens[len(providerTokens)-1]
-}
@@ -1,9 +1,18 @@
 package nodeconfig
 
 import (
+	"context"
 	"testing"
 
+	configv1 "github.com/openshift/api/config/v1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/ignition"
 )
 
 // Test_getClusterAddr tests the getClusterAddr function
@@ -24,8 +33,32 @@ func Test_getClusterAddr(t *testing.T) {
 			wantErr: false,
 		},
 		{
-			name:    "Test case with invalid no-api",
+			name:    "Test case with a host name not starting with api-int",
 			args:    args{kubeAPIServerEndpoint: "https://no-api.abc.devcluster.openshift.com:6443"},
+			want:    "no-api.abc.devcluster.openshift.com",
+			wantErr: false,
+		},
+		{
+			name:    "Test case with an IPv4 address",
+			args:    args{kubeAPIServerEndpoint: "https://10.0.0.5:6443"},
+			want:    "10.0.0.5",
+			wantErr: false,
+		},
+		{
+			name:    "Test case with an IPv6 address",
+			args:    args{kubeAPIServerEndpoint: "https://[fd00::5]:6443"},
+			want:    "fd00::5",
+			wantErr: false,
+		},
+		{
+			name:    "Test case without host",
+			args:    args{kubeAPIServerEndpoint: "https://:6443"},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name:    "Test case with invalid URL",
+			args:    args{kubeAPIServerEndpoint: "https://[fd00::5:6443"},
 			want:    "",
 			wantErr: true,
 		},
@@ -49,3 +82,116 @@ func Test_getClusterAddr(t *testing.T) {
 		})
 	}
 }
+
+// TestWorkerIgnitionEndpoint tests that the worker ignition endpoint is rebuilt from the internal API server URL of the
+// cluster Infrastructure when it changes, that the Machine Config Server URL overrides it, and that the server
+// certificate is verified against the host name of the internal API server unless another server name is given
+func TestWorkerIgnitionEndpoint(t *testing.T) {
+	defer func() { nodeConfigCache.workerIgnitionEndpoint = ignition.Endpoint{} }()
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	require.NoError(t, configv1.AddToScheme(scheme))
+	infrastructure := &configv1.Infrastructure{ObjectMeta: metav1.ObjectMeta{Name: infrastructureName},
+		Status: configv1.InfrastructureStatus{
+			APIServerInternalURL: "https://api-int.abc.devcluster.openshift.com:6443"}}
+	c := fake.NewFakeClientWithScheme(scheme, infrastructure)
+	setAPIServerInternalURL := func(url string) {
+		infrastructure.Status.APIServerInternalURL = url
+		require.NoError(t, c.Update(ctx, infrastructure))
+	}
+
+	endpoint, err := WorkerIgnitionEndpoint(ctx, c, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, ignition.Endpoint{URL: "https://api-int.abc.devcluster.openshift.com:22623/config/worker",
+		ServerName: "api-int.abc.devcluster.openshift.com"}, endpoint)
+
+	endpoint, err = WorkerIgnitionEndpoint(ctx, c, "https://10.0.0.5:22623", "")
+	require.NoError(t, err)
+	assert.Equal(t, ignition.Endpoint{URL: "https://10.0.0.5:22623/config/worker",
+		ServerName: "api-int.abc.devcluster.openshift.com"}, endpoint)
+
+	setAPIServerInternalURL("https://[fd00::5]:6443")
+	endpoint, err = WorkerIgnitionEndpoint(ctx, c, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, ignition.Endpoint{URL: "https://[fd00::5]:22623/config/worker"}, endpoint)
+
+	// An invalid URL leaves the cache untouched
+	setAPIServerInternalURL("https://:6443")
+	endpoint, err = WorkerIgnitionEndpoint(ctx, c, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, ignition.Endpoint{URL: "https://[fd00::5]:22623/config/worker"}, endpoint)
+
+	endpoint, err = WorkerIgnitionEndpoint(ctx, c, "https://10.0.0.5:22623", "mcs.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, ignition.Endpoint{URL: "https://10.0.0.5:22623/config/worker", ServerName: "mcs.example.com"},
+		endpoint)
+	_, err = WorkerIgnitionEndpoint(ctx, c, "http://10.0.0.5:22623", "")
+	assert.Error(t, err)
+
+	// The cluster Infrastructure is not needed if both the URL and the server name are given
+	endpoint, err = WorkerIgnitionEndpoint(ctx, fake.NewFakeClientWithScheme(scheme), "https://10.0.0.5:22623",
+		"mcs.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "https://10.0.0.5:22623/config/worker", endpoint.URL)
+}
+
+// TestConfiguringTaint tests that the ConfiguringTaint is added once and removed without affecting the other taints
+func TestConfiguringTaint(t *testing.T) {
+	other := v1.Taint{Key: "example.com/other", Value: "true", Effect: v1.TaintEffectNoSchedule}
+	node := &v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{other}}}
+
+	assert.True(t, AddConfiguringTaint(node))
+	assert.False(t, AddConfiguringTaint(node))
+	assert.Equal(t, []v1.Taint{other, configuringTaint}, node.Spec.Taints)
+
+	assert.True(t, removeConfiguringTaint(node))
+	assert.False(t, removeConfiguringTaint(node))
+	assert.Equal(t, []v1.Taint{other}, node.Spec.Taints)
+}
+
+// Test_nodePatch tests that node patches only hold the changed fields, and are bound to the resource version of the
+// node when they change its taints
+func Test_nodePatch(t *testing.T) {
+	original := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", ResourceVersion: "42",
+		Annotations: map[string]string{"kept": "true", "removed": "true"}}}
+	tests := []struct {
+		name   string
+		mutate func(*v1.Node)
+		want   string
+	}{
+		{
+			name:   "no change",
+			mutate: func(*v1.Node) {},
+			want:   "",
+		},
+		{
+			name: "annotations",
+			mutate: func(node *v1.Node) {
+				node.Annotations[VersionAnnotation] = "1.0.0"
+				delete(node.Annotations, "removed")
+			},
+			want: `{"metadata":{"annotations":{"removed":null,"windowsmachineconfig.openshift.io/version":"1.0.0"}}}`,
+		},
+		{
+			name: "taints",
+			mutate: func(node *v1.Node) {
+				AddConfiguringTaint(node)
+			},
+			want: `{"metadata":{"resourceVersion":"42"},"spec":{"taints":[{"effect":"NoSchedule",` +
+				`"key":"windowsmachineconfig.openshift.io/configuring"}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modified := original.DeepCopy()
+			tt.mutate(modified)
+			patch, err := nodePatch(original, modified)
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, patch)
+				return
+			}
+			assert.JSONEq(t, tt.want, string(patch))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package nodeconfig
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// PatchNode applies the changes made by the given function to the given node through a strategic merge patch, and
+// updates the node with the patched object. The patch only holds the changed fields, so that the labels and
+// annotations set by the kubelet or OVN in the meantime are kept, whatever the age of the node. The function is given
+// a node whose labels and annotations are never nil.
+// Lists without merge key, such as the taints, are replaced as a whole by a patch. Patches changing them are therefore
+// only applied to the node they were computed from, and computed again from the latest node on conflict.
+func PatchNode(ctx context.Context, clientset kubernetes.Interface, node *v1.Node, mutate func(*v1.Node)) error {
+	current := node
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		modified := current.DeepCopy()
+		if modified.Annotations == nil {
+			modified.Annotations = make(map[string]string)
+		}
+		if modified.Labels == nil {
+			modified.Labels = make(map[string]string)
+		}
+		mutate(modified)
+		patch, err := nodePatch(current, modified)
+		if err != nil {
+			return err
+		}
+		if patch == nil {
+			*node = *modified
+			return nil
+		}
+		patched, err := clientset.CoreV1().Nodes().Patch(ctx, node.Name, types.StrategicMergePatchType, patch,
+			metav1.PatchOptions{})
+		if k8sapierrors.IsConflict(err) {
+			if latest, getErr := clientset.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{}); getErr == nil {
+				current = latest
+			}
+		}
+		if err != nil {
+			return err
+		}
+		*node = *patched
+		return nil
+	})
+	return errors.Wrapf(err, "unable to patch node %s", node.Name)
+}
+
+// nodePatch returns the strategic merge patch turning the original node into the modified one, or nil if they do not
+// differ. The patch is bound to the resource version of the original node if it changes the taints.
+func nodePatch(original, modified *v1.Node) ([]byte, error) {
+	originalData, err := json.Marshal(original)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to marshal node %s", original.Name)
+	}
+	modifiedData, err := json.Marshal(modified)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to marshal node %s", original.Name)
+	}
+	data, err := strategicpatch.CreateTwoWayMergePatch(originalData, modifiedData, v1.Node{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create patch for node %s", original.Name)
+	}
+
+	var patch map[string]interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse patch for node %s", original.Name)
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	if equality.Semantic.DeepEqual(original.Spec.Taints, modified.Spec.Taints) {
+		return data, nil
+	}
+	metadata, _ := patch["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+		patch["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = original.ResourceVersion
+	data, err = json.Marshal(patch)
+	return data, errors.Wrapf(err, "unable to marshal patch for node %s", original.Name)
+}
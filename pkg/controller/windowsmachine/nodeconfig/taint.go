@@ -0,0 +1,39 @@
+package nodeconfig
+
+import (
+	"k8s.io/api/core/v1"
+)
+
+// ConfiguringTaint is the key of the NoSchedule taint which keeps pods off a Windows node until its network is fully
+// configured. It is removed along with the setting of the VersionAnnotation, and put back when the node is
+// reconfigured or upgraded.
+const ConfiguringTaint = "windowsmachineconfig.openshift.io/configuring"
+
+// configuringTaint is the taint applied to the Windows nodes being configured
+var configuringTaint = v1.Taint{Key: ConfiguringTaint, Effect: v1.TaintEffectNoSchedule}
+
+// AddConfiguringTaint adds the ConfiguringTaint to the given node. It returns true if the node was changed.
+func AddConfiguringTaint(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.MatchTaint(&configuringTaint) {
+			return false
+		}
+	}
+	node.Spec.Taints = append(node.Spec.Taints, configuringTaint)
+	return true
+}
+
+// removeConfiguringTaint removes the ConfiguringTaint from the given node. It returns true if the node was changed.
+func removeConfiguringTaint(node *v1.Node) bool {
+	var taints []v1.Taint
+	for _, taint := range node.Spec.Taints {
+		if !taint.MatchTaint(&configuringTaint) {
+			taints = append(taints, taint)
+		}
+	}
+	if len(taints) == len(node.Spec.Taints) {
+		return false
+	}
+	node.Spec.Taints = taints
+	return true
+}
@@ -1,10 +1,14 @@
 package windows
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -12,115 +16,380 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-// sshPort is the default SSH port
-const sshPort = "22"
+const (
+	// sshPort is the default SSH port
+	sshPort = "22"
+	// sshAbortTimeout is the time to wait for an aborted command or file transfer to return before the connection is
+	// considered dead
+	sshAbortTimeout = 10 * time.Second
+	// SSHBackend is the connectivity backend which uses SSH and SFTP
+	SSHBackend = "ssh"
+	// WinRMBackend is the connectivity backend which uses WinRM over HTTPS
+	WinRMBackend = "winrm"
+	// defaultConnectAttempts is the default number of attempts to connect to a VM, which may still be executing the
+	// steps in its user data
+	defaultConnectAttempts = 5
+	// connectRetryInterval is the time to wait between two attempts to connect to a VM
+	connectRetryInterval = 1 * time.Minute
+)
+
+// HostKeyStore records and retrieves the SSH host key fingerprints of the Windows VMs. It is used to pin the host key
+// presented by a VM on first contact and verify it on every subsequent connection.
+type HostKeyStore interface {
+	// Get returns the host key fingerprint recorded for the given instance ID, or an empty string if no fingerprint
+	// has been recorded yet
+	Get(instanceID string) (string, error)
+	// Set records the host key fingerprint for the given instance ID
+	Set(instanceID, fingerprint string) error
+}
+
+// HostKeyIDs returns the IDs under which the host keys of the VM with the given instance ID are recorded in a
+// HostKeyStore, one per connectivity backend
+func HostKeyIDs(instanceID string) []string {
+	return []string{instanceID, instanceID + winrmHostKeySuffix}
+}
+
+// HostKeyMismatchError is returned when the host key presented by a Windows VM, or by a jump host, does not match the
+// fingerprint that was recorded on first contact
+type HostKeyMismatchError struct {
+	// InstanceID is the cloud provider ID of the VM, or the JumpHostKeyID of the jump host
+	InstanceID string
+	// IPAddress is the IP address that was dialed
+	IPAddress string
+	// Expected is the recorded host key fingerprint
+	Expected string
+	// Actual is the fingerprint of the host key presented by the VM
+	Actual string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s at %s: expected %s, got %s", e.InstanceID, e.IPAddress,
+		e.Expected, e.Actual)
+}
+
+// ConnectionSettings holds the information required to connect to a Windows VM
+type ConnectionSettings struct {
+	// Backend is the connectivity backend used to interact with the VM, either SSHBackend or WinRMBackend. SSHBackend
+	// is used if it is empty.
+	Backend string
+	// Signer is used for authenticating against the VM when using the SSH backend
+	Signer ssh.Signer
+	// HostKeys is used to pin the SSH host key or the WinRM server certificate of the VM on first contact and to verify
+	// it on every later connection
+	HostKeys HostKeyStore
+	// WinRM holds the settings required by the WinRM backend
+	WinRM *WinRMSettings
+	// Pool holds the SSH connections reused across calls to New. A new SSH connection is dialed for every call if it
+	// is nil.
+	Pool *SSHPool
+	// Timeouts holds the timeouts of the operations run on the VM. Unset timeouts take their default value.
+	Timeouts Timeouts
+	// ConnectAttempts is the number of attempts to connect to the VM, connectRetryInterval apart, each bounded by the
+	// Connect timeout. defaultConnectAttempts are made if it is not positive.
+	ConnectAttempts int
+	// Recorder is used to record events about changes made to the VM. No events are recorded if it is nil.
+	Recorder Recorder
+	// ServiceRecovery is the recovery policy applied to the node services. DefaultRecoveryPolicy is used if it is nil.
+	ServiceRecovery *RecoveryPolicy
+	// WindowsExporter configures the windows_exporter service run on the node. DefaultExporterConfig is used if it is
+	// nil.
+	WindowsExporter *ExporterConfig
+	// KubeProxy configures the kube-proxy service run on the node. DefaultKubeProxyConfig is used if it is nil.
+	KubeProxy *KubeProxyConfig
+	// JumpHosts holds the jump hosts, in order, that the SSH connection to the VM is tunneled through. The VM is dialed
+	// directly if it is empty. It is not used by the WinRM backend.
+	JumpHosts []JumpHost
+}
+
+// newConnectivity returns the connectivity backend selected by the given settings
+func newConnectivity(ctx context.Context, instanceID, username, ipAddress string,
+	settings ConnectionSettings) (connectivity, error) {
+	switch settings.Backend {
+	case SSHBackend, "":
+		return newSshConnectivity(ctx, instanceID, username, ipAddress, settings)
+	case WinRMBackend:
+		return newWinRMConnectivity(ctx, instanceID, username, ipAddress, settings)
+	default:
+		return nil, errors.Errorf("unsupported connectivity backend %q", settings.Backend)
+	}
+}
+
+// connectAttempts returns the number of attempts to connect to the VM
+func (s ConnectionSettings) connectAttempts() int {
+	if s.ConnectAttempts <= 0 {
+		return defaultConnectAttempts
+	}
+	return s.ConnectAttempts
+}
 
 type connectivity interface {
-	// run executes the given command on the remote system
-	run(cmd string) (string, error)
-	// transfer copies the file from the local disk to the remote VM directory, creating the remote directory if needed
-	transfer(filePath, remoteDir string) error
+	// run executes the given command on the remote system. The result is returned whenever the command completes,
+	// along with an *ExitError if its exit code is non-zero. The command is aborted if the context is done before it
+	// completes.
+	run(ctx context.Context, cmd string) (*CommandResult, error)
+	// transfer copies the file from the local disk to the remote VM directory, creating the remote directory if
+	// needed. The transfer is aborted if the context is done before it completes.
+	transfer(ctx context.Context, filePath, remoteDir string) error
+	// fetch copies the file at the given path on the remote VM to the writer. The copy is aborted if the context is
+	// done before it completes.
+	fetch(ctx context.Context, remotePath string, w io.Writer) error
 	// init initialises the connectivity medium
-	init() error
+	init(ctx context.Context) error
 }
 
 // sshConnectivity encapsulates the information needed to connect to the Windows VM over ssh
 type sshConnectivity struct {
+	// instanceID is the VM's cloud provider ID, used as the key for the recorded host key
+	instanceID string
 	// username is the user to connect to the VM
 	username string
 	// ipAddress is the VM's IP address
 	ipAddress string
+	// port is the SSH port of the VM
+	port string
 	// signer is used for authenticating against the VM
 	signer ssh.Signer
+	// hostKeys is used to record and verify the host key presented by the VM
+	hostKeys HostKeyStore
+	// pool is used to reuse the SSH connection to the VM, nil if the connection is not pooled
+	pool *SSHPool
+	// connectTimeout is the maximum time a single attempt to connect to the VM is allowed to take
+	connectTimeout time.Duration
+	// connectAttempts is the number of attempts to connect to the VM, at least one attempt is made
+	connectAttempts int
+	// jumpHosts holds the jump hosts the connection to the VM is tunneled through
+	jumpHosts []JumpHost
 	// sshClient is the client used to access the Windows VM via ssh
 	sshClient *ssh.Client
 }
 
 // newSshConnectivity returns an instance of sshConnectivity
-func newSshConnectivity(username, ipAddress string, signer ssh.Signer) (connectivity, error) {
+func newSshConnectivity(ctx context.Context, instanceID, username, ipAddress string,
+	settings ConnectionSettings) (connectivity, error) {
 	c := &sshConnectivity{
-		username:  username,
-		ipAddress: ipAddress,
-		signer:    signer,
+		instanceID:      instanceID,
+		username:        username,
+		ipAddress:       ipAddress,
+		port:            sshPort,
+		signer:          settings.Signer,
+		hostKeys:        settings.HostKeys,
+		pool:            settings.Pool,
+		connectTimeout:  settings.Timeouts.withDefaults().Connect,
+		connectAttempts: settings.connectAttempts(),
+		jumpHosts:       settings.JumpHosts,
 	}
-	if err := c.init(); err != nil {
+	if err := c.init(ctx); err != nil {
 		return nil, errors.Wrap(err, "error instantiating SSH client")
 	}
 	return c, nil
 }
 
-// init initialises the key based SSH client
-func (c *sshConnectivity) init() error {
-	if c.username == "" || c.ipAddress == "" || c.signer == nil {
+// init initialises the key based SSH client, reusing the pooled connection to the VM if there is a healthy one. The
+// host key presented by the VM is recorded on first contact and verified against the recorded fingerprint on every
+// later dial.
+func (c *sshConnectivity) init(ctx context.Context) error {
+	if c.instanceID == "" || c.username == "" || c.ipAddress == "" || c.signer == nil || c.hostKeys == nil {
 		return fmt.Errorf("incomplete sshConnectivity information: %v", c)
 	}
+	if c.pool != nil {
+		if sshClient := c.pool.get(c.instanceID, c.route(), c.users(), c.signer); sshClient != nil {
+			log.V(1).Info("reusing pooled SSH connection", "IP Address", c.ipAddress)
+			c.sshClient = sshClient
+			return nil
+		}
+	}
+
+	expected, err := c.hostKeys.Get(c.instanceID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get recorded host key for VM %s", c.instanceID)
+	}
+	verifier := &hostKeyVerifier{instanceID: c.instanceID, ipAddress: c.ipAddress, expected: expected}
 
 	config := &ssh.ClientConfig{
 		User: c.username,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(c.signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: verifier.callback,
 	}
-	var err error
 	var sshClient *ssh.Client
 	// Retry if we are unable to create a client as the VM could still be executing the steps in its user data. We
 	// cannot reuse the entries in the retry package as they are too granular.
-	for retries := 0; retries < 5; retries++ {
-		sshClient, err = ssh.Dial("tcp", c.ipAddress+":"+sshPort, config)
+	for attempt := 1; ; attempt++ {
+		sshClient, err = c.dial(ctx, config)
 		if err == nil {
 			break
 		}
+		// The SSH handshake does not preserve the error returned by the host key callback, so check the verifier
+		// directly. There is no point in retrying if the VM presented the wrong host key.
+		if verifier.mismatch != nil {
+			return verifier.mismatch
+		}
+		// Nor if a jump host presented the wrong host key
+		var mismatch *HostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			return err
+		}
 		log.V(1).Info("SSH dial", "IP Address", c.ipAddress, "error", err)
-		time.Sleep(1 * time.Minute)
+		if attempt >= c.connectAttempts {
+			break
+		}
+		if err := sleep(ctx, connectRetryInterval); err != nil {
+			return errors.Wrapf(err, "unable to connect to Windows VM %s", c.ipAddress)
+		}
 	}
 	if err != nil {
 		return errors.Wrapf(err, "unable to connect to Windows VM %s", c.ipAddress)
 	}
+
+	// Trust on first use: record the host key now that we have successfully authenticated against the VM
+	if expected == "" {
+		if err := c.hostKeys.Set(c.instanceID, verifier.presented); err != nil {
+			if err := sshClient.Close(); err != nil {
+				log.Error(err, "error closing SSH client")
+			}
+			return errors.Wrapf(err, "unable to record host key for VM %s", c.instanceID)
+		}
+		log.Info("recorded host key", "fingerprint", verifier.presented)
+	}
 	c.sshClient = sshClient
+	if c.pool != nil {
+		c.pool.add(c.instanceID, c.route(), c.users(), c.signer, sshClient)
+	}
 	return nil
 }
 
-// run instantiates a new SSH session and runs the command on the VM and returns the combined stdout and stderr output
-func (c *sshConnectivity) run(cmd string) (string, error) {
+// dial connects to the VM, through the jump hosts if any, and performs the SSH handshake. The attempt is aborted once
+// the connect timeout expires or the context is done.
+func (c *sshConnectivity) dial(ctx context.Context, config *ssh.ClientConfig) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.connectTimeout)
+	defer cancel()
+	return dialSSH(ctx, c.jumpHosts, c.hostKeys, net.JoinHostPort(c.ipAddress, c.port), config)
+}
+
+// route returns the IP address of the VM prefixed with the addresses of the jump hosts the connection is tunneled
+// through, so that a pooled connection is not reused once the jump hosts change
+func (c *sshConnectivity) route() string {
+	var hops []string
+	for _, jumpHost := range c.jumpHosts {
+		hops = append(hops, jumpHost.Address)
+	}
+	return strings.Join(append(hops, c.ipAddress), ",")
+}
+
+// users returns the users the connection authenticates as on the jump hosts, in the order of route, followed by the
+// user on the VM, so that a pooled connection is not reused once any of them changes
+func (c *sshConnectivity) users() string {
+	var users []string
+	for _, jumpHost := range c.jumpHosts {
+		users = append(users, jumpHost.User)
+	}
+	return strings.Join(append(users, c.username), ",")
+}
+
+// hostKeyVerifier verifies the host key presented by a VM against the fingerprint that was recorded for it
+type hostKeyVerifier struct {
+	// instanceID is the VM's cloud provider ID
+	instanceID string
+	// ipAddress is the VM's IP address
+	ipAddress string
+	// expected is the recorded fingerprint. An empty value implies that this is the first contact with the VM.
+	expected string
+	// presented is the fingerprint of the last host key presented by the VM
+	presented string
+	// mismatch is set if the VM presented a host key that does not match the expected fingerprint
+	mismatch *HostKeyMismatchError
+}
+
+// callback is an ssh.HostKeyCallback that accepts any host key on first contact and otherwise only the host key
+// matching the recorded fingerprint
+func (v *hostKeyVerifier) callback(_ string, _ net.Addr, key ssh.PublicKey) error {
+	return v.verify(ssh.FingerprintSHA256(key))
+}
+
+// verify records the presented fingerprint and returns an error if it does not match the expected fingerprint
+func (v *hostKeyVerifier) verify(fingerprint string) error {
+	v.presented = fingerprint
+	if v.expected == "" || v.expected == v.presented {
+		return nil
+	}
+	v.mismatch = &HostKeyMismatchError{
+		InstanceID: v.instanceID,
+		IPAddress:  v.ipAddress,
+		Expected:   v.expected,
+		Actual:     v.presented,
+	}
+	return v.mismatch
+}
+
+// run instantiates a new SSH session and runs the command on the VM, returning its stdout, stderr and exit code. The
+// session is closed if the context is done before the command completes.
+func (c *sshConnectivity) run(ctx context.Context, cmd string) (*CommandResult, error) {
 	if c.sshClient == nil {
-		return "", errors.New("run cannot be called with nil SSH client")
+		return nil, errors.New("run cannot be called with nil SSH client")
 	}
+	defer c.acquire()()
 
 	session, err := c.sshClient.NewSession()
 	if err != nil {
-		return "", err
+		c.drop()
+		return nil, err
 	}
 	defer func() {
 		// io.EOF is returned if you attempt to close a session that is already closed which typically happens given
-		// that Run(), which is called by CombinedOutput(), internally closes the session.
+		// that Run() internally closes the session.
 		if err := session.Close(); err != nil && !errors.Is(err, io.EOF) {
 			log.Error(err, "error closing SSH session")
 		}
 	}()
 
-	out, err := session.CombinedOutput(cmd)
-	if err != nil {
-		return string(out), err
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	var cmdErr error
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		cmdErr = session.Run(cmd)
+		close(done)
+	}()
+	// Closing the session aborts the command
+	if err := c.waitOrAbort(ctx, done, func() { session.Close() }); err != nil {
+		return nil, errors.Wrap(err, "command aborted")
+	}
+
+	exitCode := 0
+	if cmdErr != nil {
+		var exitErr *ssh.ExitError
+		if !errors.As(cmdErr, &exitErr) {
+			// The command did not complete, for example because the connection was lost
+			return nil, cmdErr
+		}
+		exitCode = exitErr.ExitStatus()
 	}
-	return string(out), nil
+	return newCommandResult(stdout.String(), stderr.String(), exitCode, start)
 }
 
-// transfer uses FTP to copy the file from the local disk to the remote VM directory, creating the directory if needed
-func (c *sshConnectivity) transfer(filePath, remoteDir string) error {
+// transfer uses FTP to copy the file from the local disk to the remote VM directory, creating the directory if
+// needed. The SFTP session is closed if the context is done before the transfer completes.
+func (c *sshConnectivity) transfer(ctx context.Context, filePath, remoteDir string) error {
 	if c.sshClient == nil {
 		return errors.New("transfer cannot be called with nil SSH client")
 	}
+	defer c.acquire()()
 
-	ftp, err := sftp.NewClient(c.sshClient)
+	ftp, err := c.sftpClient()
 	if err != nil {
+		c.drop()
 		return err
 	}
-	defer func() {
-		if err := ftp.Close(); err != nil {
-			log.Error(err, "error closing FTP connection")
-		}
-	}()
+	if c.pool == nil {
+		defer func() {
+			if err := ftp.Close(); err != nil && !errors.Is(err, io.EOF) {
+				log.Error(err, "error closing FTP connection")
+			}
+		}()
+	}
 
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -132,11 +401,87 @@ func (c *sshConnectivity) transfer(filePath, remoteDir string) error {
 		}
 	}()
 
+	var copyErr error
+	done := make(chan struct{})
+	go func() {
+		copyErr = copyFile(ftp, f, remoteDir)
+		close(done)
+	}()
+	// Closing the SFTP session aborts the transfer
+	if err := c.waitOrAbort(ctx, done, func() { c.resetSFTP(ftp) }); err != nil {
+		return errors.Wrapf(err, "transfer of %s aborted", filePath)
+	}
+	if copyErr != nil {
+		// The SFTP session may be in a bad state, do not reuse it
+		c.resetSFTP(ftp)
+		return errors.Wrapf(copyErr, "error copying %s to the Windows VM", filePath)
+	}
+	return nil
+}
+
+// fetch uses FTP to copy the remote file to the writer. The SFTP session is closed if the context is done before the
+// copy completes.
+func (c *sshConnectivity) fetch(ctx context.Context, remotePath string, w io.Writer) error {
+	if c.sshClient == nil {
+		return errors.New("fetch cannot be called with nil SSH client")
+	}
+	defer c.acquire()()
+
+	ftp, err := c.sftpClient()
+	if err != nil {
+		c.drop()
+		return err
+	}
+	if c.pool == nil {
+		defer func() {
+			if err := ftp.Close(); err != nil && !errors.Is(err, io.EOF) {
+				log.Error(err, "error closing FTP connection")
+			}
+		}()
+	}
+
+	var copyErr error
+	done := make(chan struct{})
+	go func() {
+		copyErr = copyRemoteFile(ftp, remotePath, w)
+		close(done)
+	}()
+	// Closing the SFTP session aborts the copy
+	if err := c.waitOrAbort(ctx, done, func() { c.resetSFTP(ftp) }); err != nil {
+		return errors.Wrapf(err, "fetch of %s aborted", remotePath)
+	}
+	if copyErr != nil {
+		// A missing file leaves the SFTP session in a good state, anything else may not
+		if !errors.Is(copyErr, os.ErrNotExist) {
+			c.resetSFTP(ftp)
+		}
+		return errors.Wrapf(copyErr, "error copying %s from the Windows VM", remotePath)
+	}
+	return nil
+}
+
+// copyRemoteFile copies the remote file to the writer over the SFTP session
+func copyRemoteFile(ftp *sftp.Client, remotePath string, w io.Writer) error {
+	f, err := ftp.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.V(1).Info("error closing remote file", "file", remotePath, "error", err)
+		}
+	}()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// copyFile copies the local file to the remote directory over the SFTP session, creating the directory if needed
+func copyFile(ftp *sftp.Client, f *os.File, remoteDir string) error {
 	if err := ftp.MkdirAll(remoteDir); err != nil {
 		return errors.Wrapf(err, "error creating remote directory %s", remoteDir)
 	}
 
-	remoteFile := remoteDir + "\\" + filepath.Base(filePath)
+	remoteFile := remoteDir + "\\" + filepath.Base(f.Name())
 	dstFile, err := ftp.Create(remoteFile)
 	if err != nil {
 		return errors.Wrapf(err, "error initializing %s file on Windows VM", remoteFile)
@@ -144,7 +489,7 @@ func (c *sshConnectivity) transfer(filePath, remoteDir string) error {
 
 	_, err = io.Copy(dstFile, f)
 	if err != nil {
-		return errors.Wrapf(err, "error copying %s to the Windows VM", filePath)
+		return err
 	}
 
 	// Forcefully close the file so that we can execute it later in the case of binaries
@@ -153,3 +498,64 @@ func (c *sshConnectivity) transfer(filePath, remoteDir string) error {
 	}
 	return nil
 }
+
+// waitOrAbort waits for done to be closed. If the context is done first, abort is called to interrupt the operation
+// and the context error is returned. The connection is dropped if the operation does not return within
+// sshAbortTimeout of being aborted, as the connection is then most likely dead.
+func (c *sshConnectivity) waitOrAbort(ctx context.Context, done <-chan struct{}, abort func()) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	abort()
+	timer := time.NewTimer(sshAbortTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		c.drop()
+	}
+	return ctx.Err()
+}
+
+// sftpClient returns an SFTP client for the VM. The SFTP subsystem is reused if the connection is pooled, otherwise
+// the caller is responsible for closing the returned client.
+func (c *sshConnectivity) sftpClient() (*sftp.Client, error) {
+	if c.pool == nil {
+		return sftp.NewClient(c.sshClient)
+	}
+	return c.pool.sftpClient(c.instanceID, c.sshClient)
+}
+
+// acquire marks the pooled connection as in use, returning the function that must be called once it is no longer in
+// use
+func (c *sshConnectivity) acquire() func() {
+	if c.pool == nil {
+		return func() {}
+	}
+	return c.pool.acquire(c.instanceID, c.sshClient)
+}
+
+// resetSFTP closes the given SFTP client so that it is not reused
+func (c *sshConnectivity) resetSFTP(ftp *sftp.Client) {
+	if c.pool != nil {
+		c.pool.resetSFTP(c.instanceID, c.sshClient)
+		return
+	}
+	if err := ftp.Close(); err != nil && !errors.Is(err, io.EOF) {
+		log.V(1).Info("error closing FTP connection", "error", err)
+	}
+}
+
+// drop closes the connection, removing it from the pool, as it is no longer usable. The next call to init dials the
+// VM again.
+func (c *sshConnectivity) drop() {
+	if c.pool != nil {
+		c.pool.drop(c.instanceID, c.sshClient)
+		return
+	}
+	if err := c.sshClient.Close(); err != nil {
+		log.V(1).Info("error closing SSH client", "error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package windows
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestHostKeyVerifierCallback tests that hostKeyVerifier accepts any host key on first contact and only the recorded
+// host key afterwards
+func TestHostKeyVerifierCallback(t *testing.T) {
+	hostKey := newTestPublicKey(t)
+	otherHostKey := newTestPublicKey(t)
+
+	tests := []struct {
+		name     string
+		expected string
+		key      ssh.PublicKey
+		wantErr  bool
+	}{
+		{
+			name:     "first contact",
+			expected: "",
+			key:      hostKey,
+			wantErr:  false,
+		},
+		{
+			name:     "recorded host key",
+			expected: ssh.FingerprintSHA256(hostKey),
+			key:      hostKey,
+			wantErr:  false,
+		},
+		{
+			name:     "host key mismatch",
+			expected: ssh.FingerprintSHA256(hostKey),
+			key:      otherHostKey,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &hostKeyVerifier{instanceID: "i-0123", ipAddress: "10.0.0.1", expected: tt.expected}
+			err := v.callback("10.0.0.1:22", nil, tt.key)
+			assert.Equal(t, ssh.FingerprintSHA256(tt.key), v.presented)
+			if !tt.wantErr {
+				require.NoError(t, err)
+				assert.Nil(t, v.mismatch)
+				return
+			}
+			require.Error(t, err)
+			require.NotNil(t, v.mismatch)
+			assert.Equal(t, tt.expected, v.mismatch.Expected)
+			assert.Equal(t, ssh.FingerprintSHA256(tt.key), v.mismatch.Actual)
+		})
+	}
+}
+
+// newTestPublicKey returns a newly generated SSH public key
+func newTestPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return key
+}
+
+// TestSSHRun tests that the stdout, stderr and exit code of commands run over SSH are returned separately
+func TestSSHRun(t *testing.T) {
+	s := newFakeSSHServer(t, func(cmd string) (string, string, int) {
+		switch cmd {
+		case "hostname":
+			return "winhost\r\n", "", 0
+		case "sc.exe qc missing":
+			return "[SC] OpenService FAILED 1060\r\n", "", 1060
+		}
+		return "", "unknown command", 1
+	})
+	signer := newTestSigner(t)
+	c := &sshConnectivity{instanceID: "i-0123", sshClient: s.dial(t, signer)}
+	defer c.sshClient.Close()
+
+	tests := []struct {
+		name     string
+		cmd      string
+		expected CommandResult
+	}{
+		{
+			name:     "success",
+			cmd:      "hostname",
+			expected: CommandResult{Stdout: "winhost\r\n"},
+		},
+		{
+			name:     "Win32 error code",
+			cmd:      "sc.exe qc missing",
+			expected: CommandResult{Stdout: "[SC] OpenService FAILED 1060\r\n", ExitCode: 1060},
+		},
+		{
+			name:     "output on stderr",
+			cmd:      "unknown",
+			expected: CommandResult{Stderr: "unknown command", ExitCode: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := c.run(context.Background(), tt.cmd)
+			if tt.expected.ExitCode == 0 {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.True(t, isExitCode(err, tt.expected.ExitCode), "unexpected error %v", err)
+			}
+			require.NotNil(t, result)
+			assert.Equal(t, tt.expected.Stdout, result.Stdout)
+			assert.Equal(t, tt.expected.Stderr, result.Stderr)
+			assert.Equal(t, tt.expected.ExitCode, result.ExitCode)
+		})
+	}
+}
+
+// TestSSHInitSingleAttempt tests that an unreachable VM is given up on after a single attempt, without waiting for
+// the retry interval, when a single connection attempt is allowed
+func TestSSHInitSingleAttempt(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	// Nothing listens on the port anymore
+	require.NoError(t, listener.Close())
+
+	c := &sshConnectivity{instanceID: "i-0123", username: "Administrator", ipAddress: host, port: port,
+		signer: newTestSigner(t), hostKeys: memoryHostKeyStore{}, connectTimeout: time.Second, connectAttempts: 1}
+	start := time.Now()
+	assert.Error(t, c.init(context.Background()))
+	assert.Less(t, int64(time.Since(start)), int64(connectRetryInterval))
+}
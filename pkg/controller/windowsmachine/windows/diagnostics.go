@@ -0,0 +1,252 @@
+package windows
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxDiagnosticsFileSize is the maximum number of bytes of a remote file included in the diagnostics. Only the
+	// beginning of larger files is included.
+	maxDiagnosticsFileSize = 16 * 1024 * 1024
+	// diagnosticsErrorsFile is the file of the diagnostics listing what could not be collected
+	diagnosticsErrorsFile = "errors.txt"
+	// payloadHashesFile is the file of the diagnostics comparing the hashes of the payload files on the VM to the
+	// expected ones
+	payloadHashesFile = "payload-hashes.txt"
+)
+
+// errDiagnosticsFileTooLarge is returned by cappedBuffer once its limit is reached, to stop the copy of a remote file
+var errDiagnosticsFileTooLarge = errors.New("file is too large")
+
+// diagnosticsLogDirs holds the remote directories whose files are included in the diagnostics
+var diagnosticsLogDirs = []string{kubeletLogDir, kubeProxyLogDir, hybridOverlayLogDir}
+
+// diagnosticsServices holds the names of the Windows services whose state is included in the diagnostics
+var diagnosticsServices = []string{kubeletServiceName, hybridOverlayServiceName, kubeProxyServiceName,
+	windowsExporterServiceName}
+
+// diagnosticsCommands holds the PowerShell commands whose output is included in the diagnostics, along with the file
+// holding their output
+var diagnosticsCommands = []struct {
+	file string
+	cmd  string
+}{
+	{file: "hns/networks.json", cmd: "\"Get-HnsNetwork | ConvertTo-Json -Depth 5\""},
+	{file: "hns/endpoints.json", cmd: "\"Get-HnsEndpoint | ConvertTo-Json -Depth 5\""},
+	// Only the metadata of the ignition is collected, as it holds the bootstrap credentials of the node
+	{file: "worker-ign.json", cmd: "\"Get-Item -Path " + winTemp + workerIgnitionName + " | " +
+		"Select-Object FullName, Length, LastWriteTimeUtc | ConvertTo-Json\""},
+}
+
+// diagnostics writes the files collected from a VM to a tarball
+type diagnostics struct {
+	// tw writes the tarball
+	tw *tar.Writer
+	// failures holds the descriptions of what could not be collected
+	failures []string
+}
+
+// add adds the file with the given name and content to the tarball
+func (d *diagnostics) add(name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := d.tw.WriteHeader(header); err != nil {
+		return errors.Wrapf(err, "error writing header of %s", name)
+	}
+	if _, err := d.tw.Write(data); err != nil {
+		return errors.Wrapf(err, "error writing %s", name)
+	}
+	return nil
+}
+
+// fail records that the given item could not be collected
+func (d *diagnostics) fail(item string, err error) {
+	log.V(1).Info("unable to collect diagnostics", "item", item, "error", err)
+	d.failures = append(d.failures, fmt.Sprintf("%s: %v", item, err))
+}
+
+// CollectDiagnostics writes the diagnostics bundle of the VM to the writer as it is collected. Errors are only returned
+// if the bundle cannot be written or the context is done, the items which cannot be collected are listed in the bundle.
+func (vm *windows) CollectDiagnostics(ctx context.Context, w io.Writer) error {
+	log.Info("collecting diagnostics")
+	gz := gzip.NewWriter(w)
+	d := &diagnostics{tw: tar.NewWriter(gz)}
+	collectors := []func(context.Context, *diagnostics) error{
+		vm.collectServices,
+		vm.collectCommands,
+		vm.collectLogs,
+		vm.collectPayloadHashes,
+	}
+	for _, collect := range collectors {
+		if err := collect(ctx, d); err != nil {
+			return errors.Wrap(err, "error writing diagnostics")
+		}
+	}
+	if len(d.failures) > 0 {
+		if err := d.add(diagnosticsErrorsFile, []byte(strings.Join(d.failures, "\n")+"\n")); err != nil {
+			return errors.Wrap(err, "error writing diagnostics")
+		}
+	}
+	if err := d.tw.Close(); err != nil {
+		return errors.Wrap(err, "error closing diagnostics tarball")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "error compressing diagnostics tarball")
+	}
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "diagnostics collection aborted")
+	}
+	return nil
+}
+
+// collectServices adds the state of the node services to the diagnostics
+func (vm *windows) collectServices(ctx context.Context, d *diagnostics) error {
+	for _, name := range diagnosticsServices {
+		result, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceQuery, "sc.exe queryex "+name, false,
+			errorServiceDoesNotExist)
+		if result == nil {
+			d.fail("state of "+name+" service", err)
+			continue
+		}
+		// The output is also useful if the service does not exist
+		if err := d.add("services/"+name+".txt", []byte(result.Output())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectCommands adds the output of the diagnostics commands to the diagnostics
+func (vm *windows) collectCommands(ctx context.Context, d *diagnostics) error {
+	for _, command := range diagnosticsCommands {
+		result, err := vm.runWithTimeout(ctx, vm.timeouts.Command, command.cmd, true)
+		if err != nil {
+			if output := strings.TrimSpace(result.Output()); output != "" {
+				err = errors.Wrap(err, output)
+			}
+			d.fail(command.file, err)
+			continue
+		}
+		if err := d.add(command.file, []byte(result.Stdout)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectLogs adds the files of the log directories to the diagnostics
+func (vm *windows) collectLogs(ctx context.Context, d *diagnostics) error {
+	for _, dir := range diagnosticsLogDirs {
+		result, err := vm.runWithTimeout(ctx, vm.timeouts.Command, listFilesCmd(dir), true)
+		if err != nil {
+			d.fail("list of files in "+dir, err)
+			continue
+		}
+		for _, remotePath := range strings.Split(result.Stdout, "\n") {
+			remotePath = strings.TrimSpace(remotePath)
+			if remotePath == "" {
+				continue
+			}
+			if err := vm.collectFile(ctx, d, remotePath, "logs/"+archivePath(remotePath, logDir)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectFile adds the remote file to the diagnostics under the given name. Files larger than
+// maxDiagnosticsFileSize are truncated.
+func (vm *windows) collectFile(ctx context.Context, d *diagnostics, remotePath, name string) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, vm.timeouts.FileTransfer)
+	defer cancel()
+	buf := &cappedBuffer{limit: maxDiagnosticsFileSize}
+	if err := vm.interact.fetch(fetchCtx, remotePath, buf); err != nil {
+		if !errors.Is(err, errDiagnosticsFileTooLarge) {
+			d.fail(remotePath, err)
+			return nil
+		}
+		d.fail(remotePath, errors.Errorf("truncated to %d bytes", maxDiagnosticsFileSize))
+	}
+	return d.add(name, buf.Bytes())
+}
+
+// collectPayloadHashes adds the comparison of the hashes of the payload files on the VM to the expected ones to the
+// diagnostics
+func (vm *windows) collectPayloadHashes(ctx context.Context, d *diagnostics) error {
+	files, err := getFilesToTransfer()
+	if err != nil {
+		d.fail(payloadHashesFile, err)
+		return nil
+	}
+	var lines []string
+	for file, dir := range files {
+		remotePath := strings.TrimSuffix(dir, "\\") + "\\" + filepath.Base(file.Path)
+		actual, status := "-", "OK"
+		remoteFile, err := vm.newFileInfo(ctx, remotePath)
+		switch {
+		case isExitCode(err, 1):
+			// Get-FileHash fails if the file does not exist
+			status = "MISSING"
+		case err != nil:
+			d.fail("hash of "+remotePath, err)
+			continue
+		case remoteFile.SHA256 != file.SHA256:
+			actual, status = remoteFile.SHA256, "MISMATCH"
+		default:
+			actual = remoteFile.SHA256
+		}
+		lines = append(lines, strings.Join([]string{remotePath, file.SHA256, actual, status}, "\t"))
+	}
+	sort.Strings(lines)
+	out := "PATH\tEXPECTED SHA256\tACTUAL SHA256\tSTATUS\n" + strings.Join(lines, "\n") + "\n"
+	return d.add(payloadHashesFile, []byte(out))
+}
+
+// listFilesCmd returns the PowerShell command printing the paths of the files in the given directory and its
+// subdirectories. Nothing is printed if the directory does not exist.
+func listFilesCmd(dir string) string {
+	return "\"Get-ChildItem -Path " + dir + " -Recurse -File -ErrorAction SilentlyContinue | " +
+		"ForEach-Object { $_.FullName }\""
+}
+
+// archivePath returns the path within the diagnostics of the given remote file, relative to the given remote
+// directory
+func archivePath(remotePath, dir string) string {
+	if strings.HasPrefix(strings.ToLower(remotePath), strings.ToLower(dir)) {
+		remotePath = remotePath[len(dir):]
+	}
+	return strings.ReplaceAll(strings.TrimLeft(remotePath, "\\"), "\\", "/")
+}
+
+// cappedBuffer is a buffer which fails writes past its limit
+type cappedBuffer struct {
+	// buf holds the written bytes
+	buf bytes.Buffer
+	// limit is the maximum number of bytes held by the buffer
+	limit int
+}
+
+// Write writes up to the limit of the buffer, returning errDiagnosticsFileTooLarge if some bytes were not written
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		n, _ := b.buf.Write(p[:room])
+		return n, errDiagnosticsFileTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the written bytes
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
@@ -0,0 +1,88 @@
+package windows
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readDiagnostics returns the files of the given diagnostics tarball keyed by name
+func readDiagnostics(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(content)
+	}
+}
+
+// TestCollectDiagnostics tests that the logs, service states, HNS objects and payload hashes of a VM are collected,
+// and that what could not be collected is reported in the tarball
+func TestCollectDiagnostics(t *testing.T) {
+	vm, sim, _ := newSimulatedVM(t)
+	require.NoError(t, vm.Configure(context.Background(), []byte(testIgnition)))
+	require.NoError(t, vm.ConfigureHybridOverlay(context.Background(), "node"))
+	sim.WriteFile(kubeletLogDir+"kubelet.log", []byte("kubelet log"))
+	sim.WriteFile(hybridOverlayLogDir+"hybrid-overlay.log", []byte("hybrid-overlay log"))
+	sim.WriteFile(k8sDir+"kube-proxy.exe", []byte("corrupted"))
+
+	var buf bytes.Buffer
+	require.NoError(t, vm.CollectDiagnostics(context.Background(), &buf))
+	files := readDiagnostics(t, buf.Bytes())
+
+	assert.Equal(t, "kubelet log", files["logs/kubelet/kubelet.log"])
+	assert.Equal(t, "hybrid-overlay log", files["logs/hybrid-overlay/hybrid-overlay.log"])
+	assert.Contains(t, files["services/"+kubeletServiceName+".txt"], "RUNNING")
+	assert.Contains(t, files["services/"+kubeProxyServiceName+".txt"], "does not exist")
+	assert.Contains(t, files["hns/networks.json"], "OVNKubernetesHybridOverlayNetwork")
+	assert.Contains(t, files["worker-ign.json"], "worker.ign")
+	assert.Contains(t, files[payloadHashesFile], k8sDir+"kubelet.exe\t")
+	assert.Contains(t, files[payloadHashesFile], "MISMATCH")
+	assert.NotContains(t, files, diagnosticsErrorsFile)
+}
+
+// TestCollectDiagnosticsUnconfigured tests that the diagnostics of a VM which was never configured report the missing
+// files instead of failing
+func TestCollectDiagnosticsUnconfigured(t *testing.T) {
+	vm, _, _ := newSimulatedVM(t)
+
+	var buf bytes.Buffer
+	require.NoError(t, vm.CollectDiagnostics(context.Background(), &buf))
+	files := readDiagnostics(t, buf.Bytes())
+
+	assert.Equal(t, "[]\r\n", files["hns/endpoints.json"])
+	assert.NotContains(t, files, "worker-ign.json")
+	assert.Contains(t, files[diagnosticsErrorsFile], "worker-ign.json: ")
+	assert.Contains(t, files[payloadHashesFile], k8sDir+"kubelet.exe\t")
+	assert.NotContains(t, files[payloadHashesFile], "\tOK")
+}
+
+// TestArchivePath tests that remote files are stored under their path relative to the log directory
+func TestArchivePath(t *testing.T) {
+	tests := []struct {
+		remotePath string
+		expected   string
+	}{
+		{remotePath: "C:\\var\\log\\kubelet\\kubelet.log", expected: "kubelet/kubelet.log"},
+		{remotePath: "c:\\VAR\\log\\kube-proxy\\kube-proxy.exe.INFO", expected: "kube-proxy/kube-proxy.exe.INFO"},
+		{remotePath: "D:\\logs\\other.log", expected: "D:/logs/other.log"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, archivePath(tt.remotePath, logDir), tt.remotePath)
+	}
+}
@@ -0,0 +1,83 @@
+package windows
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultExporterPort is the port windows_exporter exposes the metrics on by default
+const DefaultExporterPort int32 = 9182
+
+var (
+	// collectorNameRegex matches the valid windows_exporter collector names
+	collectorNameRegex = regexp.MustCompile(`^[a-z0-9_]+$`)
+	// collectorFlagRegex matches the valid collector specific flag names, such as collector.process.whitelist
+	collectorFlagRegex = regexp.MustCompile(`^collector\.[a-z0-9_]+\.[a-z0-9_.-]+$`)
+)
+
+// ExporterConfig configures the windows_exporter service run on the node
+type ExporterConfig struct {
+	// Collectors holds the names of the enabled collectors
+	Collectors []string
+	// CollectorFlags holds the collector specific flags, keyed by flag name without the leading dashes, such as
+	// collector.process.whitelist
+	CollectorFlags map[string]string
+	// Port is the port the metrics are exposed on
+	Port int32
+}
+
+// DefaultExporterConfig returns the windows_exporter configuration applied to the nodes by default
+func DefaultExporterConfig() ExporterConfig {
+	return ExporterConfig{
+		Collectors: []string{"cpu", "cs", "logical_disk", "net", "os", "service", "system", "textfile", "container",
+			"memory"},
+		Port: DefaultExporterPort,
+	}
+}
+
+// Validate returns an error if windows_exporter cannot be run with the configuration. The flag values cannot hold
+// whitespaces or double quotes, as they are part of the command line of the service.
+func (c ExporterConfig) Validate() error {
+	if len(c.Collectors) == 0 {
+		return errors.New("at least one windows_exporter collector must be enabled")
+	}
+	for _, collector := range c.Collectors {
+		if !collectorNameRegex.MatchString(collector) {
+			return errors.Errorf("invalid windows_exporter collector %q", collector)
+		}
+	}
+	for flag, value := range c.CollectorFlags {
+		if !collectorFlagRegex.MatchString(flag) {
+			return errors.Errorf("invalid windows_exporter collector flag %q", flag)
+		}
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"") {
+			return errors.Errorf("invalid value %q of windows_exporter flag %s", value, flag)
+		}
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return errors.Errorf("invalid windows_exporter port %d", c.Port)
+	}
+	return nil
+}
+
+// args returns the arguments of the windows_exporter service. The listen address is left to its default if the
+// default port is used.
+func (c ExporterConfig) args() string {
+	args := "--collectors.enabled " + strings.Join(c.Collectors, ",")
+	if c.Port != DefaultExporterPort {
+		args += fmt.Sprintf(" --telemetry.addr :%d", c.Port)
+	}
+	flags := make([]string, 0, len(c.CollectorFlags))
+	for flag := range c.CollectorFlags {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	for _, flag := range flags {
+		args += " --" + flag + "=" + c.CollectorFlags[flag]
+	}
+	return args
+}
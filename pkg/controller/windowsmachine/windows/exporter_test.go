@@ -0,0 +1,89 @@
+package windows
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExporterConfigValidate tests that the windows_exporter configurations which cannot be part of the service
+// command line are rejected
+func TestExporterConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      ExporterConfig
+		expectedErr bool
+	}{
+		{
+			name:   "default",
+			config: DefaultExporterConfig(),
+		},
+		{
+			name: "collector flags",
+			config: ExporterConfig{Collectors: []string{"process", "iis"}, Port: 9200,
+				CollectorFlags: map[string]string{"collector.process.whitelist": "w3wp|sqlservr"}},
+		},
+		{
+			name:        "no collectors",
+			config:      ExporterConfig{Port: DefaultExporterPort},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid collector",
+			config:      ExporterConfig{Collectors: []string{"cpu,process"}, Port: DefaultExporterPort},
+			expectedErr: true,
+		},
+		{
+			name: "flag not specific to a collector",
+			config: ExporterConfig{Collectors: []string{"cpu"}, Port: DefaultExporterPort,
+				CollectorFlags: map[string]string{"telemetry.addr": ":80"}},
+			expectedErr: true,
+		},
+		{
+			name: "flag value with a double quote",
+			config: ExporterConfig{Collectors: []string{"process"}, Port: DefaultExporterPort,
+				CollectorFlags: map[string]string{"collector.process.whitelist": "a\" --other"}},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid port",
+			config:      ExporterConfig{Collectors: []string{"cpu"}, Port: 70000},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestConfigureWindowsExporterReconfigure tests that the windows_exporter service is reconfigured when its
+// configuration changes
+func TestConfigureWindowsExporterReconfigure(t *testing.T) {
+	vm, sim, _ := newSimulatedVM(t)
+	ctx := context.Background()
+	sim.WriteFile(windowsExporterPath, []byte("windows_exporter"))
+	require.NoError(t, vm.ConfigureWindowsExporter(ctx))
+	exporter := assertServiceRunning(t, sim, windowsExporterServiceName)
+	assert.Equal(t, windowsExporterPath+" --collectors.enabled "+
+		"cpu,cs,logical_disk,net,os,service,system,textfile,container,memory", exporter.BinaryPath)
+
+	vm.exporter = ExporterConfig{Collectors: []string{"cpu", "process", "tcp"}, Port: 9200,
+		CollectorFlags: map[string]string{"collector.process.whitelist": "w3wp|sqlservr",
+			"collector.iis.app-whitelist": "site"}}
+	require.NoError(t, vm.ConfigureWindowsExporter(ctx))
+	exporter = assertServiceRunning(t, sim, windowsExporterServiceName)
+	assert.Equal(t, windowsExporterPath+" --collectors.enabled cpu,process,tcp --telemetry.addr :9200 "+
+		"--collector.iis.app-whitelist=site --collector.process.whitelist=w3wp|sqlservr", exporter.BinaryPath)
+
+	vm.exporter = ExporterConfig{Port: 9200}
+	assert.Error(t, vm.ConfigureWindowsExporter(ctx))
+}
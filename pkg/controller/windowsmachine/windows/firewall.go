@@ -0,0 +1,215 @@
+package windows
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// firewallRuleGroup is the group of the Windows firewall rules owned by the operator. Rules in this group which are
+	// not desired are deleted.
+	firewallRuleGroup = "windows-machine-config-operator"
+	// kubeletPort is the port of the kubelet API
+	kubeletPort = "10250"
+	// defaultVXLANPort is the port of the hybrid-overlay VXLAN traffic unless a custom port is set
+	defaultVXLANPort = "4789"
+)
+
+var (
+	// firewallRuleNameRegex matches the valid firewall rule names
+	firewallRuleNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	// localPortsRegex matches a port or a range of ports
+	localPortsRegex = regexp.MustCompile(`^[0-9]{1,5}(-[0-9]{1,5})?$`)
+)
+
+// FirewallRule is an inbound Windows firewall rule, owned by the operator, allowing the traffic to local ports
+type FirewallRule struct {
+	// Name identifies the rule on the VM. It may only contain alphanumeric characters and '-'.
+	Name string
+	// Protocol is the protocol of the allowed traffic, TCP or UDP
+	Protocol string
+	// LocalPorts is the allowed local port, or range of ports such as 30000-32767
+	LocalPorts string
+}
+
+// validate returns an error if the rule cannot be created
+func (r FirewallRule) validate() error {
+	if !firewallRuleNameRegex.MatchString(r.Name) {
+		return errors.Errorf("invalid firewall rule name %q", r.Name)
+	}
+	if r.Protocol != "TCP" && r.Protocol != "UDP" {
+		return errors.Errorf("invalid protocol %q of firewall rule %s", r.Protocol, r.Name)
+	}
+	if !localPortsRegex.MatchString(r.LocalPorts) {
+		return errors.Errorf("invalid local ports %q of firewall rule %s", r.LocalPorts, r.Name)
+	}
+	return nil
+}
+
+// String returns a description of the rule, such as wmco-kubelet (TCP 10250)
+func (r FirewallRule) String() string {
+	return fmt.Sprintf("%s (%s %s)", r.Name, r.Protocol, r.LocalPorts)
+}
+
+// NodeFirewallRules returns the firewall rules required by a node: the kubelet API, the windows_exporter metrics on
+// the given port, the hybrid-overlay VXLAN traffic on the given port, or the default port if it is empty, and the
+// NodePort services in the given range, which is skipped if it is empty
+func NodeFirewallRules(metricsPort int32, vxlanPort, nodePortRange string) []FirewallRule {
+	if vxlanPort == "" {
+		vxlanPort = defaultVXLANPort
+	}
+	rules := []FirewallRule{
+		{Name: "wmco-kubelet", Protocol: "TCP", LocalPorts: kubeletPort},
+		{Name: "wmco-windows-exporter", Protocol: "TCP", LocalPorts: fmt.Sprint(metricsPort)},
+		{Name: "wmco-hybrid-overlay-vxlan", Protocol: "UDP", LocalPorts: vxlanPort},
+	}
+	if nodePortRange != "" {
+		rules = append(rules, FirewallRule{Name: "wmco-nodeport-tcp", Protocol: "TCP", LocalPorts: nodePortRange},
+			FirewallRule{Name: "wmco-nodeport-udp", Protocol: "UDP", LocalPorts: nodePortRange})
+	}
+	return rules
+}
+
+// firewallRuleState is the state of a firewall rule of the operator group, as found on the VM
+type firewallRuleState struct {
+	FirewallRule
+	// enabled is true if the rule is enabled
+	enabled bool
+	// inboundAllow is true if the rule allows inbound traffic
+	inboundAllow bool
+}
+
+// firewallChanges holds the changes needed to bring the firewall rules of the operator group to the desired state
+type firewallChanges struct {
+	// remove holds the names of the rules to delete
+	remove []string
+	// create holds the rules to create, after the rules to delete have been deleted
+	create []FirewallRule
+	// drift describes the differences between the desired and the current rules
+	drift []string
+}
+
+// diffFirewallRules returns the changes needed to bring the current rules of the operator group to the desired
+// rules. Rules which differ from the desired ones are deleted and created again.
+func diffFirewallRules(desired []FirewallRule, current map[string]firewallRuleState) *firewallChanges {
+	changes := &firewallChanges{}
+	wanted := make(map[string]bool, len(desired))
+	for _, rule := range desired {
+		wanted[rule.Name] = true
+		state, found := current[rule.Name]
+		switch {
+		case !found:
+			changes.drift = append(changes.drift, "missing "+rule.String())
+		case !strings.EqualFold(state.Protocol, rule.Protocol) || state.LocalPorts != rule.LocalPorts ||
+			!state.enabled || !state.inboundAllow:
+			changes.drift = append(changes.drift, fmt.Sprintf("changed %s, found %s", rule, state.FirewallRule))
+			changes.remove = append(changes.remove, rule.Name)
+		default:
+			continue
+		}
+		changes.create = append(changes.create, rule)
+	}
+	var stale []string
+	for name := range current {
+		if !wanted[name] {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		changes.drift = append(changes.drift, "unexpected "+current[name].String())
+		changes.remove = append(changes.remove, name)
+	}
+	return changes
+}
+
+// parseFirewallRules parses the output of firewallRulesCmd
+func parseFirewallRules(out string) (map[string]firewallRuleState, error) {
+	rules := make(map[string]firewallRuleState)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, errors.Errorf("unexpected firewall rule description %q", strings.TrimSpace(line))
+		}
+		rules[fields[0]] = firewallRuleState{
+			FirewallRule: FirewallRule{Name: fields[0], Protocol: fields[1], LocalPorts: fields[2]},
+			enabled:      fields[3] == "True",
+			inboundAllow: fields[4] == "Inbound" && fields[5] == "Allow",
+		}
+	}
+	return rules, nil
+}
+
+// ConfigureFirewall validates the given rules, then deletes the rules of the operator group which were changed or are
+// no longer needed, and creates the missing ones
+func (vm *windows) ConfigureFirewall(ctx context.Context, rules []FirewallRule) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	changes, err := vm.firewallChanges(ctx, rules)
+	if err != nil {
+		return err
+	}
+	for _, name := range changes.remove {
+		cmd := "\"Remove-NetFirewallRule -Name '" + name + "'\""
+		if _, err := vm.runWithTimeout(ctx, vm.timeouts.Command, cmd, true); err != nil {
+			return errors.Wrapf(err, "unable to delete firewall rule %s", name)
+		}
+	}
+	for _, rule := range changes.create {
+		cmd := "\"New-NetFirewallRule -Name '" + rule.Name + "' -DisplayName '" + rule.Name + "' -Group '" +
+			firewallRuleGroup + "' -Direction Inbound -Action Allow -Protocol " + rule.Protocol + " -LocalPort " +
+			rule.LocalPorts + " -EdgeTraversalPolicy Allow | Out-Null\""
+		if _, err := vm.runWithTimeout(ctx, vm.timeouts.Command, cmd, true); err != nil {
+			return errors.Wrapf(err, "unable to create firewall rule %s", rule)
+		}
+	}
+	if len(changes.drift) > 0 {
+		log.Info("configured firewall rules", "changes", changes.drift)
+	}
+	return nil
+}
+
+// FirewallDrift lists the firewall rules of the operator group on the VM and describes how they differ from the given
+// rules, without changing them
+func (vm *windows) FirewallDrift(ctx context.Context, rules []FirewallRule) ([]string, error) {
+	changes, err := vm.firewallChanges(ctx, rules)
+	if err != nil {
+		return nil, err
+	}
+	return changes.drift, nil
+}
+
+// firewallChanges returns the changes needed to bring the firewall rules of the operator group on the VM to the given
+// rules
+func (vm *windows) firewallChanges(ctx context.Context, rules []FirewallRule) (*firewallChanges, error) {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Command, firewallRulesCmd(), true)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list firewall rules")
+	}
+	current, err := parseFirewallRules(result.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	return diffFirewallRules(rules, current), nil
+}
+
+// firewallRulesCmd returns the PowerShell command printing the name, protocol, local ports, enabled state, direction
+// and action of each firewall rule of the operator group, one rule per line
+func firewallRulesCmd() string {
+	// Collect the rules first so that an empty group, which is reported as an error, does not fail the command
+	return "\"$rules = @(Get-NetFirewallRule -Group '" + firewallRuleGroup + "' -ErrorAction SilentlyContinue); " +
+		"foreach ($r in $rules) { $f = $r | Get-NetFirewallPortFilter; " +
+		"$r.Name + ' ' + $f.Protocol + ' ' + ($f.LocalPort -join ',') + ' ' + $r.Enabled + ' ' + $r.Direction + ' ' + " +
+		"$r.Action }\""
+}
@@ -0,0 +1,108 @@
+package windows
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows/simulator"
+)
+
+// TestNodeFirewallRules tests that the rules of a node cover the custom or default VXLAN port and the NodePort range
+func TestNodeFirewallRules(t *testing.T) {
+	rules := NodeFirewallRules(9182, "", "30000-32767")
+	assert.Equal(t, []FirewallRule{
+		{Name: "wmco-kubelet", Protocol: "TCP", LocalPorts: "10250"},
+		{Name: "wmco-windows-exporter", Protocol: "TCP", LocalPorts: "9182"},
+		{Name: "wmco-hybrid-overlay-vxlan", Protocol: "UDP", LocalPorts: "4789"},
+		{Name: "wmco-nodeport-tcp", Protocol: "TCP", LocalPorts: "30000-32767"},
+		{Name: "wmco-nodeport-udp", Protocol: "UDP", LocalPorts: "30000-32767"},
+	}, rules)
+
+	rules = NodeFirewallRules(9182, "9898", "")
+	require.Len(t, rules, 3)
+	assert.Equal(t, "9898", rules[2].LocalPorts)
+}
+
+// TestConfigureFirewall tests that the firewall rules owned by the operator are created, repaired and removed, and
+// that the rules of other groups are left alone
+func TestConfigureFirewall(t *testing.T) {
+	rules := NodeFirewallRules(9182, "", "30000-32767")
+	tests := []struct {
+		name string
+		// existing holds the rules set on the VM before it is configured
+		existing []simulator.FirewallRule
+		// expectedDrift is the number of differences found before the VM is configured
+		expectedDrift int
+	}{
+		{
+			name:          "no existing rules",
+			expectedDrift: len(rules),
+		},
+		{
+			name: "changed and stale rules",
+			existing: []simulator.FirewallRule{
+				{Name: "wmco-kubelet", Group: firewallRuleGroup, Protocol: "TCP", LocalPort: "10250",
+					Direction: "Inbound", Action: "Allow"},
+				{Name: "wmco-windows-exporter", Group: firewallRuleGroup, Protocol: "TCP", LocalPort: "9100",
+					Enabled: true, Direction: "Inbound", Action: "Allow"},
+				{Name: "wmco-old", Group: firewallRuleGroup, Protocol: "TCP", LocalPort: "8080", Enabled: true,
+					Direction: "Inbound", Action: "Allow"},
+				{Name: "wmco-hybrid-overlay-vxlan", Group: firewallRuleGroup, Protocol: "UDP", LocalPort: "4789",
+					Enabled: true, Direction: "Inbound", Action: "Block"},
+			},
+			// Both NodePort rules are missing
+			expectedDrift: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, sim, _ := newSimulatedVM(t)
+			ctx := context.Background()
+			other := simulator.FirewallRule{Name: "RemoteDesktop", Group: "Remote Desktop", Protocol: "TCP",
+				LocalPort: "3389", Enabled: true, Direction: "Inbound", Action: "Allow"}
+			sim.SetFirewallRule(other)
+			for _, rule := range tt.existing {
+				sim.SetFirewallRule(rule)
+			}
+
+			drift, err := vm.FirewallDrift(ctx, rules)
+			require.NoError(t, err)
+			assert.Len(t, drift, tt.expectedDrift)
+
+			require.NoError(t, vm.ConfigureFirewall(ctx, rules))
+			expected := []simulator.FirewallRule{other}
+			for _, rule := range rules {
+				expected = append(expected, simulator.FirewallRule{Name: rule.Name, Group: firewallRuleGroup,
+					Protocol: rule.Protocol, LocalPort: rule.LocalPorts, Enabled: true, Direction: "Inbound",
+					Action: "Allow"})
+			}
+			assert.ElementsMatch(t, expected, sim.FirewallRules())
+
+			// Configuring the firewall is idempotent
+			drift, err = vm.FirewallDrift(ctx, rules)
+			require.NoError(t, err)
+			assert.Empty(t, drift)
+			sim.ResetCommands()
+			require.NoError(t, vm.ConfigureFirewall(ctx, rules))
+			assert.Len(t, sim.Commands(), 1, "unchanged rules were modified")
+		})
+	}
+}
+
+// TestConfigureFirewallInvalidRule tests that invalid rules are rejected before any change is made on the VM
+func TestConfigureFirewallInvalidRule(t *testing.T) {
+	tests := []FirewallRule{
+		{Name: "wmco kubelet", Protocol: "TCP", LocalPorts: "10250"},
+		{Name: "wmco-kubelet", Protocol: "ICMP", LocalPorts: "10250"},
+		{Name: "wmco-kubelet", Protocol: "TCP", LocalPorts: "10250; Remove-Item C:\\"},
+	}
+	for _, rule := range tests {
+		vm, sim, _ := newSimulatedVM(t)
+		sim.ResetCommands()
+		assert.Error(t, vm.ConfigureFirewall(context.Background(), []FirewallRule{rule}), rule.String())
+		assert.Empty(t, sim.Commands())
+	}
+}
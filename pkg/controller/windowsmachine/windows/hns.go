@@ -0,0 +1,144 @@
+package windows
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+)
+
+// hnsNetwork is an HNS network, as listed by Get-HnsNetwork
+type hnsNetwork struct {
+	// ID is the GUID of the network
+	ID string `json:"ID"`
+	// Name is the name of the network
+	Name string `json:"Name"`
+	// Type is the type of the network, such as Overlay
+	Type string `json:"Type"`
+}
+
+// hnsEndpoint is an HNS endpoint, as listed by Get-HnsEndpoint
+type hnsEndpoint struct {
+	// ID is the GUID of the endpoint
+	ID string `json:"ID"`
+	// Name is the name of the endpoint
+	Name string `json:"Name"`
+	// VirtualNetworkName is the name of the network the endpoint belongs to
+	VirtualNetworkName string `json:"VirtualNetworkName"`
+	// IPAddress is the IP address of the endpoint
+	IPAddress string `json:"IPAddress"`
+	// MacAddress is the MAC address of the endpoint
+	MacAddress string `json:"MacAddress"`
+}
+
+// hnsEndpointFields are the fields of hnsEndpoint selected from the HNS endpoints
+const hnsEndpointFields = "ID, Name, VirtualNetworkName, IPAddress, MacAddress"
+
+// hnsQueryCmd returns the PowerShell command converting the HNS objects returned by the given pipeline, restricted to
+// the given fields, to a JSON array. The array is output even if the pipeline returns zero or one object.
+func hnsQueryCmd(pipeline, fields string) string {
+	return "ConvertTo-Json -Compress -InputObject @(" + pipeline + " | Select-Object " + fields + ")"
+}
+
+// parseHNSOutput parses the JSON array output by an HNS query into the given slice
+func parseHNSOutput(out string, objects interface{}) error {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		out = "[]"
+	}
+	return errors.Wrapf(json.Unmarshal([]byte(out), objects), "unable to parse HNS query output %q", out)
+}
+
+// vipEndpoints returns the HNS endpoints of the VM named after the VIP endpoint, on any network
+func (vm *windows) vipEndpoints(ctx context.Context) ([]hnsEndpoint, error) {
+	cmd := "\"" + hnsQueryCmd("Get-HnsEndpoint | where { $_.Name -eq '"+vipEndpointName+"' }", hnsEndpointFields) +
+		"\""
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Network, cmd, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing VIP endpoints")
+	}
+	var endpoints []hnsEndpoint
+	if err := parseHNSOutput(result.Stdout, &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// createVIPEndpoint creates the VIP endpoint on the OVN overlay network and attaches it to the host
+func (vm *windows) createVIPEndpoint(ctx context.Context) (*hnsEndpoint, error) {
+	cmd := "\"Import-Module -DisableNameChecking " + hnsPSModule + "; " +
+		"$net = (Get-HnsNetwork | where { $_.Name -eq '" + OVNKubeOverlayNetwork + "' }); " +
+		"$endpoint = New-HnsEndpoint -NetworkId $net.ID -Name " + vipEndpointName + "; " +
+		"Attach-HNSHostEndpoint -EndpointID $endpoint.ID -CompartmentID 1 | Out-Null; " +
+		hnsQueryCmd("$endpoint", hnsEndpointFields) + "\""
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Network, cmd, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating VIP endpoint")
+	}
+	var endpoints []hnsEndpoint
+	if err := parseHNSOutput(result.Stdout, &endpoints); err != nil {
+		return nil, err
+	}
+	if len(endpoints) != 1 {
+		return nil, errors.Errorf("expected the created VIP endpoint, got %d endpoints", len(endpoints))
+	}
+	return &endpoints[0], nil
+}
+
+// removeHNSEndpoints removes the given HNS endpoints
+func (vm *windows) removeHNSEndpoints(ctx context.Context, endpoints []hnsEndpoint) error {
+	ids := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		ids = append(ids, "$_.ID -eq '"+endpoint.ID+"'")
+	}
+	cmd := "\"Get-HnsEndpoint | where { " + strings.Join(ids, " -or ") + " } | Remove-HnsEndpoint\""
+	_, err := vm.runWithTimeout(ctx, vm.timeouts.Network, cmd, true)
+	return errors.Wrap(err, "error removing HNS endpoints")
+}
+
+func (vm *windows) EnsureSourceVIP(ctx context.Context, recordedVIP string) (string, error) {
+	endpoints, err := vm.vipEndpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Keep a single VIP endpoint on the OVN overlay network, preferring the one holding the recorded VIP. Previous
+	// versions created an endpoint each time kube-proxy was configured.
+	var current *hnsEndpoint
+	for i, endpoint := range endpoints {
+		if endpoint.VirtualNetworkName != OVNKubeOverlayNetwork || endpoint.IPAddress == "" {
+			continue
+		}
+		if current == nil || (endpoint.IPAddress == recordedVIP && current.IPAddress != recordedVIP) {
+			current = &endpoints[i]
+		}
+	}
+	var stale []hnsEndpoint
+	for _, endpoint := range endpoints {
+		if current == nil || endpoint.ID != current.ID {
+			stale = append(stale, endpoint)
+		}
+	}
+	if len(stale) > 0 {
+		log.Info("removing duplicate VIP endpoints", "endpoints", stale)
+		if err := vm.removeHNSEndpoints(ctx, stale); err != nil {
+			return "", err
+		}
+	}
+
+	if current == nil {
+		if current, err = vm.createVIPEndpoint(ctx); err != nil {
+			return "", err
+		}
+		log.Info("created VIP endpoint", "endpoint", current)
+	}
+	if current.IPAddress == "" {
+		return "", errors.Errorf("VIP endpoint %s has no IP address", current.ID)
+	}
+	if recordedVIP != "" && current.IPAddress != recordedVIP {
+		vm.recordEvent(core.EventTypeWarning, "SourceVIPChanged", "source VIP changed from %s to %s as the VIP "+
+			"endpoint was not found", recordedVIP, current.IPAddress)
+	}
+	return current.IPAddress, nil
+}
@@ -0,0 +1,95 @@
+package windows
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows/simulator"
+)
+
+// TestEnsureSourceVIP tests that a single VIP endpoint is kept on the OVN overlay network, reusing the existing one and
+// removing the duplicates created by earlier versions
+func TestEnsureSourceVIP(t *testing.T) {
+	vipEndpoint := func(id, network, ip string) simulator.Endpoint {
+		return simulator.Endpoint{ID: id, Name: vipEndpointName, VirtualNetworkName: network, IPAddress: ip}
+	}
+	tests := []struct {
+		name string
+		// endpoints are added to the simulator before the source VIP is ensured
+		endpoints   []simulator.Endpoint
+		recordedVIP string
+		expectedVIP string
+		// expectedID is the ID of the remaining endpoint, empty if it is created
+		expectedID     string
+		expectedEvents []string
+	}{
+		{
+			name:        "endpoint created",
+			expectedVIP: simulator.DefaultSourceVIP,
+		},
+		{
+			name:        "existing endpoint reused",
+			endpoints:   []simulator.Endpoint{vipEndpoint("a", OVNKubeOverlayNetwork, "10.132.1.5")},
+			recordedVIP: "10.132.1.5",
+			expectedVIP: "10.132.1.5",
+			expectedID:  "a",
+		},
+		{
+			name:        "existing endpoint reused without recorded VIP",
+			endpoints:   []simulator.Endpoint{vipEndpoint("a", OVNKubeOverlayNetwork, "10.132.1.5")},
+			expectedVIP: "10.132.1.5",
+			expectedID:  "a",
+		},
+		{
+			name: "duplicate endpoints removed",
+			endpoints: []simulator.Endpoint{
+				vipEndpoint("a", OVNKubeOverlayNetwork, "10.132.1.5"),
+				vipEndpoint("b", OVNKubeOverlayNetwork, "10.132.1.6"),
+				vipEndpoint("c", "OldOverlayNetwork", "10.132.1.7"),
+				vipEndpoint("d", OVNKubeOverlayNetwork, "10.132.1.8"),
+			},
+			recordedVIP: "10.132.1.6",
+			expectedVIP: "10.132.1.6",
+			expectedID:  "b",
+		},
+		{
+			name:           "recorded VIP lost",
+			endpoints:      []simulator.Endpoint{vipEndpoint("c", "OldOverlayNetwork", "10.132.1.5")},
+			recordedVIP:    "10.132.1.5",
+			expectedVIP:    simulator.DefaultSourceVIP,
+			expectedEvents: []string{"SourceVIPChanged"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, sim, recorder := newSimulatedVM(t)
+			ctx := context.Background()
+			require.NoError(t, vm.Configure(ctx, []byte(testIgnition)))
+			require.NoError(t, vm.ConfigureHybridOverlay(ctx, "node-1"))
+			recorder.reasons = nil
+			for _, endpoint := range tt.endpoints {
+				sim.AddEndpoint(endpoint)
+			}
+
+			sourceVIP, err := vm.EnsureSourceVIP(ctx, tt.recordedVIP)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedVIP, sourceVIP)
+			assert.Equal(t, tt.expectedEvents, recorder.reasons)
+			endpoints := sim.Endpoints()
+			require.Len(t, endpoints, 1)
+			if tt.expectedID != "" {
+				assert.Equal(t, tt.expectedID, endpoints[0].ID)
+			}
+
+			// Later runs reuse the endpoint, even if the VIP given to new endpoints changes
+			sim.SetSourceVIP("10.132.1.9")
+			sourceVIP, err = vm.EnsureSourceVIP(ctx, sourceVIP)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedVIP, sourceVIP)
+			assert.Equal(t, endpoints, sim.Endpoints())
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package windows
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHostKeyPrefix is prepended to the address of a jump host to form the ID its host key is recorded under in a
+// HostKeyStore, so that it does not conflict with the host keys of the VMs
+const jumpHostKeyPrefix = "jumphost."
+
+// JumpHost is an SSH server, such as an ssh-bastion, that the SSH connections to the Windows VMs are tunneled through
+// when the VMs cannot be reached directly from the operator
+type JumpHost struct {
+	// Address is the host name or IP address of the jump host, optionally followed by the SSH port
+	Address string
+	// User is the user to authenticate as on the jump host
+	User string
+	// Signer is used for authenticating against the jump host
+	Signer ssh.Signer
+	// HostKeyFingerprint is the SHA256 fingerprint of the host key of the jump host. If it is empty, the host key
+	// presented on first contact is recorded in the HostKeyStore, under JumpHostKeyID, and verified on every later
+	// connection.
+	HostKeyFingerprint string
+}
+
+// JumpHostError is returned when a Windows VM cannot be reached because the connection to one of the jump hosts
+// failed, as opposed to the VM itself being unreachable
+type JumpHostError struct {
+	// Address is the address of the jump host
+	Address string
+	// Err is the error returned while connecting to the jump host
+	Err error
+}
+
+func (e *JumpHostError) Error() string {
+	return fmt.Sprintf("unable to connect to jump host %s: %v", e.Address, e.Err)
+}
+
+// Unwrap returns the error returned while connecting to the jump host
+func (e *JumpHostError) Unwrap() error {
+	return e.Err
+}
+
+// JumpHostKeyID returns the ID under which the host key of the jump host at the given address is recorded in a
+// HostKeyStore
+func JumpHostKeyID(address string) string {
+	return jumpHostKeyPrefix + address
+}
+
+// address returns the address of the jump host, with the default SSH port if none was given
+func (j *JumpHost) address() string {
+	if _, _, err := net.SplitHostPort(j.Address); err == nil {
+		return j.Address
+	}
+	return net.JoinHostPort(j.Address, sshPort)
+}
+
+// dial connects to the jump host through the given jump host client, or directly if it is nil, and performs the SSH
+// handshake. The host key of the jump host is verified against its configured fingerprint, or against the one recorded
+// in the given store, which is recorded on first contact.
+func (j *JumpHost) dial(ctx context.Context, jump *ssh.Client, hostKeys HostKeyStore) (*ssh.Client, error) {
+	keyID := JumpHostKeyID(j.Address)
+	expected := j.HostKeyFingerprint
+	if expected == "" {
+		if hostKeys == nil {
+			return nil, errors.New("a host key store is required to verify the host key")
+		}
+		var err error
+		if expected, err = hostKeys.Get(keyID); err != nil {
+			return nil, errors.Wrap(err, "unable to get recorded host key")
+		}
+	}
+	verifier := &hostKeyVerifier{instanceID: keyID, ipAddress: j.Address, expected: expected}
+	config := &ssh.ClientConfig{
+		User: j.User,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(j.Signer),
+		},
+		HostKeyCallback: verifier.callback,
+	}
+	client, err := dialSSHVia(ctx, jump, j.address(), config)
+	if err != nil {
+		// The SSH handshake does not preserve the error returned by the host key callback
+		if verifier.mismatch != nil {
+			return nil, verifier.mismatch
+		}
+		return nil, err
+	}
+
+	// Trust on first use: record the host key now that we have successfully authenticated against the jump host
+	if expected == "" {
+		if err := hostKeys.Set(keyID, verifier.presented); err != nil {
+			closeSSHClient(client)
+			return nil, errors.Wrap(err, "unable to record host key")
+		}
+		log.Info("recorded jump host key", "address", j.Address, "fingerprint", verifier.presented)
+	}
+	return client, nil
+}
+
+// dialSSH connects to the SSH server at the given address, tunneling the connection through the given jump hosts in
+// order, and performs the SSH handshake. The host keys of the jump hosts without a configured fingerprint are pinned
+// in the given store. Errors returned while connecting to a jump host are reported as a *JumpHostError. The
+// connections to the jump hosts are closed once the returned client is closed.
+func dialSSH(ctx context.Context, jumpHosts []JumpHost, hostKeys HostKeyStore, addr string,
+	config *ssh.ClientConfig) (*ssh.Client, error) {
+	var jump *ssh.Client
+	for i := range jumpHosts {
+		client, err := jumpHosts[i].dial(ctx, jump, hostKeys)
+		if err != nil {
+			closeSSHClient(jump)
+			return nil, &JumpHostError{Address: jumpHosts[i].Address, Err: err}
+		}
+		jump = client
+	}
+
+	client, err := dialSSHVia(ctx, jump, addr, config)
+	if err != nil {
+		closeSSHClient(jump)
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialSSHVia connects to the SSH server at the given address through the given jump host client, or directly if it
+// is nil, and performs the SSH handshake. The attempt is aborted if the context is done before it completes. The jump
+// host client is closed once the returned client is closed.
+func dialSSHVia(ctx context.Context, jump *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := dialTCP(ctx, jump, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Close the connection to abort the handshake if the context is done before it completes
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), "SSH handshake aborted")
+		}
+		return nil, err
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	if jump != nil {
+		// Closing the client only closes the channel tunneled through the jump host
+		go func() {
+			client.Wait()
+			closeSSHClient(jump)
+		}()
+	}
+	return client, nil
+}
+
+// dialTCP opens a TCP connection to the given address through the given jump host client, or directly if it is nil.
+// The attempt is aborted if the context is done before it completes.
+func dialTCP(ctx context.Context, jump *ssh.Client, addr string) (net.Conn, error) {
+	if jump == nil {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	// The buffer allows the goroutine to return if the attempt is aborted
+	resultCh := make(chan dialResult, 1)
+	go func() {
+		conn, err := jump.Dial("tcp", addr)
+		resultCh <- dialResult{conn: conn, err: err}
+	}()
+	select {
+	case result := <-resultCh:
+		return result.conn, result.err
+	case <-ctx.Done():
+		// Closing the jump host client, which the caller does on error, unblocks the pending dial
+		go func() {
+			if result := <-resultCh; result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, errors.Wrapf(ctx.Err(), "connection to %s aborted", addr)
+	}
+}
+
+// closeSSHClient closes the given client, if any
+func closeSSHClient(client *ssh.Client) {
+	if client == nil {
+		return
+	}
+	if err := client.Close(); err != nil {
+		log.V(1).Info("error closing SSH client", "error", err)
+	}
+}
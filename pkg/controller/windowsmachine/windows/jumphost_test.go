@@ -0,0 +1,151 @@
+package windows
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestDialSSH tests that the SSH connection to a VM is tunneled through the jump hosts and that failures to connect to
+// a jump host are reported separately from failures to connect to the VM
+func TestDialSSH(t *testing.T) {
+	target := newFakeSSHServer(t, func(cmd string) (string, string, int) {
+		return "winhost\r\n", "", 0
+	})
+	firstJump := newFakeJumpHost(t)
+	secondJump := newFakeJumpHost(t)
+	signer := newTestSigner(t)
+
+	// Reserve an address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachable := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	jumpHost := func(s *fakeSSHServer, fingerprint string) JumpHost {
+		return JumpHost{Address: s.listener.Addr().String(), User: "core", Signer: signer,
+			HostKeyFingerprint: fingerprint}
+	}
+
+	tests := []struct {
+		name      string
+		jumpHosts []JumpHost
+		addr      string
+		// wantErr is true if an error is expected
+		wantErr bool
+		// jumpHostErr is the address of the jump host which is expected to fail, if any
+		jumpHostErr string
+		// hostKeys holds the recorded host keys
+		hostKeys memoryHostKeyStore
+		// hostKeyMismatch is true if a jump host is expected to present another host key than the recorded one
+		hostKeyMismatch bool
+	}{
+		{
+			name: "no jump hosts",
+			addr: target.listener.Addr().String(),
+		},
+		{
+			name:      "single jump host",
+			jumpHosts: []JumpHost{jumpHost(firstJump, ssh.FingerprintSHA256(firstJump.hostKey))},
+			addr:      target.listener.Addr().String(),
+		},
+		{
+			name:      "nested jump hosts",
+			jumpHosts: []JumpHost{jumpHost(firstJump, ""), jumpHost(secondJump, "")},
+			addr:      target.listener.Addr().String(),
+		},
+		{
+			name:        "jump host unreachable",
+			jumpHosts:   []JumpHost{jumpHost(firstJump, ""), {Address: unreachable, User: "core", Signer: signer}},
+			addr:        target.listener.Addr().String(),
+			wantErr:     true,
+			jumpHostErr: unreachable,
+		},
+		{
+			name:            "jump host key mismatch",
+			jumpHosts:       []JumpHost{jumpHost(firstJump, ssh.FingerprintSHA256(secondJump.hostKey))},
+			addr:            target.listener.Addr().String(),
+			wantErr:         true,
+			jumpHostErr:     firstJump.listener.Addr().String(),
+			hostKeyMismatch: true,
+		},
+		{
+			name:      "recorded jump host key",
+			jumpHosts: []JumpHost{jumpHost(firstJump, "")},
+			addr:      target.listener.Addr().String(),
+			hostKeys: memoryHostKeyStore{JumpHostKeyID(firstJump.listener.Addr().String()): ssh.FingerprintSHA256(
+				firstJump.hostKey)},
+		},
+		{
+			name:      "recorded jump host key mismatch",
+			jumpHosts: []JumpHost{jumpHost(firstJump, "")},
+			addr:      target.listener.Addr().String(),
+			hostKeys: memoryHostKeyStore{JumpHostKeyID(firstJump.listener.Addr().String()): ssh.FingerprintSHA256(
+				secondJump.hostKey)},
+			wantErr:         true,
+			jumpHostErr:     firstJump.listener.Addr().String(),
+			hostKeyMismatch: true,
+		},
+		{
+			name:      "VM unreachable from jump host",
+			jumpHosts: []JumpHost{jumpHost(firstJump, "")},
+			addr:      unreachable,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			hostKeys := tt.hostKeys
+			if hostKeys == nil {
+				hostKeys = memoryHostKeyStore{}
+			}
+			client, err := dialSSH(ctx, tt.jumpHosts, hostKeys, tt.addr, &ssh.ClientConfig{
+				User:            "Administrator",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+				HostKeyCallback: ssh.FixedHostKey(target.hostKey),
+			})
+			var jumpHostErr *JumpHostError
+			if tt.wantErr {
+				require.Error(t, err)
+				if tt.jumpHostErr == "" {
+					assert.False(t, errors.As(err, &jumpHostErr), "VM failure reported as jump host failure: %v", err)
+					return
+				}
+				require.True(t, errors.As(err, &jumpHostErr), "unexpected error %v", err)
+				assert.Equal(t, tt.jumpHostErr, jumpHostErr.Address)
+				var mismatch *HostKeyMismatchError
+				assert.Equal(t, tt.hostKeyMismatch, errors.As(err, &mismatch), "unexpected error %v", err)
+				return
+			}
+			require.NoError(t, err)
+			defer client.Close()
+			// The host keys of the jump hosts without a fingerprint are pinned on first contact
+			for _, jumpHost := range tt.jumpHosts {
+				if jumpHost.HostKeyFingerprint == "" {
+					assert.NotEmpty(t, hostKeys[JumpHostKeyID(jumpHost.Address)], "host key of %s was not recorded",
+						jumpHost.Address)
+				}
+			}
+
+			c := &sshConnectivity{instanceID: "i-0123", sshClient: client}
+			result, err := c.run(ctx, "hostname")
+			require.NoError(t, err)
+			assert.Equal(t, "winhost\r\n", result.Stdout)
+		})
+	}
+}
+
+// TestJumpHostAddress tests that the default SSH port is used for jump hosts given without a port
+func TestJumpHostAddress(t *testing.T) {
+	assert.Equal(t, "bastion.example.com:22", (&JumpHost{Address: "bastion.example.com"}).address())
+	assert.Equal(t, "bastion.example.com:2222", (&JumpHost{Address: "bastion.example.com:2222"}).address())
+	assert.Equal(t, "[fd00::1]:22", (&JumpHost{Address: "fd00::1"}).address())
+}
@@ -0,0 +1,297 @@
+package windows
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/payload"
+)
+
+const (
+	// kubeProxyConfigName is the name of the kube-proxy configuration file
+	kubeProxyConfigName = "kube-proxy-config.yaml"
+	// kubeProxyConfigPath is the location of the kube-proxy configuration file
+	kubeProxyConfigPath = k8sDir + kubeProxyConfigName
+	// winOverlayFeatureGate is the feature gate allowing kube-proxy to program the overlay network of the
+	// hybrid-overlay
+	winOverlayFeatureGate = "WinOverlay"
+	// winDSRFeatureGate is the feature gate allowing kube-proxy to use Direct Server Return
+	winDSRFeatureGate = "WinDSR"
+	// kubeProxyConfigChange is the name reported by KubeProxyDrift when the configuration file differs
+	kubeProxyConfigChange = "configuration file"
+)
+
+var (
+	// featureGateRegex matches the valid feature gate names
+	featureGateRegex = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	// kubeProxyFlagRegex matches the valid kube-proxy flag names, without the leading dashes
+	kubeProxyFlagRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	// reservedKubeProxyFlags holds the kube-proxy flags set by the operator, either on the command line or through the
+	// configuration file, which cannot be given as extra arguments
+	reservedKubeProxyFlags = map[string]bool{
+		"windows-service": true, "config": true, "v": true, "log-dir": true, "logtostderr": true,
+		"proxy-mode": true, "hostname-override": true, "kubeconfig": true, "cluster-cidr": true,
+		"network-name": true, "source-vip": true, "enable-dsr": true, "feature-gates": true,
+	}
+	// kubeProxyConfigFileFlags holds the kube-proxy flags bound to the fields of the KubeProxyConfiguration. kube-proxy
+	// ignores them when it is given a configuration file, so they cannot be given as extra arguments either.
+	kubeProxyConfigFileFlags = map[string]bool{
+		"bind-address": true, "bind-address-hard-fail": true, "healthz-bind-address": true, "healthz-port": true,
+		"metrics-bind-address": true, "metrics-port": true, "show-hidden-metrics-for-version": true,
+		"oom-score-adj": true, "profiling": true, "config-sync-period": true, "kube-api-burst": true,
+		"kube-api-content-type": true, "kube-api-qps": true, "masquerade-all": true, "detect-local-mode": true,
+		"nodeport-addresses": true, "proxy-port-range": true, "udp-timeout": true, "conntrack-max-per-core": true,
+		"conntrack-min": true, "conntrack-tcp-timeout-close-wait": true, "conntrack-tcp-timeout-established": true,
+		"iptables-masquerade-bit": true, "iptables-min-sync-period": true, "iptables-sync-period": true,
+		"ipvs-exclude-cidrs": true, "ipvs-min-sync-period": true, "ipvs-scheduler": true, "ipvs-strict-arp": true,
+		"ipvs-sync-period": true, "ipvs-tcp-timeout": true, "ipvs-tcpfin-timeout": true, "ipvs-udp-timeout": true,
+	}
+)
+
+// KubeProxyConfig configures the kube-proxy service run on the node
+type KubeProxyConfig struct {
+	// Verbosity is the log level of kube-proxy
+	Verbosity int
+	// EnableDSR enables Direct Server Return for the load balancers. It requires the WinDSR feature gate.
+	EnableDSR bool
+	// FeatureGates holds the kube-proxy feature gates. The WinOverlay feature gate is always enabled.
+	FeatureGates map[string]bool
+	// ExtraArgs holds additional kube-proxy flags, keyed by flag name without the leading dashes. The flags bound to the
+	// fields of the configuration file are rejected, as kube-proxy ignores them.
+	ExtraArgs map[string]string
+}
+
+// DefaultKubeProxyConfig returns the kube-proxy configuration applied to the nodes by default
+func DefaultKubeProxyConfig() KubeProxyConfig {
+	return KubeProxyConfig{
+		Verbosity:    4,
+		FeatureGates: map[string]bool{winOverlayFeatureGate: true},
+	}
+}
+
+// Validate returns an error if the configuration is not supported by the Windows kernelspace proxier. The extra
+// arguments cannot override the flags set by the operator, nor the fields of the generated KubeProxyConfiguration
+// which kube-proxy reads instead of its flags.
+func (c KubeProxyConfig) Validate() error {
+	if c.Verbosity < 0 || c.Verbosity > 10 {
+		return errors.Errorf("invalid kube-proxy verbosity %d", c.Verbosity)
+	}
+	for gate := range c.FeatureGates {
+		if !featureGateRegex.MatchString(gate) {
+			return errors.Errorf("invalid kube-proxy feature gate %q", gate)
+		}
+	}
+	if enabled, present := c.FeatureGates[winOverlayFeatureGate]; present && !enabled {
+		return errors.Errorf("the %s feature gate is required by the hybrid overlay network", winOverlayFeatureGate)
+	}
+	if c.EnableDSR && !c.FeatureGates[winDSRFeatureGate] {
+		return errors.Errorf("Direct Server Return requires the %s feature gate", winDSRFeatureGate)
+	}
+	for flag, value := range c.ExtraArgs {
+		if !kubeProxyFlagRegex.MatchString(flag) {
+			return errors.Errorf("invalid kube-proxy flag %q", flag)
+		}
+		if reservedKubeProxyFlags[flag] {
+			return errors.Errorf("kube-proxy flag %s is set by the operator", flag)
+		}
+		if kubeProxyConfigFileFlags[flag] {
+			return errors.Errorf("kube-proxy flag %s is ignored along with the configuration file", flag)
+		}
+		if strings.ContainsAny(value, " \t\r\n\"") {
+			return errors.Errorf("invalid value %q of kube-proxy flag %s", value, flag)
+		}
+	}
+	return nil
+}
+
+// args returns the arguments of the kube-proxy service
+func (c KubeProxyConfig) args() string {
+	args := fmt.Sprintf("--windows-service --config=%s --v=%d --log-dir=%s --logtostderr=false", kubeProxyConfigPath,
+		c.Verbosity, kubeProxyLogDir)
+	flags := make([]string, 0, len(c.ExtraArgs))
+	for flag := range c.ExtraArgs {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	for _, flag := range flags {
+		args += " --" + flag + "=" + c.ExtraArgs[flag]
+	}
+	return args
+}
+
+// kubeProxyConfiguration is the subset of the kubeproxy.config.k8s.io/v1alpha1 KubeProxyConfiguration used on the
+// Windows nodes
+type kubeProxyConfiguration struct {
+	// APIVersion is the version of the configuration schema
+	APIVersion string `json:"apiVersion"`
+	// Kind is the kind of the configuration
+	Kind string `json:"kind"`
+	// ClientConnection configures the connection to the API server
+	ClientConnection kubeProxyClientConnection `json:"clientConnection"`
+	// HostnameOverride is the name of the node
+	HostnameOverride string `json:"hostnameOverride"`
+	// ClusterCIDR is the CIDR of the pods of the cluster
+	ClusterCIDR string `json:"clusterCIDR"`
+	// Mode is the proxy mode, which is always kernelspace on Windows
+	Mode string `json:"mode"`
+	// FeatureGates holds the enabled and disabled feature gates
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// Winkernel configures the Windows kernelspace proxier
+	Winkernel kubeProxyWinkernel `json:"winkernel"`
+}
+
+// kubeProxyClientConnection configures the connection of kube-proxy to the API server
+type kubeProxyClientConnection struct {
+	// Kubeconfig is the path of the kubeconfig file
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+// kubeProxyWinkernel configures the Windows kernelspace proxier
+type kubeProxyWinkernel struct {
+	// NetworkName is the name of the HNS network the proxier programs
+	NetworkName string `json:"networkName"`
+	// SourceVip is the source VIP of the traffic to the service endpoints on other nodes
+	SourceVip string `json:"sourceVip"`
+	// EnableDSR enables Direct Server Return
+	EnableDSR bool `json:"enableDSR"`
+}
+
+// configuration returns the configuration file of kube-proxy on the given node
+func (c KubeProxyConfig) configuration(nodeName, clusterCIDR, sourceVIP string) *kubeProxyConfiguration {
+	featureGates := map[string]bool{winOverlayFeatureGate: true}
+	for gate, enabled := range c.FeatureGates {
+		featureGates[gate] = enabled
+	}
+	return &kubeProxyConfiguration{
+		APIVersion:       "kubeproxy.config.k8s.io/v1alpha1",
+		Kind:             "KubeProxyConfiguration",
+		ClientConnection: kubeProxyClientConnection{Kubeconfig: k8sDir + "kubeconfig"},
+		HostnameOverride: nodeName,
+		ClusterCIDR:      clusterCIDR,
+		Mode:             "kernelspace",
+		FeatureGates:     featureGates,
+		Winkernel: kubeProxyWinkernel{
+			NetworkName: OVNKubeOverlayNetwork,
+			SourceVip:   sourceVIP,
+			EnableDSR:   c.EnableDSR,
+		},
+	}
+}
+
+// kubeProxyService returns the kube-proxy service, which depends on the hybrid-overlay
+func (vm *windows) kubeProxyService() (*service, error) {
+	return newService(kubeProxyPath, kubeProxyServiceName, vm.kubeProxy.args(), vm.recovery,
+		hybridOverlayServiceName)
+}
+
+func (vm *windows) ConfigureKubeProxy(ctx context.Context, nodeName, hostSubnet, sourceVIP string) error {
+	if err := vm.kubeProxy.Validate(); err != nil {
+		return err
+	}
+	if sourceVIP == "" {
+		return errors.New("source VIP cannot be empty")
+	}
+
+	data, err := yaml.Marshal(vm.kubeProxy.configuration(nodeName, hostSubnet, sourceVIP))
+	if err != nil {
+		return errors.Wrap(err, "unable to generate kube-proxy configuration")
+	}
+	changed, err := vm.ensureFileContent(ctx, kubeProxyConfigName, data, k8sDir)
+	if err != nil {
+		return errors.Wrap(err, "unable to write kube-proxy configuration")
+	}
+
+	kubeProxyService, err := vm.kubeProxyService()
+	if err != nil {
+		return errors.Wrapf(err, "error creating %s service object", kubeProxyServiceName)
+	}
+	if changed {
+		// kube-proxy only reads its configuration file when it starts
+		status, err := vm.serviceState(ctx, kubeProxyServiceName)
+		if err != nil {
+			return errors.Wrapf(err, "error checking if %s Windows service exists", kubeProxyServiceName)
+		}
+		if status != nil && status.State != ServiceStopped {
+			if err := vm.stopService(ctx, kubeProxyService); err != nil {
+				return errors.Wrapf(err, "unable to restart %s Windows service", kubeProxyServiceName)
+			}
+			vm.recordEvent(core.EventTypeNormal, "ServiceReconfigured", "Windows service %s was restarted as its "+
+				"%s changed", kubeProxyServiceName, kubeProxyConfigChange)
+		}
+	}
+
+	if err := vm.ensureServiceIsRunning(ctx, kubeProxyService); err != nil {
+		return errors.Wrapf(err, "error ensuring %s Windows service has started running", kubeProxyServiceName)
+	}
+	log.Info("configured", "service", kubeProxyServiceName, "args", kubeProxyService.args, "config", string(data))
+	return nil
+}
+
+func (vm *windows) KubeProxyDrift(ctx context.Context, nodeName, hostSubnet, sourceVIP string) ([]string, error) {
+	var changes []string
+	exists, err := vm.FileExists(ctx, kubeProxyConfigPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error checking if %s exists", kubeProxyConfigPath)
+	}
+	if exists {
+		var buf bytes.Buffer
+		if err := vm.interact.fetch(ctx, kubeProxyConfigPath, &buf); err != nil {
+			return nil, errors.Wrapf(err, "unable to read %s", kubeProxyConfigPath)
+		}
+		current := &kubeProxyConfiguration{}
+		if err := yaml.Unmarshal(buf.Bytes(), current); err != nil {
+			log.Info("invalid kube-proxy configuration", "error", err)
+			current = nil
+		}
+		if current == nil || !reflect.DeepEqual(current, vm.kubeProxy.configuration(nodeName, hostSubnet, sourceVIP)) {
+			changes = append(changes, kubeProxyConfigChange)
+		}
+	} else {
+		changes = append(changes, kubeProxyConfigChange)
+	}
+
+	svc, err := vm.kubeProxyService()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating %s service object", kubeProxyServiceName)
+	}
+	status, err := vm.QueryService(ctx, kubeProxyServiceName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying %s Windows service", kubeProxyServiceName)
+	}
+	if status == nil {
+		return append(changes, "service"), nil
+	}
+	return append(changes, svc.drift(status)...), nil
+}
+
+// ensureFileContent ensures the file with the given name within the given remote directory holds the given data. It
+// returns true if the file was written.
+func (vm *windows) ensureFileContent(ctx context.Context, name string, data []byte, remoteDir string) (bool, error) {
+	// The file is transferred under its local name, so it is written to a temporary directory first
+	dir, err := ioutil.TempDir("", "wmco-")
+	if err != nil {
+		return false, errors.Wrap(err, "unable to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return false, errors.Wrapf(err, "unable to write %s", path)
+	}
+	file, err := payload.NewFileInfo(path)
+	if err != nil {
+		return false, err
+	}
+	return vm.ensureFile(ctx, file, remoteDir)
+}
@@ -0,0 +1,117 @@
+package windows
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKubeProxyConfigValidate tests that the kube-proxy configurations which are not supported by the Windows
+// kernelspace proxier, or cannot be part of the service command line, are rejected
+func TestKubeProxyConfigValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      KubeProxyConfig
+		expectedErr bool
+	}{
+		{
+			name:   "default",
+			config: DefaultKubeProxyConfig(),
+		},
+		{
+			name: "DSR with extra arguments",
+			config: KubeProxyConfig{Verbosity: 2, EnableDSR: true,
+				FeatureGates: map[string]bool{winDSRFeatureGate: true},
+				ExtraArgs:    map[string]string{"vmodule": "proxier=5"}},
+		},
+		{
+			name:        "invalid verbosity",
+			config:      KubeProxyConfig{Verbosity: 11},
+			expectedErr: true,
+		},
+		{
+			name:        "DSR without its feature gate",
+			config:      KubeProxyConfig{Verbosity: 4, EnableDSR: true},
+			expectedErr: true,
+		},
+		{
+			name:        "overlay disabled",
+			config:      KubeProxyConfig{Verbosity: 4, FeatureGates: map[string]bool{winOverlayFeatureGate: false}},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid feature gate",
+			config:      KubeProxyConfig{Verbosity: 4, FeatureGates: map[string]bool{"WinDSR=true,IPv6": true}},
+			expectedErr: true,
+		},
+		{
+			name:        "reserved extra argument",
+			config:      KubeProxyConfig{Verbosity: 4, ExtraArgs: map[string]string{"proxy-mode": "userspace"}},
+			expectedErr: true,
+		},
+		{
+			name:        "extra argument of a configuration file field",
+			config:      KubeProxyConfig{Verbosity: 4, ExtraArgs: map[string]string{"udp-timeout": "250ms"}},
+			expectedErr: true,
+		},
+		{
+			name:        "extra argument value with a whitespace",
+			config:      KubeProxyConfig{Verbosity: 4, ExtraArgs: map[string]string{"vmodule": "proxier=5 --v=0"}},
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestKubeProxyDrift tests that the differences between the kube-proxy configuration on the node and the desired one
+// are reported, and that ConfigureKubeProxy removes them
+func TestKubeProxyDrift(t *testing.T) {
+	vm, sim, _ := newSimulatedVM(t)
+	ctx := context.Background()
+	require.NoError(t, vm.Configure(ctx, []byte(testIgnition)))
+	require.NoError(t, vm.ConfigureHybridOverlay(ctx, "node-1"))
+
+	sourceVIP, err := vm.EnsureSourceVIP(ctx, "")
+	require.NoError(t, err)
+
+	drift, err := vm.KubeProxyDrift(ctx, "node-1", "10.132.0.0/14", sourceVIP)
+	require.NoError(t, err)
+	assert.Equal(t, []string{kubeProxyConfigChange, "service"}, drift)
+
+	require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", sourceVIP))
+	drift, err = vm.KubeProxyDrift(ctx, "node-1", "10.132.0.0/14", sourceVIP)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+
+	drift, err = vm.KubeProxyDrift(ctx, "node-1", "10.132.0.0/14", "10.132.1.3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{kubeProxyConfigChange}, drift)
+
+	vm.kubeProxy = KubeProxyConfig{Verbosity: 2, EnableDSR: true, FeatureGates: map[string]bool{winDSRFeatureGate: true},
+		ExtraArgs: map[string]string{"vmodule": "proxier=5"}}
+	drift, err = vm.KubeProxyDrift(ctx, "node-1", "10.132.0.0/14", sourceVIP)
+	require.NoError(t, err)
+	assert.Equal(t, []string{kubeProxyConfigChange, "binary path"}, drift)
+
+	require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", sourceVIP))
+	svc := assertServiceRunning(t, sim, kubeProxyServiceName)
+	assert.Contains(t, svc.BinaryPath, " --v=2 ")
+	assert.Contains(t, svc.BinaryPath, " --vmodule=proxier=5")
+	config := readKubeProxyConfig(t, sim)
+	assert.True(t, config.Winkernel.EnableDSR)
+	assert.Equal(t, map[string]bool{winOverlayFeatureGate: true, winDSRFeatureGate: true}, config.FeatureGates)
+	drift, err = vm.KubeProxyDrift(ctx, "node-1", "10.132.0.0/14", sourceVIP)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+}
@@ -0,0 +1,268 @@
+package windows
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM negotiate flags, as defined in section 2.2.2.5 of [MS-NLMP]
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	// ntlmFlags are the flags requested by the client
+	ntlmFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign |
+		ntlmNegotiateExtendedSessionSecurity | ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+	// ntlmAvEOL and ntlmAvTimestamp are the AV_PAIR IDs, found in the challenge target info, that we care about
+	ntlmAvEOL       = 0x0000
+	ntlmAvTimestamp = 0x0007
+
+	// ntlmAuthScheme is the HTTP authentication scheme used to carry the NTLM messages
+	ntlmAuthScheme = "Negotiate"
+)
+
+// ntlmSignature is the signature that prefixes every NTLM message
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmTransport is an http.RoundTripper that authenticates requests using NTLMv2. NTLM authenticates a connection
+// rather than a request, so the handshake is only performed when the server rejects a request.
+type ntlmTransport struct {
+	// transport is the underlying transport. It must reuse the connection between the handshake requests.
+	transport http.RoundTripper
+	// domain is the domain of the user, empty for local accounts
+	domain string
+	// username is the user to authenticate as
+	username string
+	// password is the password of the user
+	password string
+}
+
+// newNTLMTransport returns an ntlmTransport for the given user. The user can be given in DOMAIN\user form.
+func newNTLMTransport(transport http.RoundTripper, username, password string) *ntlmTransport {
+	t := &ntlmTransport{transport: transport, username: username, password: password}
+	if i := strings.Index(username, "\\"); i >= 0 {
+		t.domain = username[:i]
+		t.username = username[i+1:]
+	}
+	return t
+}
+
+// RoundTrip executes the request, performing the NTLM handshake if the server requires authentication
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, errors.Wrap(err, "unable to read request body")
+		}
+		if err := req.Body.Close(); err != nil {
+			return nil, errors.Wrap(err, "unable to close request body")
+		}
+	}
+
+	// The connection may already be authenticated
+	resp, err := t.transport.RoundTrip(cloneRequest(req, body, ""))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	drainBody(resp)
+
+	resp, err = t.transport.RoundTrip(cloneRequest(req, body, ntlmAuthScheme+" "+
+		base64.StdEncoding.EncodeToString(ntlmNegotiateMessage())))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challengeHeader := resp.Header.Get("WWW-Authenticate")
+	drainBody(resp)
+	if !strings.HasPrefix(challengeHeader, ntlmAuthScheme+" ") {
+		return nil, errors.Errorf("unexpected NTLM challenge header %q", challengeHeader)
+	}
+	challengeMessage, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(challengeHeader, ntlmAuthScheme+" "))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode NTLM challenge")
+	}
+	challenge, err := parseNTLMChallenge(challengeMessage)
+	if err != nil {
+		return nil, err
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, errors.Wrap(err, "unable to generate NTLM client challenge")
+	}
+	authenticateMessage := ntlmAuthenticateMessage(challenge, t.domain, t.username, t.password, clientChallenge,
+		time.Now())
+	return t.transport.RoundTrip(cloneRequest(req, body, ntlmAuthScheme+" "+
+		base64.StdEncoding.EncodeToString(authenticateMessage)))
+}
+
+// cloneRequest returns a copy of the request with the given body and, if not empty, Authorization header
+func cloneRequest(req *http.Request, body []byte, authorization string) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+	clone.ContentLength = int64(len(body))
+	if authorization != "" {
+		clone.Header.Set("Authorization", authorization)
+	}
+	return clone
+}
+
+// drainBody reads and closes the response body so that the connection can be reused for the next handshake request
+func drainBody(resp *http.Response) {
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		log.V(1).Info("error draining response body", "error", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.V(1).Info("error closing response body", "error", err)
+	}
+}
+
+// ntlmChallenge holds the fields of the NTLM CHALLENGE_MESSAGE needed to compute the response
+type ntlmChallenge struct {
+	// flags are the negotiated flags
+	flags uint32
+	// serverChallenge is the 8 byte nonce generated by the server
+	serverChallenge []byte
+	// targetInfo is the AV_PAIR list sent by the server
+	targetInfo []byte
+}
+
+// ntlmNegotiateMessage returns an NTLM NEGOTIATE_MESSAGE without domain or workstation information
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmFlags)
+	return msg
+}
+
+// parseNTLMChallenge parses an NTLM CHALLENGE_MESSAGE
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 48 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge message")
+	}
+	targetInfoLen := uint32(binary.LittleEndian.Uint16(msg[40:]))
+	targetInfoOffset := binary.LittleEndian.Uint32(msg[44:])
+	if targetInfoOffset+targetInfoLen > uint32(len(msg)) {
+		return nil, errors.New("invalid NTLM challenge target info")
+	}
+	return &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(msg[20:]),
+		serverChallenge: msg[24:32],
+		targetInfo:      msg[targetInfoOffset : targetInfoOffset+targetInfoLen],
+	}, nil
+}
+
+// ntlmAuthenticateMessage returns the NTLM AUTHENTICATE_MESSAGE carrying the NTLMv2 response to the given challenge
+func ntlmAuthenticateMessage(challenge *ntlmChallenge, domain, username, password string, clientChallenge []byte,
+	now time.Time) []byte {
+	// Use the server's timestamp if it is available, as required by section 3.1.5.1.2 of [MS-NLMP]
+	timestamp := ntlmAvPair(challenge.targetInfo, ntlmAvTimestamp)
+	if timestamp == nil {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, toFileTime(now))
+	}
+	ntResponse := ntlmV2Response(challenge, ntlmV2ResponseKey(domain, username, password), clientChallenge,
+		timestamp)
+	// The LMv2 response is not sent when a timestamp is available, which is always the case with NTLMv2
+	lmResponse := make([]byte, 24)
+
+	fields := [][]byte{lmResponse, ntResponse, toUTF16LE(domain), toUTF16LE(username), nil, nil}
+	// The header consists of the signature, message type, six security buffers and the negotiated flags
+	headerLen := 12 + 8*len(fields) + 4
+	msg := make([]byte, headerLen)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	offset := headerLen
+	for i, field := range fields {
+		secBuf := msg[12+8*i:]
+		binary.LittleEndian.PutUint16(secBuf, uint16(len(field)))
+		binary.LittleEndian.PutUint16(secBuf[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(secBuf[4:], uint32(offset))
+		msg = append(msg, field...)
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[12+8*len(fields):], challenge.flags&ntlmFlags)
+	return msg
+}
+
+// ntlmV2Response computes the NTLMv2 response, as defined in section 3.3.2 of [MS-NLMP]
+func ntlmV2Response(challenge *ntlmChallenge, responseKey, clientChallenge, timestamp []byte) []byte {
+	temp := []byte{0x01, 0x01, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, challenge.targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	ntProof := hmacMD5(responseKey, append(append([]byte{}, challenge.serverChallenge...), temp...))
+	return append(ntProof, temp...)
+}
+
+// ntlmV2ResponseKey computes the NTOWFv2 response key for the given user
+func ntlmV2ResponseKey(domain, username, password string) []byte {
+	h := md4.New()
+	h.Write(toUTF16LE(password))
+	return hmacMD5(h.Sum(nil), toUTF16LE(strings.ToUpper(username)+domain))
+}
+
+// ntlmAvPair returns the value of the given AV_PAIR from the target info, or nil if it is not present
+func ntlmAvPair(targetInfo []byte, id uint16) []byte {
+	for len(targetInfo) >= 4 {
+		avID := binary.LittleEndian.Uint16(targetInfo)
+		avLen := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if avID == ntlmAvEOL || len(targetInfo) < 4+avLen {
+			return nil
+		}
+		if avID == id {
+			return targetInfo[4 : 4+avLen]
+		}
+		targetInfo = targetInfo[4+avLen:]
+	}
+	return nil
+}
+
+// hmacMD5 returns the HMAC-MD5 of the data using the given key
+func hmacMD5(key, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// toUTF16LE returns the UTF-16 little endian encoding of the string
+func toUTF16LE(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+// toFileTime converts the time to a Windows FILETIME, the number of 100ns intervals since January 1, 1601 UTC
+func toFileTime(t time.Time) uint64 {
+	// 116444736000000000 is the number of 100ns intervals between January 1, 1601 and January 1, 1970
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
@@ -0,0 +1,313 @@
+package windows
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// sshKeepAliveInterval is the interval at which keepalives are sent over the pooled connections
+	sshKeepAliveInterval = 30 * time.Second
+	// sshKeepAliveTimeout is the time to wait for the reply to a keepalive before the connection is considered dead
+	sshKeepAliveTimeout = 15 * time.Second
+	// sshIdleTimeout is the time after which a pooled connection that has not been used is closed
+	sshIdleTimeout = 30 * time.Minute
+	// sshKeepAliveRequest is the global request sent as a keepalive. The VM replies with a failure as it does not know
+	// the request, but any reply proves that the connection is alive.
+	sshKeepAliveRequest = "keepalive@openssh.com"
+)
+
+var (
+	// poolLog is the logger used by the SSHPool. The package logger cannot be used as it is replaced for every VM.
+	poolLog = logf.Log.WithName("ssh-pool")
+	// poolConnectionsDesc describes the metric holding the number of pooled SSH connections
+	poolConnectionsDesc = prometheus.NewDesc("windows_machine_config_operator_ssh_pool_connections",
+		"Number of SSH connections to Windows VMs held by the connection pool", nil, nil)
+	// poolIdleConnectionsDesc describes the metric holding the number of pooled SSH connections not in use
+	poolIdleConnectionsDesc = prometheus.NewDesc("windows_machine_config_operator_ssh_pool_idle_connections",
+		"Number of pooled SSH connections to Windows VMs with no command or file transfer in progress", nil, nil)
+	// poolReconnectsDesc describes the metric holding the number of times a pooled SSH connection was replaced
+	poolReconnectsDesc = prometheus.NewDesc("windows_machine_config_operator_ssh_pool_reconnects_total",
+		"Number of times a pooled SSH connection to a Windows VM was dropped and had to be dialed again", nil, nil)
+)
+
+// SSHPool holds healthy SSH connections to the Windows VMs, keyed by instance ID, so that repeated reconciles of a VM
+// do not have to dial and authenticate every time. Keepalives are sent over the pooled connections, and connections
+// that are dead, idle for too long or no longer match the address, users or signer of the VM are dropped. SSHPool
+// implements prometheus.Collector to expose the pool size, idle connections and reconnects as metrics.
+type SSHPool struct {
+	// mu protects the fields below
+	mu sync.Mutex
+	// conns holds the pooled connections keyed by instance ID
+	conns map[string]*pooledConn
+	// dropped holds the instance IDs whose connections were dropped and not yet dialed again
+	dropped map[string]bool
+	// reconnects is the number of connections dialed to replace a dropped connection
+	reconnects uint64
+	// keepAliveInterval is the interval at which keepalives are sent
+	keepAliveInterval time.Duration
+	// keepAliveTimeout is the time to wait for the reply to a keepalive
+	keepAliveTimeout time.Duration
+	// idleTimeout is the time after which an unused connection is closed
+	idleTimeout time.Duration
+}
+
+// pooledConn is an SSH connection held by the SSHPool
+type pooledConn struct {
+	// address is the IP address the connection was dialed to, prefixed with the jump hosts it is tunneled through
+	address string
+	// users are the users the connection is authenticated as, on the jump hosts it is tunneled through and the VM
+	users string
+	// signerFingerprint is the fingerprint of the public key used to authenticate the connection
+	signerFingerprint string
+	// client is the SSH connection
+	client *ssh.Client
+	// sftp is the SFTP subsystem opened over the connection, nil if no file was transferred yet
+	sftp *sftp.Client
+	// active is the number of commands and file transfers in progress over the connection
+	active int
+	// lastUsed is the time at which the connection was last used
+	lastUsed time.Time
+	// done is closed when the connection is removed from the pool to stop the keepalive loop
+	done chan struct{}
+}
+
+// NewSSHPool returns an empty SSHPool
+func NewSSHPool() *SSHPool {
+	return &SSHPool{
+		conns:             make(map[string]*pooledConn),
+		dropped:           make(map[string]bool),
+		keepAliveInterval: sshKeepAliveInterval,
+		keepAliveTimeout:  sshKeepAliveTimeout,
+		idleTimeout:       sshIdleTimeout,
+	}
+}
+
+// get returns the pooled connection to the given VM if it is alive and was dialed to the given address as the given
+// users with the given signer. The address is the IP address of the VM, prefixed with the jump hosts the connection is
+// tunneled through if any, and the users are listed in the same order. A connection that does not meet these
+// conditions is dropped and nil is returned.
+func (p *SSHPool) get(instanceID, address, users string, signer ssh.Signer) *ssh.Client {
+	p.mu.Lock()
+	conn, ok := p.conns[instanceID]
+	if !ok {
+		p.mu.Unlock()
+		return nil
+	}
+	if conn.address != address || conn.users != users ||
+		conn.signerFingerprint != ssh.FingerprintSHA256(signer.PublicKey()) {
+		poolLog.V(1).Info("dropping pooled SSH connection as the VM address, users or signer changed", "ID",
+			instanceID)
+		p.removeLocked(instanceID, true)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	// Check that the connection is alive outside of the lock, as this can take up to keepAliveTimeout
+	if err := p.keepAlive(conn.client); err != nil {
+		poolLog.V(1).Info("dropping dead pooled SSH connection", "ID", instanceID, "error", err)
+		p.drop(instanceID, conn.client)
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.lastUsed = time.Now()
+	return conn.client
+}
+
+// add adds the connection to the given VM to the pool, replacing any existing connection, and starts sending
+// keepalives over it
+func (p *SSHPool) add(instanceID, address, users string, signer ssh.Signer, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[instanceID]; ok {
+		p.removeLocked(instanceID, true)
+	}
+	if p.dropped[instanceID] {
+		p.reconnects++
+		delete(p.dropped, instanceID)
+	}
+	conn := &pooledConn{
+		address:           address,
+		users:             users,
+		signerFingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		client:            client,
+		lastUsed:          time.Now(),
+		done:              make(chan struct{}),
+	}
+	p.conns[instanceID] = conn
+	go p.keepAliveLoop(instanceID, conn)
+}
+
+// Remove closes and removes the connection to the given VM from the pool. It is not counted as a reconnect if the VM
+// is dialed again.
+func (p *SSHPool) Remove(instanceID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[instanceID]; ok {
+		p.removeLocked(instanceID, false)
+	}
+}
+
+// drop closes and removes the given connection to the VM from the pool, if it is still pooled. It is used when the
+// connection turns out to be unusable.
+func (p *SSHPool) drop(instanceID string, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, ok := p.conns[instanceID]; ok && conn.client == client {
+		p.removeLocked(instanceID, true)
+	}
+}
+
+// removeLocked closes and removes the pooled connection to the given VM, which must exist. If failed is true, the
+// next connection added for the VM is counted as a reconnect. p.mu must be held.
+func (p *SSHPool) removeLocked(instanceID string, failed bool) {
+	conn := p.conns[instanceID]
+	delete(p.conns, instanceID)
+	if failed {
+		p.dropped[instanceID] = true
+	}
+	close(conn.done)
+	if conn.sftp != nil {
+		if err := conn.sftp.Close(); err != nil {
+			poolLog.V(1).Info("error closing pooled SFTP client", "ID", instanceID, "error", err)
+		}
+	}
+	if err := conn.client.Close(); err != nil {
+		poolLog.V(1).Info("error closing pooled SSH connection", "ID", instanceID, "error", err)
+	}
+}
+
+// acquire marks the pooled connection as in use, returning the function that must be called once the connection is
+// no longer in use
+func (p *SSHPool) acquire(instanceID string, client *ssh.Client) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, ok := p.conns[instanceID]
+	if !ok || conn.client != client {
+		return func() {}
+	}
+	conn.active++
+	conn.lastUsed = time.Now()
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		conn.active--
+		conn.lastUsed = time.Now()
+	}
+}
+
+// sftpClient returns the SFTP subsystem opened over the pooled connection, opening it if needed
+func (p *SSHPool) sftpClient(instanceID string, client *ssh.Client) (*sftp.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, ok := p.conns[instanceID]
+	if ok && conn.client == client && conn.sftp != nil {
+		return conn.sftp, nil
+	}
+	ftp, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, err
+	}
+	if ok && conn.client == client {
+		conn.sftp = ftp
+	}
+	return ftp, nil
+}
+
+// resetSFTP closes the SFTP subsystem opened over the pooled connection, so that a new one is opened by the next
+// transfer. It is used when a transfer fails, as the subsystem may be in a bad state.
+func (p *SSHPool) resetSFTP(instanceID string, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, ok := p.conns[instanceID]
+	if !ok || conn.client != client || conn.sftp == nil {
+		return
+	}
+	if err := conn.sftp.Close(); err != nil {
+		poolLog.V(1).Info("error closing pooled SFTP client", "ID", instanceID, "error", err)
+	}
+	conn.sftp = nil
+}
+
+// keepAliveLoop periodically sends keepalives over the pooled connection, dropping it if it is dead or has been idle
+// for longer than the idle timeout. It returns once the connection is removed from the pool.
+func (p *SSHPool) keepAliveLoop(instanceID string, conn *pooledConn) {
+	ticker := time.NewTicker(p.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		idle := conn.active == 0 && time.Since(conn.lastUsed) > p.idleTimeout
+		p.mu.Unlock()
+		if idle {
+			poolLog.V(1).Info("closing idle pooled SSH connection", "ID", instanceID)
+			p.mu.Lock()
+			if p.conns[instanceID] == conn {
+				p.removeLocked(instanceID, false)
+			}
+			p.mu.Unlock()
+			return
+		}
+		if err := p.keepAlive(conn.client); err != nil {
+			poolLog.V(1).Info("dropping dead pooled SSH connection", "ID", instanceID, "error", err)
+			p.drop(instanceID, conn.client)
+			return
+		}
+	}
+}
+
+// keepAlive sends a keepalive over the connection, returning an error if no reply is received in time
+func (p *SSHPool) keepAlive(client *ssh.Client) error {
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(sshKeepAliveRequest, true, nil)
+		errCh <- err
+	}()
+	timer := time.NewTimer(p.keepAliveTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		// Closing the connection unblocks the pending request
+		if err := client.Close(); err != nil {
+			poolLog.V(1).Info("error closing unresponsive SSH connection", "error", err)
+		}
+		return errors.New("timed out waiting for keepalive reply")
+	}
+}
+
+// Describe implements prometheus.Collector
+func (p *SSHPool) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnectionsDesc
+	ch <- poolIdleConnectionsDesc
+	ch <- poolReconnectsDesc
+}
+
+// Collect implements prometheus.Collector
+func (p *SSHPool) Collect(ch chan<- prometheus.Metric) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle := 0
+	for _, conn := range p.conns {
+		if conn.active == 0 {
+			idle++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(len(p.conns)))
+	ch <- prometheus.MustNewConstMetric(poolIdleConnectionsDesc, prometheus.GaugeValue, float64(idle))
+	ch <- prometheus.MustNewConstMetric(poolReconnectsDesc, prometheus.CounterValue, float64(p.reconnects))
+}
@@ -0,0 +1,288 @@
+package windows
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHServer is an SSH server which accepts any client key and replies to global requests, which is enough to
+// exercise the SSHPool. Commands are run by the handler, if one is given.
+type fakeSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	// hostKey is the public host key of the server
+	hostKey ssh.PublicKey
+	// handler returns the stdout, stderr and exit code of the given command. Sessions are rejected if it is nil.
+	handler func(cmd string) (string, string, int)
+	// forward is true if the server forwards TCP connections, as a jump host does
+	forward bool
+
+	mu sync.Mutex
+	// conns holds the accepted connections
+	conns []net.Conn
+}
+
+// newFakeSSHServer starts a fakeSSHServer listening on the loopback interface
+func newFakeSSHServer(t *testing.T, handler func(cmd string) (string, string, int)) *fakeSSHServer {
+	return startFakeSSHServer(t, handler, false)
+}
+
+// newFakeJumpHost starts a fakeSSHServer which forwards TCP connections, listening on the loopback interface
+func newFakeJumpHost(t *testing.T) *fakeSSHServer {
+	return startFakeSSHServer(t, nil, true)
+}
+
+// startFakeSSHServer starts a fakeSSHServer listening on the loopback interface
+func startFakeSSHServer(t *testing.T, handler func(cmd string) (string, string, int), forward bool) *fakeSSHServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) { return nil, nil },
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeSSHServer{listener: listener, config: config, hostKey: hostSigner.PublicKey(), handler: handler,
+		forward: forward}
+	t.Cleanup(func() {
+		listener.Close()
+		s.closeConnections()
+	})
+	go s.serve()
+	return s
+}
+
+// serve accepts connections until the listener is closed
+func (s *fakeSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			go func() {
+				for newChan := range chans {
+					if s.forward && newChan.ChannelType() == "direct-tcpip" {
+						go s.serveForward(newChan)
+						continue
+					}
+					if s.handler == nil || newChan.ChannelType() != "session" {
+						newChan.Reject(ssh.Prohibited, "channels are not supported")
+						continue
+					}
+					go s.serveSession(newChan)
+				}
+			}()
+			// Reply to keepalives with a failure, as the Windows OpenSSH server does
+			for req := range reqs {
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// serveSession runs the command of an exec request with the handler, sending back its output and exit status
+func (s *fakeSSHServer) serveSession(newChan ssh.NewChannel) {
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		stdout, stderr, exitCode := s.handler(exec.Command)
+		channel.Write([]byte(stdout))
+		channel.Stderr().Write([]byte(stderr))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(exitCode)}))
+		return
+	}
+}
+
+// serveForward connects to the destination of a direct-tcpip channel and copies the data in both directions
+func (s *fakeSSHServer) serveForward(newChan ssh.NewChannel) {
+	var forward struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChan.ExtraData(), &forward); err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(forward.Host, strconv.Itoa(int(forward.Port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+	channel.Close()
+}
+
+// closeConnections closes all the accepted connections
+func (s *fakeSSHServer) closeConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// dial returns a new client connection to the server
+func (s *fakeSSHServer) dial(t *testing.T, signer ssh.Signer) *ssh.Client {
+	client, err := ssh.Dial("tcp", s.listener.Addr().String(), &ssh.ClientConfig{
+		User:            "Administrator",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	return client
+}
+
+// newTestSigner returns a newly generated SSH signer
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+// gatherPoolMetrics returns the values of the metrics exposed by the pool keyed by metric name
+func gatherPoolMetrics(t *testing.T, p *SSHPool) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(p))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		require.Len(t, family.GetMetric(), 1)
+		metric := family.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			values[family.GetName()] = metric.GetCounter().GetValue()
+		} else {
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+// TestSSHPoolGet tests that pooled connections are reused only while they match the IP address, users and signer of
+// the VM
+func TestSSHPoolGet(t *testing.T) {
+	s := newFakeSSHServer(t, nil)
+	signer := newTestSigner(t)
+	p := NewSSHPool()
+	defer p.Remove("i-0123")
+
+	assert.Nil(t, p.get("i-0123", "10.0.0.1", "Administrator", signer), "empty pool returned a connection")
+
+	client := s.dial(t, signer)
+	p.add("i-0123", "10.0.0.1", "Administrator", signer, client)
+	assert.Equal(t, client, p.get("i-0123", "10.0.0.1", "Administrator", signer))
+	assert.Equal(t, map[string]float64{
+		"windows_machine_config_operator_ssh_pool_connections":      1,
+		"windows_machine_config_operator_ssh_pool_idle_connections": 1,
+		"windows_machine_config_operator_ssh_pool_reconnects_total": 0,
+	}, gatherPoolMetrics(t, p))
+
+	release := p.acquire("i-0123", client)
+	assert.Equal(t, float64(0),
+		gatherPoolMetrics(t, p)["windows_machine_config_operator_ssh_pool_idle_connections"])
+	release()
+
+	assert.Nil(t, p.get("i-0123", "10.0.0.2", "Administrator", signer), "connection to the old IP address was reused")
+	assert.Nil(t, p.get("i-0123", "10.0.0.2", "Administrator", signer), "dropped connection is still pooled")
+	_, _, err := client.SendRequest(sshKeepAliveRequest, true, nil)
+	assert.Error(t, err, "dropped connection was not closed")
+
+	client = s.dial(t, signer)
+	p.add("i-0123", "10.0.0.2", "Administrator", signer, client)
+	assert.Nil(t, p.get("i-0123", "10.0.0.2", "capi", signer), "connection authenticated as the old user was reused")
+
+	client = s.dial(t, signer)
+	p.add("i-0123", "10.0.0.2", "core,Administrator", signer, client)
+	assert.Nil(t, p.get("i-0123", "10.0.0.2", "ec2-user,Administrator", signer),
+		"connection authenticated as the old jump host user was reused")
+
+	client = s.dial(t, signer)
+	p.add("i-0123", "10.0.0.2", "Administrator", signer, client)
+	assert.Nil(t, p.get("i-0123", "10.0.0.2", "Administrator", newTestSigner(t)),
+		"connection using the old signer was reused")
+	assert.Equal(t, map[string]float64{
+		"windows_machine_config_operator_ssh_pool_connections":      0,
+		"windows_machine_config_operator_ssh_pool_idle_connections": 0,
+		"windows_machine_config_operator_ssh_pool_reconnects_total": 3,
+	}, gatherPoolMetrics(t, p))
+}
+
+// TestSSHPoolKeepAlive tests that dead and idle connections are dropped from the pool
+func TestSSHPoolKeepAlive(t *testing.T) {
+	s := newFakeSSHServer(t, nil)
+	signer := newTestSigner(t)
+	p := NewSSHPool()
+	p.keepAliveInterval = 10 * time.Millisecond
+	p.keepAliveTimeout = time.Second
+
+	p.add("i-dead", "10.0.0.1", "Administrator", signer, s.dial(t, signer))
+	s.closeConnections()
+	assert.Eventually(t, func() bool {
+		return gatherPoolMetrics(t, p)["windows_machine_config_operator_ssh_pool_connections"] == 0
+	}, 5*time.Second, 10*time.Millisecond, "dead connection was not dropped")
+	assert.Nil(t, p.get("i-dead", "10.0.0.1", "Administrator", signer))
+
+	p.idleTimeout = 50 * time.Millisecond
+	p.add("i-idle", "10.0.0.2", "Administrator", signer, s.dial(t, signer))
+	assert.Eventually(t, func() bool {
+		return gatherPoolMetrics(t, p)["windows_machine_config_operator_ssh_pool_connections"] == 0
+	}, 5*time.Second, 10*time.Millisecond, "idle connection was not closed")
+	assert.Equal(t, float64(0),
+		gatherPoolMetrics(t, p)["windows_machine_config_operator_ssh_pool_reconnects_total"],
+		"closing an idle connection was counted as a failure")
+}
@@ -0,0 +1,195 @@
+package windows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// containersFeature is the Windows feature required to run containers
+	containersFeature = "Containers"
+	// dockerServiceName is the name of the Windows service of the container runtime
+	dockerServiceName = "docker"
+	// nicStatusUp is the status of a connected network adapter
+	nicStatusUp = "Up"
+	// gibibyte is the number of bytes in a GiB
+	gibibyte = 1 << 30
+)
+
+// platformFactsCmd collects the platform facts of the VM as a JSON document in a single PowerShell command
+const platformFactsCmd = "\"$os = Get-ItemProperty 'HKLM:\\SOFTWARE\\Microsoft\\Windows NT\\CurrentVersion'; " +
+	"$runtime = Get-Service -Name " + dockerServiceName + " -ErrorAction SilentlyContinue; " +
+	"ConvertTo-Json -Compress -Depth 3 -InputObject @{" +
+	"build = [int]$os.CurrentBuildNumber; ubr = [int]$os.UBR; " +
+	"features = @(Get-WindowsFeature | where { $_.Installed } | Select-Object -ExpandProperty Name); " +
+	"containerRuntimeStatus = $(if ($runtime) { [string]$runtime.Status } else { '' }); " +
+	"freeDiskBytes = [int64](Get-PSDrive -Name C).Free; " +
+	"memoryBytes = [int64](Get-CimInstance -ClassName Win32_ComputerSystem).TotalPhysicalMemory; " +
+	"powerShellVersion = $PSVersionTable.PSVersion.ToString(); " +
+	"nics = @(Get-NetAdapter | Select-Object Name, MacAddress, Status)}\""
+
+// PlatformFacts describes the Windows platform of a VM, as collected before it is configured
+type PlatformFacts struct {
+	// Build is the OS build number, such as 17763 for Windows Server 2019
+	Build int `json:"build"`
+	// UBR is the update build revision of the OS, increased by the cumulative updates
+	UBR int `json:"ubr"`
+	// Features holds the names of the installed Windows features
+	Features []string `json:"features"`
+	// ContainerRuntimeStatus is the status of the docker service, such as Running. It is empty if docker is not
+	// installed.
+	ContainerRuntimeStatus string `json:"containerRuntimeStatus"`
+	// FreeDiskBytes is the free space of the C: drive
+	FreeDiskBytes int64 `json:"freeDiskBytes"`
+	// MemoryBytes is the physical memory of the VM
+	MemoryBytes int64 `json:"memoryBytes"`
+	// PowerShellVersion is the version of PowerShell, such as 5.1.17763.1432
+	PowerShellVersion string `json:"powerShellVersion"`
+	// NICs holds the network adapters of the VM
+	NICs []NIC `json:"nics"`
+}
+
+// NIC is a network adapter of a VM
+type NIC struct {
+	// Name is the name of the adapter, such as Ethernet
+	Name string `json:"Name"`
+	// MacAddress is the MAC address of the adapter
+	MacAddress string `json:"MacAddress"`
+	// Status is the status of the adapter, Up if it is connected
+	Status string `json:"Status"`
+}
+
+// OSVersion returns the OS build number and update build revision, such as 17763.1457
+func (f *PlatformFacts) OSVersion() string {
+	return fmt.Sprintf("%d.%d", f.Build, f.UBR)
+}
+
+// PlatformRequirements describes the platforms supported by the operator
+type PlatformRequirements struct {
+	// MinUBRs holds the supported OS builds, mapped to the minimum update build revision required for each
+	MinUBRs map[int]int
+	// Features holds the names of the required Windows features
+	Features []string
+	// MinFreeDiskBytes is the minimum free space of the C: drive
+	MinFreeDiskBytes int64
+	// MinMemoryBytes is the minimum physical memory
+	MinMemoryBytes int64
+	// MinPowerShellMajor and MinPowerShellMinor form the minimum PowerShell version
+	MinPowerShellMajor, MinPowerShellMinor int
+}
+
+// SupportedPlatforms describes the platforms the Windows VMs are validated against before being configured
+var SupportedPlatforms = PlatformRequirements{
+	// Windows Server 2019 LTSC
+	MinUBRs:            map[int]int{17763: 1457},
+	Features:           []string{containersFeature},
+	MinFreeDiskBytes:   10 * gibibyte,
+	MinMemoryBytes:     4 * gibibyte,
+	MinPowerShellMajor: 5,
+	MinPowerShellMinor: 1,
+}
+
+// PreflightError is returned when a VM does not meet the platform requirements
+type PreflightError struct {
+	// Violations describes each requirement which is not met
+	Violations []string
+}
+
+func (e *PreflightError) Error() string {
+	return "unsupported Windows platform: " + strings.Join(e.Violations, "; ")
+}
+
+// Violations describes each of the requirements not met by the platform. It returns an empty list if the platform is
+// supported.
+func (r PlatformRequirements) Violations(facts *PlatformFacts) []string {
+	var violations []string
+	if minUBR, supported := r.MinUBRs[facts.Build]; !supported {
+		builds := make([]string, 0, len(r.MinUBRs))
+		for build := range r.MinUBRs {
+			builds = append(builds, strconv.Itoa(build))
+		}
+		sort.Strings(builds)
+		violations = append(violations, fmt.Sprintf("OS build %d is not supported, supported builds are %s",
+			facts.Build, strings.Join(builds, ", ")))
+	} else if facts.UBR < minUBR {
+		violations = append(violations, fmt.Sprintf("OS version %s is older than the minimum supported version "+
+			"%d.%d", facts.OSVersion(), facts.Build, minUBR))
+	}
+	installed := make(map[string]bool, len(facts.Features))
+	for _, feature := range facts.Features {
+		installed[strings.ToLower(feature)] = true
+	}
+	for _, feature := range r.Features {
+		if !installed[strings.ToLower(feature)] {
+			violations = append(violations, fmt.Sprintf("Windows feature %s is not installed", feature))
+		}
+	}
+	switch facts.ContainerRuntimeStatus {
+	case "Running":
+	case "":
+		violations = append(violations, fmt.Sprintf("container runtime service %s is not installed",
+			dockerServiceName))
+	default:
+		violations = append(violations, fmt.Sprintf("container runtime service %s is %s", dockerServiceName,
+			facts.ContainerRuntimeStatus))
+	}
+	if facts.FreeDiskBytes < r.MinFreeDiskBytes {
+		violations = append(violations, fmt.Sprintf("C: drive has %.1f GiB free, %.1f GiB required",
+			float64(facts.FreeDiskBytes)/gibibyte, float64(r.MinFreeDiskBytes)/gibibyte))
+	}
+	if facts.MemoryBytes < r.MinMemoryBytes {
+		violations = append(violations, fmt.Sprintf("VM has %.1f GiB of memory, %.1f GiB required",
+			float64(facts.MemoryBytes)/gibibyte, float64(r.MinMemoryBytes)/gibibyte))
+	}
+	if !r.supportedPowerShell(facts.PowerShellVersion) {
+		violations = append(violations, fmt.Sprintf("PowerShell version %s is older than %d.%d",
+			facts.PowerShellVersion, r.MinPowerShellMajor, r.MinPowerShellMinor))
+	}
+	up := false
+	for _, nic := range facts.NICs {
+		up = up || nic.Status == nicStatusUp
+	}
+	if !up {
+		violations = append(violations, "no network adapter is up")
+	}
+	return violations
+}
+
+// supportedPowerShell returns true if the given PowerShell version is at least the minimum version
+func (r PlatformRequirements) supportedPowerShell(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return major > r.MinPowerShellMajor || (major == r.MinPowerShellMajor && minor >= r.MinPowerShellMinor)
+}
+
+func (vm *windows) Preflight(ctx context.Context) (*PlatformFacts, error) {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Command, platformFactsCmd, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to collect platform facts")
+	}
+	facts := &PlatformFacts{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(result.Stdout)), facts); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse platform facts %q", result.Stdout)
+	}
+	log.V(1).Info("collected platform facts", "facts", facts)
+	if violations := SupportedPlatforms.Violations(facts); len(violations) > 0 {
+		return facts, &PreflightError{Violations: violations}
+	}
+	return facts, nil
+}
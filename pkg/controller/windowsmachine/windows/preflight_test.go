@@ -0,0 +1,108 @@
+package windows
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows/simulator"
+)
+
+// supportedFacts returns the facts of a supported platform
+func supportedFacts() *PlatformFacts {
+	return &PlatformFacts{
+		Build:                  17763,
+		UBR:                    1457,
+		Features:               []string{"containers"},
+		ContainerRuntimeStatus: "Running",
+		FreeDiskBytes:          20 * gibibyte,
+		MemoryBytes:            8 * gibibyte,
+		PowerShellVersion:      "5.1.17763.1432",
+		NICs:                   []NIC{{Name: "Ethernet 2", Status: "Disconnected"}, {Name: "Ethernet", Status: "Up"}},
+	}
+}
+
+// TestPlatformRequirementsViolations tests that every requirement which is not met by a platform is reported
+func TestPlatformRequirementsViolations(t *testing.T) {
+	tests := []struct {
+		name string
+		// update modifies the facts of a supported platform
+		update             func(*PlatformFacts)
+		expectedViolations []string
+	}{
+		{
+			name:   "supported",
+			update: func(*PlatformFacts) {},
+		},
+		{
+			name:   "newer PowerShell",
+			update: func(f *PlatformFacts) { f.PowerShellVersion = "7.0.3" },
+		},
+		{
+			name:               "unsupported build",
+			update:             func(f *PlatformFacts) { f.Build = 14393 },
+			expectedViolations: []string{"OS build 14393 is not supported, supported builds are 17763"},
+		},
+		{
+			name:               "outdated build",
+			update:             func(f *PlatformFacts) { f.UBR = 737 },
+			expectedViolations: []string{"OS version 17763.737 is older than the minimum supported version 17763.1457"},
+		},
+		{
+			name: "every requirement violated",
+			update: func(f *PlatformFacts) {
+				*f = PlatformFacts{Build: 17763, UBR: 1457, Features: []string{"FileAndStorage-Services"},
+					ContainerRuntimeStatus: "Stopped", FreeDiskBytes: gibibyte, MemoryBytes: 2 * gibibyte,
+					PowerShellVersion: "4.0", NICs: []NIC{{Name: "Ethernet", Status: "Disconnected"}}}
+			},
+			expectedViolations: []string{
+				"Windows feature Containers is not installed",
+				"container runtime service docker is Stopped",
+				"C: drive has 1.0 GiB free, 10.0 GiB required",
+				"VM has 2.0 GiB of memory, 4.0 GiB required",
+				"PowerShell version 4.0 is older than 5.1",
+				"no network adapter is up",
+			},
+		},
+		{
+			name:               "docker not installed",
+			update:             func(f *PlatformFacts) { f.ContainerRuntimeStatus = "" },
+			expectedViolations: []string{"container runtime service docker is not installed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facts := supportedFacts()
+			tt.update(facts)
+			assert.Equal(t, tt.expectedViolations, SupportedPlatforms.Violations(facts))
+		})
+	}
+}
+
+// TestPreflight tests that the platform facts are collected from the VM and that unsupported platforms are rejected
+// with every violation listed
+func TestPreflight(t *testing.T) {
+	vm, sim, _ := newSimulatedVM(t)
+	ctx := context.Background()
+	facts, err := vm.Preflight(ctx)
+	require.NoError(t, err)
+	platform := simulator.DefaultPlatform()
+	assert.Equal(t, "17763.1577", facts.OSVersion())
+	assert.Equal(t, platform.Features, facts.Features)
+	assert.Equal(t, platform.MemoryBytes, facts.MemoryBytes)
+	assert.Equal(t, []NIC{{Name: "Ethernet", MacAddress: "02-4C-6E-2B-1A-3F", Status: "Up"}}, facts.NICs)
+
+	platform.Features = nil
+	platform.ContainerRuntimeStatus = ""
+	sim.SetPlatform(platform)
+	facts, err = vm.Preflight(ctx)
+	require.Error(t, err)
+	require.NotNil(t, facts)
+	var preflightErr *PreflightError
+	require.True(t, errors.As(err, &preflightErr))
+	assert.Equal(t, []string{"Windows feature Containers is not installed",
+		"container runtime service docker is not installed"}, preflightErr.Violations)
+}
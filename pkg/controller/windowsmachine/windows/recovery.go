@@ -0,0 +1,126 @@
+package windows
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// failureActionRestart is the failure action which restarts the service
+	failureActionRestart = "RESTART"
+	// recoveryPolicyChange is the name reported by service.drift when the recovery policy of a service differs
+	recoveryPolicyChange = "recovery policy"
+)
+
+// failureActionRegex matches a failure action reported by `sc.exe qfailure`, such as
+// `RESTART -- Delay = 10000 milliseconds.`
+var failureActionRegex = regexp.MustCompile(`^(\w+) -- Delay = (\d+) milliseconds`)
+
+// RecoveryPolicy describes how the service control manager recovers a Windows service that stops unexpectedly
+type RecoveryPolicy struct {
+	// RestartDelay is the time to wait before restarting the service
+	RestartDelay time.Duration
+	// ResetPeriod is the time without failures after which the failure count is reset
+	ResetPeriod time.Duration
+	// Attempts is the number of times the service is restarted before the failure count is reset. The service is not
+	// restarted if it is zero.
+	Attempts int
+}
+
+// DefaultRecoveryPolicy returns the recovery policy applied to the node services by default
+func DefaultRecoveryPolicy() RecoveryPolicy {
+	return RecoveryPolicy{
+		RestartDelay: 10 * time.Second,
+		ResetPeriod:  10 * time.Minute,
+		Attempts:     3,
+	}
+}
+
+// failureActions returns the failure actions implementing the policy
+func (p RecoveryPolicy) failureActions() []FailureAction {
+	var actions []FailureAction
+	for i := 0; i < p.Attempts; i++ {
+		actions = append(actions, FailureAction{Type: failureActionRestart, Delay: p.RestartDelay})
+	}
+	return actions
+}
+
+// FailureAction is an action taken by the service control manager when a service fails
+type FailureAction struct {
+	// Type is the type of the action, such as RESTART or REBOOT
+	Type string
+	// Delay is the time to wait before taking the action
+	Delay time.Duration
+}
+
+// recoveryCmds returns the commands which apply the recovery policy to the given service. The failure actions are
+// also taken when the service stops with a non-zero exit code, and not only when it crashes.
+func (p RecoveryPolicy) recoveryCmds(serviceName string) []string {
+	var actions []string
+	for _, action := range p.failureActions() {
+		actions = append(actions, strings.ToLower(action.Type)+"/"+
+			strconv.FormatInt(action.Delay.Milliseconds(), 10))
+	}
+	return []string{
+		"sc.exe failure " + serviceName + " reset= " + strconv.Itoa(int(p.ResetPeriod.Seconds())) +
+			" actions= \"" + strings.Join(actions, "/") + "\"",
+		"sc.exe failureflag " + serviceName + " 1",
+	}
+}
+
+// matches returns true if the recovery configuration of the service described by the given status implements the
+// policy
+func (p RecoveryPolicy) matches(status *ServiceStatus) bool {
+	actions := p.failureActions()
+	if len(actions) == 0 {
+		// The reset period and flag have no effect without failure actions
+		return len(status.FailureActions) == 0
+	}
+	if len(status.FailureActions) != len(actions) || !status.FailureActionsOnNonCrashFailures ||
+		status.ResetPeriod != p.ResetPeriod.Truncate(time.Second) {
+		return false
+	}
+	for i, action := range actions {
+		if status.FailureActions[i] != action {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRecoveryConfig sets the recovery configuration of the service from the output of `sc.exe qfailure` and
+// `sc.exe qfailureflag`
+func parseRecoveryConfig(status *ServiceStatus, failureOut, flagOut string) error {
+	failure := parseSCOutput(failureOut)
+	if resetPeriod, ok := failure["RESET_PERIOD (in seconds)"]; ok && resetPeriod[0] != "" {
+		seconds, err := strconv.Atoi(resetPeriod[0])
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse reset period of service %s", status.Name)
+		}
+		status.ResetPeriod = time.Duration(seconds) * time.Second
+	}
+	for _, value := range failure["FAILURE_ACTIONS"] {
+		if value == "" {
+			continue
+		}
+		match := failureActionRegex.FindStringSubmatch(value)
+		if match == nil {
+			return errors.Errorf("unable to parse failure action %q of service %s", value, status.Name)
+		}
+		delay, err := strconv.Atoi(match[2])
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse delay of failure action %q of service %s", value,
+				status.Name)
+		}
+		status.FailureActions = append(status.FailureActions,
+			FailureAction{Type: match[1], Delay: time.Duration(delay) * time.Millisecond})
+	}
+	if flag, ok := parseSCOutput(flagOut)["FAILURE_ACTIONS_ON_NONCRASH_FAILURES"]; ok {
+		status.FailureActionsOnNonCrashFailures = flag[0] == "TRUE"
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package windows
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseRecoveryConfig tests that the output of sc.exe qfailure and qfailureflag is parsed into the service status
+func TestParseRecoveryConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		failureOut  string
+		flagOut     string
+		expected    *ServiceStatus
+		expectedErr bool
+	}{
+		{
+			name: "restart actions",
+			failureOut: "[SC] QueryServiceConfig2 SUCCESS\r\n\r\nSERVICE_NAME: kube-proxy\r\n" +
+				"        RESET_PERIOD (in seconds)    : 600\r\n" +
+				"        REBOOT_MESSAGE               : \r\n" +
+				"        COMMAND_LINE                 : \r\n" +
+				"        FAILURE_ACTIONS              : RESTART -- Delay = 10000 milliseconds.\r\n" +
+				"                                       RESTART -- Delay = 20000 milliseconds.\r\n",
+			flagOut: "[SC] QueryServiceConfig2 SUCCESS\r\n\r\nSERVICE_NAME: kube-proxy\r\n" +
+				"        FAILURE_ACTIONS_ON_NONCRASH_FAILURES: TRUE\r\n",
+			expected: &ServiceStatus{
+				Name:        "kube-proxy",
+				ResetPeriod: 10 * time.Minute,
+				FailureActions: []FailureAction{
+					{Type: failureActionRestart, Delay: 10 * time.Second},
+					{Type: failureActionRestart, Delay: 20 * time.Second},
+				},
+				FailureActionsOnNonCrashFailures: true,
+			},
+		},
+		{
+			name: "no failure actions",
+			failureOut: "[SC] QueryServiceConfig2 SUCCESS\r\n\r\nSERVICE_NAME: kube-proxy\r\n" +
+				"        RESET_PERIOD (in seconds)    : 0\r\n" +
+				"        REBOOT_MESSAGE               : \r\n" +
+				"        COMMAND_LINE                 : \r\n",
+			flagOut: "[SC] QueryServiceConfig2 SUCCESS\r\n\r\nSERVICE_NAME: kube-proxy\r\n" +
+				"        FAILURE_ACTIONS_ON_NONCRASH_FAILURES: FALSE\r\n",
+			expected: &ServiceStatus{Name: "kube-proxy"},
+		},
+		{
+			name: "invalid failure action",
+			failureOut: "SERVICE_NAME: kube-proxy\r\n" +
+				"        FAILURE_ACTIONS              : RESTART after a while\r\n",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &ServiceStatus{Name: "kube-proxy"}
+			err := parseRecoveryConfig(status, tt.failureOut, tt.flagOut)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, status)
+		})
+	}
+}
+
+// TestRecoveryPolicyCmds tests the commands applying a recovery policy
+func TestRecoveryPolicyCmds(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RecoveryPolicy
+		expected []string
+	}{
+		{
+			name:   "default policy",
+			policy: DefaultRecoveryPolicy(),
+			expected: []string{
+				"sc.exe failure kubelet reset= 600 actions= \"restart/10000/restart/10000/restart/10000\"",
+				"sc.exe failureflag kubelet 1",
+			},
+		},
+		{
+			name:   "no restarts",
+			policy: RecoveryPolicy{ResetPeriod: time.Hour},
+			expected: []string{
+				"sc.exe failure kubelet reset= 3600 actions= \"\"",
+				"sc.exe failureflag kubelet 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.policy.recoveryCmds("kubelet"))
+		})
+	}
+}
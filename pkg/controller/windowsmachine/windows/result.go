@@ -0,0 +1,67 @@
+package windows
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CommandResult holds the outcome of a command run on a Windows VM
+type CommandResult struct {
+	// Stdout is the standard output of the command
+	Stdout string
+	// Stderr is the standard error of the command
+	Stderr string
+	// ExitCode is the exit code of the command. For Windows commands such as sc.exe, this is the Win32 error code.
+	ExitCode int
+	// Duration is the time taken by the command, as measured by the operator
+	Duration time.Duration
+}
+
+// Output returns the combined stdout and stderr of the command
+func (r *CommandResult) Output() string {
+	if r == nil {
+		return ""
+	}
+	return r.Stdout + r.Stderr
+}
+
+// ExitError is returned when a command run on a Windows VM completes with a non-zero exit code
+type ExitError struct {
+	// Code is the exit code of the command
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.Code)
+}
+
+// isExitCode returns true if the error was caused by a command exiting with one of the given codes
+func isExitCode(err error, codes ...int) bool {
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, code := range codes {
+		if exitErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// newCommandResult returns the result of a command that started at the given time, along with an *ExitError if the
+// command exited with a non-zero exit code
+func newCommandResult(stdout, stderr string, exitCode int, start time.Time) (*CommandResult, error) {
+	result := &CommandResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		ExitCode: exitCode,
+		Duration: time.Since(start),
+	}
+	if exitCode != 0 {
+		return result, &ExitError{Code: exitCode}
+	}
+	return result, nil
+}
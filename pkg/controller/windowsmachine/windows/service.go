@@ -1,6 +1,97 @@
 package windows
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServiceState is the current state of a Windows service, as reported by the service control manager
+type ServiceState string
+
+const (
+	// ServiceStopped is the state of a service that is not running
+	ServiceStopped ServiceState = "STOPPED"
+	// ServiceStartPending is the state of a service that is starting
+	ServiceStartPending ServiceState = "START_PENDING"
+	// ServiceStopPending is the state of a service that is stopping
+	ServiceStopPending ServiceState = "STOP_PENDING"
+	// ServiceRunning is the state of a service that is running
+	ServiceRunning ServiceState = "RUNNING"
+	// ServiceContinuePending is the state of a service that is resuming from the paused state
+	ServiceContinuePending ServiceState = "CONTINUE_PENDING"
+	// ServicePausePending is the state of a service that is pausing
+	ServicePausePending ServiceState = "PAUSE_PENDING"
+	// ServicePaused is the state of a service that is paused
+	ServicePaused ServiceState = "PAUSED"
+
+	// errorServiceSpecificError is ERROR_SERVICE_SPECIFIC_ERROR, the Win32 exit code reported by a service which
+	// exited with a service specific exit code
+	errorServiceSpecificError = 1066
+	// serviceAutoStart is the start type of the services created by the operator
+	serviceAutoStart = "AUTO_START"
+)
+
+// ServiceStatus holds the state and configuration of a Windows service, as reported by sc.exe
+type ServiceStatus struct {
+	// Name is the name of the service
+	Name string
+	// State is the current state of the service
+	State ServiceState
+	// Win32ExitCode is the Win32 error code reported by the service when it last stopped
+	Win32ExitCode int
+	// ServiceExitCode is the service specific exit code, which is only meaningful if Win32ExitCode is
+	// ERROR_SERVICE_SPECIFIC_ERROR
+	ServiceExitCode int
+	// StartType is the start type of the service, such as AUTO_START or DEMAND_START
+	StartType string
+	// BinaryPath is the command line used to start the service
+	BinaryPath string
+	// Dependencies holds the names of the services the service depends on
+	Dependencies []string
+	// ResetPeriod is the time without failures after which the failure count of the service is reset
+	ResetPeriod time.Duration
+	// FailureActions holds the actions taken by the service control manager on successive failures of the service
+	FailureActions []FailureAction
+	// FailureActionsOnNonCrashFailures is true if the failure actions are also taken when the service stops with a
+	// non-zero exit code, and not only when it crashes
+	FailureActionsOnNonCrashFailures bool
+}
+
+// exitedWithError returns true if the service stopped with a non-zero exit code
+func (s *ServiceStatus) exitedWithError() bool {
+	return s.State == ServiceStopped && s.Win32ExitCode != 0
+}
+
+// exitReason returns a description of the exit code the service stopped with
+func (s *ServiceStatus) exitReason() string {
+	if s.Win32ExitCode == errorServiceSpecificError {
+		return fmt.Sprintf("exited with service specific exit code %d", s.ServiceExitCode)
+	}
+	return fmt.Sprintf("exited with Win32 exit code %d", s.Win32ExitCode)
+}
+
+// ServiceCrashLoopError is returned when a Windows service fails to reach the running state, either because it is
+// stuck starting or because it stopped with a non-zero exit code
+type ServiceCrashLoopError struct {
+	// Status is the status of the service at the time it was found crashing
+	Status ServiceStatus
+}
+
+// Reason returns a description of why the service is not running
+func (e *ServiceCrashLoopError) Reason() string {
+	if e.Status.State == ServiceStartPending {
+		return "is stuck in " + string(ServiceStartPending)
+	}
+	return e.Status.exitReason()
+}
+
+func (e *ServiceCrashLoopError) Error() string {
+	return fmt.Sprintf("%s Windows service %s", e.Status.Name, e.Reason())
+}
 
 // service struct contains the service information
 type service struct {
@@ -10,16 +101,163 @@ type service struct {
 	name string
 	// args is the arguments that the binary will be ran with
 	args string
+	// dependencies holds the names of the services that must be running before the service is started
+	dependencies []string
+	// recovery is the policy used to recover the service when it stops unexpectedly
+	recovery RecoveryPolicy
 }
 
 // newService initializes and returns a pointer to the service struct
-func newService(binaryPath, name, args string) (*service, error) {
+func newService(binaryPath, name, args string, recovery RecoveryPolicy, dependencies ...string) (*service, error) {
 	if binaryPath == "" || name == "" {
 		return nil, errors.Errorf("can't instantiate a service with incomplete service parameters")
 	}
 	return &service{
-		binaryPath: binaryPath,
-		name:       name,
-		args:       args,
+		binaryPath:   binaryPath,
+		name:         name,
+		args:         args,
+		dependencies: dependencies,
+		recovery:     recovery,
 	}, nil
 }
+
+// commandLine returns the command line used to start the service
+func (s *service) commandLine() string {
+	return strings.TrimSpace(s.binaryPath + " " + s.args)
+}
+
+// createCmd returns the command which creates the service
+func (s *service) createCmd() string {
+	cmd := "sc.exe create " + s.name + " binPath= \"" + s.commandLine() + "\" start= auto"
+	if len(s.dependencies) > 0 {
+		cmd += " depend= " + strings.Join(s.dependencies, "/")
+	}
+	return cmd
+}
+
+// configCmd returns the command which updates the configuration of an existing service to match the service
+func (s *service) configCmd() string {
+	// A single forward slash removes all the dependencies
+	dependencies := "/"
+	if len(s.dependencies) > 0 {
+		dependencies = strings.Join(s.dependencies, "/")
+	}
+	return "sc.exe config " + s.name + " binPath= \"" + s.commandLine() + "\" start= auto depend= " + dependencies
+}
+
+// drift returns the names of the settings of the existing service, as described by the given status, which differ
+// from the service. An empty slice is returned if the service is configured as desired.
+func (s *service) drift(status *ServiceStatus) []string {
+	var changes []string
+	if strings.Join(strings.Fields(status.BinaryPath), " ") != strings.Join(strings.Fields(s.commandLine()), " ") {
+		changes = append(changes, "binary path")
+	}
+	if !sameServiceNames(status.Dependencies, s.dependencies) {
+		changes = append(changes, "dependencies")
+	}
+	if status.StartType != serviceAutoStart {
+		changes = append(changes, "start type")
+	}
+	if !s.recovery.matches(status) {
+		changes = append(changes, recoveryPolicyChange)
+	}
+	return changes
+}
+
+// sameServiceNames returns true if both slices hold the same service names, ignoring order and case as Windows does
+func sameServiceNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	names := make(map[string]int)
+	for _, name := range a {
+		names[strings.ToLower(name)]++
+	}
+	for _, name := range b {
+		names[strings.ToLower(name)]--
+	}
+	for _, count := range names {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceQueryCmd returns the command querying the configuration of the given service
+func serviceQueryCmd(serviceName string) string {
+	return "sc.exe qc " + serviceName + " " + strconv.Itoa(serviceQueryBufferSize)
+}
+
+// parseServiceStatus returns the status of the given service from the output of `sc.exe queryex` and `sc.exe qc`
+func parseServiceStatus(name, queryOut, configOut string) (*ServiceStatus, error) {
+	status := &ServiceStatus{Name: name}
+	for key, values := range parseSCOutput(queryOut) {
+		fields := strings.Fields(values[0])
+		switch key {
+		case "STATE":
+			// STATE              : 4  RUNNING
+			if len(fields) < 2 {
+				return nil, errors.Errorf("unable to parse state of service %s: %q", name, values[0])
+			}
+			status.State = ServiceState(fields[1])
+		case "WIN32_EXIT_CODE", "SERVICE_EXIT_CODE":
+			// WIN32_EXIT_CODE    : 1066  (0x42a)
+			if len(fields) < 1 {
+				return nil, errors.Errorf("unable to parse %s of service %s", key, name)
+			}
+			code, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to parse %s of service %s", key, name)
+			}
+			if key == "WIN32_EXIT_CODE" {
+				status.Win32ExitCode = code
+			} else {
+				status.ServiceExitCode = code
+			}
+		}
+	}
+	if status.State == "" {
+		return nil, errors.Errorf("state of service %s not found in %q", name, queryOut)
+	}
+
+	config := parseSCOutput(configOut)
+	if fields := strings.Fields(strings.Join(config["START_TYPE"], " ")); len(fields) > 1 {
+		// START_TYPE         : 2   AUTO_START
+		status.StartType = fields[1]
+	}
+	if binaryPath, ok := config["BINARY_PATH_NAME"]; ok {
+		status.BinaryPath = binaryPath[0]
+	}
+	for _, dependency := range config["DEPENDENCIES"] {
+		if dependency != "" {
+			status.Dependencies = append(status.Dependencies, dependency)
+		}
+	}
+	return status, nil
+}
+
+// parseSCOutput returns the values of the `KEY : value` lines printed by sc.exe, keyed by KEY. Lines with an empty
+// key or without a key, which sc.exe uses for multi-valued fields such as DEPENDENCIES and FAILURE_ACTIONS, are
+// appended to the values of the previous key.
+func parseSCOutput(out string) map[string][]string {
+	values := make(map[string][]string)
+	key := ""
+	for _, line := range strings.Split(out, "\n") {
+		separator := strings.Index(line, ":")
+		if separator == -1 {
+			if value := strings.TrimSpace(line); key != "" && value != "" {
+				values[key] = append(values[key], value)
+			}
+			continue
+		}
+		if lineKey := strings.TrimSpace(line[:separator]); lineKey != "" {
+			key = lineKey
+		}
+		if key == "" {
+			continue
+		}
+		values[key] = append(values[key], strings.TrimSpace(line[separator+1:]))
+	}
+	return values
+}
@@ -0,0 +1,349 @@
+package windows
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// runningQueryOut is the output of `sc.exe queryex` for a running service
+	runningQueryOut = "\r\nSERVICE_NAME: kube-proxy \r\n" +
+		"        TYPE               : 10  WIN32_OWN_PROCESS  \r\n" +
+		"        STATE              : 4  RUNNING \r\n" +
+		"                                (STOPPABLE, NOT_PAUSABLE, ACCEPTS_SHUTDOWN)\r\n" +
+		"        WIN32_EXIT_CODE    : 0  (0x0)\r\n" +
+		"        SERVICE_EXIT_CODE  : 0  (0x0)\r\n" +
+		"        CHECKPOINT         : 0x0\r\n" +
+		"        WAIT_HINT          : 0x0\r\n" +
+		"        PID                : 4242\r\n" +
+		"        FLAGS              :\r\n"
+	// crashedQueryOut is the output of `sc.exe queryex` for a service which exited with a service specific exit code
+	crashedQueryOut = "\r\nSERVICE_NAME: kube-proxy \r\n" +
+		"        TYPE               : 10  WIN32_OWN_PROCESS  \r\n" +
+		"        STATE              : 1  STOPPED \r\n" +
+		"        WIN32_EXIT_CODE    : 1066  (0x42a)\r\n" +
+		"        SERVICE_EXIT_CODE  : 255  (0xff)\r\n" +
+		"        CHECKPOINT         : 0x0\r\n" +
+		"        WAIT_HINT          : 0x0\r\n" +
+		"        PID                : 0\r\n" +
+		"        FLAGS              :\r\n"
+	// configOut is the output of `sc.exe qc` for a service with two dependencies
+	configOut = "[SC] QueryServiceConfig SUCCESS\r\n\r\nSERVICE_NAME: kube-proxy\r\n" +
+		"        TYPE               : 10  WIN32_OWN_PROCESS \r\n" +
+		"        START_TYPE         : 2   AUTO_START\r\n" +
+		"        ERROR_CONTROL      : 1   NORMAL\r\n" +
+		"        BINARY_PATH_NAME   : C:\\k\\kube-proxy.exe --windows-service --v=4\r\n" +
+		"        LOAD_ORDER_GROUP   : \r\n" +
+		"        TAG                : 0\r\n" +
+		"        DISPLAY_NAME       : kube-proxy\r\n" +
+		"        DEPENDENCIES       : hybrid-overlay-node\r\n" +
+		"                           : kubelet\r\n" +
+		"        SERVICE_START_NAME : LocalSystem\r\n"
+)
+
+// fakeConnectivity is a connectivity backend which runs commands with the given handler
+type fakeConnectivity struct {
+	// handler returns the stdout, stderr and exit code of the given command
+	handler func(cmd string) (string, string, int)
+	// runErr, if set, is returned by run instead of running the command, emulating a connection failure
+	runErr error
+	// inits is the number of times init was called
+	inits int
+}
+
+func (f *fakeConnectivity) run(_ context.Context, cmd string) (*CommandResult, error) {
+	if f.runErr != nil {
+		return nil, f.runErr
+	}
+	stdout, stderr, exitCode := f.handler(cmd)
+	return &CommandResult{Stdout: stdout, Stderr: stderr, ExitCode: exitCode}, exitErrorOrNil(exitCode)
+}
+
+func (f *fakeConnectivity) transfer(context.Context, string, string) error {
+	return errors.New("transfer is not supported")
+}
+
+func (f *fakeConnectivity) fetch(context.Context, string, io.Writer) error {
+	return errors.New("fetch is not supported")
+}
+
+func (f *fakeConnectivity) init(context.Context) error {
+	f.inits++
+	return nil
+}
+
+// exitErrorOrNil returns an *ExitError for a non-zero exit code, and nil otherwise
+func exitErrorOrNil(exitCode int) error {
+	if exitCode == 0 {
+		return nil
+	}
+	return &ExitError{Code: exitCode}
+}
+
+// TestParseServiceStatus tests that the output of sc.exe is parsed into a ServiceStatus
+func TestParseServiceStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		queryOut    string
+		configOut   string
+		expected    *ServiceStatus
+		expectedErr bool
+	}{
+		{
+			name:      "running service with configuration",
+			queryOut:  runningQueryOut,
+			configOut: configOut,
+			expected: &ServiceStatus{
+				Name:         "kube-proxy",
+				State:        ServiceRunning,
+				StartType:    "AUTO_START",
+				BinaryPath:   "C:\\k\\kube-proxy.exe --windows-service --v=4",
+				Dependencies: []string{"hybrid-overlay-node", "kubelet"},
+			},
+		},
+		{
+			name:     "crashed service without configuration",
+			queryOut: crashedQueryOut,
+			expected: &ServiceStatus{
+				Name:            "kube-proxy",
+				State:           ServiceStopped,
+				Win32ExitCode:   errorServiceSpecificError,
+				ServiceExitCode: 255,
+			},
+		},
+		{
+			name:        "missing state",
+			queryOut:    "[SC] EnumQueryServicesStatus:OpenService FAILED 1060:\r\n",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseServiceStatus("kube-proxy", tt.queryOut, tt.configOut)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, status)
+		})
+	}
+}
+
+// TestWaitForServiceToRun tests that a service which stops with a non-zero exit code is reported as crashing
+func TestWaitForServiceToRun(t *testing.T) {
+	tests := []struct {
+		name          string
+		queryOut      string
+		expectedCrash string
+	}{
+		{
+			name:     "running",
+			queryOut: runningQueryOut,
+		},
+		{
+			name:          "crashed",
+			queryOut:      crashedQueryOut,
+			expectedCrash: "exited with service specific exit code 255",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &windows{
+				interact: &fakeConnectivity{handler: func(cmd string) (string, string, int) {
+					return tt.queryOut, "", 0
+				}},
+				timeouts: DefaultTimeouts(),
+			}
+			err := vm.waitForServiceToRun(context.Background(), "kube-proxy")
+			if tt.expectedCrash == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var crashLoopErr *ServiceCrashLoopError
+			require.True(t, errors.As(err, &crashLoopErr), "unexpected error %v", err)
+			assert.Equal(t, tt.expectedCrash, crashLoopErr.Reason())
+		})
+	}
+}
+
+// fakeServiceManager emulates the sc.exe commands used to manage a single Windows service
+type fakeServiceManager struct {
+	// status is the status of the service, nil if it does not exist
+	status *ServiceStatus
+	// commands holds the sc.exe commands which modified the service, in the order they were run
+	commands []string
+}
+
+// scConfigRegex matches the sc.exe create and config commands run by the service helpers
+var scConfigRegex = regexp.MustCompile(`^sc\.exe (create|config) (\S+) binPath= "([^"]*)" start= auto` +
+	`(?: depend= (\S+))?$`)
+
+// scFailureRegex matches the sc.exe failure command run by the service helpers
+var scFailureRegex = regexp.MustCompile(`^sc\.exe failure \S+ reset= (\d+) actions= "([^"]*)"$`)
+
+// run emulates the given sc.exe command
+func (f *fakeServiceManager) run(cmd string) (string, string, int) {
+	fields := strings.Fields(cmd)
+	if len(fields) < 3 || fields[0] != "sc.exe" {
+		return "", "unknown command", 1
+	}
+	if f.status == nil && fields[1] != "create" {
+		return "[SC] OpenService FAILED 1060", "", errorServiceDoesNotExist
+	}
+	switch fields[1] {
+	case "queryex":
+		return fmt.Sprintf("SERVICE_NAME: %s\r\n        STATE              : 4  %s\r\n"+
+			"        WIN32_EXIT_CODE    : %d  (0x0)\r\n", f.status.Name, f.status.State, f.status.Win32ExitCode), "", 0
+	case "qc":
+		out := fmt.Sprintf("SERVICE_NAME: %s\r\n        START_TYPE         : 2   %s\r\n"+
+			"        BINARY_PATH_NAME   : %s\r\n        DEPENDENCIES       : ", f.status.Name, f.status.StartType,
+			f.status.BinaryPath)
+		return out + strings.Join(f.status.Dependencies, "\r\n                           : ") + "\r\n", "", 0
+	case "qfailure":
+		out := fmt.Sprintf("SERVICE_NAME: %s\r\n        RESET_PERIOD (in seconds)    : %d\r\n", f.status.Name,
+			int(f.status.ResetPeriod.Seconds()))
+		for i, action := range f.status.FailureActions {
+			prefix := "                                       "
+			if i == 0 {
+				prefix = "        FAILURE_ACTIONS              : "
+			}
+			out += fmt.Sprintf("%s%s -- Delay = %d milliseconds.\r\n", prefix, action.Type,
+				action.Delay.Milliseconds())
+		}
+		return out, "", 0
+	case "qfailureflag":
+		return fmt.Sprintf("SERVICE_NAME: %s\r\n        FAILURE_ACTIONS_ON_NONCRASH_FAILURES: %s\r\n", f.status.Name,
+			strings.ToUpper(strconv.FormatBool(f.status.FailureActionsOnNonCrashFailures))), "", 0
+	case "failure":
+		match := scFailureRegex.FindStringSubmatch(cmd)
+		if match == nil {
+			return "", "invalid command", 1639
+		}
+		seconds, _ := strconv.Atoi(match[1])
+		f.status.ResetPeriod = time.Duration(seconds) * time.Second
+		f.status.FailureActions = nil
+		actions := strings.Split(match[2], "/")
+		for i := 0; i+1 < len(actions); i += 2 {
+			delay, _ := strconv.Atoi(actions[i+1])
+			f.status.FailureActions = append(f.status.FailureActions, FailureAction{
+				Type: strings.ToUpper(actions[i]), Delay: time.Duration(delay) * time.Millisecond})
+		}
+	case "failureflag":
+		f.status.FailureActionsOnNonCrashFailures = fields[3] == "1"
+	case "start":
+		f.status.State = ServiceRunning
+	case "stop":
+		f.status.State = ServiceStopped
+	case "create", "config":
+		match := scConfigRegex.FindStringSubmatch(cmd)
+		if match == nil {
+			return "", "invalid command", 1639
+		}
+		dependencies := []string{}
+		if match[4] != "" && match[4] != "/" {
+			dependencies = strings.Split(match[4], "/")
+		}
+		if f.status == nil {
+			f.status = &ServiceStatus{Name: match[2], State: ServiceStopped}
+		}
+		f.status.BinaryPath = match[3]
+		f.status.StartType = serviceAutoStart
+		f.status.Dependencies = dependencies
+	default:
+		return "", "unknown command", 1
+	}
+	f.commands = append(f.commands, fields[1])
+	return "", "", 0
+}
+
+// fakeRecorder is a Recorder which keeps the reasons of the recorded events
+type fakeRecorder struct {
+	// reasons holds the reasons of the recorded events
+	reasons []string
+}
+
+func (f *fakeRecorder) Eventf(_, reason, _ string, _ ...interface{}) {
+	f.reasons = append(f.reasons, reason)
+}
+
+// TestEnsureServiceIsRunning tests that services are created if missing and reconfigured if their definition drifted
+func TestEnsureServiceIsRunning(t *testing.T) {
+	recovery := DefaultRecoveryPolicy()
+	svc, err := newService("C:\\k\\kube-proxy.exe", "kube-proxy", "--windows-service --source-vip=10.0.0.2",
+		recovery, "hybrid-overlay-node")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		existing         *ServiceStatus
+		expectedCommands []string
+		expectedEvents   []string
+	}{
+		{
+			name:             "missing service",
+			existing:         nil,
+			expectedCommands: []string{"create", "failure", "failureflag", "start"},
+		},
+		{
+			name: "running service matching the definition",
+			existing: &ServiceStatus{Name: "kube-proxy", State: ServiceRunning, StartType: serviceAutoStart,
+				BinaryPath:   "C:\\k\\kube-proxy.exe  --windows-service --source-vip=10.0.0.2",
+				Dependencies: []string{"Hybrid-Overlay-Node"}, ResetPeriod: recovery.ResetPeriod,
+				FailureActions: recovery.failureActions(), FailureActionsOnNonCrashFailures: true},
+			expectedCommands: nil,
+		},
+		{
+			name: "running service with stale arguments",
+			existing: &ServiceStatus{Name: "kube-proxy", State: ServiceRunning, StartType: serviceAutoStart,
+				BinaryPath:   "C:\\k\\kube-proxy.exe --windows-service --source-vip=10.0.0.1",
+				Dependencies: []string{"hybrid-overlay-node"}, ResetPeriod: recovery.ResetPeriod,
+				FailureActions: recovery.failureActions(), FailureActionsOnNonCrashFailures: true},
+			expectedCommands: []string{"stop", "config", "failure", "failureflag", "start"},
+			expectedEvents:   []string{"ServiceReconfigured"},
+		},
+		{
+			name: "stopped service with stale dependencies and start type",
+			existing: &ServiceStatus{Name: "kube-proxy", State: ServiceStopped, StartType: "DEMAND_START",
+				BinaryPath:  "C:\\k\\kube-proxy.exe --windows-service --source-vip=10.0.0.2",
+				ResetPeriod: recovery.ResetPeriod, FailureActions: recovery.failureActions(),
+				FailureActionsOnNonCrashFailures: true},
+			expectedCommands: []string{"config", "failure", "failureflag", "start"},
+			expectedEvents:   []string{"ServiceReconfigured"},
+		},
+		{
+			name: "running service without recovery policy",
+			existing: &ServiceStatus{Name: "kube-proxy", State: ServiceRunning, StartType: serviceAutoStart,
+				BinaryPath:   "C:\\k\\kube-proxy.exe --windows-service --source-vip=10.0.0.2",
+				Dependencies: []string{"hybrid-overlay-node"}},
+			expectedCommands: []string{"failure", "failureflag"},
+			expectedEvents:   []string{"ServiceReconfigured"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scm := &fakeServiceManager{status: tt.existing}
+			recorder := &fakeRecorder{}
+			vm := &windows{
+				interact: &fakeConnectivity{handler: scm.run},
+				timeouts: DefaultTimeouts(),
+				recorder: recorder,
+			}
+			require.NoError(t, vm.ensureServiceIsRunning(context.Background(), svc))
+			assert.Equal(t, tt.expectedCommands, scm.commands)
+			assert.Equal(t, tt.expectedEvents, recorder.reasons)
+			assert.Equal(t, ServiceRunning, scm.status.State)
+			assert.Empty(t, svc.drift(scm.status), "service definition was not repaired")
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package simulator
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// powerShellPrefix is the prefix of the commands run in PowerShell by the operator
+	powerShellPrefix = "powershell.exe -NonInteractive -ExecutionPolicy Bypass "
+	// hybridOverlayServiceName is the name of the hybrid-overlay-node Windows service
+	hybridOverlayServiceName = "hybrid-overlay-node"
+	// kubeletServiceName is the name of the kubelet Windows service created by the bootstrapper
+	kubeletServiceName = "kubelet"
+	// baseOVNKubeOverlayNetwork is the name of base OVN HNS Overlay network created by the hybrid-overlay
+	baseOVNKubeOverlayNetwork = "BaseOVNKubernetesHybridOverlayNetwork"
+	// ovnKubeOverlayNetwork is the name of the OVN HNS Overlay network created by the hybrid-overlay
+	ovnKubeOverlayNetwork = "OVNKubernetesHybridOverlayNetwork"
+	// hnsModulePath is the location of the HNS PowerShell module imported by the source VIP script
+	hnsModulePath = "C:\\Temp\\hns.psm1"
+	// vipEndpointName is the name of the HNS endpoint created for the source VIP
+	vipEndpointName = "VIPEndpoint"
+)
+
+// run emulates the given command, returning its stdout, stderr and exit code
+func (s *Simulator) run(cmd string) (string, string, int) {
+	psCmd := strings.HasPrefix(cmd, powerShellPrefix)
+	if psCmd {
+		cmd = strings.Trim(strings.TrimPrefix(cmd, powerShellPrefix), "\"")
+	}
+	switch {
+	case strings.HasPrefix(cmd, "sc.exe "):
+		return s.runSC(cmd)
+	case strings.HasPrefix(cmd, "if not exist ") && !psCmd:
+		return s.mkdir(cmd)
+	case strings.HasPrefix(cmd, "Test-Path ") && psCmd:
+		if s.fs.exists(strings.Trim(strings.TrimPrefix(cmd, "Test-Path "), "\"")) {
+			return "True\r\n", "", 0
+		}
+		return "False\r\n", "", 0
+	case strings.HasPrefix(cmd, "$out = Get-FileHash ") && psCmd:
+		return s.fileHash(cmd)
+	case strings.HasPrefix(cmd, "if (Test-Path ") && strings.Contains(cmd, "Remove-Item") && psCmd:
+		s.fs.removeAll(strings.TrimSuffix(strings.Fields(cmd)[2], ")"))
+		return "", "", 0
+	case strings.Contains(cmd, "Get-NetFirewallRule -Group") && psCmd:
+		return s.listFirewallRules(cmd)
+	case strings.HasPrefix(cmd, "New-NetFirewallRule ") && psCmd:
+		return s.newFirewallRule(cmd)
+	case strings.HasPrefix(cmd, "Remove-NetFirewallRule ") && psCmd:
+		return s.removeFirewallRule(cmd)
+	case (strings.Contains(cmd, "Remove-HnsNetwork") || strings.Contains(cmd, "Remove-HnsEndpoint")) && psCmd:
+		return s.removeHNSObjects(cmd)
+	case strings.Contains(cmd, "New-HnsEndpoint") && psCmd:
+		return s.createVIPEndpoint()
+	case strings.HasPrefix(cmd, "Get-HnsNetwork | ConvertTo-Json") && psCmd,
+		strings.HasPrefix(cmd, "ConvertTo-Json -Compress -InputObject @(Get-HnsNetwork ") && psCmd:
+		return s.listNetworks()
+	case strings.HasPrefix(cmd, "Get-HnsEndpoint | ConvertTo-Json") && psCmd,
+		strings.HasPrefix(cmd, "ConvertTo-Json -Compress -InputObject @(Get-HnsEndpoint ") && psCmd:
+		return s.listEndpoints(cmd)
+	case strings.HasPrefix(cmd, "Get-ChildItem -Path ") && psCmd:
+		fields := strings.Fields(cmd)
+		return strings.Join(append(s.fs.listFiles(fields[2]), ""), "\r\n"), "", 0
+	case strings.HasPrefix(cmd, "Get-Item -Path ") && psCmd:
+		return s.getItem(strings.Fields(cmd)[2])
+	case strings.Contains(cmd, "$PSVersionTable") && psCmd:
+		return s.platformFacts()
+	case strings.Contains(cmd, "wmcb.exe initialize-kubelet") && psCmd:
+		return s.initializeKubelet(cmd)
+	case strings.Contains(cmd, "wmcb.exe configure-cni") && psCmd:
+		return s.configureCNI(cmd)
+	default:
+		return "", fmt.Sprintf("'%s' is not recognized as an internal or external command,\r\n"+
+			"operable program or batch file.\r\n", cmd), 1
+	}
+}
+
+// mkdir emulates the `if not exist <dir> mkdir <dir>` command
+func (s *Simulator) mkdir(cmd string) (string, string, int) {
+	fields := strings.Fields(cmd)
+	if len(fields) != 6 || fields[4] != "mkdir" || !strings.EqualFold(fields[3], fields[5]) {
+		return "", "The syntax of the command is incorrect.\r\n", 1
+	}
+	if err := s.fs.mkdirAll(fields[5]); err != nil {
+		return "", "A subdirectory or file " + fields[5] + " already exists.\r\n", 1
+	}
+	return "", "", 0
+}
+
+// fileHash emulates the `$out = Get-FileHash <path> -Algorithm SHA256; $out.Hash` command
+func (s *Simulator) fileHash(cmd string) (string, string, int) {
+	fields := strings.Fields(cmd)
+	if len(fields) < 4 {
+		return "", "Get-FileHash : Cannot bind argument to parameter 'Path'\r\n", 1
+	}
+	data, ok := s.fs.readFile(fields[3])
+	if !ok {
+		return "", fmt.Sprintf("Get-FileHash : Cannot find path '%s' because it does not exist.\r\n", fields[3]), 1
+	}
+	return fmt.Sprintf("%X\r\n", sha256.Sum256(data)), "", 0
+}
+
+// getItem emulates the `Get-Item -Path <path> | Select-Object FullName, Length, LastWriteTimeUtc | ConvertTo-Json`
+// command
+func (s *Simulator) getItem(p string) (string, string, int) {
+	data, ok := s.fs.readFile(p)
+	if !ok {
+		return "", fmt.Sprintf("Get-Item : Cannot find path '%s' because it does not exist.\r\n", p), 1
+	}
+	out, err := json.Marshal(map[string]interface{}{"FullName": p, "Length": len(data),
+		"LastWriteTimeUtc": time.Now().UTC()})
+	if err != nil {
+		return "", err.Error() + "\r\n", 1
+	}
+	return string(out) + "\r\n", "", 0
+}
+
+// initializeKubelet emulates the bootstrapper configuring the kubelet, which creates and starts the kubelet service
+func (s *Simulator) initializeKubelet(cmd string) (string, string, int) {
+	fields := strings.Fields(cmd)
+	if !s.fs.exists(fields[0]) {
+		return "", fmt.Sprintf("The term '%s' is not recognized as the name of a cmdlet, function, script file, or "+
+			"operable program.\r\n", fields[0]), 1
+	}
+	ignitionFile, kubeletPath := flagValue(fields, "--ignition-file"), flagValue(fields, "--kubelet-path")
+	for _, file := range []string{ignitionFile, kubeletPath} {
+		if file == "" || !s.fs.exists(file) {
+			return "", fmt.Sprintf("initialize-kubelet failed: could not find file %q\r\n", file), 1
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[kubeletServiceName]
+	if !ok {
+		svc = &Service{Name: kubeletServiceName, StartType: StartTypeAuto, State: StateStopped}
+		s.services[kubeletServiceName] = svc
+	}
+	svc.BinaryPath = kubeletPath + " --config=c:\\k\\kubelet.conf " +
+		"--bootstrap-kubeconfig=c:\\k\\bootstrap-kubeconfig --kubeconfig=c:\\k\\kubeconfig --windows-service"
+	svc.State = StateStopped
+	if code, message := s.startLocked(svc, map[string]bool{}); code != 0 {
+		return "", "initialize-kubelet failed: unable to start kubelet: " + message + "\r\n", 1
+	}
+	return "kubelet configuration complete\r\n", "", 0
+}
+
+// configureCNI emulates the bootstrapper configuring the kubelet for CNI
+func (s *Simulator) configureCNI(cmd string) (string, string, int) {
+	fields := strings.Fields(cmd)
+	if !s.fs.exists(fields[0]) {
+		return "", fmt.Sprintf("The term '%s' is not recognized as the name of a cmdlet, function, script file, or "+
+			"operable program.\r\n", fields[0]), 1
+	}
+	var configFile string
+	for _, field := range fields {
+		if strings.HasPrefix(field, "--cni-config=") {
+			configFile = strings.Trim(strings.TrimPrefix(field, "--cni-config="), "\"")
+		}
+	}
+	if configFile == "" || !s.fs.exists(configFile) {
+		return "", fmt.Sprintf("configure-cni failed: could not find CNI config %q\r\n", configFile), 1
+	}
+	return "CNI configuration complete\r\n", "", 0
+}
+
+// hasNetworkLocked returns true if the HNS network with the given name exists. s.mu must be held.
+func (s *Simulator) hasNetworkLocked(name string) bool {
+	for _, network := range s.networks {
+		if network == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addNetworkLocked creates the HNS network with the given name if it does not exist. s.mu must be held.
+func (s *Simulator) addNetworkLocked(name string) {
+	if !s.hasNetworkLocked(name) {
+		s.networks = append(s.networks, name)
+	}
+}
+
+// flagValue returns the value following the given flag in the fields of a command, or an empty string if the flag is
+// not given
+func flagValue(fields []string, flag string) string {
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == flag {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,296 @@
+package simulator
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// memFS is an in-memory Windows filesystem. Paths are case insensitive and both forward slashes and backslashes are
+// accepted as separators.
+type memFS struct {
+	// mu protects the fields below
+	mu sync.Mutex
+	// files holds the files and directories keyed by normalized path
+	files map[string]*memFile
+}
+
+// memFile is a file or directory held by memFS
+type memFile struct {
+	// name is the base name of the file, with its original case
+	name string
+	// dir is true for directories
+	dir bool
+	// data is the content of the file
+	data []byte
+	// modTime is the time the file was last modified
+	modTime time.Time
+}
+
+// newMemFS returns a memFS holding the root of the C: drive
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memFile{"c:": {name: "C:", dir: true, modTime: time.Now()}}}
+}
+
+// normalize returns the key of the given Windows or SFTP path, such as c:/k/kubelet.exe for C:\k\\kubelet.exe
+func normalize(p string) string {
+	p = strings.ReplaceAll(p, "\\", "/")
+	p = strings.ToLower(path.Clean("/" + p))
+	return strings.TrimPrefix(p, "/")
+}
+
+// baseName returns the base name of the given path, with its original case
+func baseName(p string) string {
+	return path.Base(path.Clean("/" + strings.ReplaceAll(p, "\\", "/")))
+}
+
+// parent returns the key of the parent directory of the given key, or an empty string for the root of a drive
+func parent(key string) string {
+	if i := strings.LastIndex(key, "/"); i != -1 {
+		return key[:i]
+	}
+	return ""
+}
+
+// readFile returns the content of the file at the given path, and false if it does not exist
+func (fs *memFS) readFile(p string) ([]byte, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[normalize(p)]
+	if !ok || f.dir {
+		return nil, false
+	}
+	return append([]byte(nil), f.data...), true
+}
+
+// exists returns true if a file or directory exists at the given path
+func (fs *memFS) exists(p string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, ok := fs.files[normalize(p)]
+	return ok
+}
+
+// writeFile creates or replaces the file at the given path, creating its directory if needed
+func (fs *memFS) writeFile(p string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := normalize(p)
+	fs.mkdirAllLocked(parent(key), path.Dir(strings.ReplaceAll(p, "\\", "/")))
+	fs.files[key] = &memFile{name: baseName(p), data: append([]byte(nil), data...), modTime: time.Now()}
+}
+
+// mkdirAll creates the directory at the given path along with its parents
+func (fs *memFS) mkdirAll(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f, ok := fs.files[normalize(p)]; ok && !f.dir {
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+	}
+	fs.mkdirAllLocked(normalize(p), strings.ReplaceAll(p, "\\", "/"))
+	return nil
+}
+
+// mkdirAllLocked creates the directory with the given key and original path along with its parents. fs.mu must be
+// held.
+func (fs *memFS) mkdirAllLocked(key, original string) {
+	if key == "" {
+		return
+	}
+	if _, ok := fs.files[key]; ok {
+		return
+	}
+	fs.mkdirAllLocked(parent(key), path.Dir(path.Clean("/"+original)))
+	fs.files[key] = &memFile{name: path.Base(path.Clean("/" + original)), dir: true, modTime: time.Now()}
+}
+
+// remove removes the file or empty directory at the given path
+func (fs *memFS) remove(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := normalize(p)
+	if _, ok := fs.files[key]; !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOENT}
+	}
+	for other := range fs.files {
+		if parent(other) == key {
+			return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(fs.files, key)
+	return nil
+}
+
+// removeAll removes the file or directory at the given path along with its contents, if it exists
+func (fs *memFS) removeAll(p string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := normalize(p)
+	for other := range fs.files {
+		if other == key || strings.HasPrefix(other, key+"/") {
+			delete(fs.files, other)
+		}
+	}
+}
+
+// listFiles returns the Windows paths, with their original case, of the files in the directory at the given path and
+// its subdirectories. Nothing is returned if the directory does not exist.
+func (fs *memFS) listFiles(dir string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	prefix := normalize(dir) + "/"
+	var paths []string
+	for key, f := range fs.files {
+		if !f.dir && strings.HasPrefix(key, prefix) {
+			paths = append(paths, fs.originalPathLocked(key))
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// originalPathLocked returns the Windows path, with its original case, of the file with the given key. fs.mu must be
+// held.
+func (fs *memFS) originalPathLocked(key string) string {
+	var names []string
+	for ; key != ""; key = parent(key) {
+		names = append([]string{fs.files[key].name}, names...)
+	}
+	return strings.Join(names, "\\")
+}
+
+// handlers returns the SFTP request handlers serving the filesystem
+func (fs *memFS) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+}
+
+// Fileread implements sftp.FileReader
+func (fs *memFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	data, ok := fs.readFile(r.Filepath)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.ENOENT}
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Filewrite implements sftp.FileWriter. The file is truncated, as done by the SFTP client when creating a file.
+func (fs *memFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := normalize(r.Filepath)
+	if dir, ok := fs.files[parent(key)]; !ok || !dir.dir {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.ENOENT}
+	}
+	f := &memFile{name: baseName(r.Filepath), modTime: time.Now()}
+	fs.files[key] = f
+	return &memFileWriter{fs: fs, file: f}, nil
+}
+
+// Filecmd implements sftp.FileCmder
+func (fs *memFS) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Mkdir":
+		return fs.mkdirAll(r.Filepath)
+	case "Remove", "Rmdir":
+		return fs.remove(r.Filepath)
+	case "Setstat":
+		return nil
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// Filelist implements sftp.FileLister
+func (fs *memFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	key := normalize(r.Filepath)
+	f, ok := fs.files[key]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: r.Filepath, Err: syscall.ENOENT}
+	}
+	switch r.Method {
+	case "Stat", "Lstat":
+		return listerAt{f.info()}, nil
+	case "List":
+		var infos listerAt
+		for other, child := range fs.files {
+			if parent(other) == key {
+				infos = append(infos, child.info())
+			}
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		return infos, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// memFileWriter writes to a file held by memFS
+type memFileWriter struct {
+	// fs is the filesystem holding the file
+	fs *memFS
+	// file is the file written to
+	file *memFile
+}
+
+// WriteAt implements io.WriterAt
+func (w *memFileWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	if end := int(off) + len(p); end > len(w.file.data) {
+		w.file.data = append(w.file.data, make([]byte, end-len(w.file.data))...)
+	}
+	copy(w.file.data[off:], p)
+	w.file.modTime = time.Now()
+	return len(p), nil
+}
+
+// info returns the os.FileInfo describing the file
+func (f *memFile) info() os.FileInfo {
+	return &memFileInfo{name: f.name, dir: f.dir, size: int64(len(f.data)), modTime: f.modTime}
+}
+
+// memFileInfo implements os.FileInfo for the files held by memFS
+type memFileInfo struct {
+	name    string
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.dir }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// listerAt implements sftp.ListerAt for a fixed list of files
+type listerAt []os.FileInfo
+
+// ListAt implements sftp.ListerAt
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
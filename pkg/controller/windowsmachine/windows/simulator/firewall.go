@@ -0,0 +1,103 @@
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FirewallRule is a Windows firewall rule of the simulated VM
+type FirewallRule struct {
+	// Name is the unique name of the rule
+	Name string
+	// Group is the group the rule belongs to
+	Group string
+	// Protocol is the protocol of the traffic matched by the rule
+	Protocol string
+	// LocalPort is the local port, or range of ports, of the traffic matched by the rule
+	LocalPort string
+	// Enabled is true if the rule is enabled
+	Enabled bool
+	// Direction is the direction of the traffic matched by the rule, Inbound or Outbound
+	Direction string
+	// Action is the action taken on the traffic matched by the rule, Allow or Block
+	Action string
+}
+
+// FirewallRules returns the firewall rules, sorted by name
+func (s *Simulator) FirewallRules() []FirewallRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rules []FirewallRule
+	for _, rule := range s.firewallRules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// SetFirewallRule creates or replaces the given firewall rule
+func (s *Simulator) SetFirewallRule(rule FirewallRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firewallRules[rule.Name] = rule
+}
+
+// quotedFlagValue returns the value following the given flag in the fields of a command, without its single quotes
+func quotedFlagValue(fields []string, flag string) string {
+	return strings.Trim(flagValue(fields, flag), "'")
+}
+
+// listFirewallRules emulates the command printing the name, protocol, local ports, enabled state, direction and
+// action of each firewall rule of the group given by the -Group flag
+func (s *Simulator) listFirewallRules(cmd string) (string, string, int) {
+	group := quotedFlagValue(strings.Fields(cmd), "-Group")
+	var out string
+	for _, rule := range s.FirewallRules() {
+		if rule.Group != group {
+			continue
+		}
+		enabled := "False"
+		if rule.Enabled {
+			enabled = "True"
+		}
+		out += strings.Join([]string{rule.Name, rule.Protocol, rule.LocalPort, enabled, rule.Direction, rule.Action},
+			" ") + "\r\n"
+	}
+	return out, "", 0
+}
+
+// newFirewallRule emulates the `New-NetFirewallRule` command
+func (s *Simulator) newFirewallRule(cmd string) (string, string, int) {
+	fields := strings.Fields(cmd)
+	rule := FirewallRule{
+		Name:      quotedFlagValue(fields, "-Name"),
+		Group:     quotedFlagValue(fields, "-Group"),
+		Protocol:  quotedFlagValue(fields, "-Protocol"),
+		LocalPort: quotedFlagValue(fields, "-LocalPort"),
+		Enabled:   true,
+		Direction: quotedFlagValue(fields, "-Direction"),
+		Action:    quotedFlagValue(fields, "-Action"),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.firewallRules[rule.Name]; exists {
+		return "", fmt.Sprintf("New-NetFirewallRule : Cannot create a file when that file already exists.\r\n"+
+			"    + FullyQualifiedErrorId : Windows System Error 183,New-NetFirewallRule (%s)\r\n", rule.Name), 1
+	}
+	s.firewallRules[rule.Name] = rule
+	return "", "", 0
+}
+
+// removeFirewallRule emulates the `Remove-NetFirewallRule -Name <name>` command
+func (s *Simulator) removeFirewallRule(cmd string) (string, string, int) {
+	name := quotedFlagValue(strings.Fields(cmd), "-Name")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.firewallRules[name]; !exists {
+		return "", fmt.Sprintf("Remove-NetFirewallRule : No MSFT_NetFirewallRule objects found with property 'Name' "+
+			"equal to '%s'.\r\n", name), 1
+	}
+	delete(s.firewallRules, name)
+	return "", "", 0
+}
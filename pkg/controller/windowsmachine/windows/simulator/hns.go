@@ -0,0 +1,117 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// endpointNameFilterRegex matches the filter on the endpoint name of a Get-HnsEndpoint pipeline
+var endpointNameFilterRegex = regexp.MustCompile(`\$_\.Name -eq '([^']*)'`)
+
+// Endpoint is an HNS endpoint of the simulated VM
+type Endpoint struct {
+	// ID is the GUID of the endpoint
+	ID string `json:"ID"`
+	// Name is the name of the endpoint
+	Name string `json:"Name"`
+	// VirtualNetworkName is the name of the network the endpoint belongs to
+	VirtualNetworkName string `json:"VirtualNetworkName"`
+	// IPAddress is the IP address of the endpoint
+	IPAddress string `json:"IPAddress"`
+	// MacAddress is the MAC address of the endpoint
+	MacAddress string `json:"MacAddress"`
+}
+
+// network is an HNS network of the simulated VM, as output by Get-HnsNetwork
+type network struct {
+	// ID is the GUID of the network
+	ID string `json:"ID"`
+	// Name is the name of the network
+	Name string `json:"Name"`
+	// Type is the type of the network
+	Type string `json:"Type"`
+}
+
+// createVIPEndpoint emulates the script creating the VIP endpoint on the OVN overlay network and returning it as JSON
+func (s *Simulator) createVIPEndpoint() (string, string, int) {
+	if !s.fs.exists(hnsModulePath) {
+		return "", "Import-Module : The specified module '" + hnsModulePath + "' was not loaded because no valid " +
+			"module file was found in any module directory.\r\n", 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.hasNetworkLocked(ovnKubeOverlayNetwork) {
+		return "", "New-HnsEndpoint : Cannot validate argument on parameter 'NetworkId'. The argument is null or " +
+			"empty.\r\n", 1
+	}
+	s.createdEndpoints++
+	endpoint := Endpoint{
+		ID:                 fmt.Sprintf("%08X-0000-0000-0000-000000000000", s.createdEndpoints),
+		Name:               vipEndpointName,
+		VirtualNetworkName: ovnKubeOverlayNetwork,
+		IPAddress:          s.sourceVIP,
+		MacAddress:         fmt.Sprintf("00-15-5D-00-00-%02X", s.createdEndpoints%256),
+	}
+	s.endpoints = append(s.endpoints, endpoint)
+	return toJSON([]Endpoint{endpoint})
+}
+
+// listNetworks emulates `ConvertTo-Json` on the HNS networks
+func (s *Simulator) listNetworks() (string, string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	networks := make([]network, 0, len(s.networks))
+	for i, name := range s.networks {
+		networks = append(networks, network{ID: fmt.Sprintf("%08X-1111-0000-0000-000000000000", i+1), Name: name,
+			Type: "Overlay"})
+	}
+	return toJSON(networks)
+}
+
+// listEndpoints emulates `ConvertTo-Json` on the HNS endpoints, restricted to the endpoints with the given name if
+// the pipeline filters on it
+func (s *Simulator) listEndpoints(cmd string) (string, string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	match := endpointNameFilterRegex.FindStringSubmatch(cmd)
+	endpoints := make([]Endpoint, 0, len(s.endpoints))
+	for _, endpoint := range s.endpoints {
+		if match == nil || endpoint.Name == match[1] {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return toJSON(endpoints)
+}
+
+// removeHNSObjects emulates the removal of the HNS endpoints and networks whose names or IDs are quoted in the
+// command
+func (s *Simulator) removeHNSObjects(cmd string) (string, string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quoted := func(name string) bool { return strings.Contains(cmd, "'"+name+"'") }
+	var endpoints []Endpoint
+	var networks []string
+	for _, endpoint := range s.endpoints {
+		if !quoted(endpoint.Name) && !quoted(endpoint.ID) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	for _, network := range s.networks {
+		if !quoted(network) {
+			networks = append(networks, network)
+		}
+	}
+	s.endpoints, s.networks = endpoints, networks
+	return "", "", 0
+}
+
+// toJSON emulates `ConvertTo-Json` on the given HNS objects
+func toJSON(objects interface{}) (string, string, int) {
+	out, err := json.Marshal(objects)
+	if err != nil {
+		return "", err.Error() + "\r\n", 1
+	}
+	return string(out) + "\r\n", "", 0
+}
@@ -0,0 +1,76 @@
+package simulator
+
+import "encoding/json"
+
+// gibibyte is the number of bytes in a GiB
+const gibibyte = 1 << 30
+
+// Platform describes the Windows platform of the simulated VM, as reported to the operator before it is configured
+type Platform struct {
+	// Build is the OS build number
+	Build int `json:"build"`
+	// UBR is the update build revision of the OS
+	UBR int `json:"ubr"`
+	// Features holds the names of the installed Windows features
+	Features []string `json:"features"`
+	// ContainerRuntimeStatus is the status of the docker service, empty if docker is not installed
+	ContainerRuntimeStatus string `json:"containerRuntimeStatus"`
+	// FreeDiskBytes is the free space of the C: drive
+	FreeDiskBytes int64 `json:"freeDiskBytes"`
+	// MemoryBytes is the physical memory of the VM
+	MemoryBytes int64 `json:"memoryBytes"`
+	// PowerShellVersion is the version of PowerShell
+	PowerShellVersion string `json:"powerShellVersion"`
+	// NICs holds the network adapters of the VM
+	NICs []NIC `json:"nics"`
+}
+
+// NIC is a network adapter of the simulated VM
+type NIC struct {
+	// Name is the name of the adapter
+	Name string `json:"Name"`
+	// MacAddress is the MAC address of the adapter
+	MacAddress string `json:"MacAddress"`
+	// Status is the status of the adapter, Up if it is connected
+	Status string `json:"Status"`
+}
+
+// DefaultPlatform returns the platform of the simulator unless it is overridden: an up to date Windows Server 2019
+// with docker running
+func DefaultPlatform() Platform {
+	return Platform{
+		Build:                  17763,
+		UBR:                    1577,
+		Features:               []string{"Containers", "FileAndStorage-Services", "Storage-Services"},
+		ContainerRuntimeStatus: "Running",
+		FreeDiskBytes:          80 * gibibyte,
+		MemoryBytes:            8 * gibibyte,
+		PowerShellVersion:      "5.1.17763.1490",
+		NICs:                   []NIC{{Name: "Ethernet", MacAddress: "02-4C-6E-2B-1A-3F", Status: "Up"}},
+	}
+}
+
+// Platform returns the platform of the simulated VM
+func (s *Simulator) Platform() Platform {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.platform
+}
+
+// SetPlatform sets the platform of the simulated VM
+func (s *Simulator) SetPlatform(platform Platform) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.platform = platform
+}
+
+// platformFacts emulates the command collecting the platform facts as a JSON document
+func (s *Simulator) platformFacts() (string, string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, err := json.Marshal(s.platform)
+	if err != nil {
+		return "", err.Error() + "\r\n", 1
+	}
+	return string(out) + "\r\n", "", 0
+}
@@ -0,0 +1,431 @@
+package simulator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// StateStopped is the state of a service that is not running
+	StateStopped = "STOPPED"
+	// StateRunning is the state of a service that is running
+	StateRunning = "RUNNING"
+	// StartTypeAuto is the start type of a service started automatically at boot
+	StartTypeAuto = "AUTO_START"
+	// StartTypeDemand is the start type of a service started manually
+	StartTypeDemand = "DEMAND_START"
+
+	// The Win32 error codes below are returned as the exit code of sc.exe
+	// referenced: https://docs.microsoft.com/en-us/windows/win32/debug/system-error-codes--1000-1299-
+
+	// errorFileNotFound is ERROR_FILE_NOT_FOUND, returned when the binary of a service does not exist
+	errorFileNotFound = 2
+	// errorInsufficientBuffer is ERROR_INSUFFICIENT_BUFFER, returned when the configuration of a service does not fit
+	// in the buffer given to sc.exe qc
+	errorInsufficientBuffer = 122
+	// errorDependentServicesRunning is ERROR_DEPENDENT_SERVICES_RUNNING
+	errorDependentServicesRunning = 1051
+	// errorServiceAlreadyRunning is ERROR_SERVICE_ALREADY_RUNNING
+	errorServiceAlreadyRunning = 1056
+	// errorServiceDoesNotExist is ERROR_SERVICE_DOES_NOT_EXIST
+	errorServiceDoesNotExist = 1060
+	// errorServiceNotActive is ERROR_SERVICE_NOT_ACTIVE
+	errorServiceNotActive = 1062
+	// errorServiceSpecificError is ERROR_SERVICE_SPECIFIC_ERROR, the Win32 exit code reported by a service which
+	// exited with a service specific exit code
+	errorServiceSpecificError = 1066
+	// errorServiceDependencyFail is ERROR_SERVICE_DEPENDENCY_FAIL
+	errorServiceDependencyFail = 1068
+	// errorServiceExists is ERROR_SERVICE_EXISTS
+	errorServiceExists = 1073
+	// errorServiceDependencyDeleted is ERROR_SERVICE_DEPENDENCY_DELETED, returned when a dependency does not exist
+	errorServiceDependencyDeleted = 1075
+	// errorInvalidCommandLine is ERROR_INVALID_COMMAND_LINE
+	errorInvalidCommandLine = 1639
+
+	// scDefaultBufferSize is the size in bytes of the buffer used by sc.exe qc if none is given
+	scDefaultBufferSize = 1024
+	// queryServiceConfigSize is the size in bytes of the QUERY_SERVICE_CONFIG structure, which precedes the strings of
+	// the service configuration in the buffer
+	queryServiceConfigSize = 36
+
+	// scIndent is the indentation of the fields printed by sc.exe
+	scIndent = "        "
+	// scContinuation is the indentation of the additional values of a multi-valued field printed by sc.exe
+	scContinuation = "                           : "
+	// scFailureContinuation is the indentation of the additional failure actions printed by sc.exe qfailure
+	scFailureContinuation = "                                       "
+)
+
+// stateCodes maps the service states to the codes printed by sc.exe
+var stateCodes = map[string]int{StateStopped: 1, "START_PENDING": 2, "STOP_PENDING": 3, StateRunning: 4}
+
+// startTypeCodes maps the service start types to the codes printed by sc.exe
+var startTypeCodes = map[string]int{StartTypeAuto: 2, StartTypeDemand: 3, "DISABLED": 4}
+
+// Service is a Windows service of the simulator
+type Service struct {
+	// Name is the name of the service
+	Name string
+	// BinaryPath is the command line used to start the service
+	BinaryPath string
+	// StartType is the start type of the service, such as AUTO_START
+	StartType string
+	// Dependencies holds the names of the services the service depends on
+	Dependencies []string
+	// State is the current state of the service, such as RUNNING
+	State string
+	// Win32ExitCode is the Win32 error code reported by the service when it last stopped
+	Win32ExitCode int
+	// ServiceExitCode is the service specific exit code reported by the service when it last stopped
+	ServiceExitCode int
+	// ResetPeriod is the time without failures after which the failure count of the service is reset
+	ResetPeriod time.Duration
+	// FailureActions holds the actions taken on successive failures of the service
+	FailureActions []FailureAction
+	// FailureActionsOnNonCrashFailures is true if the failure actions are also taken when the service stops with a
+	// non-zero exit code
+	FailureActionsOnNonCrashFailures bool
+}
+
+// FailureAction is an action taken by the service control manager when a service fails
+type FailureAction struct {
+	// Type is the type of the action, such as RESTART
+	Type string
+	// Delay is the time to wait before taking the action
+	Delay time.Duration
+}
+
+// copy returns a deep copy of the service
+func (svc *Service) copy() Service {
+	copied := *svc
+	copied.Dependencies = append([]string(nil), svc.Dependencies...)
+	copied.FailureActions = append([]FailureAction(nil), svc.FailureActions...)
+	return copied
+}
+
+// binary returns the path of the binary run by the service
+func (svc *Service) binary() string {
+	if fields := strings.Fields(svc.BinaryPath); len(fields) > 0 {
+		return strings.Trim(fields[0], "\"")
+	}
+	return ""
+}
+
+// runSC emulates the given sc.exe command, returning its stdout, stderr and exit code
+func (s *Simulator) runSC(cmd string) (string, string, int) {
+	args := splitArgs(cmd)
+	if len(args) < 3 {
+		return scUsage()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	verb, name := strings.ToLower(args[1]), args[2]
+	svc, exists := s.services[strings.ToLower(name)]
+	if !exists && verb != "create" {
+		return scFailed("OpenService", errorServiceDoesNotExist,
+			"The specified service does not exist as an installed service.")
+	}
+	options, ok := scOptions(args[3:])
+	switch verb {
+	case "queryex":
+		return svc.queryOutput(), "", 0
+	case "qc":
+		bufferSize := scDefaultBufferSize
+		if len(args) > 3 {
+			var err error
+			if bufferSize, err = strconv.Atoi(args[3]); err != nil {
+				return scUsage()
+			}
+		}
+		if size := svc.configSize(); size > bufferSize {
+			out, stderr, code := scFailed("QueryServiceConfig", errorInsufficientBuffer,
+				"The data area passed to a system call is too small.")
+			return out + fmt.Sprintf("[SC] GetServiceConfig needs %d bytes\r\n", size), stderr, code
+		}
+		return svc.configOutput(), "", 0
+	case "qfailure":
+		return svc.failureOutput(), "", 0
+	case "qfailureflag":
+		return fmt.Sprintf("[SC] QueryServiceConfig2 SUCCESS\r\n\r\nSERVICE_NAME: %s\r\n"+
+			scIndent+"FAILURE_ACTIONS_ON_NONCRASH_FAILURES: %s\r\n", svc.Name,
+			strings.ToUpper(strconv.FormatBool(svc.FailureActionsOnNonCrashFailures))), "", 0
+	case "create":
+		if exists {
+			return scFailed("CreateService", errorServiceExists, "The specified service already exists.")
+		}
+		if !ok || options["binpath="] == "" {
+			return scUsage()
+		}
+		svc = &Service{Name: name, StartType: StartTypeDemand, State: StateStopped}
+		if !svc.configure(options) {
+			return scUsage()
+		}
+		s.services[strings.ToLower(name)] = svc
+		return "[SC] CreateService SUCCESS\r\n", "", 0
+	case "config":
+		if !ok || !svc.configure(options) {
+			return scUsage()
+		}
+		return "[SC] ChangeServiceConfig SUCCESS\r\n", "", 0
+	case "failure":
+		if !ok || !svc.setFailureActions(options) {
+			return scUsage()
+		}
+		return "[SC] ChangeServiceConfig2 SUCCESS\r\n", "", 0
+	case "failureflag":
+		if len(args) != 4 || (args[3] != "0" && args[3] != "1") {
+			return scUsage()
+		}
+		svc.FailureActionsOnNonCrashFailures = args[3] == "1"
+		return "[SC] ChangeServiceConfig2 SUCCESS\r\n", "", 0
+	case "start":
+		if code, message := s.startLocked(svc, map[string]bool{}); code != 0 {
+			return scFailed("StartService", code, message)
+		}
+		return svc.queryOutput(), "", 0
+	case "stop":
+		if svc.State != StateRunning {
+			return scFailed("ControlService", errorServiceNotActive, "The service has not been started.")
+		}
+		for _, other := range s.services {
+			if other.State == StateRunning && other.dependsOn(svc.Name) {
+				return scFailed("ControlService", errorDependentServicesRunning,
+					"A stop control has been sent to a service that other running services are dependent on.")
+			}
+		}
+		svc.State, svc.Win32ExitCode, svc.ServiceExitCode = StateStopped, 0, 0
+		return svc.queryOutput(), "", 0
+	case "delete":
+		delete(s.services, strings.ToLower(name))
+		return "[SC] DeleteService SUCCESS\r\n", "", 0
+	default:
+		return scUsage()
+	}
+}
+
+// startLocked starts the given service after its dependencies, returning a Win32 error code and message if it cannot
+// be started. The names of the services being started are held by starting to detect dependency cycles. s.mu must be
+// held.
+func (s *Simulator) startLocked(svc *Service, starting map[string]bool) (int, string) {
+	if svc.State == StateRunning {
+		return errorServiceAlreadyRunning, "An instance of the service is already running."
+	}
+	starting[strings.ToLower(svc.Name)] = true
+	for _, dependency := range svc.Dependencies {
+		dep, ok := s.services[strings.ToLower(dependency)]
+		if !ok {
+			return errorServiceDependencyDeleted,
+				"The dependency service does not exist or has been marked for deletion."
+		}
+		if dep.State == StateRunning {
+			continue
+		}
+		if starting[strings.ToLower(dependency)] {
+			return errorServiceDependencyFail, "The dependency service or group failed to start."
+		}
+		if code, _ := s.startLocked(dep, starting); code != 0 || dep.State != StateRunning {
+			return errorServiceDependencyFail, "The dependency service or group failed to start."
+		}
+	}
+	if !s.fs.exists(svc.binary()) {
+		return errorFileNotFound, "The system cannot find the file specified."
+	}
+	if exitCode, crashes := s.crashes[strings.ToLower(svc.Name)]; crashes {
+		svc.State, svc.Win32ExitCode, svc.ServiceExitCode = StateStopped, errorServiceSpecificError, exitCode
+		return 0, ""
+	}
+	svc.State, svc.Win32ExitCode, svc.ServiceExitCode = StateRunning, 0, 0
+	if strings.EqualFold(svc.Name, hybridOverlayServiceName) {
+		// The hybrid-overlay creates the HNS networks once it has started
+		s.addNetworkLocked(baseOVNKubeOverlayNetwork)
+		s.addNetworkLocked(ovnKubeOverlayNetwork)
+	}
+	return 0, ""
+}
+
+// configure applies the binPath=, start= and depend= options of sc.exe create and config to the service, returning
+// false if they are invalid
+func (svc *Service) configure(options map[string]string) bool {
+	for option, value := range options {
+		switch option {
+		case "binpath=":
+			svc.BinaryPath = value
+		case "start=":
+			switch value {
+			case "auto":
+				svc.StartType = StartTypeAuto
+			case "demand":
+				svc.StartType = StartTypeDemand
+			case "disabled":
+				svc.StartType = "DISABLED"
+			default:
+				return false
+			}
+		case "depend=":
+			// A single forward slash removes all the dependencies
+			svc.Dependencies = nil
+			for _, dependency := range strings.Split(value, "/") {
+				if dependency != "" {
+					svc.Dependencies = append(svc.Dependencies, dependency)
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setFailureActions applies the reset= and actions= options of sc.exe failure to the service, returning false if
+// they are invalid
+func (svc *Service) setFailureActions(options map[string]string) bool {
+	seconds, err := strconv.Atoi(options["reset="])
+	if err != nil {
+		return false
+	}
+	var actions []FailureAction
+	if value := options["actions="]; value != "" {
+		tokens := strings.Split(value, "/")
+		if len(tokens)%2 != 0 {
+			return false
+		}
+		for i := 0; i < len(tokens); i += 2 {
+			delay, err := strconv.Atoi(tokens[i+1])
+			if err != nil {
+				return false
+			}
+			actions = append(actions, FailureAction{Type: strings.ToUpper(tokens[i]),
+				Delay: time.Duration(delay) * time.Millisecond})
+		}
+	}
+	svc.ResetPeriod = time.Duration(seconds) * time.Second
+	svc.FailureActions = actions
+	return true
+}
+
+// dependsOn returns true if the service depends on the given service
+func (svc *Service) dependsOn(name string) bool {
+	for _, dependency := range svc.Dependencies {
+		if strings.EqualFold(dependency, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryOutput returns the output of sc.exe queryex for the service
+func (svc *Service) queryOutput() string {
+	pid := 0
+	if svc.State == StateRunning {
+		pid = 4242
+	}
+	return fmt.Sprintf("\r\nSERVICE_NAME: %s \r\n"+
+		scIndent+"TYPE               : 10  WIN32_OWN_PROCESS  \r\n"+
+		scIndent+"STATE              : %d  %s \r\n"+
+		scIndent+"WIN32_EXIT_CODE    : %d  (0x%x)\r\n"+
+		scIndent+"SERVICE_EXIT_CODE  : %d  (0x%x)\r\n"+
+		scIndent+"CHECKPOINT         : 0x0\r\n"+
+		scIndent+"WAIT_HINT          : 0x0\r\n"+
+		scIndent+"PID                : %d\r\n"+
+		scIndent+"FLAGS              :\r\n", svc.Name, stateCodes[svc.State], svc.State, svc.Win32ExitCode,
+		svc.Win32ExitCode, svc.ServiceExitCode, svc.ServiceExitCode, pid)
+}
+
+// configOutput returns the output of sc.exe qc for the service
+func (svc *Service) configOutput() string {
+	return fmt.Sprintf("[SC] QueryServiceConfig SUCCESS\r\n\r\nSERVICE_NAME: %s\r\n"+
+		scIndent+"TYPE               : 10  WIN32_OWN_PROCESS \r\n"+
+		scIndent+"START_TYPE         : %d   %s\r\n"+
+		scIndent+"ERROR_CONTROL      : 1   NORMAL\r\n"+
+		scIndent+"BINARY_PATH_NAME   : %s\r\n"+
+		scIndent+"LOAD_ORDER_GROUP   : \r\n"+
+		scIndent+"TAG                : 0\r\n"+
+		scIndent+"DISPLAY_NAME       : %s\r\n"+
+		scIndent+"DEPENDENCIES       : %s\r\n"+
+		scIndent+"SERVICE_START_NAME : LocalSystem\r\n", svc.Name, startTypeCodes[svc.StartType], svc.StartType,
+		svc.BinaryPath, svc.Name, strings.Join(svc.Dependencies, "\r\n"+scContinuation))
+}
+
+// configSize returns the size in bytes of the configuration of the service returned by QueryServiceConfig, whose
+// strings are UTF-16 encoded and null terminated
+func (svc *Service) configSize() int {
+	chars := len(svc.BinaryPath) + len(svc.Name) + len("LocalSystem") + 4
+	for _, dependency := range svc.Dependencies {
+		chars += len(dependency) + 1
+	}
+	return queryServiceConfigSize + 2*(chars+1)
+}
+
+// failureOutput returns the output of sc.exe qfailure for the service
+func (svc *Service) failureOutput() string {
+	out := fmt.Sprintf("[SC] QueryServiceConfig2 SUCCESS\r\n\r\nSERVICE_NAME: %s\r\n"+
+		scIndent+"RESET_PERIOD (in seconds)    : %d\r\n"+
+		scIndent+"REBOOT_MESSAGE               : \r\n"+
+		scIndent+"COMMAND_LINE                 : \r\n", svc.Name, int(svc.ResetPeriod.Seconds()))
+	for i, action := range svc.FailureActions {
+		prefix := scFailureContinuation
+		if i == 0 {
+			prefix = scIndent + "FAILURE_ACTIONS              : "
+		}
+		out += fmt.Sprintf("%s%s -- Delay = %d milliseconds.\r\n", prefix, action.Type, action.Delay.Milliseconds())
+	}
+	return out
+}
+
+// scFailed returns the output and exit code of a failed sc.exe command
+func scFailed(operation string, code int, message string) (string, string, int) {
+	return fmt.Sprintf("[SC] %s FAILED %d:\r\n\r\n%s\r\n\r\n", operation, code, message), "", code
+}
+
+// scUsage returns the output and exit code of sc.exe when it is given invalid arguments
+func scUsage() (string, string, int) {
+	return "DESCRIPTION:\r\n        SC is a command line program used for communicating with the Service Control " +
+		"Manager and services.\r\n", "", errorInvalidCommandLine
+}
+
+// scOptions returns the `option= value` pairs given to sc.exe keyed by lower case option, returning false if the
+// arguments are not made of such pairs
+func scOptions(args []string) (map[string]string, bool) {
+	options := make(map[string]string)
+	if len(args)%2 != 0 {
+		return options, false
+	}
+	for i := 0; i < len(args); i += 2 {
+		if !strings.HasSuffix(args[i], "=") {
+			return options, false
+		}
+		options[strings.ToLower(args[i])] = args[i+1]
+	}
+	return options, true
+}
+
+// splitArgs splits the given command line into arguments separated by spaces, as done by the Windows command line
+// parser. Double quotes group spaces into a single argument and are removed.
+func splitArgs(cmd string) []string {
+	var args []string
+	var current strings.Builder
+	inArg, quoted := false, false
+	for _, r := range cmd {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case r == ' ' && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
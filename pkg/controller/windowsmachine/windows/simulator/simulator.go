@@ -0,0 +1,363 @@
+// Package simulator provides an in-process Windows VM which can be configured by the operator in tests. It serves SSH
+// and SFTP on the loopback interface, keeps the files transferred to it in memory and emulates the commands run by the
+// operator, such as sc.exe, the PowerShell file and HNS commands and the bootstrapper. Failures and connection drops
+// can be injected to exercise the error handling of the operator.
+package simulator
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultSourceVIP is the IP address given to the VIP endpoints created by the simulator unless it is overridden
+	DefaultSourceVIP = "10.132.1.2"
+)
+
+// Fault is a failure injected into the commands run on the simulator
+type Fault struct {
+	// Match is the substring identifying the commands the fault is injected into
+	Match string
+	// ExitCode is the exit code returned instead of running the command. It is ignored if DropConnection is set.
+	ExitCode int
+	// Stderr is the standard error returned instead of running the command
+	Stderr string
+	// DropConnection closes the connection the command is run over, without replying, emulating a network failure
+	DropConnection bool
+	// Times is the number of times the fault is injected. The fault is injected every time if it is 0.
+	Times int
+}
+
+// Simulator is an in-process Windows VM reachable over SSH
+type Simulator struct {
+	// listener accepts the SSH connections
+	listener net.Listener
+	// config is the SSH server configuration
+	config *ssh.ServerConfig
+	// hostKey is the public host key presented by the simulator
+	hostKey ssh.PublicKey
+	// fs holds the files of the simulated VM
+	fs *memFS
+
+	// mu protects the fields below
+	mu sync.Mutex
+	// conns holds the open connections
+	conns map[net.Conn]struct{}
+	// dials is the number of accepted connections
+	dials int
+	// faults holds the injected faults
+	faults []*Fault
+	// commands holds the commands run on the simulator, in order
+	commands []string
+	// services holds the Windows services keyed by lower case name
+	services map[string]*Service
+	// networks holds the names of the HNS networks
+	networks []string
+	// endpoints holds the HNS endpoints, in creation order
+	endpoints []Endpoint
+	// createdEndpoints is the number of HNS endpoints created, used to generate their IDs
+	createdEndpoints int
+	// firewallRules holds the firewall rules keyed by name
+	firewallRules map[string]FirewallRule
+	// sourceVIP is the IP address given to the next VIP endpoint created
+	sourceVIP string
+	// platform is the Windows platform reported to the operator
+	platform Platform
+	// crashes holds the service specific exit codes of the services which crash when started, keyed by lower case
+	// name
+	crashes map[string]int
+}
+
+// New starts a Simulator listening on the loopback interface. Clients authenticating with the given public key are
+// accepted. The simulator is stopped by calling Close.
+func New(authorizedKey ssh.PublicKey) (*Simulator, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to generate host key")
+	}
+	hostSigner, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create host key signer")
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(authorizedKey) {
+				return nil, errors.New("unauthorized key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen")
+	}
+	s := &Simulator{
+		listener:      listener,
+		config:        config,
+		hostKey:       hostSigner.PublicKey(),
+		fs:            newMemFS(),
+		conns:         make(map[net.Conn]struct{}),
+		services:      make(map[string]*Service),
+		firewallRules: make(map[string]FirewallRule),
+		sourceVIP:     DefaultSourceVIP,
+		platform:      DefaultPlatform(),
+		crashes:       make(map[string]int),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the simulator, closing all the connections
+func (s *Simulator) Close() error {
+	err := s.listener.Close()
+	s.DropConnections()
+	return err
+}
+
+// Host returns the IP address the simulator listens on
+func (s *Simulator) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port the simulator listens on
+func (s *Simulator) Port() string {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return port
+}
+
+// HostKey returns the public host key presented by the simulator
+func (s *Simulator) HostKey() ssh.PublicKey {
+	return s.hostKey
+}
+
+// Inject injects the given fault into the commands run on the simulator. Faults are checked in the order they were
+// injected.
+func (s *Simulator) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := fault
+	s.faults = append(s.faults, &f)
+}
+
+// DropConnections closes all the open connections, emulating a network reconfiguration
+func (s *Simulator) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Dials returns the number of connections accepted by the simulator
+func (s *Simulator) Dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+// Commands returns the commands run on the simulator, in order
+func (s *Simulator) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// ResetCommands clears the recorded commands
+func (s *Simulator) ResetCommands() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = nil
+}
+
+// File returns the content of the file at the given Windows path, and false if the file does not exist
+func (s *Simulator) File(path string) ([]byte, bool) {
+	return s.fs.readFile(path)
+}
+
+// WriteFile creates or replaces the file at the given Windows path, creating its directory if needed
+func (s *Simulator) WriteFile(path string, data []byte) {
+	s.fs.writeFile(path, data)
+}
+
+// Service returns a copy of the given Windows service, and false if the service does not exist
+func (s *Simulator) Service(name string) (Service, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[strings.ToLower(name)]
+	if !ok {
+		return Service{}, false
+	}
+	return svc.copy(), true
+}
+
+// SetService creates or replaces the given Windows service
+func (s *Simulator) SetService(svc Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := svc.copy()
+	s.services[strings.ToLower(svc.Name)] = &copied
+}
+
+// CrashOnStart makes the given service stop with the given service specific exit code whenever it is started
+func (s *Simulator) CrashOnStart(name string, serviceExitCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crashes[strings.ToLower(name)] = serviceExitCode
+}
+
+// Networks returns the names of the HNS networks
+func (s *Simulator) Networks() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.networks...)
+}
+
+// Endpoints returns the HNS endpoints
+func (s *Simulator) Endpoints() []Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Endpoint(nil), s.endpoints...)
+}
+
+// AddEndpoint adds the given HNS endpoint, as if it had been created by an earlier operator version
+func (s *Simulator) AddEndpoint(endpoint Endpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints = append(s.endpoints, endpoint)
+}
+
+// SetSourceVIP sets the IP address given to the next VIP endpoint created
+func (s *Simulator) SetSourceVIP(vip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sourceVIP = vip
+}
+
+// serve accepts connections until the listener is closed
+func (s *Simulator) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.dials++
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn performs the SSH handshake and serves the sessions opened over the connection
+func (s *Simulator) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	// Reply to keepalives with a failure, as the Windows OpenSSH server does
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		go s.serveSession(conn, newChan)
+	}
+}
+
+// serveSession runs the command of an exec request or serves the SFTP subsystem
+func (s *Simulator) serveSession(conn net.Conn, newChan ssh.NewChannel) {
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			s.exec(conn, channel, exec.Command)
+			return
+		case "subsystem":
+			var subsystem struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &subsystem); err != nil || subsystem.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			server := sftp.NewRequestServer(channel, s.fs.handlers())
+			server.Serve()
+			server.Close()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exec runs the command, sending back its output and exit status, unless a fault is injected into it
+func (s *Simulator) exec(conn net.Conn, channel ssh.Channel, cmd string) {
+	s.mu.Lock()
+	s.commands = append(s.commands, cmd)
+	fault := s.faultLocked(cmd)
+	s.mu.Unlock()
+
+	var stdout, stderr string
+	var exitCode int
+	switch {
+	case fault != nil && fault.DropConnection:
+		conn.Close()
+		return
+	case fault != nil:
+		stderr, exitCode = fault.Stderr, fault.ExitCode
+	default:
+		stdout, stderr, exitCode = s.run(cmd)
+	}
+	channel.Write([]byte(stdout))
+	channel.Stderr().Write([]byte(stderr))
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(exitCode)}))
+}
+
+// faultLocked returns the fault to inject into the given command, if any, and consumes it. s.mu must be held.
+func (s *Simulator) faultLocked(cmd string) *Fault {
+	for i, fault := range s.faults {
+		if !strings.Contains(cmd, fault.Match) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
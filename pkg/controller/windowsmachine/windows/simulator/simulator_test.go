@@ -0,0 +1,60 @@
+package simulator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNormalize tests that Windows and SFTP paths to the same file have the same key
+func TestNormalize(t *testing.T) {
+	for _, path := range []string{"C:\\k\\kubelet.exe", "C:\\k\\\\kubelet.exe", "/C:\\k\\kubelet.exe", "c:/K/Kubelet.exe",
+		"C:\\k\\kubelet.exe\\"} {
+		assert.Equal(t, "c:/k/kubelet.exe", normalize(path), path)
+	}
+}
+
+// TestRunSC tests that the service control manager enforces the dependencies between services, and that sc.exe qc
+// needs a buffer large enough for the configuration of the service
+func TestRunSC(t *testing.T) {
+	s := &Simulator{fs: newMemFS(), services: make(map[string]*Service), crashes: make(map[string]int)}
+	s.fs.writeFile("C:\\k\\kubelet.exe", []byte("kubelet"))
+	s.fs.writeFile("C:\\k\\kube-proxy.exe", []byte("kube-proxy"))
+
+	steps := []struct {
+		cmd              string
+		expectedExitCode int
+	}{
+		{cmd: "sc.exe queryex kube-proxy", expectedExitCode: errorServiceDoesNotExist},
+		{cmd: "sc.exe create kube-proxy binPath= \"C:\\k\\kube-proxy.exe --v=4\" start= auto depend= kubelet"},
+		{cmd: "sc.exe start kube-proxy", expectedExitCode: errorServiceDependencyDeleted},
+		{cmd: "sc.exe create kubelet binPath= \"C:\\k\\kubelet.exe\" start= auto"},
+		{cmd: "sc.exe start kube-proxy"},
+		{cmd: "sc.exe start kube-proxy", expectedExitCode: errorServiceAlreadyRunning},
+		{cmd: "sc.exe stop kubelet", expectedExitCode: errorDependentServicesRunning},
+		{cmd: "sc.exe stop kube-proxy"},
+		{cmd: "sc.exe stop kube-proxy", expectedExitCode: errorServiceNotActive},
+		{cmd: "sc.exe failure kubelet reset= 600 actions= \"restart/10000/restart/10000\""},
+		{cmd: "sc.exe failure kubelet reset= 600 actions= \"restart\"", expectedExitCode: errorInvalidCommandLine},
+		{cmd: "sc.exe config kube-proxy binPath= \"C:\\k\\kube-proxy.exe --v=4 --vmodule=" +
+			strings.Repeat("proxier=5,", 100) + "\""},
+		{cmd: "sc.exe qc kube-proxy", expectedExitCode: errorInsufficientBuffer},
+		{cmd: "sc.exe qc kube-proxy 8192"},
+	}
+	for _, step := range steps {
+		_, _, exitCode := s.run(step.cmd)
+		assert.Equal(t, step.expectedExitCode, exitCode, step.cmd)
+	}
+
+	kubelet, ok := s.Service("kubelet")
+	require.True(t, ok)
+	assert.Equal(t, StateRunning, kubelet.State, "dependency was not started")
+	assert.Len(t, kubelet.FailureActions, 2)
+	proxy, ok := s.Service("kube-proxy")
+	require.True(t, ok)
+	assert.Equal(t, StateStopped, proxy.State)
+	assert.True(t, strings.HasPrefix(proxy.BinaryPath, "C:\\k\\kube-proxy.exe --v=4 --vmodule="))
+	assert.Equal(t, []string{"kubelet"}, proxy.Dependencies)
+}
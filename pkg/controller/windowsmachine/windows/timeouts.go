@@ -0,0 +1,73 @@
+package windows
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts holds the maximum time each type of operation run on a Windows VM is allowed to take. The operation is
+// cancelled, closing the underlying session, once its timeout expires.
+type Timeouts struct {
+	// Connect is the maximum time a single attempt to connect to the VM is allowed to take
+	Connect time.Duration
+	// Command is the timeout of the commands which do not belong to any of the other types
+	Command time.Duration
+	// FileHash is the timeout of the commands checking the existence and hash of a file
+	FileHash time.Duration
+	// FileTransfer is the timeout of a single file transfer
+	FileTransfer time.Duration
+	// ServiceQuery is the timeout of the commands querying the configuration and state of a Windows service
+	ServiceQuery time.Duration
+	// ServiceControl is the timeout of the commands creating, starting and stopping a Windows service
+	ServiceControl time.Duration
+	// Bootstrapper is the timeout of the bootstrapper runs
+	Bootstrapper time.Duration
+	// Network is the timeout of the commands querying and configuring the HNS networks
+	Network time.Duration
+}
+
+// DefaultTimeouts returns the default operation timeouts
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:        30 * time.Second,
+		Command:        2 * time.Minute,
+		FileHash:       time.Minute,
+		FileTransfer:   10 * time.Minute,
+		ServiceQuery:   30 * time.Second,
+		ServiceControl: time.Minute,
+		Bootstrapper:   10 * time.Minute,
+		Network:        2 * time.Minute,
+	}
+}
+
+// withDefaults returns a copy of the timeouts in which every unset timeout is replaced with its default value
+func (t Timeouts) withDefaults() Timeouts {
+	defaults := DefaultTimeouts()
+	for _, pair := range []struct{ timeout, defaultTimeout *time.Duration }{
+		{&t.Connect, &defaults.Connect},
+		{&t.Command, &defaults.Command},
+		{&t.FileHash, &defaults.FileHash},
+		{&t.FileTransfer, &defaults.FileTransfer},
+		{&t.ServiceQuery, &defaults.ServiceQuery},
+		{&t.ServiceControl, &defaults.ServiceControl},
+		{&t.Bootstrapper, &defaults.Bootstrapper},
+		{&t.Network, &defaults.Network},
+	} {
+		if *pair.timeout <= 0 {
+			*pair.timeout = *pair.defaultTimeout
+		}
+	}
+	return t
+}
+
+// sleep waits for the given duration, returning early with an error if the context is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,13 +1,16 @@
 package windows
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
+	core "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 
@@ -20,14 +23,18 @@ const (
 	remoteDir = "C:\\Temp\\"
 	// winTemp is the default Windows temporary directory
 	winTemp = "C:\\Windows\\Temp\\"
-	// wgetIgnoreCertCmd is the remote location of the wget-ignore-cert.ps1 script
-	wgetIgnoreCertCmd = remoteDir + "wget-ignore-cert.ps1"
+	// workerIgnitionName is the name of the worker ignition file given to the bootstrapper
+	workerIgnitionName = "worker.ign"
+	// legacyWgetScript is the remote location of the script previous versions downloaded the worker ignition with
+	legacyWgetScript = remoteDir + "wget-ignore-cert.ps1"
 	// hnsPSModule is the remote location of the hns.psm1 module
 	hnsPSModule = remoteDir + "hns.psm1"
 	// k8sDir is the remote kubernetes executable directory
 	k8sDir = "C:\\k\\"
 	// logDir is the remote kubernetes log directory
 	logDir = "C:\\var\\log\\"
+	// kubeletLogDir is the remote kubelet log directory, as set by the bootstrapper
+	kubeletLogDir = logDir + "kubelet\\"
 	// kubeProxyLogDir is the remote kube-proxy log directory
 	kubeProxyLogDir = logDir + "kube-proxy\\"
 	// hybridOverlayLogDir is the remote hybrid-overlay log directory
@@ -45,36 +52,53 @@ const (
 
 	// hybridOverlayServiceName is the name of the hybrid-overlay-node Windows service
 	hybridOverlayServiceName = "hybrid-overlay-node"
-	// hybridOverlayConfigurationTime is the approximate time taken for the hybrid-overlay to complete reconfiguring
-	// the Windows VM's network
-	hybridOverlayConfigurationTime = 2 * time.Minute
 	// BaseOVNKubeOverlayNetwork is the name of base OVN HNS Overlay network
 	BaseOVNKubeOverlayNetwork = "BaseOVNKubernetesHybridOverlayNetwork"
 	// OVNKubeOverlayNetwork is the name of the OVN HNS Overlay network
 	OVNKubeOverlayNetwork = "OVNKubernetesHybridOverlayNetwork"
+	// vipEndpointName is the name of the HNS endpoint created on the OVN HNS Overlay network for the source VIP
+	vipEndpointName = "VIPEndpoint"
 	// kubeProxyServiceName is the name of the kube-proxy Windows service
 	kubeProxyServiceName = "kube-proxy"
 	// kubeletServiceName is the name of the kubelet Windows service
 	kubeletServiceName = "kubelet"
 	// windowsExporterServiceName is the name of the windows_exporter Windows service
 	windowsExporterServiceName = "windows_exporter"
-	// windowsExporterServiceArgs specifies metrics for the windows_exporter service to collect
-	// and expose metrics at endpoint with default port :9182 and default URL path /metrics
-	windowsExporterServiceArgs = "--collectors.enabled " +
-		"cpu,cs,logical_disk,net,os,service,system,textfile,container,memory\""
 	// remotePowerShellCmdPrefix holds the PowerShell prefix that needs to be prefixed  for every remote PowerShell
 	// command executed on the remote Windows VM
 	remotePowerShellCmdPrefix = "powershell.exe -NonInteractive -ExecutionPolicy Bypass "
-	// serviceQueryCmd is the Windows command used to query a service
-	serviceQueryCmd = "sc.exe qc "
-	// serviceNotFound is part of the error message returned when a service does not exist. 1060 is an error code
-	// representing ERROR_SERVICE_DOES_NOT_EXIST
+	// serviceQueryBufferSize is the size in bytes of the buffer sc.exe is given to query the configuration of a
+	// service. The default buffer of sc.exe is too small for the command lines of services run with many arguments.
+	serviceQueryBufferSize = 8192
+
+	// The Win32 error codes below are returned as the exit code of sc.exe
 	// referenced: https://docs.microsoft.com/en-us/windows/win32/debug/system-error-codes--1000-1299-
-	serviceNotFound = "status 1060"
+
+	// errorServiceAlreadyRunning is ERROR_SERVICE_ALREADY_RUNNING
+	errorServiceAlreadyRunning = 1056
+	// errorServiceDoesNotExist is ERROR_SERVICE_DOES_NOT_EXIST
+	errorServiceDoesNotExist = 1060
+	// errorServiceCannotAcceptControl is ERROR_SERVICE_CANNOT_ACCEPT_CTRL, returned when stopping a service which is
+	// starting or already stopping
+	errorServiceCannotAcceptControl = 1061
+	// errorServiceNotActive is ERROR_SERVICE_NOT_ACTIVE
+	errorServiceNotActive = 1062
+	// errorServiceMarkedForDelete is ERROR_SERVICE_MARKED_FOR_DELETE, returned when deleting a service which is
+	// already being deleted
+	errorServiceMarkedForDelete = 1072
 )
 
 var log = logf.Log.WithName("windows")
 
+// requiredServices holds the names of the services run on the node. The slice order matters due to service
+// dependencies: a service is listed before the services it depends on.
+var requiredServices = []string{windowsExporterServiceName, kubeProxyServiceName, hybridOverlayServiceName,
+	kubeletServiceName}
+
+// deconfiguredPaths holds the remote files and directories deleted when deconfiguring the VM
+var deconfiguredPaths = []string{k8sDir, kubeletLogDir, kubeProxyLogDir, hybridOverlayLogDir, legacyWgetScript,
+	hnsPSModule, winTemp + workerIgnitionName}
+
 // filesToTransfer is a map of what files should be copied to the Windows VM and where they should be copied to
 var filesToTransfer map[*payload.FileInfo]string
 
@@ -84,17 +108,16 @@ func getFilesToTransfer() (map[*payload.FileInfo]string, error) {
 		return filesToTransfer, nil
 	}
 	srcDestPairs := map[string]string{
-		payload.IgnoreWgetPowerShellPath: remoteDir,
-		payload.WmcbPath:                 k8sDir,
-		payload.HybridOverlayPath:        k8sDir,
-		payload.HNSPSModule:              remoteDir,
-		payload.WindowsExporterPath:      k8sDir,
-		payload.FlannelCNIPluginPath:     cniDir,
-		payload.WinBridgeCNIPlugin:       cniDir,
-		payload.HostLocalCNIPlugin:       cniDir,
-		payload.WinOverlayCNIPlugin:      cniDir,
-		payload.KubeProxyPath:            k8sDir,
-		payload.KubeletPath:              k8sDir,
+		payload.WmcbPath:             k8sDir,
+		payload.HybridOverlayPath:    k8sDir,
+		payload.HNSPSModule:          remoteDir,
+		payload.WindowsExporterPath:  k8sDir,
+		payload.FlannelCNIPluginPath: cniDir,
+		payload.WinBridgeCNIPlugin:   cniDir,
+		payload.HostLocalCNIPlugin:   cniDir,
+		payload.WinOverlayCNIPlugin:  cniDir,
+		payload.KubeProxyPath:        k8sDir,
+		payload.KubeletPath:          k8sDir,
 	}
 	files := make(map[*payload.FileInfo]string)
 	for src, dest := range srcDestPairs {
@@ -108,33 +131,81 @@ func getFilesToTransfer() (map[*payload.FileInfo]string, error) {
 	return filesToTransfer, nil
 }
 
-// Windows contains all the  methods needed to configure a Windows VM to become a worker node
+// Windows contains all the  methods needed to configure a Windows VM to become a worker node. Every method interacting
+// with the VM is aborted once the given context is done. In addition, each command run on the VM is bounded by the
+// timeout of its operation type.
 type Windows interface {
 	// ID returns the cloud provider ID of the VM
 	ID() string
 	// EnsureFile ensures the given file exists within the specified directory on the Windows VM. The file will be copied
 	// to the Windows VM if it is not present or if it has the incorrect contents. The remote directory is created if it
 	// does not exist.
-	EnsureFile(*payload.FileInfo, string) error
+	EnsureFile(context.Context, *payload.FileInfo, string) error
 	// FileExists returns true if a specific file exists at the given path on the Windows VM
-	FileExists(string) (bool, error)
-	// Run executes the given command remotely on the Windows VM over a ssh connection and returns the combined output
-	// of stdout and stderr. If the bool is set, it implies that the cmd is to be execute in PowerShell. This function
-	// should be used in scenarios where you want to execute a command that runs in the background. In these cases we
-	// have observed that Run() returns before the command completes and as a result killing the process.
-	Run(string, bool) (string, error)
-	// Reinitialize re-initializes the Windows VM's SSH client
-	Reinitialize() error
-	// Configure prepares the Windows VM for the bootstrapper and then runs it
-	Configure() error
+	FileExists(context.Context, string) (bool, error)
+	// Run executes the given command remotely on the Windows VM over the connectivity backend and returns its stdout,
+	// stderr, exit code and duration. The result is returned whenever the command completes, along with an error
+	// wrapping an *ExitError if the exit code is non-zero. If the bool is set, it implies that the cmd is to be execute
+	// in PowerShell. This function should be used in scenarios where you want to execute a command that runs in the
+	// background. In these cases we have observed that Run() returns before the command completes and as a result
+	// killing the process.
+	Run(context.Context, string, bool) (*CommandResult, error)
+	// Reinitialize re-initializes the Windows VM's SSH or WinRM client
+	Reinitialize(context.Context) error
+	// Preflight collects the platform facts of the VM in a single command and checks them against
+	// SupportedPlatforms. The facts are returned along with a *PreflightError listing every violated requirement if
+	// the platform is not supported.
+	Preflight(context.Context) (*PlatformFacts, error)
+	// Configure prepares the Windows VM for the bootstrapper and then runs it with the given worker ignition file
+	Configure(context.Context, []byte) error
 	// ConfigureCNI ensures that the CNI configuration in done on the node
-	ConfigureCNI(string) error
-	// ConfigureHybridOverlay ensures that the hybrid overlay is running on the node
-	ConfigureHybridOverlay(string) error
-	// ConfigureWindowsExporter ensures that the Windows metrics exporter is running on the node
-	ConfigureWindowsExporter() error
-	// ConfigureKubeProxy ensures that the kube-proxy service is running
-	ConfigureKubeProxy(string, string) error
+	ConfigureCNI(context.Context, string) error
+	// ConfigureHybridOverlay ensures that the hybrid overlay is running on the node. It returns without waiting for the
+	// hybrid-overlay to reconfigure the network, see HybridOverlayNetworksReady.
+	ConfigureHybridOverlay(context.Context, string) error
+	// HybridOverlayNetworksReady returns true if the OVN overlay HNS networks have been created by the hybrid-overlay.
+	// The network reconfiguration drops the connection to the VM, so on connection errors a single reconnection attempt
+	// is made before the error is returned, allowing the caller to retry.
+	HybridOverlayNetworksReady(context.Context) (bool, error)
+	// ConfigureWindowsExporter ensures that the Windows metrics exporter is running on the node with the collectors,
+	// flags and port of its configuration. The service is reconfigured if it was started with other arguments.
+	ConfigureWindowsExporter(context.Context) error
+	// EnsureSourceVIP ensures that a single VIP endpoint exists on the OVN overlay HNS network and returns its IP
+	// address, the source VIP of the node. An existing endpoint is reused, preferring the one holding the given
+	// previously recorded source VIP, and duplicate endpoints are removed. A warning event is recorded if the source
+	// VIP differs from the recorded one.
+	EnsureSourceVIP(context.Context, string) (string, error)
+	// ConfigureKubeProxy ensures that the kube-proxy service is running on the node with the given name, cluster CIDR
+	// and source VIP, driven by a configuration file generated from its configuration. The service is restarted if the
+	// file changed.
+	ConfigureKubeProxy(context.Context, string, string, string) error
+	// KubeProxyDrift describes the differences between the kube-proxy configuration file and service on the node with
+	// the given name, cluster CIDR and source VIP and the desired ones. It returns an empty list if ConfigureKubeProxy
+	// has nothing to change.
+	KubeProxyDrift(context.Context, string, string, string) ([]string, error)
+	// QueryService returns the state and configuration of the given Windows service, or nil if the service does not
+	// exist
+	QueryService(context.Context, string) (*ServiceStatus, error)
+	// ConfigureFirewall creates the given firewall rules, repairs the ones which were changed, and deletes the rules
+	// owned by the operator which are not given
+	ConfigureFirewall(context.Context, []FirewallRule) error
+	// FirewallDrift describes the differences between the given firewall rules and the rules owned by the operator on
+	// the VM. It returns an empty list if ConfigureFirewall has nothing to change.
+	FirewallDrift(context.Context, []FirewallRule) ([]string, error)
+	// Deconfigure reverts Configure and the other configuration steps: the node services are stopped and deleted, the
+	// firewall rules owned by the operator, the OVN overlay HNS networks and the VIP endpoint are removed and the files
+	// transferred to the VM are deleted. It succeeds on a VM which is not, or only partially, configured.
+	Deconfigure(context.Context) error
+	// CollectDiagnostics writes a gzipped tarball holding the node service logs and states, the HNS networks and
+	// endpoints, the worker ignition metadata and the hashes of the payload files to the writer. Collection is best
+	// effort: what could not be collected is listed in the errors.txt file of the tarball.
+	CollectDiagnostics(context.Context, io.Writer) error
+}
+
+// Recorder records events about a Windows VM on the object backing it
+type Recorder interface {
+	// Eventf records an event of the given type, with the given reason and formatted message
+	Eventf(eventType, reason, messageFmt string, args ...interface{})
 }
 
 // windows implements the Windows interface
@@ -143,46 +214,59 @@ type windows struct {
 	ipAddress string
 	// id is the VM's cloud provider ID
 	id string
-	// workerIgnitionEndpoint is the Machine Config Server(MCS) endpoint from which we can download the
-	// the OpenShift worker ignition file.
-	workerIgnitionEndpoint string
 	// signer is used for authenticating against the VM
 	signer ssh.Signer
 	// interact is used to connect to and interact with the VM
 	interact connectivity
 	// vxlanPort is the custom VXLAN port
 	vxlanPort string
+	// timeouts holds the timeouts of the operations run on the VM
+	timeouts Timeouts
+	// recorder is used to record events about the VM, nil if events are not recorded
+	recorder Recorder
+	// recovery is the recovery policy applied to the node services
+	recovery RecoveryPolicy
+	// exporter configures the windows_exporter service
+	exporter ExporterConfig
+	// kubeProxy configures the kube-proxy service
+	kubeProxy KubeProxyConfig
 }
 
-// New returns a new Windows instance constructed from the given WindowsVM
-func New(ipAddress, providerName, instanceID, workerIgnitionEndpoint, vxlanPort string, signer ssh.Signer) (Windows, error) {
-	if workerIgnitionEndpoint == "" {
-		return nil, errors.New("cannot use empty ignition endpoint")
-	}
-
-	// TODO: This should be changed so that the "core" user is used on all platforms for SSH connections.
-	// https://issues.redhat.com/browse/WINC-430
-	var adminUser string
-	if providerName == "azure" {
-		adminUser = "capi"
-	} else {
-		adminUser = "Administrator"
-	}
-
+// New returns a new Windows instance constructed from the given WindowsVM, connected to as the given user. The
+// connectivity backend used to interact with the VM is chosen based on the given connection settings.
+func New(ctx context.Context, ipAddress, username, instanceID, vxlanPort string,
+	connSettings ConnectionSettings) (Windows, error) {
 	// Update the logger name with the VM's cloud ID
 	log = logf.Log.WithName(fmt.Sprintf("VM %s", instanceID))
 
-	log.V(1).Info("initializing SSH connection", "user", adminUser)
-	conn, err := newSshConnectivity(adminUser, ipAddress, signer)
+	log.V(1).Info("initializing connection", "user", username, "backend", connSettings.Backend)
+	conn, err := newConnectivity(ctx, instanceID, username, ipAddress, connSettings)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to setup VM %s sshConnectivity", instanceID)
+		return nil, errors.Wrapf(err, "unable to setup VM %s connectivity", instanceID)
+	}
+
+	recovery := DefaultRecoveryPolicy()
+	if connSettings.ServiceRecovery != nil {
+		recovery = *connSettings.ServiceRecovery
+	}
+	exporter := DefaultExporterConfig()
+	if connSettings.WindowsExporter != nil {
+		exporter = *connSettings.WindowsExporter
+	}
+	kubeProxy := DefaultKubeProxyConfig()
+	if connSettings.KubeProxy != nil {
+		kubeProxy = *connSettings.KubeProxy
 	}
 
 	return &windows{
-			id:                     instanceID,
-			interact:               conn,
-			workerIgnitionEndpoint: workerIgnitionEndpoint,
-			vxlanPort:              vxlanPort,
+			id:        instanceID,
+			interact:  conn,
+			vxlanPort: vxlanPort,
+			timeouts:  connSettings.Timeouts.withDefaults(),
+			recorder:  connSettings.Recorder,
+			recovery:  recovery,
+			exporter:  exporter,
+			kubeProxy: kubeProxy,
 		},
 		nil
 }
@@ -193,161 +277,197 @@ func (vm *windows) ID() string {
 	return vm.id
 }
 
-func (vm *windows) EnsureFile(file *payload.FileInfo, remoteDir string) error {
-	// Only copy the file to the Windows VM if it does not already exist wth the desired content
-	remotePath := remoteDir + "\\" + filepath.Base(file.Path)
-	fileExists, err := vm.FileExists(remotePath)
-	if err != nil {
-		return errors.Wrapf(err, "error checking if file '%s' exists on the Windows VM", remotePath)
-	}
-	if fileExists {
-		remoteFile, err := vm.newFileInfo(remotePath)
-		if err != nil {
-			return errors.Wrapf(err, "error getting info on file '%s' on the Windows VM", remotePath)
-		}
-		if file.SHA256 == remoteFile.SHA256 {
-			// The file already exists with the expected content, do nothing
-			log.V(1).Info("file already exists on VM with expected content", "file", file.Path)
-			return nil
-		}
-	}
-
-	log.V(1).Info("copy", "local file", file.Path, "remote dir", remoteDir)
-	if err := vm.interact.transfer(file.Path, remoteDir); err != nil {
-		return errors.Wrapf(err, "unable to transfer %s to remote dir %s", file.Path, remoteDir)
-	}
-	return nil
+func (vm *windows) EnsureFile(ctx context.Context, file *payload.FileInfo, remoteDir string) error {
+	_, err := vm.ensureFile(ctx, file, remoteDir)
+	return err
 }
 
-func (vm *windows) FileExists(path string) (bool, error) {
-	out, err := vm.Run("Test-Path "+path, true)
+func (vm *windows) FileExists(ctx context.Context, path string) (bool, error) {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.FileHash, "Test-Path "+path, true)
 	if err != nil {
 		return false, errors.Wrapf(err, "error checking if file %s exists on Windows VM %s", path, vm.ID())
 	}
-	return strings.TrimSpace(out) == "True", nil
+	return strings.TrimSpace(result.Stdout) == "True", nil
+}
+
+func (vm *windows) Run(ctx context.Context, cmd string, psCmd bool) (*CommandResult, error) {
+	return vm.runWithTimeout(ctx, vm.timeouts.Command, cmd, psCmd)
 }
 
-func (vm *windows) Run(cmd string, psCmd bool) (string, error) {
+// runWithTimeout runs the command in the same way as Run, aborting it if it does not complete within the given
+// timeout. The error is not logged if the command exits with one of the expected exit codes, as the caller handles it.
+func (vm *windows) runWithTimeout(ctx context.Context, timeout time.Duration, cmd string, psCmd bool,
+	expectedExitCodes ...int) (*CommandResult, error) {
 	if psCmd {
 		cmd = remotePowerShellCmdPrefix + cmd
 	}
 
-	out, err := vm.interact.run(cmd)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result, err := vm.interact.run(ctx, cmd)
 	if err != nil {
-		// Hack to not print the error log for "sc.exe qc" returning 1060 for non existent services.
-		if !(strings.HasPrefix(cmd, serviceQueryCmd) && strings.HasSuffix(err.Error(), serviceNotFound)) {
-			log.Error(err, "error running", "cmd", cmd, "out", out)
+		if isExitCode(err, expectedExitCodes...) {
+			log.V(1).Info("run", "cmd", cmd, "exit code", result.ExitCode, "duration", result.Duration)
+		} else if result != nil {
+			log.Error(err, "error running", "cmd", cmd, "stdout", result.Stdout, "stderr", result.Stderr,
+				"duration", result.Duration)
+		} else {
+			log.Error(err, "error running", "cmd", cmd)
 		}
-		return out, errors.Wrapf(err, "error running %s", cmd)
+		return result, errors.Wrapf(err, "error running %s", cmd)
+	}
+	log.V(1).Info("run", "cmd", cmd, "stdout", result.Stdout, "stderr", result.Stderr, "duration", result.Duration)
+	return result, nil
+}
+
+func (vm *windows) QueryService(ctx context.Context, serviceName string) (*ServiceStatus, error) {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceQuery, "sc.exe queryex "+serviceName, false,
+		errorServiceDoesNotExist)
+	if err != nil {
+		if isExitCode(err, errorServiceDoesNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error querying state of %s Windows service", serviceName)
+	}
+	queryOut := result.Stdout
+	result, err = vm.runWithTimeout(ctx, vm.timeouts.ServiceQuery, serviceQueryCmd(serviceName), false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying configuration of %s Windows service", serviceName)
+	}
+	status, err := parseServiceStatus(serviceName, queryOut, result.Stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err = vm.runWithTimeout(ctx, vm.timeouts.ServiceQuery, "sc.exe qfailure "+serviceName, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying failure actions of %s Windows service", serviceName)
+	}
+	failureOut := result.Stdout
+	result, err = vm.runWithTimeout(ctx, vm.timeouts.ServiceQuery, "sc.exe qfailureflag "+serviceName, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying failure actions flag of %s Windows service", serviceName)
 	}
-	log.V(1).Info("run", "cmd", cmd, "out", out)
-	return out, nil
+	if err := parseRecoveryConfig(status, failureOut, result.Stdout); err != nil {
+		return nil, err
+	}
+	return status, nil
 }
 
-func (vm *windows) Reinitialize() error {
-	if err := vm.interact.init(); err != nil {
-		return fmt.Errorf("failed to reinitialize ssh client: %v", err)
+func (vm *windows) Reinitialize(ctx context.Context) error {
+	if err := vm.interact.init(ctx); err != nil {
+		return errors.Wrap(err, "failed to reinitialize connectivity")
 	}
 	return nil
 }
 
 // ensureRequiredServicesStopped ensures that all services that are needed to configure a VM are stopped
-func (vm *windows) ensureRequiredServicesStopped() error {
-	// This slice order matters due to service dependencies
-	requiredSVCs := []string{windowsExporterServiceName, kubeProxyServiceName, hybridOverlayServiceName,
-		kubeletServiceName}
-	for _, svcName := range requiredSVCs {
+func (vm *windows) ensureRequiredServicesStopped(ctx context.Context) error {
+	for _, svcName := range requiredServices {
 		svc := &service{name: svcName}
-		if err := vm.ensureServiceNotRunning(svc); err != nil {
+		if err := vm.ensureServiceNotRunning(ctx, svc); err != nil {
 			return errors.Wrap(err, "could not stop service %d")
 		}
 	}
 	return nil
 }
 
-func (vm *windows) Configure() error {
+func (vm *windows) Configure(ctx context.Context, workerIgnition []byte) error {
 	log.Info("configuring")
-	if err := vm.ensureRequiredServicesStopped(); err != nil {
+	if err := vm.ensureRequiredServicesStopped(ctx); err != nil {
 		return errors.Wrap(err, "unable to stop required services")
 	}
-	if err := vm.createDirectories(); err != nil {
+	if err := vm.createDirectories(ctx); err != nil {
 		return errors.Wrap(err, "error creating directories on Windows VM")
 	}
-	if err := vm.transferFiles(); err != nil {
+	if err := vm.transferFiles(ctx); err != nil {
 		return errors.Wrap(err, "error transferring files to Windows VM")
 	}
-	if err := vm.ConfigureWindowsExporter(); err != nil {
+	if err := vm.ConfigureWindowsExporter(ctx); err != nil {
 		return errors.Wrapf(err, "error configuring Windows exporter on the Windows VM %s", vm.ID())
 	}
 
-	return vm.runBootstrapper()
+	return vm.runBootstrapper(ctx, workerIgnition)
 }
 
 // Start Windows metrics exporter service, only if the file is present on the VM
-func (vm *windows) ConfigureWindowsExporter() error {
-	windowsExporterService, err := newService(windowsExporterPath, windowsExporterServiceName, windowsExporterServiceArgs)
+func (vm *windows) ConfigureWindowsExporter(ctx context.Context) error {
+	if err := vm.exporter.Validate(); err != nil {
+		return err
+	}
+	windowsExporterService, err := newService(windowsExporterPath, windowsExporterServiceName, vm.exporter.args(),
+		vm.recovery)
 	if err != nil {
 		return errors.Wrapf(err, "error creating %s service object", windowsExporterServiceName)
 	}
 
-	if err := vm.ensureServiceIsRunning(windowsExporterService); err != nil {
+	if err := vm.ensureServiceIsRunning(ctx, windowsExporterService); err != nil {
 		return errors.Wrapf(err, "error ensuring %s Windows service has started running", windowsExporterServiceName)
 	}
 
 	return nil
 }
 
-func (vm *windows) ConfigureHybridOverlay(nodeName string) error {
+func (vm *windows) ConfigureHybridOverlay(ctx context.Context, nodeName string) error {
 	var customVxlanPortArg = ""
 	if len(vm.vxlanPort) > 0 {
 		customVxlanPortArg = " --hybrid-overlay-vxlan-port=" + vm.vxlanPort
 	}
 
 	hybridOverlayServiceArgs := "--node " + nodeName + customVxlanPortArg + " --k8s-kubeconfig c:\\k\\kubeconfig " +
-		"--windows-service " + "--logfile " + hybridOverlayLogDir + "hybrid-overlay.log\" depend= " + kubeletServiceName
+		"--windows-service " + "--logfile " + hybridOverlayLogDir + "hybrid-overlay.log"
 
 	log.Info("configure", "service", hybridOverlayServiceName, "args", hybridOverlayServiceArgs)
 
-	hybridOverlayService, err := newService(hybridOverlayPath, hybridOverlayServiceName, hybridOverlayServiceArgs)
+	hybridOverlayService, err := newService(hybridOverlayPath, hybridOverlayServiceName, hybridOverlayServiceArgs,
+		vm.recovery, kubeletServiceName)
 	if err != nil {
 		return errors.Wrapf(err, "error creating %s service object", hybridOverlayServiceName)
 	}
 
-	if err := vm.ensureServiceIsRunning(hybridOverlayService); err != nil {
+	if err := vm.ensureServiceIsRunning(ctx, hybridOverlayService); err != nil {
 		return errors.Wrapf(err, "error ensuring %s Windows service has started running", hybridOverlayServiceName)
 	}
 
-	if err = vm.waitForServiceToRun(hybridOverlayServiceName); err != nil {
-		return errors.Wrapf(err, "error running %s Windows service", hybridOverlayServiceName)
-	}
-	// Wait for the hybrid-overlay to complete reconfiguring the network. The only way to detect that it has completed
-	// the reconfiguration is to check for the HNS networks but doing that without reinitializing the WinRM client
-	// results in 5+ minutes wait times for the vm.Run() call to complete. So the only alternative is to wait before
-	// proceeding.
-	time.Sleep(hybridOverlayConfigurationTime)
+	log.Info("configured", "service", hybridOverlayServiceName, "args", hybridOverlayServiceArgs)
+	return nil
+}
 
-	// Running the hybrid-overlay causes network reconfiguration in the Windows VM which results in the ssh connection
-	// being closed and the client is not smart enough to reconnect. We have observed that the WinRM connection does not
-	// get closed and does not need reinitialization.
-	if err = vm.Reinitialize(); err != nil {
-		return errors.Wrap(err, "error reinitializing VM after running hybrid-overlay")
+func (vm *windows) HybridOverlayNetworksReady(ctx context.Context) (bool, error) {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Network, "\""+hnsQueryCmd("Get-HnsNetwork", "ID, Name, Type")+"\"",
+		true)
+	if err != nil {
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) && ctx.Err() == nil {
+			// Running the hybrid-overlay causes network reconfiguration in the Windows VM which results in the SSH
+			// connection being closed. Reconnect with a single attempt so that the caller can retry quickly.
+			reconnectCtx, cancel := context.WithTimeout(ctx, vm.timeouts.Connect)
+			defer cancel()
+			if initErr := vm.interact.init(reconnectCtx); initErr != nil {
+				log.V(1).Info("unable to reconnect while waiting for the HNS networks", "error", initErr)
+			}
+		}
+		return false, errors.Wrap(err, "error listing HNS networks")
 	}
-
-	if err = vm.waitForHNSNetworks(); err != nil {
-		return errors.Wrap(err, "error waiting for OVN HNS networks to be created")
+	var networks []hnsNetwork
+	if err := parseHNSOutput(result.Stdout, &networks); err != nil {
+		return false, err
 	}
-
-	log.Info("configured", "service", hybridOverlayServiceName, "args", hybridOverlayServiceArgs)
-	return nil
+	baseNetworkFound, networkFound := false, false
+	for _, network := range networks {
+		baseNetworkFound = baseNetworkFound || network.Name == BaseOVNKubeOverlayNetwork
+		networkFound = networkFound || network.Name == OVNKubeOverlayNetwork
+	}
+	return baseNetworkFound && networkFound, nil
 }
 
-func (vm *windows) ConfigureCNI(configFile string) error {
+func (vm *windows) ConfigureCNI(ctx context.Context, configFile string) error {
 	// copy the CNI config file to the Windows VM
 	file, err := payload.NewFileInfo(configFile)
 	if err != nil {
 		return errors.Wrap(err, "unable to get info for the CNI config file")
 	}
-	if err := vm.EnsureFile(file, cniConfDir); err != nil {
+	if err := vm.EnsureFile(ctx, file, cniConfDir); err != nil {
 		return errors.Errorf("unable to copy CNI file %s to %s", configFile, cniConfDir)
 	}
 
@@ -356,43 +476,46 @@ func (vm *windows) ConfigureCNI(configFile string) error {
 	configureCNICmd := k8sDir + "wmcb.exe configure-cni --cni-dir=\"" +
 		cniDir + " --cni-config=\"" + cniConfigDest
 
-	out, err := vm.Run(configureCNICmd, true)
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Bootstrapper, configureCNICmd, true)
 	if err != nil {
 		return errors.Wrap(err, "CNI configuration failed")
 	}
 
-	log.Info("configured kubelet for CNI", "cmd", configureCNICmd, "output", out)
+	log.Info("configured kubelet for CNI", "cmd", configureCNICmd, "output", result.Output())
 	return nil
 }
 
-func (vm *windows) ConfigureKubeProxy(nodeName, hostSubnet string) error {
-	sVIP, err := vm.getSourceVIP()
-	if err != nil {
-		return errors.Wrap(err, "error getting source VIP")
+func (vm *windows) Deconfigure(ctx context.Context) error {
+	log.Info("deconfiguring")
+	for _, svcName := range requiredServices {
+		svc := &service{name: svcName}
+		if err := vm.ensureServiceNotRunning(ctx, svc); err != nil {
+			return errors.Wrapf(err, "unable to stop %s service", svcName)
+		}
+		if err := vm.deleteService(ctx, svc); err != nil {
+			return err
+		}
 	}
-
-	kubeProxyServiceArgs := "--windows-service --v=4 --proxy-mode=kernelspace --feature-gates=WinOverlay=true " +
-		"--hostname-override=" + nodeName + " --kubeconfig=c:\\k\\kubeconfig " +
-		"--cluster-cidr=" + hostSubnet + " --log-dir=" + kubeProxyLogDir + " --logtostderr=false " +
-		"--network-name=OVNKubernetesHybridOverlayNetwork --source-vip=" + sVIP +
-		" --enable-dsr=false\" depend= " + hybridOverlayServiceName
-
-	kubeProxyService, err := newService(kubeProxyPath, kubeProxyServiceName, kubeProxyServiceArgs)
-	if err != nil {
-		return errors.Wrapf(err, "error creating %s service object", kubeProxyServiceName)
+	if err := vm.ConfigureFirewall(ctx, nil); err != nil {
+		return err
 	}
-
-	if err := vm.ensureServiceIsRunning(kubeProxyService); err != nil {
-		return errors.Wrapf(err, "error ensuring %s Windows service has started running", kubeProxyServiceName)
+	for _, path := range deconfiguredPaths {
+		if _, err := vm.runWithTimeout(ctx, vm.timeouts.Command, removePathCmd(path), true); err != nil {
+			return errors.Wrapf(err, "unable to delete %s", path)
+		}
+	}
+	// The network is reconfigured last, as it can drop the connection to the VM
+	if err := vm.removeHNSNetworks(ctx); err != nil {
+		return err
 	}
-	log.Info("configured", "service", kubeProxyServiceName, "args", kubeProxyServiceArgs)
+	log.Info("deconfigured")
 	return nil
 }
 
 // Interface helper methods
 
 // createDirectories creates directories required for configuring the Windows node on the VM
-func (vm *windows) createDirectories() error {
+func (vm *windows) createDirectories(ctx context.Context) error {
 	directoriesToCreate := []string{
 		k8sDir,
 		remoteDir,
@@ -403,7 +526,7 @@ func (vm *windows) createDirectories() error {
 		hybridOverlayLogDir,
 	}
 	for _, dir := range directoriesToCreate {
-		if _, err := vm.Run(mkdirCmd(dir), false); err != nil {
+		if _, err := vm.Run(ctx, mkdirCmd(dir), false); err != nil {
 			return errors.Wrapf(err, "unable to create remote directory %s", dir)
 		}
 	}
@@ -411,105 +534,153 @@ func (vm *windows) createDirectories() error {
 }
 
 // transferFiles copies various files required for configuring the Windows node, to the VM.
-func (vm *windows) transferFiles() error {
+func (vm *windows) transferFiles(ctx context.Context) error {
 	log.Info("transferring files")
 	filesToTransfer, err := getFilesToTransfer()
 	if err != nil {
 		return errors.Wrapf(err, "error getting list of files to transfer")
 	}
 	for src, dest := range filesToTransfer {
-		if err := vm.EnsureFile(src, dest); err != nil {
+		if err := vm.EnsureFile(ctx, src, dest); err != nil {
 			return errors.Wrapf(err, "error copying %s to %s ", src.Path, dest)
 		}
 	}
 	return nil
 }
 
-// runBootstrapper copies the bootstrapper and runs the code on the remote Windows VM
-func (vm *windows) runBootstrapper() error {
-	err := vm.initializeBootstrapperFiles()
-	if err != nil {
-		return errors.Wrap(err, "error initializing bootstrapper files")
+// runBootstrapper copies the worker ignition file and runs the bootstrapper on the remote Windows VM
+func (vm *windows) runBootstrapper(ctx context.Context, workerIgnition []byte) error {
+	// The ignition holds the bootstrap credentials of the node, it is transferred instead of being downloaded by the
+	// VM, which cannot verify the Machine Config Server certificate
+	if _, err := vm.ensureFileContent(ctx, workerIgnitionName, workerIgnition, winTemp); err != nil {
+		return errors.Wrap(err, "error transferring the worker ignition")
 	}
 	wmcbInitializeCmd := k8sDir + "\\wmcb.exe initialize-kubelet --ignition-file " + winTemp +
-		"worker.ign --kubelet-path " + k8sDir + "kubelet.exe"
+		workerIgnitionName + " --kubelet-path " + k8sDir + "kubelet.exe"
 
-	out, err := vm.Run(wmcbInitializeCmd, true)
-	log.Info("configured kubelet", "cmd", wmcbInitializeCmd, "output", out)
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.Bootstrapper, wmcbInitializeCmd, true)
+	log.Info("configured kubelet", "cmd", wmcbInitializeCmd, "output", result.Output())
 	if err != nil {
 		return errors.Wrap(err, "error running bootstrapper")
 	}
-	return nil
-}
-
-// initializeTestBootstrapperFiles initializes the files required for initialize-kubelet
-func (vm *windows) initializeBootstrapperFiles() error {
-	// Ignition v2.3.0 maps to Ignition config spec v3.1.0.
-	ignitionAcceptHeaderSpec := "application/vnd.coreos.ignition+json`;version=3.1.0"
-	// Download the worker ignition to C:\Windows\Temp\ using the script that ignores the server cert
-	ignitionFileDownloadCmd := wgetIgnoreCertCmd + " -server " + vm.workerIgnitionEndpoint + " -output " +
-		winTemp + "worker.ign" + " -acceptHeader " + ignitionAcceptHeaderSpec
-	_, err := vm.Run(ignitionFileDownloadCmd, true)
-	if err != nil {
-		return errors.Wrap(err, "unable to download worker.ign")
+	// The kubelet service is created by the bootstrapper, which does not set any failure actions
+	if err := vm.ensureRecoveryPolicy(ctx, kubeletServiceName); err != nil {
+		return errors.Wrap(err, "error setting kubelet recovery policy")
 	}
 	return nil
 }
 
-// ensureServiceIsRunning ensures a Windows service is running on the VM, creating and starting it if not already so
-func (vm *windows) ensureServiceIsRunning(svc *service) error {
-	serviceExists, err := vm.serviceExists(svc.name)
+// ensureServiceIsRunning ensures a Windows service is running on the VM, creating and starting it if not already so.
+// A *ServiceCrashLoopError is returned if the service does not reach the running state.
+func (vm *windows) ensureServiceIsRunning(ctx context.Context, svc *service) error {
+	status, err := vm.QueryService(ctx, svc.name)
 	if err != nil {
 		return errors.Wrapf(err, "error checking if %s Windows service exists", svc.name)
 	}
-	// create service if it does not exist
-	if !serviceExists {
-		if err := vm.createService(svc); err != nil {
+	// create service if it does not exist, and reconfigure it if it was created with different settings
+	if status == nil {
+		if err := vm.createService(ctx, svc); err != nil {
 			return errors.Wrapf(err, "error creating %s Windows service", svc.name)
 		}
+	} else if changes := svc.drift(status); len(changes) > 0 {
+		if err := vm.reconfigureService(ctx, svc, status, changes); err != nil {
+			return errors.Wrapf(err, "error reconfiguring %s Windows service", svc.name)
+		}
 	}
-	if err := vm.startService(svc); err != nil {
+	if err := vm.startService(ctx, svc); err != nil {
 		return errors.Wrapf(err, "error starting %s Windows service", svc.name)
 	}
+	if err := vm.waitForServiceToRun(ctx, svc.name); err != nil {
+		return errors.Wrapf(err, "error running %s Windows service", svc.name)
+	}
 	return nil
 }
 
 // createService creates the service on the Windows VM
-func (vm *windows) createService(svc *service) error {
+func (vm *windows) createService(ctx context.Context, svc *service) error {
 	if svc == nil {
 		return errors.New("service object should not be nil")
 	}
-	svcCreateCmd := "sc.exe create " + svc.name + " binPath=\"" + svc.binaryPath + " " + svc.args + " start=auto"
-	_, err := vm.Run(svcCreateCmd, false)
+	_, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceControl, svc.createCmd(), false)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create service %s", svc.name)
 	}
-	return nil
+	return vm.applyRecoveryPolicy(ctx, svc.name, svc.recovery)
 }
 
-// ensureServiceNotRunning stops a service if it exists and is running
-func (vm *windows) ensureServiceNotRunning(svc *service) error {
-	if svc == nil {
-		return errors.New("service object should not be nil")
+// applyRecoveryPolicy sets the failure actions of the given service to implement the recovery policy
+func (vm *windows) applyRecoveryPolicy(ctx context.Context, serviceName string, recovery RecoveryPolicy) error {
+	for _, cmd := range recovery.recoveryCmds(serviceName) {
+		if _, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceControl, cmd, false); err != nil {
+			return errors.Wrapf(err, "failed to set recovery policy of service %s", serviceName)
+		}
 	}
+	return nil
+}
 
-	exists, err := vm.serviceExists(svc.name)
+// ensureRecoveryPolicy applies the recovery policy to the given existing service, if its failure actions differ. It is
+// used for the services which are not created by the operator itself.
+func (vm *windows) ensureRecoveryPolicy(ctx context.Context, serviceName string) error {
+	status, err := vm.QueryService(ctx, serviceName)
 	if err != nil {
-		return errors.Wrap(err, "error checking if service exists")
+		return errors.Wrapf(err, "error querying %s Windows service", serviceName)
 	}
-	if !exists {
-		// service does not exist, therefore it is not running
+	if status == nil {
+		return errors.Errorf("%s Windows service does not exist", serviceName)
+	}
+	if vm.recovery.matches(status) {
 		return nil
 	}
+	log.Info("updating recovery policy", "service", serviceName, "failure actions", status.FailureActions,
+		"reset period", status.ResetPeriod)
+	if err := vm.applyRecoveryPolicy(ctx, serviceName, vm.recovery); err != nil {
+		return err
+	}
+	vm.recordEvent(core.EventTypeNormal, "ServiceReconfigured", "Windows service %s was reconfigured as its %s "+
+		"changed", serviceName, recoveryPolicyChange)
+	return nil
+}
+
+// reconfigureService stops the existing service, described by the given status, and updates its configuration to match
+// the given service. The changes are the names of the settings which differ.
+func (vm *windows) reconfigureService(ctx context.Context, svc *service, status *ServiceStatus,
+	changes []string) error {
+	log.Info("reconfiguring service", "service", svc.name, "changes", changes, "current binary path",
+		status.BinaryPath, "desired binary path", svc.commandLine(), "current dependencies", status.Dependencies,
+		"desired dependencies", svc.dependencies, "current start type", status.StartType,
+		"current failure actions", status.FailureActions, "current reset period", status.ResetPeriod)
+	// The recovery policy can be changed while the service is running, anything else requires a restart
+	if len(changes) > 1 || changes[0] != recoveryPolicyChange {
+		if err := vm.ensureServiceNotRunning(ctx, svc); err != nil {
+			return errors.Wrap(err, "unable to stop service before reconfiguring it")
+		}
+		if _, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceControl, svc.configCmd(), false); err != nil {
+			return errors.Wrapf(err, "failed to update configuration of service %s", svc.name)
+		}
+	}
+	if err := vm.applyRecoveryPolicy(ctx, svc.name, svc.recovery); err != nil {
+		return err
+	}
+	vm.recordEvent(core.EventTypeNormal, "ServiceReconfigured", "Windows service %s was reconfigured as its %s "+
+		"changed", svc.name, strings.Join(changes, ", "))
+	return nil
+}
+
+// ensureServiceNotRunning stops a service if it exists and is not stopped
+func (vm *windows) ensureServiceNotRunning(ctx context.Context, svc *service) error {
+	if svc == nil {
+		return errors.New("service object should not be nil")
+	}
 
-	running, err := vm.isRunning(svc.name)
+	status, err := vm.serviceState(ctx, svc.name)
 	if err != nil {
-		return errors.Wrap(err, "unable to check if service is running")
+		return errors.Wrap(err, "error checking if service exists")
 	}
-	if !running {
+	// A service that does not exist is not running
+	if status == nil || status.State == ServiceStopped {
 		return nil
 	}
-	if err := vm.stopService(svc); err != nil {
+	if err := vm.stopService(ctx, svc); err != nil {
 		return errors.Wrap(err, "unable to stop service")
 	}
 	return nil
@@ -517,25 +688,29 @@ func (vm *windows) ensureServiceNotRunning(svc *service) error {
 }
 
 // stopService stops the service that was already running
-func (vm *windows) stopService(svc *service) error {
+func (vm *windows) stopService(ctx context.Context, svc *service) error {
 	if svc == nil {
 		return errors.New("service object should not be nil")
 	}
-	// Success here means that the stop has initiated, not necessarily completed
-	out, err := vm.Run("sc.exe stop "+svc.name, false)
-	if err != nil {
-		return errors.Wrapf(err, "failed to stop %s service with output: %s", svc.name, out)
+	// Success here means that the stop has initiated, not necessarily completed. The service may have stopped on its
+	// own since it was last queried, or may already be stopping, neither of which is an error.
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceControl, "sc.exe stop "+svc.name, false,
+		errorServiceNotActive, errorServiceCannotAcceptControl)
+	if err != nil && !isExitCode(err, errorServiceNotActive, errorServiceCannotAcceptControl) {
+		return errors.Wrapf(err, "failed to stop %s service with output: %s", svc.name, result.Output())
 	}
 
 	// Wait until the service has stopped
-	err = wait.Poll(retry.Interval, retry.Timeout, func() (bool, error) {
-		serviceRunning, err := vm.isRunning(svc.name)
+	pollCtx, cancel := context.WithTimeout(ctx, retry.Timeout)
+	defer cancel()
+	err = wait.PollImmediateUntil(retry.Interval, func() (bool, error) {
+		status, err := vm.serviceState(pollCtx, svc.name)
 		if err != nil {
-			log.V(1).Error(err, "unable to check if Windows service is running", "service", svc.name)
+			log.V(1).Error(err, "unable to check if Windows service is stopped", "service", svc.name)
 			return false, nil
 		}
-		return !serviceRunning, nil
-	})
+		return status == nil || status.State == ServiceStopped, nil
+	}, pollCtx.Done())
 	if err != nil {
 		return errors.Wrapf(err, "error waiting for the %s service to stop", svc.name)
 	}
@@ -543,125 +718,163 @@ func (vm *windows) stopService(svc *service) error {
 	return nil
 }
 
-// serviceExists checks if the given service exists on Windows VM
-func (vm *windows) serviceExists(serviceName string) (bool, error) {
-	_, err := vm.Run(serviceQueryCmd+serviceName, false)
-	if err != nil {
-		if strings.Contains(err.Error(), serviceNotFound) {
-			return false, nil
-		}
-		return false, err
+// deleteService deletes the given service if it exists. The service should be stopped beforehand.
+func (vm *windows) deleteService(ctx context.Context, svc *service) error {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceControl, "sc.exe delete "+svc.name, false,
+		errorServiceDoesNotExist, errorServiceMarkedForDelete)
+	if err != nil && !isExitCode(err, errorServiceDoesNotExist, errorServiceMarkedForDelete) {
+		return errors.Wrapf(err, "failed to delete %s service with output: %s", svc.name, result.Output())
 	}
-	return true, nil
+	return nil
 }
 
-// isRunning checks the status of given service
-func (vm *windows) isRunning(serviceName string) (bool, error) {
-	out, err := vm.Run("sc.exe query "+serviceName, false)
+// removeHNSNetworks removes the VIP endpoint and the OVN overlay HNS networks, if they exist
+func (vm *windows) removeHNSNetworks(ctx context.Context) error {
+	cmd := "\"Get-HnsEndpoint | where { $_.Name -eq '" + vipEndpointName + "' } | Remove-HnsEndpoint; " +
+		"Get-HnsNetwork | where { $_.Name -eq '" + OVNKubeOverlayNetwork + "' -or $_.Name -eq '" +
+		BaseOVNKubeOverlayNetwork + "' } | Remove-HnsNetwork\""
+	_, err := vm.runWithTimeout(ctx, vm.timeouts.Network, cmd, true)
+	var exitErr *ExitError
+	if err == nil || errors.As(err, &exitErr) || ctx.Err() != nil {
+		return errors.Wrap(err, "error removing HNS networks")
+	}
+	// Removing the networks reconfigures the network of the VM, which can close the connection before the command
+	// returns. The command is idempotent, so reconnect and run it again to ensure it completed.
+	log.V(1).Info("reconnecting after removing HNS networks", "error", err)
+	if err := vm.Reinitialize(ctx); err != nil {
+		return errors.Wrap(err, "unable to reconnect after removing HNS networks")
+	}
+	_, err = vm.runWithTimeout(ctx, vm.timeouts.Network, cmd, true)
+	return errors.Wrap(err, "error removing HNS networks")
+}
+
+// serviceState returns the state of the given service, without its configuration, or nil if the service does not
+// exist
+func (vm *windows) serviceState(ctx context.Context, serviceName string) (*ServiceStatus, error) {
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceQuery, "sc.exe queryex "+serviceName, false,
+		errorServiceDoesNotExist)
 	if err != nil {
-		return false, err
+		if isExitCode(err, errorServiceDoesNotExist) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	return strings.Contains(out, "RUNNING"), nil
+	return parseServiceStatus(serviceName, result.Stdout, "")
 }
 
 // startService starts a previously created Windows service
-func (vm *windows) startService(svc *service) error {
+func (vm *windows) startService(ctx context.Context, svc *service) error {
 	if svc == nil {
 		return errors.New("service object should not be nil")
 	}
-	serviceRunning, err := vm.isRunning(svc.name)
+	status, err := vm.serviceState(ctx, svc.name)
 	if err != nil {
 		return errors.Wrapf(err, "unable to check if %s Windows service is running", svc.name)
 	}
-	if serviceRunning {
+	if status != nil && status.State != ServiceStopped {
+		// The service is running or is being started by the service control manager
 		return nil
 	}
-	out, err := vm.Run("sc.exe start "+svc.name, false)
-	if err != nil {
-		return errors.Wrapf(err, "failed to start %s service with output: %s", svc.name, out)
+	// The service may have been started by the service control manager since it was queried, which is not an error
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.ServiceControl, "sc.exe start "+svc.name, false,
+		errorServiceAlreadyRunning)
+	if err != nil && !isExitCode(err, errorServiceAlreadyRunning) {
+		return errors.Wrapf(err, "failed to start %s service with output: %s", svc.name, result.Output())
 	}
 	return nil
 }
 
-// waitForHNSNetworks waits for the OVN overlay HNS networks to be created until the timeout is reached
-func (vm *windows) waitForHNSNetworks() error {
-	var out string
+// waitForServiceToRun waits for the given service to be in RUNNING state until the timeout is reached. A
+// *ServiceCrashLoopError is returned if the service stops with a non-zero exit code or is still starting once the
+// timeout is reached.
+func (vm *windows) waitForServiceToRun(ctx context.Context, serviceName string) error {
+	var status *ServiceStatus
 	var err error
 	for retries := 0; retries < retry.Count; retries++ {
-		out, err = vm.Run("Get-HnsNetwork", true)
+		status, err = vm.serviceState(ctx, serviceName)
 		if err != nil {
-			// retry
-			continue
+			return errors.Wrapf(err, "unable to check if %s Windows service is running", serviceName)
 		}
-
-		if strings.Contains(out, BaseOVNKubeOverlayNetwork) &&
-			strings.Contains(out, OVNKubeOverlayNetwork) {
+		if status == nil {
+			return errors.Errorf("%s Windows service does not exist", serviceName)
+		}
+		if status.State == ServiceRunning {
 			return nil
 		}
-		time.Sleep(retry.Interval)
-	}
-
-	// OVN overlay HNS networks were not found
-	log.Info("Get-HnsNetwork", "output", out)
-	return errors.Wrap(err, "timeout waiting for OVN overlay HNS networks")
-}
-
-// waitForServiceToRun waits for the given service to be in RUNNING state
-// until the timeout is reached
-func (vm *windows) waitForServiceToRun(serviceName string) error {
-	var err error
-	for retries := 0; retries < retry.Count; retries++ {
-		serviceRunning, err := vm.isRunning(serviceName)
-		if err != nil {
-			return errors.Wrapf(err, "unable to check if %s Windows service is running", serviceName)
+		if status.exitedWithError() {
+			return &ServiceCrashLoopError{Status: *status}
 		}
-		if serviceRunning {
-			return nil
+		if err := sleep(ctx, retry.Interval); err != nil {
+			return errors.Wrapf(err, "aborted waiting for %s service to be in running state", serviceName)
 		}
-		time.Sleep(retry.Interval)
 	}
 
-	// service did not reach running state
-	return fmt.Errorf("timeout waiting for %s service to be in running state: %v", serviceName, err)
-}
-
-// getSourceVIP returns the source VIP of the VM
-func (vm *windows) getSourceVIP() (string, error) {
-	cmd := "\"Import-Module -DisableNameChecking " + hnsPSModule + "; " +
-		"$net = (Get-HnsNetwork | where { $_.Name -eq 'OVNKubernetesHybridOverlayNetwork' }); " +
-		"$endpoint = New-HnsEndpoint -NetworkId $net.ID -Name VIPEndpoint; " +
-		"Attach-HNSHostEndpoint -EndpointID $endpoint.ID -CompartmentID 1; " +
-		"(Get-NetIPConfiguration -AllCompartments -All -Detailed | " +
-		"where { $_.NetAdapter.LinkLayerAddress -eq $endpoint.MacAddress }).IPV4Address.IPAddress.Trim()\""
-	out, err := vm.Run(cmd, true)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to get source VIP")
+	if status.State == ServiceStartPending {
+		return &ServiceCrashLoopError{Status: *status}
 	}
-
-	// stdout will have trailing '\r\n', so need to trim it
-	sourceVIP := strings.TrimSpace(out)
-	if sourceVIP == "" {
-		return "", fmt.Errorf("source VIP is empty")
-	}
-	return sourceVIP, nil
+	// service did not reach running state
+	return fmt.Errorf("timeout waiting for %s service to be in running state, service is in %s state", serviceName,
+		status.State)
 }
 
 // newFileInfo returns a pointer to a FileInfo object created from the specified file on the Windows VM
-func (vm *windows) newFileInfo(path string) (*payload.FileInfo, error) {
+func (vm *windows) newFileInfo(ctx context.Context, path string) (*payload.FileInfo, error) {
 	// Get-FileHash returns an object with multiple properties, we are interested in the `Hash` property
 	command := "$out = Get-FileHash " + path + " -Algorithm SHA256; $out.Hash"
-	out, err := vm.Run(command, true)
+	result, err := vm.runWithTimeout(ctx, vm.timeouts.FileHash, command, true)
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting file hash")
 	}
 	// The returned hash will be in all caps with newline characters, doing ToLower() to
 	// make the output normalized with the go sha256 library
-	sha := strings.ToLower(strings.TrimSpace(out))
+	sha := strings.ToLower(strings.TrimSpace(result.Stdout))
 	return &payload.FileInfo{Path: path, SHA256: sha}, nil
 }
 
+// ensureFile copies the file to the given remote directory, unless it already exists there with the desired content.
+// It returns true if the file was copied.
+func (vm *windows) ensureFile(ctx context.Context, file *payload.FileInfo, remoteDir string) (bool, error) {
+	remotePath := remoteDir + "\\" + filepath.Base(file.Path)
+	fileExists, err := vm.FileExists(ctx, remotePath)
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking if file '%s' exists on the Windows VM", remotePath)
+	}
+	if fileExists {
+		remoteFile, err := vm.newFileInfo(ctx, remotePath)
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting info on file '%s' on the Windows VM", remotePath)
+		}
+		if file.SHA256 == remoteFile.SHA256 {
+			// The file already exists with the expected content, do nothing
+			log.V(1).Info("file already exists on VM with expected content", "file", file.Path)
+			return false, nil
+		}
+	}
+
+	log.V(1).Info("copy", "local file", file.Path, "remote dir", remoteDir)
+	transferCtx, cancel := context.WithTimeout(ctx, vm.timeouts.FileTransfer)
+	defer cancel()
+	if err := vm.interact.transfer(transferCtx, file.Path, remoteDir); err != nil {
+		return false, errors.Wrapf(err, "unable to transfer %s to remote dir %s", file.Path, remoteDir)
+	}
+	return true, nil
+}
+
+// recordEvent records an event about the VM, if a recorder was given
+func (vm *windows) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if vm.recorder == nil {
+		return
+	}
+	vm.recorder.Eventf(eventType, reason, messageFmt, args...)
+}
+
 // Generic helper methods
 
+// removePathCmd returns the PowerShell command to delete a file or directory, along with its contents, if it exists
+func removePathCmd(path string) string {
+	return "\"if (Test-Path " + path + ") { Remove-Item -Path " + path + " -Recurse -Force }\""
+}
+
 // mkdirCmd returns the Windows command to create a directory if it does not exists
 func mkdirCmd(dirName string) string {
 	return "if not exist " + dirName + " mkdir " + dirName
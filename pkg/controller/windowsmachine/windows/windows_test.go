@@ -0,0 +1,420 @@
+package windows
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/payload"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows/simulator"
+)
+
+// testIgnition is the worker ignition given to the simulated VMs
+const testIgnition = `{"ignition":{"version":"3.1.0"}}`
+
+// newSimulatedVM returns a Windows VM backed by a newly started simulator. The payload transferred to the VM is
+// replaced by small local files for the duration of the test.
+func newSimulatedVM(t *testing.T) (*windows, *simulator.Simulator, *fakeRecorder) {
+	signer := newTestSigner(t)
+	sim, err := simulator.New(signer.PublicKey())
+	require.NoError(t, err)
+	t.Cleanup(func() { sim.Close() })
+	useTestPayload(t)
+
+	conn := &sshConnectivity{
+		instanceID:     "i-0123",
+		username:       "Administrator",
+		ipAddress:      sim.Host(),
+		port:           sim.Port(),
+		signer:         signer,
+		hostKeys:       memoryHostKeyStore{},
+		connectTimeout: DefaultTimeouts().Connect,
+	}
+	require.NoError(t, conn.init(context.Background()))
+	recorder := &fakeRecorder{}
+	return &windows{
+		id:        "i-0123",
+		interact:  conn,
+		timeouts:  DefaultTimeouts(),
+		recorder:  recorder,
+		recovery:  DefaultRecoveryPolicy(),
+		exporter:  DefaultExporterConfig(),
+		kubeProxy: DefaultKubeProxyConfig(),
+	}, sim, recorder
+}
+
+// useTestPayload replaces the files transferred to the VMs by local files with the same names for the duration of the
+// test
+func useTestPayload(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[*payload.FileInfo]string)
+	for src, dest := range map[string]string{
+		payload.WmcbPath:             k8sDir,
+		payload.HybridOverlayPath:    k8sDir,
+		payload.HNSPSModule:          remoteDir,
+		payload.WindowsExporterPath:  k8sDir,
+		payload.FlannelCNIPluginPath: cniDir,
+		payload.WinBridgeCNIPlugin:   cniDir,
+		payload.HostLocalCNIPlugin:   cniDir,
+		payload.WinOverlayCNIPlugin:  cniDir,
+		payload.KubeProxyPath:        k8sDir,
+		payload.KubeletPath:          k8sDir,
+	} {
+		path := filepath.Join(dir, filepath.Base(src))
+		require.NoError(t, ioutil.WriteFile(path, []byte("content of "+filepath.Base(src)), 0644))
+		file, err := payload.NewFileInfo(path)
+		require.NoError(t, err)
+		files[file] = dest
+	}
+	previous := filesToTransfer
+	filesToTransfer = files
+	t.Cleanup(func() { filesToTransfer = previous })
+}
+
+// assertServiceRunning asserts that the given service of the simulator is running with the default recovery policy
+// and returns it
+func assertServiceRunning(t *testing.T, sim *simulator.Simulator, name string) simulator.Service {
+	svc, ok := sim.Service(name)
+	require.True(t, ok, "%s service does not exist", name)
+	assert.Equal(t, simulator.StateRunning, svc.State, "%s service is not running", name)
+	assert.Equal(t, simulator.StartTypeAuto, svc.StartType)
+	assert.Len(t, svc.FailureActions, DefaultRecoveryPolicy().Attempts, "%s recovery policy was not applied", name)
+	assert.True(t, svc.FailureActionsOnNonCrashFailures)
+	return svc
+}
+
+// TestHybridOverlayNetworksReady tests that the OVN overlay HNS networks are detected and that the VM is reconnected
+// to when the connection was dropped
+func TestHybridOverlayNetworksReady(t *testing.T) {
+	tests := []struct {
+		name          string
+		stdout        string
+		exitCode      int
+		runErr        error
+		expected      bool
+		expectedErr   bool
+		expectedInits int
+	}{
+		{
+			name: "both networks",
+			stdout: `[{"ID":"1","Name":"ext","Type":"L2Bridge"},{"ID":"2","Name":"` + BaseOVNKubeOverlayNetwork +
+				`","Type":"Overlay"},{"ID":"3","Name":"` + OVNKubeOverlayNetwork + `","Type":"Overlay"}]` + "\r\n",
+			expected: true,
+		},
+		{
+			name:     "base network only",
+			stdout:   `[{"ID":"2","Name":"` + BaseOVNKubeOverlayNetwork + `","Type":"Overlay"}]` + "\r\n",
+			expected: false,
+		},
+		{
+			name:     "no networks",
+			stdout:   "[]\r\n",
+			expected: false,
+		},
+		{
+			name:        "invalid output",
+			stdout:      BaseOVNKubeOverlayNetwork + "\r\n" + OVNKubeOverlayNetwork + "\r\n",
+			expectedErr: true,
+		},
+		{
+			name:        "command failure",
+			exitCode:    1,
+			expectedErr: true,
+		},
+		{
+			name:          "connection dropped",
+			runErr:        io.EOF,
+			expectedErr:   true,
+			expectedInits: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeConnectivity{
+				handler: func(string) (string, string, int) { return tt.stdout, "", tt.exitCode },
+				runErr:  tt.runErr,
+			}
+			vm := &windows{interact: conn, timeouts: DefaultTimeouts()}
+			ready, err := vm.HybridOverlayNetworksReady(context.Background())
+			if tt.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, ready)
+			assert.Equal(t, tt.expectedInits, conn.inits, "unexpected number of reconnections")
+		})
+	}
+}
+
+// TestConfigure tests that a VM is prepared for the bootstrapper and that the kubelet is configured by it
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup is run against the simulator before the VM is configured
+		setup         func(sim *simulator.Simulator)
+		expectedErr   string
+		expectedCrash string
+	}{
+		{
+			name:  "fresh VM",
+			setup: func(*simulator.Simulator) {},
+		},
+		{
+			name: "corrupted binary",
+			setup: func(sim *simulator.Simulator) {
+				sim.WriteFile(k8sDir+"kubelet.exe", []byte("corrupted"))
+			},
+		},
+		{
+			name: "stale running services",
+			setup: func(sim *simulator.Simulator) {
+				sim.WriteFile(windowsExporterPath, []byte("old"))
+				sim.SetService(simulator.Service{Name: windowsExporterServiceName, BinaryPath: windowsExporterPath,
+					StartType: simulator.StartTypeAuto, State: simulator.StateRunning})
+			},
+		},
+		{
+			name: "bootstrapper failure",
+			setup: func(sim *simulator.Simulator) {
+				sim.Inject(simulator.Fault{Match: "wmcb.exe initialize-kubelet", ExitCode: 1,
+					Stderr: "initialize-kubelet failed"})
+			},
+			expectedErr: "error running bootstrapper",
+		},
+		{
+			name: "crashing Windows exporter",
+			setup: func(sim *simulator.Simulator) {
+				sim.CrashOnStart(windowsExporterServiceName, 255)
+			},
+			expectedCrash: "exited with service specific exit code 255",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, sim, _ := newSimulatedVM(t)
+			tt.setup(sim)
+			err := vm.Configure(context.Background(), []byte(testIgnition))
+			if tt.expectedCrash != "" {
+				var crashLoopErr *ServiceCrashLoopError
+				require.True(t, errors.As(err, &crashLoopErr), "unexpected error %v", err)
+				assert.Equal(t, tt.expectedCrash, crashLoopErr.Reason())
+				return
+			}
+			if tt.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			kubelet, ok := sim.File(k8sDir + "kubelet.exe")
+			require.True(t, ok, "kubelet was not transferred")
+			assert.Equal(t, "content of kubelet.exe", string(kubelet))
+			ignition, ok := sim.File(winTemp + workerIgnitionName)
+			require.True(t, ok, "worker ignition was not transferred")
+			assert.Equal(t, testIgnition, string(ignition))
+			assertServiceRunning(t, sim, kubeletServiceName)
+			exporter := assertServiceRunning(t, sim, windowsExporterServiceName)
+			assert.Equal(t, windowsExporterPath+" "+DefaultExporterConfig().args(), exporter.BinaryPath)
+		})
+	}
+}
+
+// TestConfigureHybridOverlay tests that the hybrid-overlay is started after the kubelet and that its HNS networks are
+// detected once the connection dropped by the network reconfiguration is re-established
+func TestConfigureHybridOverlay(t *testing.T) {
+	tests := []struct {
+		name      string
+		vxlanPort string
+		// configure is true if the VM is configured before the hybrid-overlay
+		configure   bool
+		expectedErr bool
+	}{
+		{
+			name:      "default VXLAN port",
+			configure: true,
+		},
+		{
+			name:      "custom VXLAN port",
+			vxlanPort: "9898",
+			configure: true,
+		},
+		{
+			name:        "missing kubelet",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, sim, _ := newSimulatedVM(t)
+			vm.vxlanPort = tt.vxlanPort
+			if tt.configure {
+				require.NoError(t, vm.Configure(context.Background(), []byte(testIgnition)))
+			} else {
+				require.NoError(t, vm.transferFiles(context.Background()))
+			}
+			err := vm.ConfigureHybridOverlay(context.Background(), "node-1")
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			svc := assertServiceRunning(t, sim, hybridOverlayServiceName)
+			assert.Contains(t, svc.BinaryPath, "--node node-1 ")
+			assert.Equal(t, tt.vxlanPort != "", strings.Contains(svc.BinaryPath,
+				"--hybrid-overlay-vxlan-port="+tt.vxlanPort))
+			assert.Equal(t, []string{kubeletServiceName}, svc.Dependencies)
+
+			// The network reconfiguration drops the connection while the networks are listed
+			sim.Inject(simulator.Fault{Match: "Get-HnsNetwork", DropConnection: true, Times: 1})
+			dials := sim.Dials()
+			_, err = vm.HybridOverlayNetworksReady(context.Background())
+			assert.Error(t, err)
+			assert.Equal(t, dials+1, sim.Dials(), "VM was not reconnected to")
+			ready, err := vm.HybridOverlayNetworksReady(context.Background())
+			require.NoError(t, err)
+			assert.True(t, ready)
+		})
+	}
+}
+
+// TestConfigureKubeProxy tests that kube-proxy is started with a configuration file holding the source VIP of the VM,
+// and restarted with the updated file once the source VIP changes
+func TestConfigureKubeProxy(t *testing.T) {
+	vm, sim, recorder := newSimulatedVM(t)
+	ctx := context.Background()
+	// The source VIP cannot be found before the hybrid-overlay has created its network
+	require.NoError(t, vm.Configure(ctx, []byte(testIgnition)))
+	_, err := vm.EnsureSourceVIP(ctx, "")
+	assert.Error(t, err)
+	assert.Error(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", ""))
+
+	require.NoError(t, vm.ConfigureHybridOverlay(ctx, "node-1"))
+	// Ignore the events about the recovery policy of the kubelet created by the bootstrapper
+	recorder.reasons = nil
+	sourceVIP, err := vm.EnsureSourceVIP(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, simulator.DefaultSourceVIP, sourceVIP)
+	require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", sourceVIP))
+	svc := assertServiceRunning(t, sim, kubeProxyServiceName)
+	assert.Contains(t, svc.BinaryPath, "--config="+kubeProxyConfigPath+" ")
+	assert.Equal(t, []string{hybridOverlayServiceName}, svc.Dependencies)
+	config := readKubeProxyConfig(t, sim)
+	assert.Equal(t, simulator.DefaultSourceVIP, config.Winkernel.SourceVip)
+	assert.Equal(t, "10.132.0.0/14", config.ClusterCIDR)
+	assert.Equal(t, "node-1", config.HostnameOverride)
+	assert.Empty(t, recorder.reasons)
+
+	require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", "10.132.1.3"))
+	assertServiceRunning(t, sim, kubeProxyServiceName)
+	assert.Equal(t, "10.132.1.3", readKubeProxyConfig(t, sim).Winkernel.SourceVip)
+	assert.Equal(t, []string{"ServiceReconfigured"}, recorder.reasons)
+}
+
+// TestConfigureKubeProxyLongCommandLine tests that the configuration of a kube-proxy service run with a command line
+// too long for the default buffer of sc.exe qc can be queried, so that the service is not reconfigured again
+func TestConfigureKubeProxyLongCommandLine(t *testing.T) {
+	vm, sim, recorder := newSimulatedVM(t)
+	ctx := context.Background()
+	vm.kubeProxy.ExtraArgs = map[string]string{"vmodule": strings.Repeat("proxier=5,", 100) + "winkernel=5"}
+	require.NoError(t, vm.Configure(ctx, []byte(testIgnition)))
+	require.NoError(t, vm.ConfigureHybridOverlay(ctx, "node-1"))
+	sourceVIP, err := vm.EnsureSourceVIP(ctx, "")
+	require.NoError(t, err)
+	require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", sourceVIP))
+	svc := assertServiceRunning(t, sim, kubeProxyServiceName)
+	require.Greater(t, len(svc.BinaryPath), 1024)
+
+	status, err := vm.QueryService(ctx, kubeProxyServiceName)
+	require.NoError(t, err)
+	assert.Equal(t, svc.BinaryPath, status.BinaryPath)
+	recorder.reasons = nil
+	drift, err := vm.KubeProxyDrift(ctx, "node-1", "10.132.0.0/14", sourceVIP)
+	require.NoError(t, err)
+	assert.Empty(t, drift)
+	require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", sourceVIP))
+	assert.Empty(t, recorder.reasons, "kube-proxy was reconfigured")
+}
+
+// readKubeProxyConfig returns the kube-proxy configuration file written to the simulated VM
+func readKubeProxyConfig(t *testing.T, sim *simulator.Simulator) *kubeProxyConfiguration {
+	data, found := sim.File(kubeProxyConfigPath)
+	require.True(t, found, "kube-proxy configuration file not found")
+	config := &kubeProxyConfiguration{}
+	require.NoError(t, yaml.Unmarshal(data, config))
+	return config
+}
+
+// TestDeconfigure tests that the services, HNS networks and files set up on a VM are removed, and that only the files
+// transferred by the operator are deleted
+func TestDeconfigure(t *testing.T) {
+	tests := []struct {
+		name string
+		// configured is true if the VM is configured into a node before being deconfigured
+		configured bool
+		// fault is injected into the simulator before the VM is deconfigured
+		fault *simulator.Fault
+	}{
+		{
+			name:       "configured node",
+			configured: true,
+		},
+		{
+			name:       "connection dropped while removing the HNS networks",
+			configured: true,
+			fault:      &simulator.Fault{Match: "Remove-HnsNetwork", DropConnection: true, Times: 1},
+		},
+		{
+			name: "unconfigured VM",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, sim, _ := newSimulatedVM(t)
+			ctx := context.Background()
+			sim.WriteFile(remoteDir+"user-data.log", []byte("not ours"))
+			if tt.configured {
+				require.NoError(t, vm.Configure(ctx, []byte(testIgnition)))
+				require.NoError(t, vm.ConfigureHybridOverlay(ctx, "node-1"))
+				sourceVIP, err := vm.EnsureSourceVIP(ctx, "")
+				require.NoError(t, err)
+				require.NoError(t, vm.ConfigureKubeProxy(ctx, "node-1", "10.132.0.0/14", sourceVIP))
+				require.NoError(t, vm.ConfigureFirewall(ctx, NodeFirewallRules(9182, "", "30000-32767")))
+				sim.WriteFile(kubeProxyLogDir+"kube-proxy.exe.INFO", []byte("log"))
+				require.NotEmpty(t, sim.Endpoints())
+			}
+			if tt.fault != nil {
+				sim.Inject(*tt.fault)
+			}
+
+			require.NoError(t, vm.Deconfigure(ctx))
+			for _, name := range requiredServices {
+				_, ok := sim.Service(name)
+				assert.False(t, ok, "%s service was not deleted", name)
+			}
+			assert.Empty(t, sim.Networks())
+			assert.Empty(t, sim.Endpoints())
+			assert.Empty(t, sim.FirewallRules())
+			for _, path := range []string{k8sDir + "kubelet.exe", cniDir + "flannel.exe", hnsPSModule,
+				winTemp + "worker.ign", kubeProxyLogDir + "kube-proxy.exe.INFO"} {
+				_, ok := sim.File(path)
+				assert.False(t, ok, "%s was not deleted", path)
+			}
+			_, ok := sim.File(remoteDir + "user-data.log")
+			assert.True(t, ok, "a file not transferred by the operator was deleted")
+
+			// Deconfiguring is idempotent
+			require.NoError(t, vm.Deconfigure(ctx))
+		})
+	}
+}
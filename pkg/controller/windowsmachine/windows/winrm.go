@@ -0,0 +1,573 @@
+package windows
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// WinRMCertificateAuth is the WinRM authentication type which uses a client certificate mapped to a local user
+	WinRMCertificateAuth = "certificate"
+	// WinRMNTLMAuth is the WinRM authentication type which uses NTLMv2 with a username and password
+	WinRMNTLMAuth = "ntlm"
+
+	// winrmHostKeySuffix is appended to the instance ID when recording the fingerprint of the WinRM server certificate,
+	// so that it does not conflict with the SSH host key of the same VM
+	winrmHostKeySuffix = ".winrm"
+	// winrmOperationTimeout is the maximum time the WinRM service waits before responding to a Receive request
+	winrmOperationTimeout = 60 * time.Second
+	// winrmHTTPTimeout is the timeout for a single WinRM HTTP request
+	winrmHTTPTimeout = winrmOperationTimeout + 30*time.Second
+	// winrmChunkSize is the number of bytes uploaded per Send request by transfer. The chunk is base64 encoded into a
+	// line of the command input, which is base64 encoded again into the request envelope, so it has to stay within the
+	// default 150 KiB envelope size limit of the WinRM service.
+	winrmChunkSize = 65536
+	// winrmFetchChunkSize is the number of bytes downloaded per command by fetch. The chunk is base64 encoded into the
+	// command output, which has to fit in a single response envelope.
+	winrmFetchChunkSize = 65536
+	// winrmMaxEnvelopeSize is the maximum size of a WinRM response envelope, in bytes
+	winrmMaxEnvelopeSize = 153600
+	// winrmMutualAuthHeader is the Authorization header value used for certificate authentication
+	winrmMutualAuthHeader = "http://schemas.dmtf.org/wbem/wsman/1/wsman/secprofile/https/mutual"
+	// winrmCleanupTimeout is the timeout of the requests terminating commands and deleting shells, which are sent
+	// even if the operation was aborted
+	winrmCleanupTimeout = 30 * time.Second
+	// winrmTimedOutFault is the WS-Management fault code returned when a Receive request times out without output
+	winrmTimedOutFault = "2150858793"
+
+	// WS-Management actions and URIs used by the WinRM shell protocol, as defined in [MS-WSMV]
+	wsmanCreateAction    = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	wsmanDeleteAction    = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	wsmanCommandAction   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	wsmanReceiveAction   = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	wsmanSendAction      = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Send"
+	wsmanSignalAction    = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+	wsmanCmdShellURI     = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+	wsmanTerminateSignal = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+	wsmanCommandDone     = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+)
+
+// WinRMSettings holds the information required to connect to a Windows VM over WinRM
+type WinRMSettings struct {
+	// Port is the WinRM HTTPS port
+	Port string
+	// AuthType is either WinRMCertificateAuth or WinRMNTLMAuth
+	AuthType string
+	// Username is the user to authenticate as when using NTLM authentication. The provider specific administrator
+	// is used if it is empty.
+	Username string
+	// Password is the password of the user when using NTLM authentication
+	Password string
+	// Certificate is the client certificate used for certificate authentication
+	Certificate *tls.Certificate
+}
+
+// winrmConnectivity encapsulates the information needed to connect to the Windows VM over WinRM
+type winrmConnectivity struct {
+	// instanceID is the VM's cloud provider ID, used as the key for the recorded server certificate fingerprint
+	instanceID string
+	// username is the user to connect to the VM as, when using NTLM authentication
+	username string
+	// ipAddress is the VM's IP address
+	ipAddress string
+	// settings holds the WinRM port and credentials
+	settings *WinRMSettings
+	// hostKeys is used to record and verify the server certificate presented by the VM
+	hostKeys HostKeyStore
+	// connectTimeout is the maximum time a single attempt to connect to the VM is allowed to take
+	connectTimeout time.Duration
+	// connectAttempts is the number of attempts to connect to the VM, at least one attempt is made
+	connectAttempts int
+	// endpoint is the WinRM service URL
+	endpoint string
+	// client is the HTTP client used to send requests to the WinRM service
+	client *http.Client
+}
+
+// newWinRMConnectivity returns an instance of winrmConnectivity
+func newWinRMConnectivity(ctx context.Context, instanceID, username, ipAddress string,
+	settings ConnectionSettings) (connectivity, error) {
+	if settings.WinRM == nil {
+		return nil, errors.New("WinRM settings are required for the WinRM backend")
+	}
+	if settings.WinRM.Username != "" {
+		username = settings.WinRM.Username
+	}
+	c := &winrmConnectivity{
+		instanceID:      instanceID,
+		username:        username,
+		ipAddress:       ipAddress,
+		settings:        settings.WinRM,
+		hostKeys:        settings.HostKeys,
+		connectTimeout:  settings.Timeouts.withDefaults().Connect,
+		connectAttempts: settings.connectAttempts(),
+	}
+	if err := c.init(ctx); err != nil {
+		return nil, errors.Wrap(err, "error instantiating WinRM client")
+	}
+	return c, nil
+}
+
+// init initialises the WinRM HTTPS client and verifies that a shell can be created on the VM. The server certificate
+// presented by the VM is recorded on first contact and verified against the recorded fingerprint on every later call.
+func (c *winrmConnectivity) init(ctx context.Context) error {
+	if c.instanceID == "" || c.ipAddress == "" || c.settings == nil || c.hostKeys == nil {
+		return fmt.Errorf("incomplete winrmConnectivity information: %v", c)
+	}
+
+	hostKeyID := c.instanceID + winrmHostKeySuffix
+	expected, err := c.hostKeys.Get(hostKeyID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to get recorded server certificate for VM %s", c.instanceID)
+	}
+	verifier := &hostKeyVerifier{instanceID: c.instanceID, ipAddress: c.ipAddress, expected: expected}
+
+	tlsConfig := &tls.Config{
+		// The VMs use self-signed certificates, the certificate is instead pinned by verifyCertificate
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifier.verifyCertificate,
+	}
+	var transport http.RoundTripper
+	httpTransport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		// NTLM authenticates connections, so all requests to a VM have to go through the same connection
+		MaxConnsPerHost:     1,
+		MaxIdleConnsPerHost: 1,
+		DialContext:         (&net.Dialer{Timeout: c.connectTimeout}).DialContext,
+		TLSHandshakeTimeout: c.connectTimeout,
+	}
+	transport = httpTransport
+	switch c.settings.AuthType {
+	case WinRMCertificateAuth:
+		if c.settings.Certificate == nil {
+			return errors.New("client certificate is required for WinRM certificate authentication")
+		}
+		tlsConfig.Certificates = []tls.Certificate{*c.settings.Certificate}
+	case WinRMNTLMAuth:
+		if c.username == "" || c.settings.Password == "" {
+			return errors.New("username and password are required for WinRM NTLM authentication")
+		}
+		transport = newNTLMTransport(httpTransport, c.username, c.settings.Password)
+	default:
+		return errors.Errorf("unsupported WinRM authentication type %q", c.settings.AuthType)
+	}
+	c.client = &http.Client{Transport: transport, Timeout: winrmHTTPTimeout}
+	c.endpoint = "https://" + net.JoinHostPort(c.ipAddress, c.settings.Port) + "/wsman"
+
+	// Retry if we are unable to create a shell as the VM could still be executing the steps in its user data
+	var shellID string
+	for attempt := 1; ; attempt++ {
+		shellID, err = c.createShell(ctx)
+		if err == nil {
+			break
+		}
+		if verifier.mismatch != nil {
+			return verifier.mismatch
+		}
+		log.V(1).Info("WinRM connect", "IP Address", c.ipAddress, "error", err)
+		if attempt >= c.connectAttempts {
+			break
+		}
+		if err := sleep(ctx, connectRetryInterval); err != nil {
+			return errors.Wrapf(err, "unable to connect to Windows VM %s", c.ipAddress)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to connect to Windows VM %s", c.ipAddress)
+	}
+	c.deleteShell(shellID)
+
+	// Trust on first use: record the server certificate now that we have successfully authenticated against the VM
+	if expected == "" {
+		if err := c.hostKeys.Set(hostKeyID, verifier.presented); err != nil {
+			return errors.Wrapf(err, "unable to record server certificate for VM %s", c.instanceID)
+		}
+		log.Info("recorded WinRM server certificate", "fingerprint", verifier.presented)
+	}
+	return nil
+}
+
+// run executes the command in a new WinRM shell, returning its stdout, stderr and exit code. The command is
+// terminated if the context is done before it completes.
+func (c *winrmConnectivity) run(ctx context.Context, cmd string) (*CommandResult, error) {
+	if c.client == nil {
+		return nil, errors.New("run cannot be called with nil WinRM client")
+	}
+	start := time.Now()
+	shellID, err := c.createShell(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.deleteShell(shellID)
+
+	stdout, stderr, exitCode, err := c.execute(ctx, shellID, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return newCommandResult(stdout, stderr, exitCode, start)
+}
+
+// transfer copies the file from the local disk to the remote VM directory, creating the directory if needed. The file
+// is streamed in base64 encoded chunks to the input of a single command, which writes them to the remote file. The
+// transfer is aborted if the context is done before it completes.
+func (c *winrmConnectivity) transfer(ctx context.Context, filePath, remoteDir string) error {
+	if c.client == nil {
+		return errors.New("transfer cannot be called with nil WinRM client")
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %s file to be transferred", filePath)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Error(err, "error closing local file", "file", filePath)
+		}
+	}()
+
+	shellID, err := c.createShell(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.deleteShell(shellID)
+
+	if err := c.executeChecked(ctx, shellID, mkdirCmd(remoteDir)); err != nil {
+		return errors.Wrapf(err, "error creating %s directory on Windows VM", remoteDir)
+	}
+
+	remoteFile := remoteDir + "\\" + filepath.Base(filePath)
+	commandID, err := c.startCommand(ctx, shellID, writeFileCmd(remoteFile))
+	if err != nil {
+		return errors.Wrapf(err, "error copying %s to the Windows VM", filePath)
+	}
+	defer c.terminate(shellID, commandID)
+
+	chunk := make([]byte, winrmChunkSize)
+	for {
+		n, err := io.ReadFull(f, chunk)
+		end := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !end {
+			return errors.Wrapf(err, "error reading %s", filePath)
+		}
+		var line []byte
+		if n > 0 {
+			line = []byte(base64.StdEncoding.EncodeToString(chunk[:n]) + "\r\n")
+		}
+		if err := c.sendInput(ctx, shellID, commandID, line, end); err != nil {
+			return errors.Wrapf(err, "error copying %s to the Windows VM", filePath)
+		}
+		if end {
+			break
+		}
+	}
+
+	stdout, stderr, exitCode, err := c.receive(ctx, shellID, commandID)
+	if err != nil {
+		return errors.Wrapf(err, "error copying %s to the Windows VM", filePath)
+	}
+	if exitCode != 0 {
+		return errors.Wrapf(&ExitError{Code: exitCode}, "error writing %s: %s", remoteFile, stdout+stderr)
+	}
+	return nil
+}
+
+// fetch copies the remote file to the writer in base64 encoded chunks. The copy is aborted if the context is done
+// before it completes.
+func (c *winrmConnectivity) fetch(ctx context.Context, remotePath string, w io.Writer) error {
+	if c.client == nil {
+		return errors.New("fetch cannot be called with nil WinRM client")
+	}
+
+	shellID, err := c.createShell(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.deleteShell(shellID)
+
+	for offset := int64(0); ; {
+		stdout, stderr, exitCode, err := c.execute(ctx, shellID, readChunkCmd(remotePath, offset))
+		if err != nil {
+			return errors.Wrapf(err, "error copying %s from the Windows VM", remotePath)
+		}
+		if exitCode != 0 {
+			return errors.Wrapf(&ExitError{Code: exitCode}, "error reading %s: %s", remotePath, stdout+stderr)
+		}
+		chunk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(stdout))
+		if err != nil {
+			return errors.Wrapf(err, "invalid chunk of %s at offset %d", remotePath, offset)
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return errors.Wrapf(err, "error writing %s", remotePath)
+		}
+		offset += int64(len(chunk))
+	}
+}
+
+// readChunkCmd returns the command which prints the base64 encoded bytes of the remote file starting at the given
+// offset. Nothing is printed once the end of the file is reached.
+func readChunkCmd(remoteFile string, offset int64) string {
+	return remotePowerShellCmdPrefix + "-Command \"$f = [IO.File]::OpenRead('" + remoteFile + "'); $f.Seek(" +
+		strconv.FormatInt(offset, 10) + ", [IO.SeekOrigin]::Begin) | Out-Null; $b = New-Object byte[] " +
+		strconv.Itoa(winrmFetchChunkSize) + "; $n = $f.Read($b, 0, $b.Length); $f.Close(); " +
+		"[Convert]::ToBase64String($b, 0, $n)\""
+}
+
+// writeFileCmd returns the command which writes the base64 encoded lines read from its input to the remote file,
+// replacing its previous contents
+func writeFileCmd(remoteFile string) string {
+	return remotePowerShellCmdPrefix + "-Command \"$f = [IO.File]::Open('" + remoteFile + "', [IO.FileMode]::Create); " +
+		"while (($l = [Console]::In.ReadLine()) -ne $null) { $b = [Convert]::FromBase64String($l); " +
+		"$f.Write($b, 0, $b.Length) }; $f.Close()\""
+}
+
+// executeChecked executes the command in the given shell, returning an error if it exits with a non-zero status
+func (c *winrmConnectivity) executeChecked(ctx context.Context, shellID, cmd string) error {
+	stdout, stderr, exitCode, err := c.execute(ctx, shellID, cmd)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return errors.Wrap(&ExitError{Code: exitCode}, stdout+stderr)
+	}
+	return nil
+}
+
+// execute runs the command in the given shell and waits for it to complete, returning its stdout, stderr and exit
+// code
+func (c *winrmConnectivity) execute(ctx context.Context, shellID, cmd string) (string, string, int, error) {
+	commandID, err := c.startCommand(ctx, shellID, cmd)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer c.terminate(shellID, commandID)
+	return c.receive(ctx, shellID, commandID)
+}
+
+// startCommand starts the command in the given shell, returning its ID
+func (c *winrmConnectivity) startCommand(ctx context.Context, shellID, cmd string) (string, error) {
+	var escaped bytes.Buffer
+	if err := xml.EscapeText(&escaped, []byte(cmd)); err != nil {
+		return "", errors.Wrap(err, "unable to escape command")
+	}
+	body := "<rsp:CommandLine><rsp:Command>" + escaped.String() + "</rsp:Command></rsp:CommandLine>"
+	options := map[string]string{"WINRS_CONSOLEMODE_STDIN": "TRUE", "WINRS_SKIP_CMD_SHELL": "FALSE"}
+	resp, err := c.send(ctx, wsmanCommandAction, shellID, options, body)
+	if err != nil {
+		return "", errors.Wrap(err, "error starting command")
+	}
+	if resp.Body.CommandID == "" {
+		return "", errors.New("WinRM service did not return a command ID")
+	}
+	return resp.Body.CommandID, nil
+}
+
+// sendInput sends the given data to the input of the command. The input of the command is closed if end is true.
+func (c *winrmConnectivity) sendInput(ctx context.Context, shellID, commandID string, data []byte, end bool) error {
+	body := "<rsp:Send><rsp:Stream Name=\"stdin\" CommandId=\"" + commandID + "\""
+	if end {
+		body += " End=\"true\""
+	}
+	body += ">" + base64.StdEncoding.EncodeToString(data) + "</rsp:Stream></rsp:Send>"
+	if _, err := c.send(ctx, wsmanSendAction, shellID, nil, body); err != nil {
+		return errors.Wrap(err, "error sending command input")
+	}
+	return nil
+}
+
+// receive waits for the command to complete, returning its stdout, stderr and exit code
+func (c *winrmConnectivity) receive(ctx context.Context, shellID, commandID string) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	for {
+		body := "<rsp:Receive><rsp:DesiredStream CommandId=\"" + commandID + "\">stdout stderr</rsp:DesiredStream>" +
+			"</rsp:Receive>"
+		resp, err := c.send(ctx, wsmanReceiveAction, shellID, nil, body)
+		if err != nil {
+			// The service times out the Receive request if the command does not produce output in time
+			if strings.Contains(err.Error(), winrmTimedOutFault) {
+				continue
+			}
+			return stdout.String(), stderr.String(), 0, errors.Wrap(err, "error receiving command output")
+		}
+		for _, stream := range resp.Body.Streams {
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(stream.Data))
+			if err != nil {
+				return stdout.String(), stderr.String(), 0, errors.Wrap(err, "unable to decode command output")
+			}
+			if stream.Name == "stderr" {
+				stderr.Write(data)
+			} else {
+				stdout.Write(data)
+			}
+		}
+		if resp.Body.CommandState.State == wsmanCommandDone {
+			return stdout.String(), stderr.String(), resp.Body.CommandState.ExitCode, nil
+		}
+	}
+}
+
+// createShell creates a new cmd shell on the VM, returning its ID
+func (c *winrmConnectivity) createShell(ctx context.Context) (string, error) {
+	body := "<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr" +
+		"</rsp:OutputStreams></rsp:Shell>"
+	options := map[string]string{"WINRS_NOPROFILE": "FALSE", "WINRS_CODEPAGE": "65001"}
+	resp, err := c.send(ctx, wsmanCreateAction, "", options, body)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating WinRM shell")
+	}
+	if resp.Body.ShellID == "" {
+		return "", errors.New("WinRM service did not return a shell ID")
+	}
+	return resp.Body.ShellID, nil
+}
+
+// terminate sends the terminate signal to the given command. Errors are logged as the command may have already exited.
+func (c *winrmConnectivity) terminate(shellID, commandID string) {
+	body := "<rsp:Signal CommandId=\"" + commandID + "\"><rsp:Code>" + wsmanTerminateSignal + "</rsp:Code></rsp:Signal>"
+	// Use a new context as the command has to be terminated even if it was aborted
+	ctx, cancel := context.WithTimeout(context.Background(), winrmCleanupTimeout)
+	defer cancel()
+	if _, err := c.send(ctx, wsmanSignalAction, shellID, nil, body); err != nil {
+		log.V(1).Info("error terminating WinRM command", "error", err)
+	}
+}
+
+// deleteShell deletes the given shell. Errors are logged as there is nothing the caller can do about them.
+func (c *winrmConnectivity) deleteShell(shellID string) {
+	// Use a new context as the shell has to be deleted even if the operation was aborted
+	ctx, cancel := context.WithTimeout(context.Background(), winrmCleanupTimeout)
+	defer cancel()
+	if _, err := c.send(ctx, wsmanDeleteAction, shellID, nil, ""); err != nil {
+		log.Error(err, "error deleting WinRM shell")
+	}
+}
+
+// send sends a WS-Management request with the given action and body to the cmd shell resource, returning the parsed
+// response envelope
+func (c *winrmConnectivity) send(ctx context.Context, action, shellID string, options map[string]string,
+	body string) (*wsmanEnvelope, error) {
+	messageID, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+	var header strings.Builder
+	header.WriteString("<a:To>" + c.endpoint + "</a:To>")
+	header.WriteString("<a:ReplyTo><a:Address s:mustUnderstand=\"true\">" +
+		"http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>")
+	header.WriteString(fmt.Sprintf("<w:MaxEnvelopeSize s:mustUnderstand=\"true\">%d</w:MaxEnvelopeSize>",
+		winrmMaxEnvelopeSize))
+	header.WriteString("<a:MessageID>uuid:" + messageID + "</a:MessageID>")
+	header.WriteString("<w:Locale xml:lang=\"en-US\" s:mustUnderstand=\"false\"/>")
+	header.WriteString(fmt.Sprintf("<w:OperationTimeout>PT%dS</w:OperationTimeout>",
+		int(winrmOperationTimeout.Seconds())))
+	header.WriteString("<w:ResourceURI s:mustUnderstand=\"true\">" + wsmanCmdShellURI + "</w:ResourceURI>")
+	header.WriteString("<a:Action s:mustUnderstand=\"true\">" + action + "</a:Action>")
+	if shellID != "" {
+		header.WriteString("<w:SelectorSet><w:Selector Name=\"ShellId\">" + shellID + "</w:Selector></w:SelectorSet>")
+	}
+	if len(options) > 0 {
+		header.WriteString("<w:OptionSet>")
+		for name, value := range options {
+			header.WriteString("<w:Option Name=\"" + name + "\">" + value + "</w:Option>")
+		}
+		header.WriteString("</w:OptionSet>")
+	}
+
+	envelope := "<s:Envelope xmlns:s=\"http://www.w3.org/2003/05/soap-envelope\" " +
+		"xmlns:a=\"http://schemas.xmlsoap.org/ws/2004/08/addressing\" " +
+		"xmlns:w=\"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd\" " +
+		"xmlns:rsp=\"http://schemas.microsoft.com/wbem/wsman/1/windows/shell\">" +
+		"<s:Header>" + header.String() + "</s:Header><s:Body>" + body + "</s:Body></s:Envelope>"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(envelope))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create WinRM request")
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	if c.settings.AuthType == WinRMCertificateAuth {
+		req.Header.Set("Authorization", winrmMutualAuthHeader)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "WinRM request failed")
+	}
+	defer drainBody(resp)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read WinRM response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("WinRM request failed with status %d: %s", resp.StatusCode, string(respBody))
+	}
+	parsed := &wsmanEnvelope{}
+	if err := xml.Unmarshal(respBody, parsed); err != nil {
+		return nil, errors.Wrap(err, "unable to parse WinRM response")
+	}
+	return parsed, nil
+}
+
+// wsmanEnvelope holds the fields of the WS-Management response envelopes that we care about
+type wsmanEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		// ShellID is returned in response to a Create request
+		ShellID string `xml:"Shell>ShellId"`
+		// CommandID is returned in response to a Command request
+		CommandID string `xml:"CommandResponse>CommandId"`
+		// Streams hold the output returned in response to a Receive request
+		Streams []wsmanStream `xml:"ReceiveResponse>Stream"`
+		// CommandState holds the state of the command returned in response to a Receive request
+		CommandState struct {
+			State    string `xml:"State,attr"`
+			ExitCode int    `xml:"ExitCode"`
+		} `xml:"ReceiveResponse>CommandState"`
+	} `xml:"Body"`
+}
+
+// wsmanStream holds a base64 encoded chunk of command output
+type wsmanStream struct {
+	Name string `xml:"Name,attr"`
+	Data string `xml:",chardata"`
+}
+
+// newMessageID returns a random UUID used to identify a WS-Management request
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "unable to generate message ID")
+	}
+	// Set the version 4 and variant bits
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// verifyCertificate is a tls.Config.VerifyPeerCertificate callback that pins the certificate presented by the WinRM
+// service in the same way as callback pins SSH host keys
+func (v *hostKeyVerifier) verifyCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("WinRM service did not present a certificate")
+	}
+	sum := sha256.Sum256(rawCerts[0])
+	return v.verify("SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]))
+}
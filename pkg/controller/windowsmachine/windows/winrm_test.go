@@ -0,0 +1,510 @@
+package windows
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWinRMServer is a test double of the Windows WinRM service. It implements the subset of the WS-Management shell
+// protocol and of NTLM authentication used by winrmConnectivity.
+type fakeWinRMServer struct {
+	*httptest.Server
+	// handler returns the stdout, stderr and exit code of the given command
+	handler func(cmd string) (string, string, int)
+	// inputHandler returns the stdout, stderr and exit code of the given command which was sent the given input. The
+	// commands which were sent input are run by handler if it is nil.
+	inputHandler func(cmd string, input []byte) (string, string, int)
+	// password enables NTLM authentication if set, otherwise certificate authentication is required
+	password string
+
+	mu sync.Mutex
+	// authenticated holds the remote addresses of the connections that completed NTLM authentication
+	authenticated map[string]bool
+	// shells holds the IDs of the open shells
+	shells map[string]bool
+	// commands maps the ID of each started command to its command line
+	commands map[string]string
+	// inputs maps the ID of each command which was sent input to the input received so far
+	inputs map[string][]byte
+	// sendRequests is the number of Send requests received
+	sendRequests int
+	// nextID is used to generate shell and command IDs
+	nextID int
+}
+
+// fakeRequest holds the fields of the WS-Management requests that the fake server cares about
+type fakeRequest struct {
+	Action   string `xml:"Header>Action"`
+	Selector string `xml:"Header>SelectorSet>Selector"`
+	Command  string `xml:"Body>CommandLine>Command"`
+	Receive  struct {
+		CommandID string `xml:"CommandId,attr"`
+	} `xml:"Body>Receive>DesiredStream"`
+	Send struct {
+		CommandID string `xml:"CommandId,attr"`
+		Data      string `xml:",chardata"`
+	} `xml:"Body>Send>Stream"`
+}
+
+// newFakeWinRMServer starts a fake WinRM service which runs commands using the given handler
+func newFakeWinRMServer(t *testing.T, password string, handler func(cmd string) (string, string, int)) *fakeWinRMServer {
+	s := &fakeWinRMServer{
+		handler:       handler,
+		password:      password,
+		authenticated: make(map[string]bool),
+		shells:        make(map[string]bool),
+		commands:      make(map[string]string),
+		inputs:        make(map[string][]byte),
+	}
+	s.Server = httptest.NewUnstartedServer(s)
+	s.Server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// ServeHTTP handles a WS-Management request
+func (s *fakeWinRMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &fakeRequest{}
+	if err := xml.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Action != wsmanCreateAction && !s.shells[req.Selector] {
+		http.Error(w, "unknown shell "+req.Selector, http.StatusInternalServerError)
+		return
+	}
+	var response string
+	switch req.Action {
+	case wsmanCreateAction:
+		id := s.newID()
+		s.shells[id] = true
+		response = "<rsp:Shell><rsp:ShellId>" + id + "</rsp:ShellId></rsp:Shell>"
+	case wsmanCommandAction:
+		id := s.newID()
+		s.commands[id] = req.Command
+		response = "<rsp:CommandResponse><rsp:CommandId>" + id + "</rsp:CommandId></rsp:CommandResponse>"
+	case wsmanReceiveAction:
+		cmd, ok := s.commands[req.Receive.CommandID]
+		if !ok {
+			http.Error(w, "unknown command "+req.Receive.CommandID, http.StatusInternalServerError)
+			return
+		}
+		input, sent := s.inputs[req.Receive.CommandID]
+		// Run the handler without holding the lock, so that slow commands do not block other requests
+		s.mu.Unlock()
+		var stdout, stderr string
+		var exitCode int
+		if sent && s.inputHandler != nil {
+			stdout, stderr, exitCode = s.inputHandler(cmd, input)
+		} else {
+			stdout, stderr, exitCode = s.handler(cmd)
+		}
+		s.mu.Lock()
+		response = fmt.Sprintf("<rsp:ReceiveResponse>"+
+			"<rsp:Stream Name=\"stdout\" CommandId=\"%[1]s\">%[2]s</rsp:Stream>"+
+			"<rsp:Stream Name=\"stderr\" CommandId=\"%[1]s\">%[3]s</rsp:Stream>"+
+			"<rsp:CommandState CommandId=\"%[1]s\" State=\"%[4]s\"><rsp:ExitCode>%[5]d</rsp:ExitCode>"+
+			"</rsp:CommandState></rsp:ReceiveResponse>", req.Receive.CommandID,
+			base64.StdEncoding.EncodeToString([]byte(stdout)), base64.StdEncoding.EncodeToString([]byte(stderr)),
+			wsmanCommandDone, exitCode)
+	case wsmanSendAction:
+		if _, ok := s.commands[req.Send.CommandID]; !ok {
+			http.Error(w, "unknown command "+req.Send.CommandID, http.StatusInternalServerError)
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(req.Send.Data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.sendRequests++
+		s.inputs[req.Send.CommandID] = append(s.inputs[req.Send.CommandID], data...)
+		response = "<rsp:SendResponse/>"
+	case wsmanSignalAction:
+		response = "<rsp:SignalResponse/>"
+	case wsmanDeleteAction:
+		delete(s.shells, req.Selector)
+	default:
+		http.Error(w, "unsupported action "+req.Action, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	fmt.Fprintf(w, "<s:Envelope xmlns:s=\"http://www.w3.org/2003/05/soap-envelope\" "+
+		"xmlns:rsp=\"http://schemas.microsoft.com/wbem/wsman/1/windows/shell\"><s:Body>%s</s:Body></s:Envelope>",
+		response)
+}
+
+// authenticate returns true if the request is authenticated, otherwise it writes the next authentication response
+func (s *fakeWinRMServer) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if s.password == "" {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || r.Header.Get("Authorization") != winrmMutualAuthHeader {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.authenticated[r.RemoteAddr] {
+		return true
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"),
+		ntlmAuthScheme+" "))
+	if err != nil || len(token) < 12 {
+		w.Header().Set("WWW-Authenticate", ntlmAuthScheme)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	switch binary.LittleEndian.Uint32(token[8:]) {
+	case 1:
+		w.Header().Set("WWW-Authenticate", ntlmAuthScheme+" "+
+			base64.StdEncoding.EncodeToString(fakeChallengeMessage()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	case 3:
+		if s.verifyAuthenticateMessage(token) {
+			s.authenticated[r.RemoteAddr] = true
+			return true
+		}
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// verifyAuthenticateMessage returns true if the AUTHENTICATE_MESSAGE carries a valid NTLMv2 response for the password
+func (s *fakeWinRMServer) verifyAuthenticateMessage(msg []byte) bool {
+	field := func(i int) []byte {
+		secBuf := msg[12+8*i:]
+		length := binary.LittleEndian.Uint16(secBuf)
+		offset := binary.LittleEndian.Uint32(secBuf[4:])
+		return msg[offset : offset+uint32(length)]
+	}
+	ntResponse := field(1)
+	domain := fromUTF16LE(field(2))
+	username := fromUTF16LE(field(3))
+	challenge, err := parseNTLMChallenge(fakeChallengeMessage())
+	if err != nil || len(ntResponse) < 16 {
+		return false
+	}
+	responseKey := ntlmV2ResponseKey(domain, username, s.password)
+	expected := hmacMD5(responseKey, append(append([]byte{}, challenge.serverChallenge...), ntResponse[16:]...))
+	return bytes.Equal(expected, ntResponse[:16])
+}
+
+// newID returns a new shell or command ID
+func (s *fakeWinRMServer) newID() string {
+	s.nextID++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextID)
+}
+
+// fakeChallengeMessage returns the CHALLENGE_MESSAGE sent by the fake server
+func fakeChallengeMessage() []byte {
+	targetInfo := []byte{0x02, 0x00, 0x0c, 0x00}
+	targetInfo = append(targetInfo, toUTF16LE("Domain")...)
+	targetInfo = append(targetInfo, 0x00, 0x00, 0x00, 0x00)
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], ntlmFlags)
+	copy(msg[24:], []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(len(msg)))
+	return append(msg, targetInfo...)
+}
+
+// fromUTF16LE decodes a UTF-16 little endian string containing only ASCII characters
+func fromUTF16LE(b []byte) string {
+	var s strings.Builder
+	for i := 0; i+1 < len(b); i += 2 {
+		s.WriteByte(b[i])
+	}
+	return s.String()
+}
+
+// memoryHostKeyStore is a HostKeyStore that keeps the fingerprints in memory
+type memoryHostKeyStore map[string]string
+
+func (m memoryHostKeyStore) Get(instanceID string) (string, error) {
+	return m[instanceID], nil
+}
+
+func (m memoryHostKeyStore) Set(instanceID, fingerprint string) error {
+	m[instanceID] = fingerprint
+	return nil
+}
+
+// newTestClientCertificate returns a self-signed client certificate
+func newTestClientCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Administrator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestWinRMConnectivity returns a winrmConnectivity connected to the given fake server
+func newTestWinRMConnectivity(t *testing.T, s *fakeWinRMServer, settings *WinRMSettings,
+	hostKeys HostKeyStore) (*winrmConnectivity, error) {
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	require.NoError(t, err)
+	settings.Port = port
+	conn, err := newWinRMConnectivity(context.Background(), "i-0123", "Administrator", host,
+		ConnectionSettings{Backend: WinRMBackend, WinRM: settings, HostKeys: hostKeys})
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*winrmConnectivity), nil
+}
+
+// TestWinRMRun tests running commands over WinRM with both authentication types
+func TestWinRMRun(t *testing.T) {
+	handler := func(cmd string) (string, string, int) {
+		switch cmd {
+		case "hostname":
+			return "winhost\r\n", "", 0
+		case "sc.exe qc missing":
+			return "", "[SC] OpenService FAILED 1060", 1060
+		}
+		return "", "unknown command", 1
+	}
+	certificate := newTestClientCertificate(t)
+
+	tests := []struct {
+		name     string
+		password string
+		settings *WinRMSettings
+	}{
+		{
+			name:     "certificate authentication",
+			settings: &WinRMSettings{AuthType: WinRMCertificateAuth, Certificate: &certificate},
+		},
+		{
+			name:     "NTLM authentication",
+			password: "Password",
+			settings: &WinRMSettings{AuthType: WinRMNTLMAuth, Password: "Password"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeWinRMServer(t, tt.password, handler)
+			hostKeys := memoryHostKeyStore{}
+			c, err := newTestWinRMConnectivity(t, s, tt.settings, hostKeys)
+			require.NoError(t, err)
+			assert.NotEmpty(t, hostKeys["i-0123"+winrmHostKeySuffix], "server certificate was not recorded")
+
+			result, err := c.run(context.Background(), "hostname")
+			require.NoError(t, err)
+			assert.Equal(t, "winhost\r\n", result.Stdout)
+			assert.Empty(t, result.Stderr)
+			assert.Equal(t, 0, result.ExitCode)
+
+			result, err = c.run(context.Background(), "sc.exe qc missing")
+			require.Error(t, err)
+			assert.True(t, isExitCode(err, errorServiceDoesNotExist), "unexpected error %v", err)
+			require.NotNil(t, result)
+			assert.Empty(t, result.Stdout)
+			assert.Equal(t, "[SC] OpenService FAILED 1060", result.Stderr)
+			assert.Equal(t, errorServiceDoesNotExist, result.ExitCode)
+
+			assert.Empty(t, s.shells, "shells were not deleted")
+		})
+	}
+}
+
+// TestWinRMRunCancelled tests that a command which does not complete in time is aborted and terminated
+func TestWinRMRunCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := newFakeWinRMServer(t, "Password", func(cmd string) (string, string, int) {
+		if cmd == "wmcb.exe initialize-kubelet" {
+			<-release
+		}
+		return "", "", 0
+	})
+	c, err := newTestWinRMConnectivity(t, s, &WinRMSettings{AuthType: WinRMNTLMAuth, Password: "Password"},
+		memoryHostKeyStore{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.run(ctx, "wmcb.exe initialize-kubelet")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+	assert.Empty(t, s.shells, "shell was not deleted after the command was aborted")
+}
+
+// TestWinRMAuthenticationFailure tests that NTLM authentication with the wrong password is rejected
+func TestWinRMAuthenticationFailure(t *testing.T) {
+	s := newFakeWinRMServer(t, "Password", func(string) (string, string, int) { return "", "", 0 })
+	c, err := newTestWinRMConnectivity(t, s, &WinRMSettings{AuthType: WinRMNTLMAuth, Password: "Password"},
+		memoryHostKeyStore{})
+	require.NoError(t, err)
+	c.client.Transport.(*ntlmTransport).password = "wrong"
+	// Force a new connection so that the handshake is performed again
+	c.client.Transport.(*ntlmTransport).transport.(*http.Transport).CloseIdleConnections()
+	_, err = c.run(context.Background(), "hostname")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+}
+
+// TestWinRMServerCertificateMismatch tests that a server presenting a different certificate than the one recorded is
+// rejected
+func TestWinRMServerCertificateMismatch(t *testing.T) {
+	s := newFakeWinRMServer(t, "Password", func(string) (string, string, int) { return "", "", 0 })
+	hostKeys := memoryHostKeyStore{"i-0123" + winrmHostKeySuffix: "SHA256:recorded"}
+	_, err := newTestWinRMConnectivity(t, s, &WinRMSettings{AuthType: WinRMNTLMAuth, Password: "Password"}, hostKeys)
+	require.Error(t, err)
+	var mismatch *HostKeyMismatchError
+	require.True(t, errors.As(err, &mismatch), "expected a HostKeyMismatchError, got %v", err)
+	assert.Equal(t, "SHA256:recorded", mismatch.Expected)
+}
+
+// TestWinRMTransfer tests that transfer streams a file to a single command in chunks which reassemble to the original
+// contents
+func TestWinRMTransfer(t *testing.T) {
+	writeCmd := regexp.MustCompile(`\[IO\.File\]::Open\('([^']*)', \[IO\.FileMode\]::Create\)`)
+	var mu sync.Mutex
+	remoteFiles := make(map[string][]byte)
+	s := newFakeWinRMServer(t, "Password", func(cmd string) (string, string, int) {
+		if strings.HasPrefix(cmd, "if not exist") {
+			return "", "", 0
+		}
+		return "", "unknown command", 1
+	})
+	s.inputHandler = func(cmd string, input []byte) (string, string, int) {
+		match := writeCmd.FindStringSubmatch(cmd)
+		if match == nil {
+			return "", "unknown command", 1
+		}
+		var contents []byte
+		for _, line := range strings.Split(strings.TrimSuffix(string(input), "\r\n"), "\r\n") {
+			chunk, err := base64.StdEncoding.DecodeString(line)
+			if err != nil {
+				return "", err.Error(), 1
+			}
+			contents = append(contents, chunk...)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		remoteFiles[match[1]] = contents
+		return "", "", 0
+	}
+	c, err := newTestWinRMConnectivity(t, s, &WinRMSettings{AuthType: WinRMNTLMAuth, Password: "Password"},
+		memoryHostKeyStore{})
+	require.NoError(t, err)
+	// Ignore the commands run while connecting
+	commands := len(s.commands)
+
+	// The file spans ten full chunks and a partial one
+	contents := bytes.Repeat([]byte("0123456789"), winrmChunkSize+1)
+	localFile := filepath.Join(t.TempDir(), "kubelet.exe")
+	require.NoError(t, ioutil.WriteFile(localFile, contents, os.ModePerm))
+
+	require.NoError(t, c.transfer(context.Background(), localFile, "C:\\k"))
+	assert.Equal(t, contents, remoteFiles["C:\\k\\kubelet.exe"])
+	// The directory is created by one command and the file is written by another, whatever its size
+	assert.Equal(t, 2, len(s.commands)-commands, "unexpected commands %v", s.commands)
+	assert.Equal(t, 11, s.sendRequests)
+	assert.Empty(t, s.shells, "shell was not deleted")
+}
+
+// TestWinRMFetch tests that fetch downloads a file in chunks which reassemble to the original contents
+func TestWinRMFetch(t *testing.T) {
+	readCmd := regexp.MustCompile(`OpenRead\('([^']*)'\); \$f\.Seek\(([0-9]+),`)
+	contents := bytes.Repeat([]byte("0123456789"), winrmFetchChunkSize/4)
+	s := newFakeWinRMServer(t, "Password", func(cmd string) (string, string, int) {
+		match := readCmd.FindStringSubmatch(cmd)
+		if match == nil {
+			return "", "unknown command", 1
+		}
+		if match[1] != "C:\\var\\log\\kubelet\\kubelet.log" {
+			return "", "Exception calling \"OpenRead\": Could not find file", 1
+		}
+		offset, err := strconv.Atoi(match[2])
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		end := offset + winrmFetchChunkSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		return base64.StdEncoding.EncodeToString(contents[offset:end]) + "\r\n", "", 0
+	})
+	c, err := newTestWinRMConnectivity(t, s, &WinRMSettings{AuthType: WinRMNTLMAuth, Password: "Password"},
+		memoryHostKeyStore{})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.fetch(context.Background(), "C:\\var\\log\\kubelet\\kubelet.log", &buf))
+	assert.Equal(t, contents, buf.Bytes())
+
+	err = c.fetch(context.Background(), "C:\\missing.log", &buf)
+	require.Error(t, err)
+	assert.True(t, isExitCode(err, 1), "unexpected error %v", err)
+}
+
+// TestNTLMv2Response tests the NTLMv2 computations against the test vectors in section 4.2.4 of [MS-NLMP]
+func TestNTLMv2Response(t *testing.T) {
+	responseKey := ntlmV2ResponseKey("Domain", "User", "Password")
+	assert.Equal(t, "0c868a403bfd7a93a3001ef22ef02e3f", hex.EncodeToString(responseKey))
+
+	targetInfo, err := hex.DecodeString("02000c0044006f006d00610069006e0001000c005300650072007600650072000000" +
+		"0000")
+	require.NoError(t, err)
+	challenge := &ntlmChallenge{
+		serverChallenge: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		targetInfo:      targetInfo,
+	}
+	clientChallenge := bytes.Repeat([]byte{0xaa}, 8)
+	response := ntlmV2Response(challenge, responseKey, clientChallenge, make([]byte, 8))
+	assert.Equal(t, "68cd0ab851e51c96aabc927bebef6a1c", hex.EncodeToString(response[:16]))
+}
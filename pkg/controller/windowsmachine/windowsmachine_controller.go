@@ -2,9 +2,14 @@ package windowsmachine
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
 
+	config "github.com/openshift/api/config/v1"
 	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
@@ -16,22 +21,28 @@ import (
 	kubeTypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/openshift/windows-machine-config-operator/pkg/clusternetwork"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/diagnostics"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/operatorconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/provider"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/secrets"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/signer"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/metrics"
 	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/controller/windowsmachine/windows"
 	"github.com/openshift/windows-machine-config-operator/version"
 )
 
@@ -43,6 +54,22 @@ const (
 	maxUnhealthyCount = 1
 	// windowsOSLabel is the label used to identify the Windows Machines.
 	windowsOSLabel = "machine.openshift.io/os-id"
+	// ConnectivityAnnotation is the Machine annotation which selects the connectivity backend, ssh or winrm, used to
+	// configure the Machine. It overrides the backend set in the operator configuration.
+	ConnectivityAnnotation = "windowsmachineconfig.openshift.io/connectivity"
+	// UsernameAnnotation is the Machine annotation which sets the user the operator connects to the Machine as. It
+	// overrides the user of the Machine's platform.
+	UsernameAnnotation = "windowsmachineconfig.openshift.io/username"
+	// CollectDiagnosticsAnnotation is the Machine annotation which requests the collection of a diagnostics bundle from
+	// the Machine. The annotation is removed once the bundle is saved in the diagnostics store of the operator pod.
+	CollectDiagnosticsAnnotation = "windowsmachineconfig.openshift.io/collect-diagnostics"
+	// diagnosticsTimeout is the maximum amount of time spent collecting a diagnostics bundle
+	diagnosticsTimeout = 5 * time.Minute
+	// nodeHealthTimeout is the maximum amount of time spent validating and repairing the configuration of a node
+	nodeHealthTimeout = 5 * time.Minute
+	// nodeHealthRequeueInterval is the time after which the configuration of a node whose VM could not be reached is
+	// validated again
+	nodeHealthRequeueInterval = 2 * time.Minute
 )
 
 var log = logf.Log.WithName(ControllerName)
@@ -54,7 +81,7 @@ func Add(mgr manager.Manager, networkConfig clusternetwork.ClusterNetworkConfig,
 	if err != nil {
 		return errors.Wrapf(err, "could not create %s reconciler", ControllerName)
 	}
-	return add(mgr, reconciler)
+	return add(mgr, reconciler, watchNamespace)
 }
 
 // newReconciler returns a new reconcile.Reconciler
@@ -63,7 +90,7 @@ func newReconciler(mgr manager.Manager, networkConfig clusternetwork.ClusterNetw
 	// could be stale and result in a get call to return an older version
 	// of the object. Hence we are using a non-default-client referenced
 	// by operator-sdk.
-	cfg, err := config.GetConfig()
+	cfg, err := clientconfig.GetConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -89,20 +116,50 @@ func newReconciler(mgr manager.Manager, networkConfig clusternetwork.ClusterNetw
 		return nil, errors.Wrap(err, "unable to initialize Prometheus configuration")
 	}
 
+	// Expose the SSH connection pool metrics along with the other operator metrics
+	sshPool := windows.NewSSHPool()
+	if err := crmetrics.Registry.Register(sshPool); err != nil {
+		return nil, errors.Wrap(err, "unable to register SSH connection pool metrics")
+	}
+
+	diagnosticsStore, err := diagnostics.NewStore(diagnostics.DefaultDir(), diagnostics.DefaultMaxBundles,
+		diagnostics.DefaultMaxBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create diagnostics store")
+	}
+
+	// The reconciler is not given a context by controller-runtime. Create one that is cancelled when the manager stops,
+	// so that a wedged command on a Windows VM cannot prevent the operator from shutting down.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		<-stop
+		cancel()
+		return nil
+	})); err != nil {
+		cancel()
+		return nil, errors.Wrap(err, "unable to add reconciler shutdown hook")
+	}
+
 	return &ReconcileWindowsMachine{client: client,
 			scheme:               mgr.GetScheme(),
 			k8sclientset:         clientset,
 			clusterServiceCIDR:   serviceCIDR,
 			vxlanPort:            networkConfig.VXLANPort(),
+			serviceNodePortRange: networkConfig.ServiceNodePortRange(),
 			recorder:             mgr.GetEventRecorderFor(ControllerName),
 			watchNamespace:       watchNamespace,
 			prometheusNodeConfig: pc,
+			hostKeys:             secrets.NewHostKeyStore(client, watchNamespace),
+			sshPool:              sshPool,
+			diagnostics:          diagnosticsStore,
+			ctx:                  ctx,
 		},
 		nil
 }
 
-// add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+// add adds a new Controller to mgr with r as the reconcile.Reconciler. The operator configuration is read from the
+// given namespace.
+func add(mgr manager.Manager, r reconcile.Reconciler, watchNamespace string) error {
 	// Create a new controller
 	c, err := controller.New(ControllerName, mgr, controller.Options{Reconciler: r})
 	if err != nil {
@@ -154,9 +211,107 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return errors.Wrap(err, "could not create watch on node objects")
 	}
 
+	// Reconcile all the Windows Machines when the operator configuration changes, so that it is applied to the
+	// configured nodes. The ConfigMaps are watched through a cache of their own, limited to the operator namespace, as
+	// the manager cache spans the whole cluster.
+	operatorNamespaceCache, err := cache.New(mgr.GetConfig(), cache.Options{Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(), Namespace: watchNamespace})
+	if err != nil {
+		return errors.Wrap(err, "could not create cache of the operator namespace")
+	}
+	if err := mgr.Add(operatorNamespaceCache); err != nil {
+		return errors.Wrap(err, "could not add cache of the operator namespace to the manager")
+	}
+	isOperatorConfig := func(object meta.Object) bool {
+		return object.GetNamespace() == watchNamespace && object.GetName() == operatorconfig.ConfigMapName
+	}
+	err = c.Watch(source.NewKindWithCache(&core.ConfigMap{}, operatorNamespaceCache),
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: &allMachinesMapper{client: mgr.GetClient()}},
+		predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool {
+				return isOperatorConfig(e.Meta)
+			},
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				return isOperatorConfig(e.MetaNew)
+			},
+			DeleteFunc: func(e event.DeleteEvent) bool {
+				return isOperatorConfig(e.Meta)
+			},
+		})
+	if err != nil {
+		return errors.Wrap(err, "could not create watch on the operator configuration")
+	}
+
+	// Reconcile all the Windows Machines when the rendered config of the worker MachineConfigPool changes, so that
+	// the nodes are reconfigured if the parts of the worker ignition file they use changed
+	err = c.Watch(&source.Kind{Type: newMachineConfigPool()},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: &allMachinesMapper{client: mgr.GetClient()}},
+		predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool {
+				return isWorkerPool(e.Meta)
+			},
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				return isWorkerPool(e.MetaNew) && renderedConfig(e.ObjectOld) != renderedConfig(e.ObjectNew)
+			},
+			DeleteFunc: func(e event.DeleteEvent) bool {
+				return false
+			},
+		})
+	if err != nil {
+		return errors.Wrap(err, "could not create watch on the worker MachineConfigPool")
+	}
+
+	// Reconcile all the Windows Machines when the internal API server URL of the cluster Infrastructure changes, so that
+	// the nodes bootstrapped from the previous worker ignition endpoint are reconfigured
+	isClusterInfrastructure := func(object meta.Object) bool {
+		return object.GetName() == infrastructureName
+	}
+	err = c.Watch(&source.Kind{Type: &config.Infrastructure{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: &allMachinesMapper{client: mgr.GetClient()}},
+		predicate.Funcs{
+			CreateFunc: func(e event.CreateEvent) bool {
+				return isClusterInfrastructure(e.Meta)
+			},
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				return isClusterInfrastructure(e.MetaNew) &&
+					apiServerInternalURL(e.ObjectOld) != apiServerInternalURL(e.ObjectNew)
+			},
+			DeleteFunc: func(e event.DeleteEvent) bool {
+				return false
+			},
+		})
+	if err != nil {
+		return errors.Wrap(err, "could not create watch on the cluster Infrastructure")
+	}
+
 	return nil
 }
 
+// allMachinesMapper fulfills the mapper interface and maps any object to all the Windows Machines
+type allMachinesMapper struct {
+	// client is used to list the Windows Machines
+	client client.Client
+}
+
+// Map maps the given object to all the Windows Machines
+func (m *allMachinesMapper) Map(_ handler.MapObject) []reconcile.Request {
+	machines := &mapi.MachineList{}
+	err := m.client.List(context.TODO(), machines,
+		client.MatchingLabels(map[string]string{windowsOSLabel: "Windows"}))
+	if err != nil {
+		log.Error(err, "could not get a list of machines")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, machine := range machines.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: machine.GetNamespace(),
+			Name:      machine.GetName(),
+		}})
+	}
+	return requests
+}
+
 // nodeToMachineMapper fulfills the mapper interface and allows for the mapping from a node to the associated Machine
 type nodeToMachineMapper struct {
 	client client.Client
@@ -203,6 +358,17 @@ func (m *nodeToMachineMapper) Map(object handler.MapObject) []reconcile.Request
 	return nil
 }
 
+// machineSetName returns the name of the MachineSet owning the given Machine, or an empty string if it is not owned by
+// a MachineSet
+func machineSetName(machine *mapi.Machine) string {
+	for _, owner := range machine.GetOwnerReferences() {
+		if owner.Kind == "MachineSet" {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
 // isWindowsMachine checks if the machine is a Windows machine or not
 func isWindowsMachine(labels map[string]string) bool {
 	windowsOSLabel := "machine.openshift.io/os-id"
@@ -225,19 +391,29 @@ type ReconcileWindowsMachine struct {
 	// scheme is the scheme used to resolve runtime.Objects to resources
 	scheme *runtime.Scheme
 	// k8sclientset holds the kube client that we can re-use for all kube objects other than custom resources.
-	k8sclientset *kubernetes.Clientset
+	k8sclientset kubernetes.Interface
 	// clusterServiceCIDR holds the cluster network service CIDR
 	clusterServiceCIDR string
 	// signer is a signer created from the user's private key
 	signer ssh.Signer
 	// vxlanPort is the custom VXLAN port
 	vxlanPort string
+	// serviceNodePortRange is the port range of the NodePort services, opened on the nodes
+	serviceNodePortRange string
 	// recorder to generate events
 	recorder record.EventRecorder
 	// watchNamespace is the namespace the operator is watching as defined by the operator CSV
 	watchNamespace string
 	// prometheusConfig stores information required to configure Prometheus
 	prometheusNodeConfig *metrics.PrometheusNodeConfig
+	// hostKeys records the SSH host key fingerprints of the Windows VMs
+	hostKeys *secrets.HostKeyStore
+	// sshPool holds the SSH connections to the Windows VMs so that they are reused across reconciles
+	sshPool *windows.SSHPool
+	// diagnostics holds the diagnostics bundles collected from the Windows VMs
+	diagnostics *diagnostics.Store
+	// ctx is cancelled when the manager stops. It is used to abort the operations on the Windows VMs.
+	ctx context.Context
 }
 
 // Reconcile reads that state of the cluster for a Windows Machine object and makes changes based on the state read
@@ -253,7 +429,8 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 	if err != nil {
 		if k8sapierrors.IsNotFound(err) {
 			// Private key was removed, requeue
-			return reconcile.Result{}, errors.Wrapf(err, "%s does not exist, please create it", secrets.PrivateKeySecret)
+			return reconcile.Result{}, errors.Wrapf(err, "%s does not exist, please create it",
+				secrets.PrivateKeySecret)
 		}
 		return reconcile.Result{}, errors.Wrapf(err, "unable to get secret %s", request.NamespacedName)
 	}
@@ -270,6 +447,12 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
+	if !machine.GetDeletionTimestamp().IsZero() {
+		if !hasFinalizer(machine, DeconfigureFinalizer) {
+			return reconcile.Result{}, nil
+		}
+		return r.deconfigure(machine, privateKey)
+	}
 	// provisionedPhase is the status of the machine when it is in the `Provisioned` state
 	provisionedPhase := "Provisioned"
 	// runningPhase is the status of the machine when it is in the `Running` state, indicating that it is configured into a node
@@ -278,7 +461,18 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 		// Phase is nil and should be ignored by WMCO until phase is set
 		// TODO: Instead of requeuing ignore certain events: https://issues.redhat.com/browse/WINC-500
 		return reconcile.Result{}, fmt.Errorf("could not get the phase associated with machine %s", machine.Name)
-	} else if *machine.Status.Phase == runningPhase {
+	}
+	if _, present := machine.GetAnnotations()[CollectDiagnosticsAnnotation]; present {
+		return reconcile.Result{}, r.collectRequestedDiagnostics(machine, privateKey)
+	}
+	if *machine.Status.Phase == provisionedPhase || *machine.Status.Phase == runningPhase {
+		// Ensure the VM is deconfigured when the Machine is deleted, including the Machines configured before the
+		// finalizer was introduced
+		if err := r.ensureFinalizer(machine); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	if *machine.Status.Phase == runningPhase {
 		// Machine has been configured into a node, we need to ensure that the version annotation exists. If it doesn't
 		// the machine was not fully configured and needs to be configured properly.
 		if machine.Status.NodeRef == nil {
@@ -291,7 +485,8 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 		err := r.client.Get(context.TODO(), kubeTypes.NamespacedName{Namespace: machine.Status.NodeRef.Namespace,
 			Name: machine.Status.NodeRef.Name}, node)
 		if err != nil {
-			return reconcile.Result{}, errors.Wrapf(err, "could not get node associated with machine %s", machine.GetName())
+			return reconcile.Result{}, errors.Wrapf(err, "could not get node associated with machine %s",
+				machine.GetName())
 		}
 
 		if _, present := node.Annotations[nodeconfig.VersionAnnotation]; present {
@@ -302,7 +497,7 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 					machinesetName = machine.OwnerReferences[0].Name
 				}
 				log.Info("upgrading machineset", "name", machinesetName)
-				if !r.isAllowedDeletion(machine) {
+				if !r.isAllowedDisruption(machine) {
 					log.Info("machine deletion restricted", "name", machine.GetName(),
 						"maxUnhealthyCount", maxUnhealthyCount)
 					r.recorder.Eventf(machine, core.EventTypeWarning, "MachineDeletionRestricted",
@@ -315,6 +510,13 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 					return reconcile.Result{}, nil
 				}
 
+				// Keep new pods off the node while it is replaced
+				err := nodeconfig.PatchNode(r.ctx, r.k8sclientset, node, func(node *core.Node) {
+					nodeconfig.AddConfiguringTaint(node)
+				})
+				if err != nil {
+					return reconcile.Result{}, errors.Wrapf(err, "unable to taint node %s", node.Name)
+				}
 				if err := r.client.Delete(context.TODO(), machine); err != nil {
 					r.recorder.Eventf(machine, core.EventTypeWarning, "MachineDeletionFailed",
 						"Machine %v deletion failed: %v", machine.Name, err)
@@ -327,100 +529,422 @@ func (r *ReconcileWindowsMachine) Reconcile(request reconcile.Request) (reconcil
 			}
 			log.Info("machine has current version", "name", machine.GetName(),
 				"version", node.Annotations[nodeconfig.VersionAnnotation])
+			if result, err := r.ensureRenderedConfig(machine, node); err != nil || result != (reconcile.Result{}) {
+				return result, err
+			}
+			result, healthErr := r.ensureNodeHealth(machine, node, privateKey)
 			// version annotation exists with a valid value, node is fully configured.
 			// configure Prometheus when we have already configured Windows Nodes. This is required to update Endpoints object if
-			// it gets reverted when the operator pod restarts.
-			if err := r.prometheusNodeConfig.Configure(); err != nil {
-				return reconcile.Result{}, errors.Wrap(err, "unable to configure Prometheus")
+			// it gets reverted when the operator pod restarts. This is done even if the VM cannot be validated.
+			if err := r.configurePrometheus(); err != nil {
+				return reconcile.Result{}, err
 			}
-			return reconcile.Result{}, nil
+			return result, healthErr
 		}
 	} else if *machine.Status.Phase != provisionedPhase {
 		log.V(1).Info("machine not provisioned", "phase", *machine.Status.Phase)
 		// configure Prometheus when a machine is not in `Running` or `Provisioned` phase. This configuration is
 		// required to update Endpoints object when Windows machines are being deleted.
-		if err := r.prometheusNodeConfig.Configure(); err != nil {
-			return reconcile.Result{}, errors.Wrap(err, "unable to configure Prometheus")
+		if err := r.configurePrometheus(); err != nil {
+			return reconcile.Result{}, err
 		}
 		// Machine is not in provisioned or running state, nothing we should do as of now
 		return reconcile.Result{}, nil
 	}
 
-	// Update the signer with the existing privateKey
-	r.signer, err = signer.Create(privateKey)
+	access, err := r.vmAccess(machine, privateKey)
 	if err != nil {
-		return reconcile.Result{}, errors.Wrap(err, "error creating signer")
+		return reconcile.Result{}, err
 	}
+
 	// validate userData secret
-	if err := r.validateUserData(privateKey); err != nil {
+	if err := r.validateUserData(privateKey, access.platform.UserData); err != nil {
 		return reconcile.Result{}, errors.Wrapf(err, "error validating userData secret")
 	}
 
+	log.Info("processing", "namespace", request.Namespace, "name", request.Name)
+	// Make the Machine a Windows Worker node
+	if err := r.addWorkerNode(r.ctx, machine, access); err != nil {
+		var hostKeyErr *windows.HostKeyMismatchError
+		var jumpHostErr *windows.JumpHostError
+		if errors.As(err, &jumpHostErr) {
+			if errors.As(jumpHostErr.Err, &hostKeyErr) {
+				r.recorder.Eventf(machine, core.EventTypeWarning, "JumpHostKeyMismatch",
+					"Jump host %s presented host key %s, expected %s. Remove the %s entry from the %s secret if "+
+						"the host key was rotated", jumpHostErr.Address, hostKeyErr.Actual, hostKeyErr.Expected,
+					secrets.HostKeySecretKey(hostKeyErr.InstanceID), secrets.HostKeySecret)
+			}
+			r.recorder.Eventf(machine, core.EventTypeWarning, "JumpHostUnreachable",
+				"Machine %s could not be reached through jump host %s: %v", machine.Name, jumpHostErr.Address,
+				jumpHostErr.Err)
+		} else if errors.As(err, &hostKeyErr) {
+			r.recorder.Eventf(machine, core.EventTypeWarning, "HostKeyMismatch",
+				"Machine %s presented host key %s, expected %s. Remove the %s entry from the %s secret if the "+
+					"host key was rotated", machine.Name, hostKeyErr.Actual, hostKeyErr.Expected,
+				secrets.HostKeySecretKey(hostKeyErr.InstanceID), secrets.HostKeySecret)
+		}
+		var preflightErr *windows.PreflightError
+		if errors.As(err, &preflightErr) {
+			r.recorder.Eventf(machine, core.EventTypeWarning, "PreflightFailed",
+				"Machine %s does not run a supported Windows platform: %s", machine.Name,
+				strings.Join(preflightErr.Violations, "; "))
+		}
+		var crashLoopErr *windows.ServiceCrashLoopError
+		if errors.As(err, &crashLoopErr) {
+			r.recorder.Eventf(machine, core.EventTypeWarning, "ServiceCrashLoop",
+				"Windows service %s on Machine %s %s", crashLoopErr.Status.Name, machine.Name, crashLoopErr.Reason())
+		}
+		r.recorder.Eventf(machine, core.EventTypeWarning, "MachineSetupFailure",
+			"Machine %s configuration failure", machine.Name)
+		return reconcile.Result{}, err
+	}
+	r.recorder.Eventf(machine, core.EventTypeNormal, "MachineSetup",
+		"Machine %s configured successfully", machine.Name)
+	// configure Prometheus after a Windows machine is configured as a Node.
+	if err := r.configurePrometheus(); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+// vmAccess holds what is needed to connect to the Windows VM backing a Machine
+type vmAccess struct {
+	// platform describes the platform the VM runs on
+	platform *provider.Platform
+	// instanceID is the cloud ID of the VM
+	instanceID string
+	// ipAddress is the address the VM is reached at
+	ipAddress string
+	// username is the user the operator connects to the VM as
+	username string
+	// connSettings holds the settings used to connect to the VM
+	connSettings windows.ConnectionSettings
+	// firewallRules holds the firewall rules required by the node: the kubelet, windows_exporter, hybrid-overlay
+	// VXLAN and NodePort services ports
+	firewallRules []windows.FirewallRule
+}
+
+// vmAccess returns what is needed to connect to the Windows VM backing the given Machine, using the given private key
+func (r *ReconcileWindowsMachine) vmAccess(machine *mapi.Machine, privateKey []byte) (*vmAccess, error) {
+	cfg, err := operatorconfig.Get(r.client, r.watchNamespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get operator configuration")
+	}
+
+	// Update the signer with the existing privateKey
+	r.signer, err = signer.Create(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating signer")
+	}
+
+	// Get the platform and instance ID associated with the Windows machine.
+	if machine.Spec.ProviderID == nil || len(*machine.Spec.ProviderID) == 0 {
+		return nil, errors.Errorf("empty provider ID associated with machine %s", machine.Name)
+	}
+	platform, instanceID, err := provider.ForProviderID(*machine.Spec.ProviderID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get instance ID of machine %s", machine.Name)
+	}
+
 	// Get the IP address associated with the Windows machine, if not error out to requeue again
 	if len(machine.Status.Addresses) == 0 {
-		return reconcile.Result{}, errors.Errorf("machine %s doesn't have any ip addresses defined",
-			machine.Name)
+		return nil, errors.Errorf("machine %s doesn't have any ip addresses defined", machine.Name)
 	}
 	ipAddress := ""
 	for _, address := range machine.Status.Addresses {
-		if address.Type == core.NodeInternalIP {
+		if address.Type == platform.AddressType {
 			ipAddress = address.Address
 		}
 	}
 	if len(ipAddress) == 0 {
-		return reconcile.Result{}, errors.Errorf("no internal ip address associated with machine %s",
-			machine.Name)
+		return nil, errors.Errorf("no %s address associated with machine %s", platform.AddressType, machine.Name)
 	}
 
-	// Get the instance ID associated with the Windows machine.
-	providerID := *machine.Spec.ProviderID
-	if len(providerID) == 0 {
-		return reconcile.Result{}, errors.Errorf("empty provider ID associated with machine %s", machine.Name)
-	}
-	// Ex: aws:///us-east-1e/i-078285fdadccb2eaa
-	// We always want the last entry which is the instanceID, and the first which is the provider name.
-	providerTokens := strings.Split(providerID, "/")
-	instanceID := providerTokens[len(providerTokens)-1]
-	if len(instanceID) == 0 {
-		return reconcile.Result{}, errors.Errorf("unable to get instance ID from provider ID for machine %s", machine.Name)
+	username := platform.User
+	if value := machine.GetAnnotations()[UsernameAnnotation]; value != "" {
+		username = value
 	}
-	providerName := strings.TrimSuffix(providerTokens[0], ":")
 
-	log.Info("processing", "namespace", request.Namespace, "name", request.Name)
-	// Make the Machine a Windows Worker node
-	if err := r.addWorkerNode(ipAddress, providerName, instanceID); err != nil {
-		r.recorder.Eventf(machine, core.EventTypeWarning, "MachineSetupFailure",
-			"Machine %s configuration failure", machine.Name)
-		return reconcile.Result{}, err
-	}
-	r.recorder.Eventf(machine, core.EventTypeNormal, "MachineSetup",
-		"Machine %s configured successfully", machine.Name)
-	// configure Prometheus after a Windows machine is configured as a Node.
-	if err := r.prometheusNodeConfig.Configure(); err != nil {
-		return reconcile.Result{}, errors.Wrap(err, "unable to configure Prometheus")
+	connSettings, err := r.connectionSettings(machine, cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get connection settings for machine %s", machine.Name)
 	}
-	return reconcile.Result{}, nil
+	firewallRules := windows.NodeFirewallRules(connSettings.WindowsExporter.Port, r.vxlanPort,
+		r.serviceNodePortRange)
+	return &vmAccess{platform: platform, instanceID: instanceID, ipAddress: ipAddress, username: username,
+		connSettings: connSettings, firewallRules: firewallRules}, nil
 }
 
-// addWorkerNode configures the given Windows VM, adding it as a node object to the cluster
-func (r *ReconcileWindowsMachine) addWorkerNode(ipAddress, providerName, instanceID string) error {
-	nc, err := nodeconfig.NewNodeConfig(r.k8sclientset, ipAddress, providerName, instanceID, r.clusterServiceCIDR, r.vxlanPort,
-		r.signer)
+// addWorkerNode configures the Windows VM backing the given Machine, adding it as a node object to the cluster. A
+// diagnostics bundle is collected from the VM if the configuration fails.
+func (r *ReconcileWindowsMachine) addWorkerNode(ctx context.Context, machine *mapi.Machine, access *vmAccess) error {
+	// The rendered config is read before the worker ignition file is fetched, so that a change made in between is
+	// detected by the next reconcile
+	renderedConfig, err := r.renderedWorkerConfig()
+	if err != nil {
+		return err
+	}
+	ignitionEndpoint, err := r.workerIgnitionEndpoint()
 	if err != nil {
-		return errors.Wrapf(err, "failed to configure Windows VM %s", instanceID)
+		return err
 	}
-	if err := nc.Configure(); err != nil {
+	nc, err := nodeconfig.NewNodeConfig(ctx, r.k8sclientset, access.ipAddress, access.username, access.instanceID,
+		r.clusterServiceCIDR, r.vxlanPort, access.firewallRules, access.connSettings)
+	if err != nil {
+		return errors.Wrapf(err, "failed to configure Windows VM %s", access.instanceID)
+	}
+	if err := nc.Configure(ctx, ignitionEndpoint, renderedConfig); err != nil {
+		r.saveDiagnostics(machine, nc.Windows)
 		// TODO: Unwrap to extract correct error
-		return errors.Wrapf(err, "failed to configure Windows VM %s", instanceID)
+		return errors.Wrapf(err, "failed to configure Windows VM %s", access.instanceID)
 	}
 
 	log.Info("Windows VM has been configured as a worker node", "ID", nc.ID())
 	return nil
 }
 
+// collectRequestedDiagnostics collects a diagnostics bundle from the Windows VM backing the given Machine and removes
+// the CollectDiagnosticsAnnotation from the Machine. Failing to collect the bundle is reported as an event on the
+// Machine rather than retried, so that an unreachable VM does not keep the request pending forever.
+func (r *ReconcileWindowsMachine) collectRequestedDiagnostics(machine *mapi.Machine, privateKey []byte) error {
+	log.Info("collecting requested diagnostics", "name", machine.Name)
+	access, err := r.vmAccess(machine, privateKey)
+	if err == nil {
+		var win windows.Windows
+		win, err = windows.New(r.ctx, access.ipAddress, access.username, access.instanceID, r.vxlanPort,
+			access.connSettings)
+		if err == nil {
+			r.saveDiagnostics(machine, win)
+		}
+	}
+	if err != nil {
+		r.recorder.Eventf(machine, core.EventTypeWarning, "DiagnosticsCollectionFailed",
+			"Unable to collect diagnostics from Machine %s: %v", machine.Name, err)
+	}
+
+	patch := client.MergeFrom(machine.DeepCopy())
+	annotations := machine.GetAnnotations()
+	delete(annotations, CollectDiagnosticsAnnotation)
+	machine.SetAnnotations(annotations)
+	if err := r.client.Patch(r.ctx, machine, patch); err != nil {
+		return errors.Wrapf(err, "unable to remove %s annotation from machine %s", CollectDiagnosticsAnnotation,
+			machine.Name)
+	}
+	return nil
+}
+
+// ensureNodeHealth validates the configuration of the Windows VM backing the given Machine, configured as the given
+// node. Firewall rules which drifted from the rules required by the node are reported as an event on the Machine and
+// repaired. kube-proxy and windows_exporter are reconfigured if their configuration changed, and the node's source VIP
+// and metrics port annotations are updated to match the VIP endpoint and the windows_exporter port.
+// The VM is given a single connection attempt, as the reconciles of the other Machines wait in the meantime. A VM which
+// cannot be reached is validated again after nodeHealthRequeueInterval.
+func (r *ReconcileWindowsMachine) ensureNodeHealth(machine *mapi.Machine, node *core.Node,
+	privateKey []byte) (reconcile.Result, error) {
+	access, err := r.vmAccess(machine, privateKey)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, nodeHealthTimeout)
+	defer cancel()
+	connSettings := access.connSettings
+	connSettings.ConnectAttempts = 1
+	nc, err := nodeconfig.NewNodeConfig(ctx, r.k8sclientset, access.ipAddress, access.username, access.instanceID,
+		r.clusterServiceCIDR, r.vxlanPort, access.firewallRules, connSettings)
+	if err != nil {
+		// A VM presenting another host key is not merely unreachable
+		var hostKeyErr *windows.HostKeyMismatchError
+		if errors.As(err, &hostKeyErr) {
+			return reconcile.Result{}, errors.Wrapf(err, "unable to validate Windows VM %s", access.instanceID)
+		}
+		log.Info("unable to reach Windows VM to validate its configuration", "name", machine.Name,
+			"requeueAfter", nodeHealthRequeueInterval, "error", err)
+		return reconcile.Result{RequeueAfter: nodeHealthRequeueInterval}, nil
+	}
+
+	drift, err := nc.FirewallDrift(ctx, access.firewallRules)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "unable to validate firewall rules of Windows VM %s",
+			access.instanceID)
+	}
+	if len(drift) > 0 {
+		r.recorder.Eventf(machine, core.EventTypeWarning, "FirewallRulesDrifted",
+			"Machine %s firewall rules drifted, repairing them: %s", machine.Name, strings.Join(drift, ", "))
+		if err := nc.ConfigureFirewall(ctx, access.firewallRules); err != nil {
+			return reconcile.Result{}, errors.Wrapf(err, "unable to repair firewall rules of Windows VM %s",
+				access.instanceID)
+		}
+		log.Info("repaired firewall rules", "name", machine.Name, "drift", drift)
+	}
+
+	sourceVIP, err := nc.EnsureSourceVIP(ctx, node.Annotations[nodeconfig.SourceVIPAnnotation])
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "unable to get source VIP of Windows VM %s", access.instanceID)
+	}
+	hostSubnet := node.Annotations[nodeconfig.HybridOverlaySubnet]
+	drift, err = nc.KubeProxyDrift(ctx, node.Name, hostSubnet, sourceVIP)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "unable to validate kube-proxy configuration of Windows VM %s",
+			access.instanceID)
+	}
+	if len(drift) > 0 {
+		if err := nc.ConfigureKubeProxy(ctx, node.Name, hostSubnet, sourceVIP); err != nil {
+			return reconcile.Result{}, errors.Wrapf(err, "unable to reconfigure kube-proxy on Windows VM %s",
+				access.instanceID)
+		}
+		r.recorder.Eventf(machine, core.EventTypeNormal, "KubeProxyReconfigured",
+			"Machine %s kube-proxy was reconfigured as its %s changed", machine.Name, strings.Join(drift, ", "))
+		log.Info("reconfigured kube-proxy", "name", machine.Name, "drift", drift)
+	}
+
+	if err := nc.ConfigureWindowsExporter(ctx); err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "unable to configure windows_exporter on Windows VM %s",
+			access.instanceID)
+	}
+	annotations := map[string]string{
+		nodeconfig.MetricsPortAnnotation: strconv.Itoa(int(access.connSettings.WindowsExporter.Port)),
+		nodeconfig.SourceVIPAnnotation:   sourceVIP,
+	}
+	err = nodeconfig.PatchNode(r.ctx, r.k8sclientset, node, func(node *core.Node) {
+		for key, value := range annotations {
+			node.Annotations[key] = value
+		}
+	})
+	return reconcile.Result{}, errors.Wrapf(err, "unable to update annotations of node %s", node.Name)
+}
+
+// configurePrometheus updates the metrics Endpoints object with the current Windows nodes and their metrics ports,
+// and the port of the metrics Service with the windows_exporter port of the operator configuration
+func (r *ReconcileWindowsMachine) configurePrometheus() error {
+	cfg, err := operatorconfig.Get(r.client, r.watchNamespace)
+	if err != nil {
+		return errors.Wrap(err, "unable to get operator configuration")
+	}
+	return errors.Wrap(r.prometheusNodeConfig.Configure(cfg.WindowsExporter.Port), "unable to configure Prometheus")
+}
+
+// saveDiagnostics collects a diagnostics bundle from the given Windows VM and saves it in the diagnostics store. The
+// outcome is recorded as an event on the Machine backing the VM.
+func (r *ReconcileWindowsMachine) saveDiagnostics(machine *mapi.Machine, win windows.Windows) {
+	// The configuration may have failed because it timed out, so the collection is given its own timeout
+	collectCtx, cancel := context.WithTimeout(r.ctx, diagnosticsTimeout)
+	defer cancel()
+
+	// The bundle is streamed to the store, so that it is never held in memory
+	path, err := r.diagnostics.Save(machine.Name, func(w io.Writer) error {
+		return win.CollectDiagnostics(collectCtx, w)
+	})
+	if err != nil {
+		log.Error(err, "unable to save diagnostics", "name", machine.Name)
+		if path == "" {
+			r.recorder.Eventf(machine, core.EventTypeWarning, "DiagnosticsCollectionFailed",
+				"Unable to collect diagnostics from Machine %s: %v", machine.Name, err)
+			return
+		}
+	}
+	log.Info("diagnostics saved", "name", machine.Name, "path", path)
+	r.recorder.Eventf(machine, core.EventTypeNormal, "DiagnosticsCollected",
+		"Diagnostics of Machine %s saved to %s in the operator pod", machine.Name, path)
+}
+
+// connectionSettings returns the settings used to connect to the VM backing the given Machine. The connectivity backend
+// is taken from the Machine's ConnectivityAnnotation, falling back to the backend set in the operator configuration.
+func (r *ReconcileWindowsMachine) connectionSettings(machine *mapi.Machine,
+	cfg *operatorconfig.Config) (windows.ConnectionSettings, error) {
+	backend := cfg.Connectivity.Backend
+	if value, present := machine.GetAnnotations()[ConnectivityAnnotation]; present {
+		if err := operatorconfig.ValidateBackend(value); err != nil {
+			return windows.ConnectionSettings{}, errors.Wrapf(err, "invalid %s annotation", ConnectivityAnnotation)
+		}
+		backend = value
+	}
+
+	connSettings := windows.ConnectionSettings{Backend: backend, Signer: r.signer, HostKeys: r.hostKeys,
+		Pool: r.sshPool, Timeouts: cfg.Timeouts.Windows(), ServiceRecovery: cfg.ServiceRecovery.Windows(),
+		WindowsExporter: cfg.WindowsExporter.ForMachineSet(machineSetName(machine)),
+		KubeProxy:       cfg.KubeProxy.Windows(),
+		Recorder:        &machineRecorder{recorder: r.recorder, machine: machine}}
+	if backend != windows.WinRMBackend {
+		jumpHosts, err := r.jumpHosts(cfg)
+		if err != nil {
+			return windows.ConnectionSettings{}, err
+		}
+		connSettings.JumpHosts = jumpHosts
+		return connSettings, nil
+	}
+
+	credentials := &core.Secret{}
+	err := r.client.Get(context.TODO(), kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+		Name: cfg.Connectivity.WinRM.CredentialsSecret}, credentials)
+	if err != nil {
+		return windows.ConnectionSettings{}, errors.Wrapf(err, "unable to get WinRM credentials secret %s",
+			cfg.Connectivity.WinRM.CredentialsSecret)
+	}
+	winrmSettings := &windows.WinRMSettings{
+		Port:     cfg.Connectivity.WinRM.Port,
+		AuthType: cfg.Connectivity.WinRM.AuthType,
+	}
+	switch winrmSettings.AuthType {
+	case windows.WinRMCertificateAuth:
+		certificate, err := tls.X509KeyPair(credentials.Data[core.TLSCertKey], credentials.Data[core.TLSPrivateKeyKey])
+		if err != nil {
+			return windows.ConnectionSettings{}, errors.Wrapf(err, "invalid client certificate in secret %s",
+				credentials.Name)
+		}
+		winrmSettings.Certificate = &certificate
+	case windows.WinRMNTLMAuth:
+		winrmSettings.Username = string(credentials.Data[secrets.WinRMUsernameKey])
+		winrmSettings.Password = string(credentials.Data[secrets.WinRMPasswordKey])
+	}
+	connSettings.WinRM = winrmSettings
+	return connSettings, nil
+}
+
+// jumpHosts returns the jump hosts set in the operator configuration, with the signers created from the private keys
+// held by their key secrets
+func (r *ReconcileWindowsMachine) jumpHosts(cfg *operatorconfig.Config) ([]windows.JumpHost, error) {
+	var jumpHosts []windows.JumpHost
+	for _, jumpHost := range cfg.Connectivity.JumpHosts {
+		privateKey, err := secrets.GetPrivateKey(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+			Name: jumpHost.KeySecret}, r.client)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get private key of jump host %s from secret %s",
+				jumpHost.Address, jumpHost.KeySecret)
+		}
+		jumpSigner, err := signer.Create(privateKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid private key in secret %s", jumpHost.KeySecret)
+		}
+		jumpHosts = append(jumpHosts, windows.JumpHost{
+			Address:            jumpHost.Address,
+			User:               jumpHost.User,
+			Signer:             jumpSigner,
+			HostKeyFingerprint: jumpHost.HostKeyFingerprint,
+		})
+	}
+	return jumpHosts, nil
+}
+
+// machineRecorder implements windows.Recorder, recording the events about a Windows VM on its Machine
+type machineRecorder struct {
+	// recorder is used to generate the events
+	recorder record.EventRecorder
+	// machine is the Machine backing the VM
+	machine *mapi.Machine
+}
+
+// Eventf implements windows.Recorder
+func (m *machineRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	m.recorder.Eventf(m.machine, eventType, reason, messageFmt, args...)
+}
+
 // validateUserData validates userData secret. It returns error if the secret doesn`t
-// contain expected public key bytes.
-func (r *ReconcileWindowsMachine) validateUserData(privateKey []byte) error {
+// contain expected public key bytes in the given user data flavor.
+func (r *ReconcileWindowsMachine) validateUserData(privateKey []byte, flavor provider.UserDataFlavor) error {
+	if flavor == provider.UserDataNone {
+		// The VMs are not provisioned with the user data
+		return nil
+	}
 	userDataSecret := &core.Secret{}
 	err := r.client.Get(context.TODO(), kubeTypes.NamespacedName{Name: "windows-user-data", Namespace: "openshift-machine-api"}, userDataSecret)
 
@@ -429,7 +953,7 @@ func (r *ReconcileWindowsMachine) validateUserData(privateKey []byte) error {
 	}
 
 	secretData := string(userDataSecret.Data["userData"][:])
-	desiredUserDataSecret, err := secrets.GenerateUserData(privateKey)
+	desiredUserDataSecret, err := secrets.GenerateUserData(privateKey, flavor)
 	if err != nil {
 		return err
 	}
@@ -439,9 +963,9 @@ func (r *ReconcileWindowsMachine) validateUserData(privateKey []byte) error {
 	return nil
 }
 
-// isAllowedDeletion determines if the number of machines after deletion of the given machine doesn`t fall below the
-// minHealthyCount
-func (r *ReconcileWindowsMachine) isAllowedDeletion(machine *mapi.Machine) bool {
+// isAllowedDisruption determines if the number of machines after deletion or reconfiguration of the given machine
+// doesn`t fall below the minHealthyCount
+func (r *ReconcileWindowsMachine) isAllowedDisruption(machine *mapi.Machine) bool {
 	if len(machine.OwnerReferences) == 0 {
 		return false
 	}
@@ -490,6 +1014,7 @@ func (r *ReconcileWindowsMachine) isAllowedDeletion(machine *mapi.Machine) bool
 // 1. Machine is not in a 'Running' phase
 // 2. Machine is not associated with a Node object
 // 3. Associated Node object doesn't have a Version annotation
+// 4. Associated Node object is being reconfigured
 func (r *ReconcileWindowsMachine) isWindowsMachineHealthy(machine *mapi.Machine) bool {
 	if (machine.Status.Phase == nil || *machine.Status.Phase != "Running") &&
 		machine.Status.NodeRef == nil {
@@ -505,6 +1030,9 @@ func (r *ReconcileWindowsMachine) isWindowsMachineHealthy(machine *mapi.Machine)
 	if !present {
 		return false
 	}
+	if _, reconfiguring := node.Annotations[nodeconfig.ReconfigureAnnotation]; reconfiguring {
+		return false
+	}
 
 	return true
 }
@@ -0,0 +1,175 @@
+package ignition
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// rootCANamespace is the namespace of the ConfigMap holding the root CA of the cluster
+	rootCANamespace = "kube-system"
+	// rootCAConfigMap is the name of the ConfigMap holding the root CA of the cluster, which signs the Machine Config
+	// Server certificate
+	rootCAConfigMap = "root-ca"
+	// rootCAKey is the key within the root CA ConfigMap which holds the PEM encoded certificate
+	rootCAKey = "ca.crt"
+	// mediaType is the media type of the ignition files served by the Machine Config Server
+	mediaType = "application/vnd.coreos.ignition+json"
+	// fetchTimeout is the maximum time to fetch an ignition file
+	fetchTimeout = 30 * time.Second
+	// maxSize is the maximum size of an ignition file
+	maxSize = 10 << 20
+	// ServerPort is the port the Machine Config Server listens on, on the hosts of the internal API server
+	ServerPort = "22623"
+	// workerConfigPath is the path of the worker ignition file on the Machine Config Server
+	workerConfigPath = "/config/worker"
+)
+
+// SupportedSpecVersions holds the ignition config spec versions understood by the bootstrapper, in preference order
+var SupportedSpecVersions = []string{"3.1.0", "3.0.0"}
+
+// Ignition is an ignition file fetched from the Machine Config Server
+type Ignition struct {
+	// Data is the content of the ignition file
+	Data []byte
+	// SpecVersion is the ignition config spec version of the file, as negotiated with the Machine Config Server
+	SpecVersion string
+	// SHA256 is the hex encoded SHA-256 hash of the file
+	SHA256 string
+}
+
+// Endpoint is the location of an ignition file served by a Machine Config Server
+type Endpoint struct {
+	// URL is the URL of the ignition file
+	URL string
+	// ServerName is the host name the server certificate is verified against, as the certificate of the Machine Config
+	// Server only holds the host name of the internal API server. The host of the URL is used if it is empty.
+	ServerName string
+}
+
+// ServerURL returns the base URL of the Machine Config Server running on the given host, which is either a host name
+// or an IPv4 or IPv6 address
+func ServerURL(host string) string {
+	return "https://" + net.JoinHostPort(host, ServerPort)
+}
+
+// WorkerEndpoint returns the endpoint of the worker ignition file served by the Machine Config Server at the given
+// base URL, such as https://api-int.example.com:22623 or https://[fd00::5]:22623
+func WorkerEndpoint(serverURL string) (string, error) {
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid Machine Config Server URL %q", serverURL)
+	}
+	if server.Scheme != "https" || server.Hostname() == "" {
+		return "", errors.Errorf("invalid Machine Config Server URL %q, expected https://<host>[:<port>]", serverURL)
+	}
+	if strings.Trim(server.Path, "/") != "" || server.RawQuery != "" || server.Fragment != "" {
+		return "", errors.Errorf("invalid Machine Config Server URL %q, it cannot have a path or query", serverURL)
+	}
+	return server.Scheme + "://" + server.Host + workerConfigPath, nil
+}
+
+// GetRootCA returns the PEM encoded root CA of the cluster, used to verify the Machine Config Server certificate
+func GetRootCA(ctx context.Context, client kubernetes.Interface) ([]byte, error) {
+	configMap, err := client.CoreV1().ConfigMaps(rootCANamespace).Get(ctx, rootCAConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get ConfigMap %s/%s", rootCANamespace, rootCAConfigMap)
+	}
+	rootCA, ok := configMap.Data[rootCAKey]
+	if !ok || rootCA == "" {
+		return nil, errors.Errorf("ConfigMap %s/%s has no %s", rootCANamespace, rootCAConfigMap, rootCAKey)
+	}
+	return []byte(rootCA), nil
+}
+
+// acceptHeader returns the Accept header requesting the supported spec versions, weighted by preference
+func acceptHeader() string {
+	types := make([]string, 0, len(SupportedSpecVersions))
+	for i, version := range SupportedSpecVersions {
+		mediaRange := mediaType + ";version=" + version
+		if i > 0 {
+			mediaRange += fmt.Sprintf(";q=%.1f", 1-float64(i)/10)
+		}
+		types = append(types, mediaRange)
+	}
+	return strings.Join(types, ", ")
+}
+
+// Fetch fetches the ignition file served at the given Machine Config Server endpoint, verifying the server certificate
+// against the given PEM encoded root CA. An error is returned if the spec version of the file is not supported.
+func Fetch(ctx context.Context, endpoint Endpoint, rootCA []byte) (*Ignition, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootCA) {
+		return nil, errors.New("unable to parse the root CA")
+	}
+	client := &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: endpoint.ServerName},
+		},
+	}
+	// The transport is specific to the root CA and server name of this fetch, its connections are not reused
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.URL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ignition endpoint %s", endpoint.URL)
+	}
+	req.Header.Set("Accept", acceptHeader())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch ignition from %s", endpoint.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unable to fetch ignition from %s: %s", endpoint.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read ignition from %s", endpoint.URL)
+	}
+	if len(data) > maxSize {
+		return nil, errors.Errorf("ignition from %s exceeds %d bytes", endpoint.URL, maxSize)
+	}
+
+	var config struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse ignition from %s", endpoint.URL)
+	}
+	if !supported(config.Ignition.Version) {
+		return nil, errors.Errorf("ignition spec version %q from %s is not supported, supported versions are %s",
+			config.Ignition.Version, endpoint.URL, strings.Join(SupportedSpecVersions, ", "))
+	}
+	hash := sha256.Sum256(data)
+	return &Ignition{Data: data, SpecVersion: config.Ignition.Version, SHA256: hex.EncodeToString(hash[:])}, nil
+}
+
+// supported returns true if the given ignition spec version is supported
+func supported(version string) bool {
+	for _, supportedVersion := range SupportedSpecVersions {
+		if version == supportedVersion {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package ignition
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetch tests that the ignition is only accepted from a Machine Config Server whose certificate is signed by the
+// root CA, and with a supported spec version
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name string
+		// status is the status code returned by the server
+		status int
+		// body is the ignition returned by the server
+		body string
+		// untrusted is true if the root CA does not sign the server certificate
+		untrusted       bool
+		expectedVersion string
+		expectedErr     bool
+	}{
+		{
+			name:            "spec 3.1.0",
+			status:          http.StatusOK,
+			body:            `{"ignition":{"version":"3.1.0"}}`,
+			expectedVersion: "3.1.0",
+		},
+		{
+			name:            "spec 3.0.0",
+			status:          http.StatusOK,
+			body:            `{"ignition":{"version":"3.0.0"}}`,
+			expectedVersion: "3.0.0",
+		},
+		{
+			name:        "untrusted certificate",
+			status:      http.StatusOK,
+			body:        `{"ignition":{"version":"3.1.0"}}`,
+			untrusted:   true,
+			expectedErr: true,
+		},
+		{
+			name:        "unsupported spec version",
+			status:      http.StatusOK,
+			body:        `{"ignition":{"version":"2.2.0"}}`,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid ignition",
+			status:      http.StatusOK,
+			body:        `ignition`,
+			expectedErr: true,
+		},
+		{
+			name:        "too large",
+			status:      http.StatusOK,
+			body:        `{"ignition":{"version":"3.1.0"}}` + strings.Repeat(" ", maxSize),
+			expectedErr: true,
+		},
+		{
+			name:        "server error",
+			status:      http.StatusInternalServerError,
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "application/vnd.coreos.ignition+json;version=3.1.0, "+
+					"application/vnd.coreos.ignition+json;version=3.0.0;q=0.9", r.Header.Get("Accept"))
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			rootCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+			if tt.untrusted {
+				rootCA = selfSignedCA(t)
+			}
+
+			ign, err := Fetch(context.Background(), Endpoint{URL: server.URL + "/config/worker"}, rootCA)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(ign.Data))
+			assert.Equal(t, tt.expectedVersion, ign.SpecVersion)
+			assert.Len(t, ign.SHA256, 64)
+		})
+	}
+}
+
+// TestFetchServerName tests that the ignition is fetched from a Machine Config Server reached through its IP address,
+// whose certificate only holds the host name of the internal API server, when that host name is given
+func TestFetchServerName(t *testing.T) {
+	rootCA, caCert, caKey := newTestCA(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "api-int.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"api-int.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ignition":{"version":"3.1.0"}}`))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	defer server.Close()
+	// The server is reached through an IP literal URL, such as https://127.0.0.1:port
+	url := server.URL + "/config/worker"
+
+	_, err = Fetch(context.Background(), Endpoint{URL: url}, rootCA)
+	assert.Error(t, err)
+	ign, err := Fetch(context.Background(), Endpoint{URL: url, ServerName: "api-int.example.com"}, rootCA)
+	require.NoError(t, err)
+	assert.Equal(t, "3.1.0", ign.SpecVersion)
+}
+
+// selfSignedCA returns a PEM encoded self-signed CA certificate
+func selfSignedCA(t *testing.T) []byte {
+	rootCA, _, _ := newTestCA(t)
+	return rootCA
+}
+
+// newTestCA returns a self-signed CA certificate, PEM encoded and parsed, along with its key
+func newTestCA(t *testing.T) ([]byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), cert, key
+}
+
+// TestWorkerEndpoint tests that the worker ignition endpoint is derived from the Machine Config Server URL
+func TestWorkerEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverURL   string
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:      "host name",
+			serverURL: ServerURL("api-int.example.com"),
+			expected:  "https://api-int.example.com:22623/config/worker",
+		},
+		{
+			name:      "IPv4 address with a trailing slash",
+			serverURL: "https://10.0.0.5:22623/",
+			expected:  "https://10.0.0.5:22623/config/worker",
+		},
+		{
+			name:      "IPv6 address",
+			serverURL: ServerURL("fd00::5"),
+			expected:  "https://[fd00::5]:22623/config/worker",
+		},
+		{
+			name:      "default port",
+			serverURL: "https://mcs.example.com",
+			expected:  "https://mcs.example.com/config/worker",
+		},
+		{
+			name:        "http scheme",
+			serverURL:   "http://mcs.example.com:22623",
+			expectedErr: true,
+		},
+		{
+			name:        "path",
+			serverURL:   "https://mcs.example.com:22623/config/worker",
+			expectedErr: true,
+		},
+		{
+			name:        "no host",
+			serverURL:   "https://:22623",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid URL",
+			serverURL:   "https://[fd00::5:22623",
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := WorkerEndpoint(tt.serverURL)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, endpoint)
+		})
+	}
+}
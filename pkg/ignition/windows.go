@@ -0,0 +1,146 @@
+package ignition
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// kubeconfigPath is the path of the bootstrap kubeconfig in the worker ignition
+	kubeconfigPath = "/etc/kubernetes/kubeconfig"
+	// caPath is the path of the kubelet CA bundle in the worker ignition
+	caPath = "/etc/kubernetes/kubelet-ca.crt"
+	// kubeletConfigPath is the path of the kubelet configuration in the worker ignition
+	kubeletConfigPath = "/etc/kubernetes/kubelet.conf"
+	// cloudConfigPath is the path of the cloud provider configuration in the worker ignition, absent on platforms
+	// without one
+	cloudConfigPath = "/etc/kubernetes/cloud.conf"
+)
+
+// WindowsConfig holds the parts of a worker ignition file which are used by the bootstrapper to configure the kubelet
+// of the Windows nodes. The rest of the file only applies to the Linux workers.
+type WindowsConfig struct {
+	// Kubeconfig is the bootstrap kubeconfig of the kubelet
+	Kubeconfig []byte
+	// CA is the CA bundle used by the kubelet to verify the API server
+	CA []byte
+	// CloudConfig is the cloud provider configuration, empty if the platform does not have one
+	CloudConfig []byte
+	// Kubelet holds the fields of the kubelet configuration used by the bootstrapper
+	Kubelet KubeletFields
+}
+
+// KubeletFields holds the fields of the kubelet configuration of the worker ignition used by the bootstrapper
+type KubeletFields struct {
+	// ClusterDNS holds the IP addresses of the cluster DNS servers
+	ClusterDNS []string `json:"clusterDNS"`
+	// ClusterDomain is the DNS domain of the cluster
+	ClusterDomain string `json:"clusterDomain"`
+}
+
+// ignitionFiles holds the storage files of an ignition config
+type ignitionFiles struct {
+	Storage struct {
+		Files []struct {
+			Path     string `json:"path"`
+			Contents struct {
+				Source string `json:"source"`
+			} `json:"contents"`
+		} `json:"files"`
+	} `json:"storage"`
+}
+
+// ParseWindowsConfig returns the parts of the given worker ignition file affecting the Windows nodes. An error is
+// returned if the kubeconfig, CA bundle or kubelet configuration is missing.
+func ParseWindowsConfig(data []byte) (*WindowsConfig, error) {
+	var config ignitionFiles
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "unable to parse ignition")
+	}
+	files := make(map[string][]byte)
+	for _, file := range config.Storage.Files {
+		switch file.Path {
+		case kubeconfigPath, caPath, kubeletConfigPath, cloudConfigPath:
+			contents, err := decodeDataURL(file.Contents.Source)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to decode the contents of %s", file.Path)
+			}
+			files[file.Path] = contents
+		}
+	}
+	for _, path := range []string{kubeconfigPath, caPath, kubeletConfigPath} {
+		if _, ok := files[path]; !ok {
+			return nil, errors.Errorf("ignition has no %s file", path)
+		}
+	}
+	windowsConfig := &WindowsConfig{Kubeconfig: files[kubeconfigPath], CA: files[caPath],
+		CloudConfig: files[cloudConfigPath]}
+	if err := yaml.Unmarshal(files[kubeletConfigPath], &windowsConfig.Kubelet); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s", kubeletConfigPath)
+	}
+	return windowsConfig, nil
+}
+
+// decodeDataURL returns the data held by the given data URL, such as data:,foo or
+// data:text/plain;charset=utf-8;base64,Zm9v
+func decodeDataURL(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "data:") {
+		return nil, errors.Errorf("unsupported source %q, only data URLs are supported", source)
+	}
+	comma := strings.Index(source, ",")
+	if comma < 0 {
+		return nil, errors.New("invalid data URL, missing comma")
+	}
+	mediaType, data := source[len("data:"):comma], source[comma+1:]
+	if strings.HasSuffix(mediaType, ";base64") {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		return decoded, errors.Wrap(err, "invalid base64 data URL")
+	}
+	decoded, err := url.PathUnescape(data)
+	return []byte(decoded), errors.Wrap(err, "invalid data URL")
+}
+
+// Hashes returns the hex encoded SHA-256 hash of each part of the configuration, keyed by the name of the part
+func (c *WindowsConfig) Hashes() (map[string]string, error) {
+	kubelet, err := json.Marshal(c.Kubelet)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal kubelet fields")
+	}
+	hashes := make(map[string]string)
+	for name, data := range map[string][]byte{
+		"kubeconfig":   c.Kubeconfig,
+		"CA":           c.CA,
+		"cloud config": c.CloudConfig,
+		"kubelet":      kubelet,
+	} {
+		hash := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(hash[:])
+	}
+	return hashes, nil
+}
+
+// ChangedParts returns the sorted names of the parts whose hashes differ between the given hashes, as returned by
+// WindowsConfig.Hashes
+func ChangedParts(previous, current map[string]string) []string {
+	var changed []string
+	for name, hash := range current {
+		if previous[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
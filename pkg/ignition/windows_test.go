@@ -0,0 +1,52 @@
+package ignition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIgnition is a worker ignition holding the files used by the bootstrapper along with a file only used by the
+// Linux workers
+const testIgnition = `{"ignition":{"version":"3.1.0"},"storage":{"files":[
+{"path":"/etc/kubernetes/kubeconfig","contents":{"source":"data:,apiVersion%3A%20v1%0Akind%3A%20Config%0A"}},
+{"path":"/etc/kubernetes/kubelet-ca.crt","contents":{"source":"data:text/plain;charset=utf-8;base64,Q0E="}},
+{"path":"/etc/kubernetes/kubelet.conf","contents":{"source":"data:,clusterDNS%3A%0A-%20172.30.0.10%0A` +
+	`clusterDomain%3A%20cluster.local%0AmaxPods%3A%20250%0A"}},
+{"path":"/etc/motd","contents":{"source":"data:,hello"}}]}}`
+
+// TestParseWindowsConfig tests that the files used by the bootstrapper are extracted from the worker ignition
+func TestParseWindowsConfig(t *testing.T) {
+	config, err := ParseWindowsConfig([]byte(testIgnition))
+	require.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1\nkind: Config\n", string(config.Kubeconfig))
+	assert.Equal(t, "CA", string(config.CA))
+	assert.Empty(t, config.CloudConfig)
+	assert.Equal(t, KubeletFields{ClusterDNS: []string{"172.30.0.10"}, ClusterDomain: "cluster.local"},
+		config.Kubelet)
+
+	_, err = ParseWindowsConfig([]byte(`{"ignition":{"version":"3.1.0"}}`))
+	assert.Error(t, err)
+	_, err = ParseWindowsConfig([]byte(`{"storage":{"files":[{"path":"/etc/kubernetes/kubeconfig",` +
+		`"contents":{"source":"https://example.com/kubeconfig"}}]}}`))
+	assert.Error(t, err)
+}
+
+// TestChangedParts tests that the parts of the Windows configuration which changed between two worker ignition files
+// are reported
+func TestChangedParts(t *testing.T) {
+	config, err := ParseWindowsConfig([]byte(testIgnition))
+	require.NoError(t, err)
+	previous, err := config.Hashes()
+	require.NoError(t, err)
+
+	config.Kubelet.ClusterDomain = "example.local"
+	config.CA = []byte("rotated CA")
+	current, err := config.Hashes()
+	require.NoError(t, err)
+
+	assert.Empty(t, ChangedParts(previous, previous))
+	assert.Equal(t, []string{"CA", "kubelet"}, ChangedParts(previous, current))
+	assert.Equal(t, []string{"CA", "cloud config", "kubeconfig", "kubelet"}, ChangedParts(nil, current))
+}